@@ -0,0 +1,203 @@
+package sqltest
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"testing"
+)
+
+// The benchmarks run identical workloads against every registered driver
+// as sub-benchmarks, e.g. BenchmarkQueryRow/pq and BenchmarkQueryRow/pgx,
+// on the same schema:
+//
+//	bench (id INTEGER PRIMARY KEY, name VARCHAR(50), n BIGINT, f DOUBLE), benchRows rows
+//	bench_blob (id INTEGER PRIMARY KEY, data BLOB), one benchBlobSize row
+//
+// Compare drivers with, for example:
+//
+//	go test -run NONE -bench 'QueryRow/(pq|pgx)$'
+const (
+	benchRows     = 1000
+	benchBlobSize = 1 << 20
+)
+
+// benchDB is the database a benchmark runs against.
+type benchDB struct {
+	*sql.DB
+	b       *testing.B
+	dialect *Dialect
+	prefix  string // see isolate
+}
+
+func (db benchDB) table(name string) string { return tableName(db.b, db.dialect, db.prefix, name) }
+
+func (db benchDB) q(sql string) string { return db.dialect.q(db.b, sql) }
+
+func (db benchDB) mustExec(sql string, args ...interface{}) {
+	if _, err := db.Exec(sql, args...); err != nil {
+		db.b.Fatalf("Error running %q: %v", sql, err)
+	}
+}
+
+// benchAll runs fn as a sub-benchmark for every registered driver, on
+// freshly created bench tables.
+func benchAll(b *testing.B, fn func(benchDB)) {
+	for _, d := range drivers {
+		d := d
+		b.Run(d.name, func(b *testing.B) {
+			sqlDB := d.tester.Open(b)
+			db := benchDB{sqlDB, b, d.tester.Dialect(), ""}
+			db.prefix = isolate(b, sqlDB, db.dialect)
+			benchSetup(db)
+			b.ReportAllocs()
+			b.ResetTimer()
+			fn(db)
+		})
+	}
+}
+
+func benchSetup(db benchDB) {
+	d := db.dialect
+	db.mustExec(fmt.Sprintf("CREATE TABLE %s (id INTEGER PRIMARY KEY, name VARCHAR(50), n %s, f %s)",
+		db.table("bench"), d.bigint, d.double))
+	db.mustExec(fmt.Sprintf("CREATE TABLE %s (id INTEGER PRIMARY KEY, data %s)",
+		db.table("bench_blob"), d.blobType(benchBlobSize)))
+
+	tx, err := db.Begin()
+	if err != nil {
+		db.b.Fatal(err)
+	}
+	defer tx.Rollback()
+	ins, err := tx.Prepare(db.q("INSERT INTO " + db.table("bench") + " (id, name, n, f) VALUES (?, ?, ?, ?)"))
+	if err != nil {
+		db.b.Fatal(err)
+	}
+	for i := 0; i < benchRows; i++ {
+		if _, err := ins.Exec(i, fmt.Sprintf("name %d", i), int64(i)*1e9, float64(i)/3); err != nil {
+			db.b.Fatal(err)
+		}
+	}
+	ins.Close()
+	blob := bytes.Repeat([]byte{0xa5}, benchBlobSize)
+	if _, err := tx.Exec(db.q("INSERT INTO "+db.table("bench_blob")+" (id, data) VALUES (?, ?)"), 1, blob); err != nil {
+		db.b.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		db.b.Fatal(err)
+	}
+}
+
+func BenchmarkQueryRow(b *testing.B) {
+	benchAll(b, func(db benchDB) {
+		query := db.q("SELECT name FROM " + db.table("bench") + " WHERE id = ?")
+		var name string
+		for i := 0; i < db.b.N; i++ {
+			if err := db.QueryRow(query, i%benchRows).Scan(&name); err != nil {
+				db.b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkScan1k(b *testing.B) {
+	benchAll(b, func(db benchDB) {
+		query := "SELECT id, name, n, f FROM " + db.table("bench")
+		var (
+			id, n int64
+			name  string
+			f     float64
+		)
+		for i := 0; i < db.b.N; i++ {
+			rows, err := db.Query(query)
+			if err != nil {
+				db.b.Fatal(err)
+			}
+			count := 0
+			for rows.Next() {
+				if err := rows.Scan(&id, &name, &n, &f); err != nil {
+					db.b.Fatal(err)
+				}
+				count++
+			}
+			if err := rows.Err(); err != nil {
+				db.b.Fatal(err)
+			}
+			rows.Close()
+			if count != benchRows {
+				db.b.Fatalf("scanned %d rows; want %d", count, benchRows)
+			}
+		}
+	})
+}
+
+// BenchmarkBulkInsert inserts 100 rows per op in one transaction through
+// a prepared statement.
+func BenchmarkBulkInsert(b *testing.B) {
+	const batch = 100
+	benchAll(b, func(db benchDB) {
+		query := db.q("INSERT INTO " + db.table("bench") + " (id, name, n, f) VALUES (?, ?, ?, ?)")
+		for i := 0; i < db.b.N; i++ {
+			tx, err := db.Begin()
+			if err != nil {
+				db.b.Fatal(err)
+			}
+			ins, err := tx.Prepare(query)
+			if err != nil {
+				db.b.Fatal(err)
+			}
+			for j := 0; j < batch; j++ {
+				id := benchRows + i*batch + j
+				if _, err := ins.Exec(id, "bulk", int64(id), 0.5); err != nil {
+					db.b.Fatal(err)
+				}
+			}
+			ins.Close()
+			if err := tx.Commit(); err != nil {
+				db.b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkExecPrepared(b *testing.B) {
+	benchAll(b, func(db benchDB) {
+		stmt, err := db.Prepare(db.q("UPDATE " + db.table("bench") + " SET n = n + 1 WHERE id = ?"))
+		if err != nil {
+			db.b.Fatal(err)
+		}
+		defer stmt.Close()
+		for i := 0; i < db.b.N; i++ {
+			if _, err := stmt.Exec(i % benchRows); err != nil {
+				db.b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkExecUnprepared(b *testing.B) {
+	benchAll(b, func(db benchDB) {
+		query := db.q("UPDATE " + db.table("bench") + " SET n = n + 1 WHERE id = ?")
+		for i := 0; i < db.b.N; i++ {
+			if _, err := db.Exec(query, i%benchRows); err != nil {
+				db.b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkBlobRead(b *testing.B) {
+	benchAll(b, func(db benchDB) {
+		db.b.SetBytes(benchBlobSize)
+		query := db.q("SELECT data FROM " + db.table("bench_blob") + " WHERE id = ?")
+		var data []byte
+		for i := 0; i < db.b.N; i++ {
+			if err := db.QueryRow(query, 1).Scan(&data); err != nil {
+				db.b.Fatal(err)
+			}
+			if len(data) != benchBlobSize {
+				db.b.Fatalf("read %d bytes; want %d", len(data), benchBlobSize)
+			}
+		}
+	})
+}
@@ -0,0 +1,501 @@
+package sqltest
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func init() {
+	registerScenario("Catalog", testCatalog, 0)
+	registerScenario("ColumnNames", testColumnNames, 0)
+}
+
+// A tableSchema describes a table as the backend's catalog does, with
+// names in the case the backend stores them in.
+type tableSchema struct {
+	columns    []columnSchema // in order
+	primaryKey []string       // columns, in key order
+	indexes    []indexSchema  // other than the primary key's, by name
+}
+
+type columnSchema struct {
+	name     string
+	typ      string // as the catalog names it
+	nullable bool
+}
+
+type indexSchema struct {
+	name    string
+	columns []string // in key order
+	unique  bool
+}
+
+// columnNames returns the names of the columns of s.
+func (s *tableSchema) columnNames() []string {
+	var names []string
+	for _, c := range s.columns {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// A catalog reads the description of tables from a backend's system
+// catalog. Names are given and returned in the case the backend stores
+// them in.
+type catalog interface {
+	// tables returns the names of the tables in the namespace ns, or
+	// in the default one if ns is empty.
+	tables(db *sql.DB, ns string) ([]string, error)
+
+	// describe returns the schema of the table called name in ns.
+	describe(db *sql.DB, ns, name string) (*tableSchema, error)
+}
+
+// splitTable returns the namespace and name of a table named by
+// params.table.
+func splitTable(table string) (ns, name string) {
+	if i := strings.LastIndexByte(table, '.'); i >= 0 {
+		return table[:i], table[i+1:]
+	}
+	return "", table
+}
+
+// describeTable returns the schema of table, named by params.table, as
+// the catalog of d describes it.
+func describeTable(db *sql.DB, d *Dialect, table string) (*tableSchema, error) {
+	ns, name := splitTable(table)
+	return d.catalog.describe(db, d.stored(ns), d.stored(name))
+}
+
+// catalogRows returns the rows of query, each mapping the lower-cased
+// name of a column to its value, "" for NULL.
+func catalogRows(db *sql.DB, query string, args ...interface{}) ([]map[string]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var all []map[string]string
+	for rows.Next() {
+		vals := make([]sql.NullString, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := map[string]string{}
+		for i, col := range cols {
+			row[strings.ToLower(col)] = vals[i].String
+		}
+		all = append(all, row)
+	}
+	return all, rows.Err()
+}
+
+// catalogColumn returns the values of column col of the rows of query.
+func catalogColumn(db *sql.DB, col, query string, args ...interface{}) ([]string, error) {
+	rows, err := catalogRows(db, query, args...)
+	var vals []string
+	for _, r := range rows {
+		vals = append(vals, r[col])
+	}
+	return vals, err
+}
+
+// addIndexColumn adds col to the index called name of s, numbered seq
+// from 1 in its key, adding the index if it is the first.
+func (s *tableSchema) addIndexColumn(name, col string, seq int, unique bool) {
+	for i := range s.indexes {
+		if ix := &s.indexes[i]; ix.name == name {
+			if seq > len(ix.columns) {
+				ix.columns = append(ix.columns, make([]string, seq-len(ix.columns))...)
+			}
+			ix.columns[seq-1] = col
+			return
+		}
+	}
+	s.indexes = append(s.indexes, indexSchema{name: name, unique: unique})
+	s.addIndexColumn(name, col, seq, unique)
+}
+
+// informationSchema reads the tables and columns of Postgres and MySQL
+// from information_schema, which both have.
+type informationSchema struct {
+	placeholders [2]string // for the first and second parameters
+	defaultNS    string    // the default namespace, if known
+}
+
+func (c informationSchema) tables(db *sql.DB, ns string) ([]string, error) {
+	if ns == "" {
+		ns = c.defaultNS
+	}
+	return catalogColumn(db, "table_name", "SELECT table_name FROM information_schema.tables WHERE table_schema = "+c.placeholders[0], ns)
+}
+
+func (c informationSchema) columns(db *sql.DB, ns, name string) (*tableSchema, error) {
+	rows, err := catalogRows(db, "SELECT column_name, data_type, is_nullable FROM information_schema.columns WHERE table_schema = "+
+		c.placeholders[0]+" AND table_name = "+c.placeholders[1]+" ORDER BY ordinal_position", ns, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("table %s.%s not found in information_schema.columns", ns, name)
+	}
+	s := &tableSchema{}
+	for _, r := range rows {
+		s.columns = append(s.columns, columnSchema{r["column_name"], r["data_type"], r["is_nullable"] == "YES"})
+	}
+	return s, nil
+}
+
+// postgresCatalog adds the indexes of pg_indexes, taking the columns of
+// each from its definition, as Postgres has no portable view of them.
+type postgresCatalog struct{ informationSchema }
+
+func (c postgresCatalog) describe(db *sql.DB, ns, name string) (*tableSchema, error) {
+	if ns == "" {
+		ns = c.defaultNS
+	}
+	s, err := c.columns(db, ns, name)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := catalogColumn(db, "constraint_name", "SELECT constraint_name FROM information_schema.table_constraints "+
+		"WHERE table_schema = $1 AND table_name = $2 AND constraint_type = 'PRIMARY KEY'", ns, name)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := catalogRows(db, "SELECT indexname, indexdef FROM pg_indexes WHERE schemaname = $1 AND tablename = $2 ORDER BY indexname", ns, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		cols, err := indexDefColumns(r["indexdef"])
+		if err != nil {
+			return nil, err
+		}
+		if len(pk) > 0 && r["indexname"] == pk[0] {
+			s.primaryKey = cols
+			continue
+		}
+		s.indexes = append(s.indexes, indexSchema{r["indexname"], cols, strings.HasPrefix(r["indexdef"], "CREATE UNIQUE ")})
+	}
+	return s, nil
+}
+
+// indexDefColumns returns the columns listed at the end of def, a
+// CREATE INDEX statement as pg_indexes shows it.
+func indexDefColumns(def string) ([]string, error) {
+	open := strings.LastIndex(def, " (")
+	if open < 0 || !strings.HasSuffix(def, ")") {
+		return nil, fmt.Errorf("no column list in index definition %q", def)
+	}
+	var cols []string
+	for _, col := range strings.Split(def[open+2:len(def)-1], ", ") {
+		if strings.HasPrefix(col, `"`) {
+			col = strings.Replace(strings.Trim(col, `"`), `""`, `"`, -1)
+		}
+		cols = append(cols, col)
+	}
+	return cols, nil
+}
+
+// mysqlCatalog adds the indexes SHOW INDEX lists. The default
+// namespace, the database of the DSN, is listed by SHOW TABLES.
+type mysqlCatalog struct{ informationSchema }
+
+func (c mysqlCatalog) tables(db *sql.DB, ns string) ([]string, error) {
+	if ns != "" {
+		return c.informationSchema.tables(db, ns)
+	}
+	rows, err := catalogRows(db, "SHOW TABLES")
+	var names []string
+	for _, r := range rows {
+		for _, name := range r {
+			names = append(names, name)
+		}
+	}
+	return names, err
+}
+
+func (c mysqlCatalog) describe(db *sql.DB, ns, name string) (*tableSchema, error) {
+	s, err := c.columns(db, ns, name)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := catalogRows(db, "SHOW INDEX FROM "+mysqlDialect.quote(name)+" FROM "+mysqlDialect.quote(ns))
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		var seq int
+		fmt.Sscan(r["seq_in_index"], &seq)
+		if r["key_name"] == "PRIMARY" {
+			s.primaryKey = append(s.primaryKey, r["column_name"])
+			continue
+		}
+		s.addIndexColumn(r["key_name"], r["column_name"], seq, r["non_unique"] == "0")
+	}
+	sortIndexes(s.indexes)
+	return s, nil
+}
+
+// sqliteCatalog reads sqlite_master and the table_info, index_list and
+// index_info pragmas. SQLite has one namespace per database file.
+type sqliteCatalog struct{}
+
+func (sqliteCatalog) tables(db *sql.DB, ns string) ([]string, error) {
+	return catalogColumn(db, "name", "SELECT name FROM sqlite_master WHERE type = 'table'")
+}
+
+func (sqliteCatalog) describe(db *sql.DB, ns, name string) (*tableSchema, error) {
+	rows, err := catalogRows(db, "PRAGMA table_info("+sqliteDialect.quote(name)+")")
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("table %s not found by PRAGMA table_info", name)
+	}
+	s := &tableSchema{}
+	key := map[int]string{}
+	for _, r := range rows {
+		s.columns = append(s.columns, columnSchema{r["name"], r["type"], r["notnull"] == "0"})
+		var pos int
+		if fmt.Sscan(r["pk"], &pos); pos > 0 {
+			key[pos] = r["name"]
+		}
+	}
+	for pos := 1; pos <= len(key); pos++ {
+		s.primaryKey = append(s.primaryKey, key[pos])
+	}
+	indexes, err := catalogRows(db, "PRAGMA index_list("+sqliteDialect.quote(name)+")")
+	if err != nil {
+		return nil, err
+	}
+	for _, ix := range indexes {
+		if ix["origin"] == "pk" {
+			continue
+		}
+		cols, err := catalogRows(db, "PRAGMA index_info("+sqliteDialect.quote(ix["name"])+")")
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cols {
+			var seq int
+			fmt.Sscan(c["seqno"], &seq)
+			s.addIndexColumn(ix["name"], c["name"], seq+1, ix["unique"] == "1")
+		}
+	}
+	sortIndexes(s.indexes)
+	return s, nil
+}
+
+// oracleCatalog reads the user_ views of the Oracle data dictionary.
+// The namespace is always the user's schema.
+type oracleCatalog struct{}
+
+func (oracleCatalog) tables(db *sql.DB, ns string) ([]string, error) {
+	return catalogColumn(db, "table_name", "SELECT table_name FROM user_tables")
+}
+
+func (oracleCatalog) describe(db *sql.DB, ns, name string) (*tableSchema, error) {
+	rows, err := catalogRows(db, "SELECT column_name, data_type, nullable FROM user_tab_columns WHERE table_name = :1 ORDER BY column_id", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("table %s not found in user_tab_columns", name)
+	}
+	s := &tableSchema{}
+	for _, r := range rows {
+		s.columns = append(s.columns, columnSchema{r["column_name"], r["data_type"], r["nullable"] == "Y"})
+	}
+	pk, err := catalogColumn(db, "index_name", "SELECT index_name FROM user_constraints WHERE table_name = :1 AND constraint_type = 'P'", name)
+	if err != nil {
+		return nil, err
+	}
+	rows, err = catalogRows(db, "SELECT i.index_name, i.uniqueness, c.column_name, c.column_position FROM user_indexes i "+
+		"JOIN user_ind_columns c ON c.index_name = i.index_name WHERE i.table_name = :1 ORDER BY i.index_name, c.column_position", name)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		if len(pk) > 0 && r["index_name"] == pk[0] {
+			s.primaryKey = append(s.primaryKey, r["column_name"])
+			continue
+		}
+		var seq int
+		fmt.Sscan(r["column_position"], &seq)
+		s.addIndexColumn(r["index_name"], r["column_name"], seq, r["uniqueness"] == "UNIQUE")
+	}
+	return s, nil
+}
+
+// sortIndexes sorts indexes by name.
+func sortIndexes(indexes []indexSchema) {
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].name < indexes[j].name })
+}
+
+// sameType reports whether the catalog type typ is that of a column
+// declared as decl: whether the first word of decl, without any length,
+// starts typ, whatever their case. The catalog may spell out the rest,
+// as Postgres does "double precision".
+func sameType(decl, typ string) bool {
+	word := strings.FieldsFunc(decl, func(r rune) bool { return r == ' ' || r == '(' })[0]
+	return len(typ) >= len(word) && strings.EqualFold(typ[:len(word)], word)
+}
+
+func testCatalog(t params) {
+	d := t.dialect()
+	tbl := t.table("cat")
+	t.mustExec("CREATE TABLE " + tbl + " (id " + d.bigint + " NOT NULL, seq " + d.bigint + " NOT NULL, name " + d.text +
+		", score " + d.double + ", code " + d.bigint + " UNIQUE, PRIMARY KEY (id, seq))")
+	// An index is named without a namespace, going in its table's.
+	_, ix := splitTable(t.table("cat_score"))
+	t.mustExec("CREATE INDEX " + ix + " ON " + tbl + " (score, seq)")
+
+	ns, name := splitTable(tbl)
+	tables, err := d.catalog.tables(t.DB, d.stored(ns))
+	if err != nil {
+		t.Fatalf("listing tables: %v", err)
+	}
+	found := false
+	for _, n := range tables {
+		found = found || n == d.stored(name)
+	}
+	if !found {
+		t.Errorf("tables %q do not include %s", tables, d.stored(name))
+	}
+
+	s, err := describeTable(t.DB, d, tbl)
+	if err != nil {
+		t.Fatalf("describing %s: %v", tbl, err)
+	}
+	want := []struct {
+		name, typ string
+		nullable  bool
+	}{
+		{"id", d.bigint, false},
+		{"seq", d.bigint, false},
+		{"name", d.text, true},
+		{"score", d.double, true},
+		{"code", d.bigint, true},
+	}
+	if len(s.columns) != len(want) {
+		t.Fatalf("got columns %q; want id, seq, name, score, code", s.columnNames())
+	}
+	for i, w := range want {
+		c := s.columns[i]
+		if c.name != d.stored(w.name) || !sameType(w.typ, c.typ) || c.nullable != w.nullable {
+			t.Errorf("column %d is %s %s, nullable %v; want %s %s, nullable %v", i+1, c.name, c.typ, c.nullable, d.stored(w.name), w.typ, w.nullable)
+		}
+	}
+	if got, want := fmt.Sprint(s.primaryKey), fmt.Sprint([]string{d.stored("id"), d.stored("seq")}); got != want {
+		t.Errorf("primary key is %s; want %s", got, want)
+	}
+
+	// The UNIQUE constraint's index is named by the backend.
+	var gotIndexes []string
+	for _, x := range s.indexes {
+		if x.name == d.stored(ix) {
+			x.name = "ix"
+		} else {
+			x.name = "?"
+		}
+		gotIndexes = append(gotIndexes, fmt.Sprintf("%s %q unique=%v", x.name, x.columns, x.unique))
+	}
+	sort.Strings(gotIndexes)
+	wantIndexes := []string{
+		fmt.Sprintf("? %q unique=true", []string{d.stored("code")}),
+		fmt.Sprintf("ix %q unique=false", []string{d.stored("score"), d.stored("seq")}),
+	}
+	if fmt.Sprint(gotIndexes) != fmt.Sprint(wantIndexes) {
+		t.Errorf("got indexes %q; want %q", gotIndexes, wantIndexes)
+	}
+}
+
+// checkColumnNames checks that Rows.Columns of query are want.
+func checkColumnNames(t params, query string, want []string) {
+	rows, err := t.Query(query)
+	if err != nil {
+		t.Errorf("%s: %v", query, err)
+		return
+	}
+	defer rows.Close()
+	got, err := rows.Columns()
+	if err != nil || fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+		t.Errorf("%s: got columns %q, %v; want %q", query, got, err, want)
+	}
+}
+
+func testColumnNames(t params) {
+	d := t.dialect()
+	tbl := t.table("names")
+	t.mustExec("CREATE TABLE " + tbl + " (id " + d.bigint + ", name " + d.text + ", " + d.quote("Mixed Case") + " " + d.bigint +
+		", " + d.quote("order") + " " + d.bigint + ")")
+	s, err := describeTable(t.DB, d, tbl)
+	if err != nil {
+		t.Fatalf("describing %s: %v", tbl, err)
+	}
+	id, name := d.stored("id"), d.stored("name")
+	if got, want := fmt.Sprintf("%q", s.columnNames()), fmt.Sprintf("%q", []string{id, name, "Mixed Case", "order"}); got != want {
+		t.Errorf("catalog lists columns %s; want %s", got, want)
+	}
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		{"SELECT * FROM " + tbl, s.columnNames()},
+		{"SELECT id, " + d.quote("Mixed Case") + ", " + d.quote("order") + " FROM " + tbl, []string{id, "Mixed Case", "order"}},
+		{"SELECT id AS renamed, name AS MixedAlias, id AS " + d.quote("Quoted Alias") + " FROM " + tbl,
+			[]string{d.stored("renamed"), d.stored("MixedAlias"), "Quoted Alias"}},
+		{"SELECT id, id FROM " + tbl, []string{id, id}},
+		{"SELECT id AS x, name AS x FROM " + tbl, []string{d.stored("x"), d.stored("x")}},
+	} {
+		checkColumnNames(t, c.query, c.want)
+	}
+
+	// Quoted names differing only in case are different columns where
+	// quoted names are case-sensitive. Elsewhere they clash, and a
+	// column is found whatever the case of its name.
+	pair := t.table("case")
+	upper, lower := d.quote("Case"), d.quote("case")
+	_, err = t.Exec("CREATE TABLE " + pair + " (" + upper + " " + d.bigint + ", " + lower + " " + d.bigint + ")")
+	if !d.quotedCaseSensitive {
+		if err == nil {
+			t.Fatalf("created columns %s and %s; want an error", upper, lower)
+		}
+		t.mustExec("CREATE TABLE " + pair + " (" + upper + " " + d.bigint + ")")
+		t.mustExec("INSERT INTO " + pair + " (" + upper + ") VALUES (1)")
+		var n int64
+		if err := t.QueryRow("SELECT " + d.quote("CASE") + " FROM " + pair).Scan(&n); err != nil || n != 1 {
+			t.Errorf("reading %s as %s: got %d, %v; want 1", upper, d.quote("CASE"), n, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("creating columns %s and %s: %v", upper, lower, err)
+	}
+	t.mustExec("INSERT INTO " + pair + " (" + upper + ", " + lower + ") VALUES (1, 2)")
+	s, err = describeTable(t.DB, d, pair)
+	if err != nil {
+		t.Fatalf("describing %s: %v", pair, err)
+	}
+	if got := fmt.Sprintf("%q", s.columnNames()); got != `["Case" "case"]` {
+		t.Errorf("catalog lists columns %s; want Case and case", got)
+	}
+	checkColumnNames(t, "SELECT * FROM "+pair, []string{"Case", "case"})
+	checkColumnNames(t, "SELECT "+lower+", "+upper+" FROM "+pair, []string{"case", "Case"})
+	var l, u int64
+	if err := t.QueryRow("SELECT "+lower+", "+upper+" FROM "+pair).Scan(&l, &u); err != nil || l != 2 || u != 1 {
+		t.Errorf("reading %s and %s: got %d, %d, %v; want 2, 1", lower, upper, l, u, err)
+	}
+}
@@ -0,0 +1,406 @@
+package sqltest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Each driver's DSN is taken from the environment variable
+// GOSQLTEST_<NAME>_DSN (GOSQLTEST_PQ_DSN, GOSQLTEST_GOMYSQL_DSN, ...)
+// or else from the "dsn" object of a JSON config file:
+//
+//	{"dsn": {"pq": "host=/var/run/postgresql dbname=gosqltest", "pgx": "postgres://db:5433/gosqltest"}}
+//
+// The file is named by GOSQLTEST_CONFIG and defaults to gosqltest.json
+// in the package directory. A DSN for "mysql", in go-mysql-driver's
+// form, serves both MySQL drivers, converted to mymysql's form for it,
+// unless one is configured for the driver itself. Drivers with no
+// configured DSN use the defaults in sql_test.go.
+type config struct {
+	DSN map[string]string `json:"dsn"`
+}
+
+const defaultConfigFile = "gosqltest.json"
+
+var (
+	configOnce sync.Once
+	configVal  config
+	configErr  error
+)
+
+// loadConfig reads the config file once. A missing default file is not
+// an error.
+func loadConfig() (config, error) {
+	configOnce.Do(func() {
+		file, named := os.Getenv("GOSQLTEST_CONFIG"), true
+		if file == "" {
+			file, named = defaultConfigFile, false
+		}
+		b, err := os.ReadFile(file)
+		if os.IsNotExist(err) && !named {
+			return
+		}
+		if err != nil {
+			configErr = fmt.Errorf("reading sqltest config: %v", err)
+			return
+		}
+		if err := json.Unmarshal(b, &configVal); err != nil {
+			configErr = fmt.Errorf("parsing sqltest config %s: %v", file, err)
+		}
+	})
+	return configVal, configErr
+}
+
+// configKeys returns the names DSNs can be configured for: those of
+// the registered drivers that don't bring their own server, and those
+// shared by the drivers of a server.
+func configKeys() []string {
+	var keys []string
+	shared := map[string]bool{}
+	for _, d := range drivers {
+		switch t := d.tester.(type) {
+		case *serverDB:
+			keys = append(keys, t.name)
+			if t.sharedName != "" && !shared[t.sharedName] {
+				shared[t.sharedName] = true
+				keys = append(keys, t.sharedName)
+			}
+		case sqliteDB:
+			keys = append(keys, "sqlite")
+		}
+	}
+	return keys
+}
+
+// unknownDSNs returns the GOSQLTEST_<NAME>_DSN variables of environ and
+// the keys of cfg.DSN that name none of keys.
+func unknownDSNs(environ []string, cfg config, keys []string) []string {
+	known := map[string]bool{}
+	for _, k := range keys {
+		known[k] = true
+	}
+	var unknown []string
+	for _, kv := range environ {
+		v := strings.SplitN(kv, "=", 2)[0]
+		if strings.HasPrefix(v, "GOSQLTEST_") && strings.HasSuffix(v, "_DSN") &&
+			!known[strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(v, "GOSQLTEST_"), "_DSN"))] {
+			unknown = append(unknown, v)
+		}
+	}
+	for k := range cfg.DSN {
+		if !known[k] {
+			unknown = append(unknown, fmt.Sprintf("%q in the config file", k))
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+var warnOnce sync.Once
+
+// configDSN returns the DSN configured for the named driver, and whether
+// one was configured at all. The first call warns about DSNs configured
+// for drivers that don't exist, which would otherwise go unused.
+func configDSN(name string) (dsn string, ok bool, err error) {
+	warnOnce.Do(func() {
+		cfg, _ := loadConfig()
+		keys := configKeys()
+		for _, u := range unknownDSNs(os.Environ(), cfg, keys) {
+			fmt.Fprintf(os.Stderr, "sqltest: warning: ignoring DSN %s: known names are %s\n", u, strings.Join(keys, ", "))
+		}
+	})
+	if dsn := os.Getenv("GOSQLTEST_" + strings.ToUpper(name) + "_DSN"); dsn != "" {
+		return dsn, true, nil
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return "", false, err
+	}
+	dsn, ok = cfg.DSN[name]
+	return dsn, ok, nil
+}
+
+var (
+	probeMu sync.Mutex
+	probed  = map[string]bool{} // "network address" => listening
+)
+
+// listening reports whether something accepts connections on the given
+// address. The result is cached for the rest of the run.
+func listening(network, addr string) bool {
+	probeMu.Lock()
+	defer probeMu.Unlock()
+	key := network + " " + addr
+	up, ok := probed[key]
+	if !ok {
+		c, err := net.DialTimeout(network, addr, 2*time.Second)
+		if err == nil {
+			up = true
+			c.Close()
+		}
+		probed[key] = up
+	}
+	return up
+}
+
+// postgresAddr returns the address lib/pq or pgx dials for dsn, which may
+// be a URL or a list of key=value settings. A host starting with a slash
+// is a Unix socket directory.
+func postgresAddr(dsn string) (network, addr string) {
+	host, port := "localhost", "5432"
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", ""
+		}
+		if h := u.Hostname(); h != "" {
+			host = h
+		}
+		if h := u.Query().Get("host"); h != "" {
+			host = h
+		}
+		if p := u.Port(); p != "" {
+			port = p
+		}
+	} else {
+		for _, kv := range strings.Fields(dsn) {
+			kv := strings.SplitN(kv, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v := strings.Trim(kv[1], "'")
+			switch kv[0] {
+			case "host":
+				host = v
+			case "port":
+				port = v
+			}
+		}
+	}
+	if strings.HasPrefix(host, "/") {
+		return "unix", filepath.Join(host, ".s.PGSQL."+port)
+	}
+	return "tcp", net.JoinHostPort(host, port)
+}
+
+// postgresSetAddr returns dsn with the driver dialing the TCP address
+// addr instead.
+func postgresSetAddr(dsn, addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return dsn
+		}
+		u.Host = addr
+		q := u.Query()
+		q.Del("host")
+		q.Del("port")
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	var kvs []string
+	for _, kv := range strings.Fields(dsn) {
+		if !strings.HasPrefix(kv, "host=") && !strings.HasPrefix(kv, "port=") {
+			kvs = append(kvs, kv)
+		}
+	}
+	return strings.Join(append(kvs, "host="+host, "port="+port), " ")
+}
+
+// myMysqlAddr returns the address mymysql dials for a DSN of the form
+// [tcp:ADDR*|unix:SOCKPATH*]DBNAME/USER/PASSWD.
+func myMysqlAddr(dsn string) (network, addr string) {
+	pd := strings.SplitN(dsn, "*", 2)
+	if len(pd) != 2 {
+		return "tcp", "127.0.0.1:3306"
+	}
+	p := strings.SplitN(pd[0], ":", 2)
+	if len(p) != 2 {
+		return "", ""
+	}
+	return p[0], p[1]
+}
+
+// myMysqlSetAddr returns dsn with mymysql dialing the TCP address addr
+// instead.
+func myMysqlSetAddr(dsn, addr string) string {
+	if pd := strings.SplitN(dsn, "*", 2); len(pd) == 2 {
+		dsn = pd[1]
+	}
+	return "tcp:" + addr + "*" + dsn
+}
+
+// goMysqlDSN matches the [user[:password]@][net[(addr)]]/ prefix of a
+// go-mysql-driver DSN, as parsed by the driver itself.
+var goMysqlDSN = regexp.MustCompile(`^(?:.*?(?::.*)?@)?(?:([^\(]*)(?:\(([^\)]*)\))?)?\/`)
+
+// goMysqlAddr returns the address go-mysql-driver dials for dsn.
+func goMysqlAddr(dsn string) (network, addr string) {
+	m := goMysqlDSN.FindStringSubmatch(dsn)
+	if m == nil {
+		return "", ""
+	}
+	network, addr = m[1], m[2]
+	if network == "" {
+		network = "tcp"
+	}
+	if addr == "" {
+		addr = "127.0.0.1:3306"
+	}
+	return network, addr
+}
+
+// goMysqlSetAddr returns dsn with go-mysql-driver dialing the TCP
+// address addr instead.
+func goMysqlSetAddr(dsn, addr string) string {
+	m := goMysqlDSN.FindStringSubmatchIndex(dsn)
+	if m == nil {
+		return dsn
+	}
+	start, slash := m[2], m[1]-1
+	if start < 0 {
+		start = slash
+	}
+	return dsn[:start] + "tcp(" + addr + ")" + dsn[slash:]
+}
+
+// myMysqlDSN converts dsn from go-mysql-driver's form,
+// [user[:password]@][net[(addr)]]/dbname[?params], to mymysql's, dropping
+// the parameters.
+func myMysqlDSN(dsn string) (string, error) {
+	m := goMysqlDSN.FindStringSubmatchIndex(dsn)
+	if m == nil {
+		return "", fmt.Errorf("MySQL DSN %q is not of the form [user[:password]@][net[(addr)]]/dbname", dsn)
+	}
+	var user, pass string
+	prefix := dsn[:m[1]-1]
+	if i := strings.LastIndex(prefix, "@"); i >= 0 {
+		user = prefix[:i]
+		if j := strings.Index(user, ":"); j >= 0 {
+			user, pass = user[:j], user[j+1:]
+		}
+	}
+	dbname := strings.SplitN(dsn[m[1]:], "?", 2)[0]
+	network, addr := goMysqlAddr(dsn)
+	return fmt.Sprintf("%s:%s*%s/%s/%s", network, addr, dbname, user, pass), nil
+}
+
+// oracleAddr returns the address goracle dials for a DSN of the form
+// user/passwd@host[:port][/service]. A bare TNS alias after the @ cannot
+// be resolved here, so it is not probed.
+func oracleAddr(dsn string) (network, addr string) {
+	i := strings.LastIndex(dsn, "@")
+	if i < 0 {
+		return "tcp", "localhost:1521"
+	}
+	connect := strings.TrimPrefix(dsn[i+1:], "//")
+	if j := strings.Index(connect, "/"); j >= 0 {
+		connect = connect[:j]
+	} else if !strings.Contains(connect, ":") {
+		return "", ""
+	}
+	if _, _, err := net.SplitHostPort(connect); err != nil {
+		connect = net.JoinHostPort(connect, "1521")
+	}
+	return "tcp", connect
+}
+
+func TestServerAddr(t *testing.T) {
+	tests := []struct {
+		addr          func(string) (string, string)
+		dsn           string
+		network, want string
+	}{
+		{postgresAddr, "user=bob dbname=gosqltest", "tcp", "localhost:5432"},
+		{postgresAddr, "host=db port=5433 dbname=gosqltest", "tcp", "db:5433"},
+		{postgresAddr, "host=/var/run/postgresql dbname=gosqltest", "unix", "/var/run/postgresql/.s.PGSQL.5432"},
+		{postgresAddr, "postgres://bob:pw@localhost/gosqltest", "tcp", "localhost:5432"},
+		{postgresAddr, "postgres://bob:pw@10.0.0.2:6543/gosqltest", "tcp", "10.0.0.2:6543"},
+		{myMysqlAddr, "gosqltest/root/root", "tcp", "127.0.0.1:3306"},
+		{myMysqlAddr, "tcp:db:3307*gosqltest/root/root", "tcp", "db:3307"},
+		{myMysqlAddr, "unix:/tmp/mysql.sock*gosqltest/root/root", "unix", "/tmp/mysql.sock"},
+		{goMysqlAddr, "root:root@/gosqltest", "tcp", "127.0.0.1:3306"},
+		{goMysqlAddr, "root:root@tcp(db:3307)/gosqltest", "tcp", "db:3307"},
+		{goMysqlAddr, "root@unix(/tmp/mysql.sock)/gosqltest?charset=utf8", "unix", "/tmp/mysql.sock"},
+		{oracleAddr, "", "tcp", "localhost:1521"},
+		{oracleAddr, "scott/tiger@db/orcl", "tcp", "db:1521"},
+		{oracleAddr, "scott/tiger@db:1522/orcl", "tcp", "db:1522"},
+		{oracleAddr, "scott/tiger@ORCL", "", ""},
+	}
+	for _, tt := range tests {
+		network, addr := tt.addr(tt.dsn)
+		if network != tt.network || addr != tt.want {
+			t.Errorf("addr(%q) = %q, %q; want %q, %q", tt.dsn, network, addr, tt.network, tt.want)
+		}
+	}
+}
+
+func TestServerSetAddr(t *testing.T) {
+	tests := []struct {
+		setAddr func(string, string) string
+		dsn     string
+		want    string
+	}{
+		{postgresSetAddr, "user=bob dbname=gosqltest", "user=bob dbname=gosqltest host=127.0.0.1 port=9"},
+		{postgresSetAddr, "host=/var/run/postgresql port=5433 dbname=gosqltest", "dbname=gosqltest host=127.0.0.1 port=9"},
+		{postgresSetAddr, "postgres://bob:pw@localhost/gosqltest?sslmode=disable", "postgres://bob:pw@127.0.0.1:9/gosqltest?sslmode=disable"},
+		{postgresSetAddr, "postgres://bob:pw@/gosqltest?host=/tmp", "postgres://bob:pw@127.0.0.1:9/gosqltest"},
+		{myMysqlSetAddr, "gosqltest/root/root", "tcp:127.0.0.1:9*gosqltest/root/root"},
+		{myMysqlSetAddr, "unix:/tmp/mysql.sock*gosqltest/root/root", "tcp:127.0.0.1:9*gosqltest/root/root"},
+		{goMysqlSetAddr, "root:root@/gosqltest", "root:root@tcp(127.0.0.1:9)/gosqltest"},
+		{goMysqlSetAddr, "root@unix(/tmp/mysql.sock)/gosqltest?charset=utf8", "root@tcp(127.0.0.1:9)/gosqltest?charset=utf8"},
+		{goMysqlSetAddr, "/gosqltest", "tcp(127.0.0.1:9)/gosqltest"},
+	}
+	for _, tt := range tests {
+		if got := tt.setAddr(tt.dsn, "127.0.0.1:9"); got != tt.want {
+			t.Errorf("setAddr(%q) = %q; want %q", tt.dsn, got, tt.want)
+		}
+	}
+}
+
+func TestMyMysqlDSN(t *testing.T) {
+	tests := []struct {
+		dsn, want string
+	}{
+		{"root:root@/gosqltest", "tcp:127.0.0.1:3306*gosqltest/root/root"},
+		{"bob@tcp(db:3307)/gosqltest?charset=utf8", "tcp:db:3307*gosqltest/bob/"},
+		{"bob:p:w@unix(/tmp/mysql.sock)/gosqltest", "unix:/tmp/mysql.sock*gosqltest/bob/p:w"},
+		{"/gosqltest", "tcp:127.0.0.1:3306*gosqltest//"},
+	}
+	for _, tt := range tests {
+		if got, err := myMysqlDSN(tt.dsn); got != tt.want || err != nil {
+			t.Errorf("myMysqlDSN(%q) = %q, %v; want %q", tt.dsn, got, err, tt.want)
+		}
+	}
+	if got, err := myMysqlDSN("gosqltest"); err == nil {
+		t.Errorf("myMysqlDSN(%q) = %q; want an error", "gosqltest", got)
+	}
+}
+
+func TestUnknownDSNs(t *testing.T) {
+	environ := []string{
+		"HOME=/root",
+		"GOSQLTEST_PQ_DSN=dbname=gosqltest",
+		"GOSQLTEST_MYSQL_DSN=root:root@/gosqltest",
+		"GOSQLTEST_POSTGRES_DSN=dbname=gosqltest",
+		"GOSQLTEST_PQ_USER=bob",
+		"GOSQLTEST_CONFIG=gosqltest.json",
+	}
+	cfg := config{DSN: map[string]string{"pgx": "postgres://db/gosqltest", "postgres": "dbname=gosqltest"}}
+	got := strings.Join(unknownDSNs(environ, cfg, []string{"pq", "pgx", "gomysql", "mysql"}), "; ")
+	want := `"postgres" in the config file; GOSQLTEST_POSTGRES_DSN`
+	if got != want {
+		t.Errorf("unknownDSNs = %s; want %s", got, want)
+	}
+}
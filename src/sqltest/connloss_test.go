@@ -0,0 +1,186 @@
+package sqltest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"sqltest/faultproxy"
+)
+
+func init() {
+	registerScenario("ConnLoss", testConnLoss, 0)
+}
+
+// A connKiller ends the server session with the given ID.
+type connKiller struct {
+	name string
+	kill func(id int64, p *faultproxy.Proxy) error
+}
+
+// sqlKiller kills sessions with d's killSession statement, run on
+// killer. The server may end the session some time after agreeing to.
+func sqlKiller(d *Dialect, killer *sql.DB) connKiller {
+	return connKiller{"server kill", func(id int64, p *faultproxy.Proxy) error {
+		_, err := killer.Exec(fmt.Sprintf(d.killSession, id))
+		return err
+	}}
+}
+
+// proxyKiller kills sessions by resetting their connection in the
+// proxy, as a server crash or a stateful firewall would.
+var proxyKiller = connKiller{"proxy reset", func(id int64, p *faultproxy.Proxy) error {
+	p.CloseConns()
+	return nil
+}}
+
+// sessionOf returns the ID of the session q runs in, or 0 on error.
+func sessionOf(q rowQueryer, d *Dialect) (int64, error) {
+	var id int64
+	err := q.QueryRowContext(context.Background(), d.sessionID).Scan(&id)
+	return id, err
+}
+
+// checkConnLoss kills the session of db's only connection with k
+// between two statements, and then inside a transaction, watching for
+// the loss through db itself. Between statements, the following queries
+// must succeed, and soon run in a new session: database/sql opens one
+// when the driver returns driver.ErrBadConn. Drivers with
+// quirkBrokenConnReused fail them instead, and have the dead connection
+// dropped from the pool before the transaction, and drivers with
+// quirkIdleConnLossFails fail the first. Inside a transaction, a
+// statement must soon fail instead of silently going on in a new
+// session, and the pool must recover once the transaction is done,
+// except with quirkBrokenConnReused, where the next query fails.
+func checkConnLoss(t *testing.T, db *sql.DB, p *faultproxy.Proxy, d *Dialect, k connKiller, quirks quirk, query string, want []int64) {
+	db.SetMaxOpenConns(1)
+	var id, now int64
+	var err error
+	run := func(what string, fn func()) bool { return within(t, p.CloseConns, what, fn) }
+	kill := func() bool {
+		if !run(k.name, func() { err = k.kill(id, p) }) {
+			return false
+		}
+		if err != nil {
+			t.Errorf("%s of session %d: %v", k.name, id, err)
+			return false
+		}
+		return true
+	}
+
+	if id, err = sessionOf(db, d); err != nil {
+		t.Fatalf("before the kill: %v", err)
+	}
+	if !kill() {
+		return
+	}
+	failed := false
+	for deadline := time.Now().Add(faultTimeout); ; time.Sleep(10 * time.Millisecond) {
+		if !run("query after the kill", func() { now, err = sessionOf(db, d) }) {
+			return
+		}
+		switch {
+		case err != nil && quirks&quirkBrokenConnReused != 0:
+			t.Logf("%s: query after the kill: %v, as documented", k.name, err)
+			// The pool is stuck with the dead connection; drop it to
+			// go on with the transaction.
+			db.SetMaxIdleConns(0)
+			db.SetMaxIdleConns(1)
+		case err != nil && quirks&quirkIdleConnLossFails != 0 && !failed:
+			t.Logf("%s: query after the kill: %v, as documented", k.name, err)
+			failed = true
+			continue
+		case err != nil:
+			t.Errorf("%s: query after the kill: %v; want it retried on a new connection", k.name, err)
+			return
+		case now != id:
+			if quirks&quirkBrokenConnReused != 0 {
+				t.Errorf("%s: the driver no longer reuses the dead connection; remove its quirk", k.name)
+			}
+			if quirks&quirkIdleConnLossFails != 0 && !failed {
+				t.Errorf("%s: the driver no longer fails a query on the dead connection; remove its quirk", k.name)
+			}
+			t.Logf("%s: query after the kill: succeeded in session %d", k.name, now)
+		case time.Now().After(deadline):
+			t.Errorf("%s: session %d still alive after %v", k.name, id, faultTimeout)
+			return
+		default:
+			continue
+		}
+		break
+	}
+	if got, err := queryInts(db, query); err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%s: after the kill: got %v, %v; want %v", k.name, got, err, want)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if id, err = sessionOf(tx, d); err != nil {
+		t.Fatalf("in the transaction, before the kill: %v", err)
+	}
+	if !kill() {
+		tx.Rollback()
+		return
+	}
+	for deadline := time.Now().Add(faultTimeout); ; time.Sleep(10 * time.Millisecond) {
+		if !run("statement in the transaction after the kill", func() { now, err = sessionOf(tx, d) }) {
+			return
+		}
+		if err != nil {
+			t.Logf("%s: statement in the transaction after the kill: %v", k.name, err)
+			break
+		}
+		if now != id {
+			t.Errorf("%s: the transaction went on in session %d after %d was killed", k.name, now, id)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("%s: session %d still alive after %v", k.name, id, faultTimeout)
+			break
+		}
+	}
+	run("Rollback after the kill", func() { tx.Rollback() })
+	var got []int64
+	if !run("query after the transaction", func() { got, err = queryInts(db, query) }) {
+		return
+	}
+	switch {
+	case err != nil && quirks&quirkBrokenConnReused != 0:
+		t.Logf("%s: query after the transaction: %v, as documented", k.name, err)
+	case err == nil && quirks&quirkBrokenConnReused != 0:
+		t.Errorf("%s: the driver no longer reuses the dead connection after the transaction; remove its quirk", k.name)
+	case err != nil || fmt.Sprint(got) != fmt.Sprint(want):
+		t.Errorf("%s: query after the transaction: got %v, %v; want %v", k.name, got, err, want)
+	}
+}
+
+func testConnLoss(t params) {
+	pt, ok := t.dbType.(proxiedTester)
+	if !ok {
+		t.Skip("driver does not connect over TCP")
+	}
+	d := t.dialect()
+	if d.sessionID == "" {
+		t.Skip("sessions have no ID")
+	}
+	tbl := t.table("connloss")
+	t.mustExec("CREATE TABLE " + tbl + " (id INTEGER PRIMARY KEY)")
+	for id := 1; id <= 3; id++ {
+		t.mustExec(t.q("INSERT INTO "+tbl+" (id) VALUES (?)"), id)
+	}
+	killers := []connKiller{proxyKiller}
+	if d.killSession != "" {
+		killers = append(killers, sqlKiller(d, t.DB))
+	}
+	for _, k := range killers {
+		k := k
+		t.Run(k.name, func(tt *testing.T) {
+			db, p := pt.OpenProxied(tt)
+			checkConnLoss(tt, db, p, d, k, t.drv.quirks, "SELECT id FROM "+tbl+" ORDER BY id", []int64{1, 2, 3})
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package sqltest
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// placeholderStyle is how a backend spells bind parameters.
+type placeholderStyle int
+
+const (
+	placeholderQuestion placeholderStyle = iota // ?, ?, ?
+	placeholderDollar                           // $1, $2, $n
+	placeholderColon                            // :1, :2, :n
+	placeholderNamed                            // :a, :b, :name
+)
+
+func (s placeholderStyle) String() string {
+	switch s {
+	case placeholderQuestion:
+		return "?"
+	case placeholderDollar:
+		return "$n"
+	case placeholderColon:
+		return ":n"
+	case placeholderNamed:
+		return ":name"
+	}
+	return fmt.Sprintf("placeholderStyle(%d)", int(s))
+}
+
+// A Dialect describes the SQL spoken by a backend, so scenarios can be
+// written once and adapted to each driver instead of switching on the
+// Tester.
+type Dialect struct {
+	placeholder placeholderStyle
+	blob        func(size int) string // column type holding size bytes
+	text        string                // column type for unbounded text
+	bigint      string                // column type for an int64
+	double      string                // column type for a float64
+	float       string                // column type for a float32
+	timestamp   string                // column type for a date and time of day
+	date        string                // column type for a date, "" if none
+	timeOfDay   string                // column type for a time of day, "" if none
+	timestamptz string                // column type for an instant, "" if none
+	boolean     string                // column type for true/false
+	decimal     string                // printf format taking precision and scale
+	maxIdent    int                   // longest identifier allowed, 0 if unlimited
+
+	// backslashEscapes is set if a backslash escapes the next character
+	// of a quoted string, as in MySQL's default SQL mode.
+	backslashEscapes bool
+
+	// autoIncrement is the definition of an integer primary key column
+	// the backend numbers itself.
+	autoIncrement string
+
+	// firstInsertId is set if LastInsertId of an INSERT of several
+	// rows is the ID of its first row rather than its last.
+	firstInsertId bool
+
+	// emptyStringIsNull is set if the backend stores '' as NULL.
+	emptyStringIsNull bool
+
+	// decimalIsFloat is set if DECIMAL columns hold floating point
+	// numbers, losing digits beyond a float64's.
+	decimalIsFloat bool
+
+	// errorAbortsTx is set if any failed statement aborts the rest of
+	// the transaction.
+	errorAbortsTx bool
+
+	// lockTimeoutSession is a statement a session must run to give up
+	// soon on a lock another session holds, if any, rather than wait.
+	lockTimeoutSession string
+
+	// errorCodes gives the category of each code errorCode finds in an
+	// error, and errorText matches the code in the text of an error
+	// whose driver has no field for it, as its group if it has one.
+	errorCodes map[string]errorCategory
+	errorText  *regexp.Regexp
+
+	// foreignKeySession is a statement a session must run to enforce
+	// foreign keys, if any, and divisionByZeroIsNull is set if dividing
+	// by zero gives NULL rather than an error.
+	foreignKeySession    string
+	divisionByZeroIsNull bool
+
+	// catalog describes the tables of the backend. foldCase converts an
+	// unquoted name to the case the backend stores it in, nil if it
+	// keeps the case it is written in, and identQuote is the character
+	// enclosing a name kept as written. quotedCaseSensitive is set if
+	// quoted names differing only in case name different columns.
+	catalog             catalog
+	foldCase            func(string) string
+	identQuote          string
+	quotedCaseSensitive bool
+
+	// createNamespace and dropNamespace are printf formats taking a
+	// name, which create and drop a schema or database holding one
+	// test's tables. If empty, tests share a namespace and are kept
+	// apart by table name prefix instead.
+	createNamespace, dropNamespace string
+
+	// sessionID is a query returning the ID of the server session
+	// running it, and killSession a printf format taking one, which
+	// disconnects that session and returns a false value or fails if
+	// there is none. They are empty if sessions cannot be killed.
+	sessionID, killSession string
+
+	// checkedOffset is the offset in a server reply of a byte every
+	// driver must check, such as the message type of Postgres, at 0, and
+	// the packet sequence number of MySQL.
+	checkedOffset int64
+
+	// preparedStmts is a query returning the number of statements
+	// prepared on the server as its last column, counting those of the
+	// session running it if sessionStmts is set and of every session
+	// otherwise. It is empty if the backend does not tell.
+	preparedStmts string
+	sessionStmts  bool
+
+	// utf8Text is a column type for text of up to 100 characters
+	// stored as UTF-8, and utf8Session a statement a session must run
+	// to exchange text as UTF-8, if any.
+	utf8Text, utf8Session string
+
+	// charLength is the function counting the characters of a text,
+	// and byteOrder a printf format taking an expression, which orders
+	// texts by their bytes in UTF-8.
+	charLength, byteOrder string
+
+	// nulTextFails is set if the backend refuses text holding a NUL
+	// byte, and lengthEndsAtNul if charLength stops counting at one.
+	nulTextFails, lengthEndsAtNul bool
+
+	caps capability
+}
+
+var (
+	sqliteDialect = &Dialect{
+		placeholder: placeholderQuestion,
+		blob:        func(size int) string { return fmt.Sprintf("blob[%d]", size) },
+		text:        "text",
+		bigint:      "integer",
+		double:      "real",
+		float:       "real",
+		timestamp:   "timestamp",
+		date:        "date",
+		timeOfDay:   "time",
+		boolean:     "boolean",
+		decimal:     "decimal(%d,%d)",
+		catalog:     sqliteCatalog{},
+		identQuote:  `"`,
+		caps:        capLastInsertId | capSavepoints | capReleaseSavepoint,
+
+		autoIncrement: "INTEGER PRIMARY KEY AUTOINCREMENT",
+
+		utf8Text:        "text",
+		charLength:      "length",
+		byteOrder:       "%s",
+		lengthEndsAtNul: true,
+
+		errorCodes:           sqliteErrorCodes,
+		errorText:            sqliteErrorText,
+		lockTimeoutSession:   "PRAGMA busy_timeout = 100",
+		foreignKeySession:    "PRAGMA foreign_keys = ON",
+		divisionByZeroIsNull: true,
+		decimalIsFloat:       true,
+	}
+
+	mysqlDialect = &Dialect{
+		placeholder: placeholderQuestion,
+		blob:        mysqlBlob,
+		text:        "TEXT",
+		bigint:      "BIGINT",
+		double:      "DOUBLE",
+		float:       "FLOAT",
+		timestamp:   "DATETIME",
+		date:        "DATE",
+		timeOfDay:   "TIME(6)",
+		timestamptz: "TIMESTAMP(6)",
+		boolean:     "BOOL",
+		decimal:     "DECIMAL(%d,%d)",
+		maxIdent:    64,
+		catalog:     mysqlCatalog{informationSchema{[2]string{"?", "?"}, ""}},
+		identQuote:  "`",
+		caps:        capLastInsertId | capSavepoints | capReleaseSavepoint | capMultiResultSets,
+
+		autoIncrement: "BIGINT AUTO_INCREMENT PRIMARY KEY",
+		firstInsertId: true,
+
+		backslashEscapes: true,
+
+		createNamespace: "CREATE DATABASE %s",
+		dropNamespace:   "DROP DATABASE %s",
+
+		sessionID:   "SELECT CONNECTION_ID()",
+		killSession: "KILL %d",
+
+		checkedOffset: 3,
+
+		preparedStmts: "SHOW GLOBAL STATUS LIKE 'Prepared_stmt_count'",
+
+		utf8Text:    "VARCHAR(100) CHARACTER SET utf8mb4",
+		utf8Session: "SET NAMES utf8mb4",
+		charLength:  "CHAR_LENGTH",
+		byteOrder:   "%s COLLATE utf8mb4_bin",
+
+		errorCodes: mysqlErrorCodes,
+		errorText:  mysqlErrorText,
+	}
+
+	postgresDialect = &Dialect{
+		placeholder: placeholderDollar,
+		blob:        func(int) string { return "bytea" },
+		text:        "text",
+		bigint:      "bigint",
+		double:      "double precision",
+		float:       "real",
+		timestamp:   "timestamp",
+		date:        "date",
+		timeOfDay:   "time",
+		timestamptz: "timestamptz",
+		boolean:     "boolean",
+		decimal:     "numeric(%d,%d)",
+		maxIdent:    63,
+		catalog:     postgresCatalog{informationSchema{[2]string{"$1", "$2"}, "public"}},
+		foldCase:    strings.ToLower,
+		identQuote:  `"`,
+		caps:        capReturning | capSavepoints | capReleaseSavepoint | capMultiResultSets,
+
+		quotedCaseSensitive: true,
+
+		autoIncrement: "bigserial PRIMARY KEY",
+
+		createNamespace: "CREATE SCHEMA %s",
+		dropNamespace:   "DROP SCHEMA %s CASCADE",
+
+		sessionID:   "SELECT pg_backend_pid()",
+		killSession: "SELECT pg_terminate_backend(%d)",
+
+		preparedStmts: "SELECT COUNT(*) FROM pg_prepared_statements",
+		sessionStmts:  true,
+
+		utf8Text:     "varchar(100)",
+		charLength:   "char_length",
+		byteOrder:    `%s COLLATE "C"`,
+		nulTextFails: true,
+
+		errorAbortsTx: true,
+		errorCodes:    postgresErrorCodes,
+		errorText:     postgresErrorText,
+	}
+
+	oracleDialect = &Dialect{
+		placeholder: placeholderColon,
+		blob:        oracleBlob,
+		text:        "CLOB",
+		bigint:      "NUMBER(19)",
+		double:      "BINARY_DOUBLE",
+		float:       "BINARY_FLOAT",
+		timestamp:   "TIMESTAMP",
+		date:        "DATE",
+		timestamptz: "TIMESTAMP(9) WITH TIME ZONE",
+		boolean:     "NUMBER(1)",
+		decimal:     "NUMBER(%d,%d)",
+		maxIdent:    30,
+		catalog:     oracleCatalog{},
+		foldCase:    strings.ToUpper,
+		identQuote:  `"`,
+		caps:        capSavepoints,
+
+		quotedCaseSensitive: true,
+
+		autoIncrement: "NUMBER(19) GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY",
+
+		utf8Text:   "VARCHAR2(100 CHAR)",
+		charLength: "LENGTH",
+		byteOrder:  "NLSSORT(%s, 'NLS_SORT=BINARY')",
+
+		emptyStringIsNull: true,
+		errorCodes:        oracleErrorCodes,
+		errorText:         oracleErrorText,
+
+		sessionID:   "SELECT SYS_CONTEXT('USERENV', 'SID') FROM DUAL",
+		killSession: oracleKillSession,
+	}
+)
+
+// oracleKillSession kills the session with a SID, which ALTER SYSTEM
+// KILL SESSION names together with its serial number, looked up in
+// v$session. SELECT INTO fails if there is no such session.
+const oracleKillSession = `DECLARE serial NUMBER;
+BEGIN
+	SELECT serial# INTO serial FROM v$session WHERE sid = %[1]d;
+	EXECUTE IMMEDIATE 'ALTER SYSTEM KILL SESSION ''%[1]d,' || serial || ''' IMMEDIATE';
+END;`
+
+// mysqlBlob switches to LONGBLOB beyond the 64 KB VARBINARY row limit.
+func mysqlBlob(size int) string {
+	if size > 65535 {
+		return "LONGBLOB"
+	}
+	return fmt.Sprintf("VARBINARY(%d)", size)
+}
+
+// oracleBlob switches to BLOB beyond the 2000 byte RAW limit.
+func oracleBlob(size int) string {
+	if size > 2000 {
+		return "BLOB"
+	}
+	return fmt.Sprintf("RAW(%d)", size)
+}
+
+// stored returns the unquoted name ident in the case the backend stores
+// it in.
+func (d *Dialect) stored(ident string) string {
+	if d.foldCase == nil {
+		return ident
+	}
+	return d.foldCase(ident)
+}
+
+// quote returns ident quoted, so the backend keeps it as written.
+func (d *Dialect) quote(ident string) string {
+	return d.identQuote + strings.Replace(ident, d.identQuote, d.identQuote+d.identQuote, -1) + d.identQuote
+}
+
+// blobType returns the column type for a binary value of size bytes.
+func (d *Dialect) blobType(size int) string {
+	return d.blob(size)
+}
+
+// decimalType returns the column type for an exact number with the given
+// precision and scale.
+func (d *Dialect) decimalType(precision, scale int) string {
+	return fmt.Sprintf(d.decimal, precision, scale)
+}
+
+// q converts the placeholders in sql, "?" in the scenarios, to the
+// backend's style: $1, $2, $n on postgres, :1, :2, :n on Oracle. It
+// fails tb if sql cannot be converted, which is a bug in the scenario.
+func (d *Dialect) q(tb testing.TB, sql string) string {
+	if d.placeholder == placeholderQuestion {
+		return sql
+	}
+	s, err := rewritePlaceholders(sql, d.placeholder, d.backslashEscapes)
+	if err != nil {
+		tb.Fatalf("converting placeholders: %v", err)
+	}
+	return s
+}
@@ -0,0 +1,405 @@
+package sqltest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	jackcpgx "github.com/jackc/pgx"
+	libpq "github.com/lib/pq"
+	goracle "github.com/tgulacsi/goracle/oracle"
+	mymysql "github.com/ziutek/mymysql/mysql"
+)
+
+func init() {
+	registerScenario("ErrorUnique", testErrorUnique, 0)
+	registerScenario("ErrorNotNull", testErrorNotNull, 0)
+	registerScenario("ErrorForeignKey", testErrorForeignKey, 0)
+	registerScenario("ErrorSyntax", testErrorSyntax, 0)
+	registerScenario("ErrorDivisionByZero", testErrorDivisionByZero, 0)
+	registerScenario("ErrorSerialization", testErrorSerialization, 0)
+}
+
+// errorCategory is what went wrong, as far as an application deciding
+// whether to retry, or what to tell its user, needs to know.
+type errorCategory int
+
+const (
+	errOther               errorCategory = iota // not recognized
+	errUniqueViolation                          // a duplicate key
+	errForeignKeyViolation                      // a missing or still referenced row
+	errNotNullViolation                         // NULL in a NOT NULL column
+	errSyntax                                   // SQL the backend cannot parse
+	errDivisionByZero                           // a division by zero
+	errSerialization                            // lost a conflict with another transaction; retrying may succeed
+)
+
+func (c errorCategory) String() string {
+	switch c {
+	case errOther:
+		return "other"
+	case errUniqueViolation:
+		return "unique violation"
+	case errForeignKeyViolation:
+		return "foreign key violation"
+	case errNotNullViolation:
+		return "not null violation"
+	case errSyntax:
+		return "syntax error"
+	case errDivisionByZero:
+		return "division by zero"
+	case errSerialization:
+		return "serialization failure"
+	}
+	return fmt.Sprintf("errorCategory(%d)", int(c))
+}
+
+// errorSource is where errorCode found the code of an error.
+type errorSource int
+
+const (
+	sourceNone  errorSource = iota // nowhere
+	sourceField                    // a field of the driver's error type
+	sourceText                     // the error's text
+)
+
+func (s errorSource) String() string {
+	switch s {
+	case sourceNone:
+		return "nowhere"
+	case sourceField:
+		return "field"
+	case sourceText:
+		return "text"
+	}
+	return fmt.Sprintf("errorSource(%d)", int(s))
+}
+
+// errorSources records, for each driver, where errorCode finds the codes
+// of its errors. Drivers with a field for the code let an application
+// recognize errors worth retrying without parsing messages meant for
+// people, which change with the server's version and language.
+var errorSources = map[string]errorSource{
+	"sqlite":  sourceText, // errors.New(sqlite3_errmsg())
+	"pq":      sourceField,
+	"pgx":     sourceField,
+	"mymysql": sourceField,
+	"gomysql": sourceText, // fmt.Errorf("Error %d: %s"), without the SQLSTATE
+	"oracle":  sourceField,
+}
+
+func init() {
+	for _, name := range []string{"pq", "pgx", "mymysql", "gomysql"} {
+		errorSources[name+"-fake"] = errorSources[name]
+	}
+}
+
+// The codes of the errors the scenarios provoke, and a few neighbours a
+// retrying application would treat the same, with the patterns finding
+// them in the text of errors. SQLite reports no codes, so the parts of
+// its messages naming the failure stand in for them.
+var (
+	postgresErrorCodes = map[string]errorCategory{
+		"23505": errUniqueViolation,
+		"23503": errForeignKeyViolation,
+		"23502": errNotNullViolation,
+		"42601": errSyntax,
+		"22012": errDivisionByZero,
+		"40001": errSerialization, // serialization_failure
+		"40P01": errSerialization, // deadlock_detected
+	}
+	postgresErrorText = regexp.MustCompile(`SQLSTATE ([0-9A-Z]{5})`)
+
+	mysqlErrorCodes = map[string]errorCategory{
+		"1062": errUniqueViolation,     // ER_DUP_ENTRY
+		"1216": errForeignKeyViolation, // ER_NO_REFERENCED_ROW
+		"1217": errForeignKeyViolation, // ER_ROW_IS_REFERENCED
+		"1451": errForeignKeyViolation, // ER_ROW_IS_REFERENCED_2
+		"1452": errForeignKeyViolation, // ER_NO_REFERENCED_ROW_2
+		"1048": errNotNullViolation,    // ER_BAD_NULL_ERROR
+		"1064": errSyntax,              // ER_PARSE_ERROR
+		"1365": errDivisionByZero,      // ER_DIVISION_BY_ZERO
+		"1213": errSerialization,       // ER_LOCK_DEADLOCK
+	}
+	mysqlErrorText = regexp.MustCompile(`^Error (\d+):`)
+
+	oracleErrorCodes = map[string]errorCategory{
+		"ORA-00001": errUniqueViolation,
+		"ORA-02291": errForeignKeyViolation, // parent key not found
+		"ORA-02292": errForeignKeyViolation, // child record found
+		"ORA-01400": errNotNullViolation,
+		"ORA-01407": errNotNullViolation,
+		"ORA-00900": errSyntax, // invalid SQL statement
+		"ORA-00933": errSyntax, // SQL command not properly ended
+		"ORA-00936": errSyntax, // missing expression
+		"ORA-01476": errDivisionByZero,
+		"ORA-08177": errSerialization, // can't serialize access
+		"ORA-00060": errSerialization, // deadlock detected
+	}
+	oracleErrorText = regexp.MustCompile(`ORA-\d{5}`)
+
+	sqliteErrorCodes = map[string]errorCategory{
+		"UNIQUE constraint failed":      errUniqueViolation,
+		"FOREIGN KEY constraint failed": errForeignKeyViolation,
+		"NOT NULL constraint failed":    errNotNullViolation,
+		"syntax error":                  errSyntax,
+		"database is locked":            errSerialization,
+	}
+	sqliteErrorText = regexp.MustCompile(`(?:UNIQUE|FOREIGN KEY|NOT NULL) constraint failed|syntax error|database is locked`)
+)
+
+// errorCode returns the code err reports, from a field of the driver's
+// error type if it has one and else from the text of err, using the
+// dialect's errorText.
+func errorCode(d *Dialect, err error) (string, errorSource) {
+	switch e := err.(type) {
+	case *libpq.Error:
+		return string(e.Code), sourceField
+	case jackcpgx.PgError:
+		return e.Code, sourceField
+	case *mymysql.Error:
+		return strconv.Itoa(int(e.Code)), sourceField
+	case *goracle.Error:
+		return fmt.Sprintf("ORA-%05d", e.Code), sourceField
+	}
+	if d.errorText == nil {
+		return "", sourceNone
+	}
+	m := d.errorText.FindStringSubmatch(err.Error())
+	if m == nil {
+		return "", sourceNone
+	}
+	return m[len(m)-1], sourceText
+}
+
+// classifyError returns the category of err and where its code was
+// found.
+func classifyError(d *Dialect, err error) (errorCategory, errorSource) {
+	code, src := errorCode(d, err)
+	return d.errorCodes[code], src
+}
+
+// checkError fails unless err, returned by what, is of the category
+// want, with its code where errorSources records the driver puts it.
+func checkError(t params, what string, err error, want errorCategory) {
+	if err == nil {
+		t.Errorf("%s succeeded; want a %v", what, want)
+		return
+	}
+	code, src := errorCode(t.dialect(), err)
+	if got := t.dialect().errorCodes[code]; got != want {
+		t.Errorf("%s: %v: classified as %v from code %q; want %v", what, err, got, code, want)
+	}
+	if t.drv == nil {
+		return
+	}
+	if exp, ok := errorSources[t.drv.name]; ok && src != exp {
+		t.Errorf("%s: %v: code %q found in %v; errorSources records %v", what, err, code, src, exp)
+	}
+}
+
+// errorsTable creates an empty table for the error scenarios and
+// returns its name.
+func errorsTable(t params) string {
+	tbl := t.table("errs")
+	t.mustExec("CREATE TABLE " + tbl + " (id INTEGER PRIMARY KEY, name VARCHAR(50) NOT NULL, n INTEGER)")
+	return tbl
+}
+
+func testErrorUnique(t params) {
+	t.Parallel()
+	tbl := errorsTable(t)
+	insert := t.q("INSERT INTO " + tbl + " (id, name) VALUES (?, ?)")
+	t.mustExec(insert, 1, "bob")
+	_, err := t.Exec(insert, 1, "dup")
+	checkError(t, "duplicate primary key", err, errUniqueViolation)
+}
+
+func testErrorNotNull(t params) {
+	t.Parallel()
+	tbl := errorsTable(t)
+	_, err := t.Exec(t.q("INSERT INTO "+tbl+" (id, name) VALUES (?, NULL)"), 1)
+	checkError(t, "NULL name", err, errNotNullViolation)
+}
+
+// testErrorForeignKey inserts a row referring to a missing one, and
+// deletes a row another refers to.
+func testErrorForeignKey(t params) {
+	t.Parallel()
+	d := t.dialect()
+	ctx := context.Background()
+	c, err := t.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if d.foreignKeySession != "" {
+		if _, err := c.ExecContext(ctx, d.foreignKeySession); err != nil {
+			t.Fatalf("%s: %v", d.foreignKeySession, err)
+		}
+	}
+	parent, child := t.table("parent"), t.table("child")
+	t.mustExec("CREATE TABLE " + parent + " (id INTEGER PRIMARY KEY)")
+	t.mustExec("CREATE TABLE " + child + " (id INTEGER PRIMARY KEY, parent INTEGER, FOREIGN KEY (parent) REFERENCES " + parent + " (id))")
+	// Backends without namespaces refuse to drop a referenced table.
+	t.Cleanup(func() {
+		if _, err := t.DB.Exec("DROP TABLE " + child); err != nil {
+			t.Errorf("dropping %s: %v", child, err)
+		}
+	})
+	if _, err := c.ExecContext(ctx, t.q("INSERT INTO "+parent+" (id) VALUES (?)"), 1); err != nil {
+		t.Fatal(err)
+	}
+	insert := t.q("INSERT INTO " + child + " (id, parent) VALUES (?, ?)")
+	if _, err := c.ExecContext(ctx, insert, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ExecContext(ctx, insert, 2, 2)
+	checkError(t, "insert referring to a missing row", err, errForeignKeyViolation)
+	_, err = c.ExecContext(ctx, t.q("DELETE FROM "+parent+" WHERE id = ?"), 1)
+	checkError(t, "delete of a referenced row", err, errForeignKeyViolation)
+}
+
+func testErrorSyntax(t params) {
+	t.Parallel()
+	_, err := t.Exec("SELEC 1")
+	checkError(t, "misspelled SELECT", err, errSyntax)
+}
+
+// testErrorDivisionByZero divides by zero in an INSERT rather than a
+// SELECT, where MySQL returns NULL with a warning even in strict mode.
+func testErrorDivisionByZero(t params) {
+	t.Parallel()
+	tbl := errorsTable(t)
+	_, err := t.Exec(t.q("INSERT INTO "+tbl+" (id, name, n) VALUES (?, ?, 1 / 0)"), 1, "bob")
+	if !t.dialect().divisionByZeroIsNull {
+		checkError(t, "division by zero", err, errDivisionByZero)
+		return
+	}
+	if err != nil {
+		t.Fatalf("division by zero: %v; want NULL", err)
+	}
+	var n sql.NullInt64
+	if err := t.QueryRow(t.q("SELECT n FROM "+tbl+" WHERE id = ?"), 1).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n.Valid {
+		t.Errorf("1 / 0 = %d; want NULL", n.Int64)
+	}
+}
+
+// deadlockTimeout bounds the wait for a backend to detect a deadlock,
+// which Postgres starts looking for after a second.
+const deadlockTimeout = 10 * time.Second
+
+// testErrorSerialization has two transactions update two rows in
+// opposite orders. Either the backend refuses the second writer, as
+// SQLite does, or one of the transactions must fail as a deadlock.
+func testErrorSerialization(t params) {
+	skipTraced(t.T, "which transaction loses the deadlock varies")
+	tbl := errorsTable(t)
+	insert := t.q("INSERT INTO " + tbl + " (id, name, n) VALUES (?, ?, ?)")
+	t.mustExec(insert, 1, "bob", 0)
+	t.mustExec(insert, 2, "alice", 0)
+	ctx := context.Background()
+	c1, c2 := twoConns(t)
+	if q := t.dialect().lockTimeoutSession; q != "" {
+		for _, c := range []*sql.Conn{c1, c2} {
+			if _, err := c.ExecContext(ctx, q); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tx1, err := c1.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx1.Rollback()
+	tx2, err := c2.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx2.Rollback()
+	update := t.q("UPDATE " + tbl + " SET n = n + 1 WHERE id = ?")
+	if _, err := tx1.Exec(update, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx2.Exec(update, 2); err != nil {
+		checkError(t, "second writer", err, errSerialization)
+		return
+	}
+
+	// The loser of the deadlock rolls back, which lets the winner go on.
+	// Both crossing updates run under one deadline, so a backend or
+	// driver that never reports the deadlock fails the scenario rather
+	// than hanging it.
+	ctx, cancel := context.WithTimeout(ctx, deadlockTimeout)
+	defer cancel()
+	cross := func(tx *sql.Tx, id int) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := tx.ExecContext(ctx, update, id)
+			if err != nil {
+				tx.Rollback()
+			}
+			done <- err
+		}()
+		return done
+	}
+	done1, done2 := cross(tx1, 2), cross(tx2, 1)
+	var err1, err2 error
+	timeout := time.After(deadlockTimeout)
+	for done1 != nil || done2 != nil {
+		select {
+		case err1 = <-done1:
+			done1 = nil
+		case err2 = <-done2:
+			done2 = nil
+		case <-timeout:
+			t.Fatalf("no deadlock detected after %v", deadlockTimeout)
+		}
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("no deadlock detected after %v: %v; %v", deadlockTimeout, err1, err2)
+	}
+	switch {
+	case err1 != nil && err2 != nil:
+		t.Errorf("both transactions failed: %v; %v", err1, err2)
+	case err1 != nil:
+		checkError(t, "first transaction", err1, errSerialization)
+	default:
+		checkError(t, "second transaction", err2, errSerialization)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	for _, c := range []struct {
+		d    *Dialect
+		err  error
+		want errorCategory
+		src  errorSource
+	}{
+		{postgresDialect, &libpq.Error{Code: "23505"}, errUniqueViolation, sourceField},
+		{postgresDialect, jackcpgx.PgError{Code: "40P01"}, errSerialization, sourceField},
+		{postgresDialect, errors.New("ERROR: division by zero (SQLSTATE 22012)"), errDivisionByZero, sourceText},
+		{postgresDialect, errors.New("pq: relation does not exist"), errOther, sourceNone},
+		{mysqlDialect, &mymysql.Error{Code: 1213}, errSerialization, sourceField},
+		{mysqlDialect, errors.New("Error 1452: Cannot add or update a child row"), errForeignKeyViolation, sourceText},
+		{mysqlDialect, errors.New("Error 1146: Table 'x' doesn't exist"), errOther, sourceText},
+		{oracleDialect, errors.New("ORA-01400: cannot insert NULL into (\"X\".\"T\".\"NAME\")"), errNotNullViolation, sourceText},
+		{sqliteDialect, errors.New("UNIQUE constraint failed: t.id"), errUniqueViolation, sourceText},
+		{sqliteDialect, errors.New(`near "SELEC": syntax error`), errSyntax, sourceText},
+		{sqliteDialect, errors.New("database is locked"), errSerialization, sourceText},
+	} {
+		got, src := classifyError(c.d, c.err)
+		if got != c.want || src != c.src {
+			t.Errorf("classifyError(%q) = %v, %v; want %v, %v", c.err, got, src, c.want, c.src)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package sqltest
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"sqltest/fakemysql"
+	"sqltest/fakepg"
+	"sqltest/faultproxy"
+)
+
+var (
+	// pqFake runs the pq scenarios against an in-process fake Postgres.
+	pqFake = &fakeDB{
+		driver:  "postgres",
+		dialect: postgresDialect,
+		start:   startFakePostgres,
+		dsn: func(addr string) string {
+			host, port, _ := net.SplitHostPort(addr)
+			return fmt.Sprintf("host=%s port=%s user=gosqltest password=gosqltest dbname=gosqltest sslmode=disable", host, port)
+		},
+	}
+
+	// pgxFake runs the pgx scenarios against an in-process fake Postgres.
+	pgxFake = &fakeDB{
+		driver:  "pgx",
+		dialect: postgresDialect,
+		start:   startFakePostgres,
+		dsn: func(addr string) string {
+			return fmt.Sprintf("postgres://gosqltest:gosqltest@%s/gosqltest", addr)
+		},
+	}
+
+	// mymysqlFake runs the mymysql scenarios against an in-process fake
+	// MySQL.
+	mymysqlFake = &fakeDB{
+		driver:  "mymysql",
+		dialect: mysqlDialect,
+		start:   startFakeMySQL,
+		dsn: func(addr string) string {
+			return myMysqlSetAddr("gosqltest/gosqltest/gosqltest", addr)
+		},
+	}
+
+	// gomysqlFake runs the gomysql scenarios against an in-process fake
+	// MySQL.
+	gomysqlFake = &fakeDB{
+		driver:  "mysql",
+		dialect: mysqlDialect,
+		start:   startFakeMySQL,
+		dsn: func(addr string) string {
+			return goMysqlSetAddr("gosqltest:gosqltest@/gosqltest", addr)
+		},
+	}
+)
+
+func init() {
+	registerDriver(&driverInfo{name: "pq-fake", tester: pqFake, quirks: pqQuirks})
+	registerDriver(&driverInfo{name: "pgx-fake", tester: pgxFake, quirks: pgxQuirks})
+	registerDriver(&driverInfo{name: "mymysql-fake", tester: mymysqlFake, quirks: mymysqlQuirks})
+	registerDriver(&driverInfo{name: "gomysql-fake", tester: gomysqlFake, quirks: gomysqlQuirks})
+}
+
+// fakeDB is a Tester for a driver talking to a fake server started in
+// the test process, so its scenarios need no database installed.
+type fakeDB struct {
+	driver  string
+	dialect *Dialect
+	start   func(testing.TB) string // starts the server if needed, returning its address
+	dsn     func(addr string) string
+}
+
+func (s *fakeDB) Dialect() *Dialect { return s.dialect }
+
+// Addr implements addrTester.
+func (s *fakeDB) Addr(tb testing.TB) string { return s.start(tb) }
+
+func (s *fakeDB) Open(tb testing.TB) *sql.DB { return s.OpenAt(tb, s.start(tb)) }
+
+// OpenAt implements addrTester.
+func (s *fakeDB) OpenAt(tb testing.TB, addr string) *sql.DB {
+	db, err := sql.Open(s.driver, s.dsn(addr))
+	if err != nil {
+		tb.Fatalf("error connecting: %v", err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	return db
+}
+
+// OpenProxied implements proxiedTester.
+func (s *fakeDB) OpenProxied(tb testing.TB) (*sql.DB, *faultproxy.Proxy) {
+	p := startProxy(tb, s.start(tb))
+	return s.OpenAt(tb, p.Addr()), p
+}
+
+func (s *fakeDB) RunTest(t *testing.T, fn func(params)) { runTest(s, t, fn) }
+
+var fakePostgres struct {
+	once sync.Once
+	srv  *fakepg.Server
+	err  error
+}
+
+// startFakePostgres starts the fake Postgres shared by all tests, which
+// requires MD5 authentication as a default Postgres install does.
+func startFakePostgres(tb testing.TB) string {
+	if recordDir != "" {
+		return startPrivate(tb, "fake Postgres", func() fakeServer {
+			return &fakepg.Server{Handler: fakepg.NewDB(), Auth: fakepg.AuthMD5, Password: "gosqltest", Rand: rand.New(rand.NewSource(1))}
+		})
+	}
+	f := &fakePostgres
+	f.once.Do(func() {
+		f.srv = &fakepg.Server{Handler: fakepg.NewDB(), Auth: fakepg.AuthMD5, Password: "gosqltest"}
+		f.err = f.srv.Start()
+	})
+	if f.err != nil {
+		tb.Fatalf("starting fake Postgres: %v", f.err)
+	}
+	return f.srv.Addr()
+}
+
+var fakeMySQL struct {
+	once sync.Once
+	srv  *fakemysql.Server
+	err  error
+}
+
+// startFakeMySQL starts the fake MySQL shared by all tests.
+func startFakeMySQL(tb testing.TB) string {
+	if recordDir != "" {
+		return startPrivate(tb, "fake MySQL", func() fakeServer {
+			return &fakemysql.Server{Handler: fakemysql.NewDB(), Password: "gosqltest", Rand: rand.New(rand.NewSource(1))}
+		})
+	}
+	f := &fakeMySQL
+	f.once.Do(func() {
+		f.srv = &fakemysql.Server{Handler: fakemysql.NewDB(), Password: "gosqltest"}
+		f.err = f.srv.Start()
+	})
+	if f.err != nil {
+		tb.Fatalf("starting fake MySQL: %v", f.err)
+	}
+	return f.srv.Addr()
+}
+
+// A fakeServer is a fakepg.Server or a fakemysql.Server.
+type fakeServer interface {
+	Start() error
+	Addr() string
+	Close() error
+}
+
+var privateServers struct {
+	mu    sync.Mutex
+	addrs map[string]string // by server name and scenario
+}
+
+// startPrivate starts a server for the scenario tb runs, or a subtest
+// of, unless it has one, closing it when tb finishes. A recorded
+// session must not depend on other scenarios, so each gets a server of
+// its own, which numbers sessions from the first and sends the same
+// salt to each.
+func startPrivate(tb testing.TB, name string, newServer func() fakeServer) string {
+	scenario := strings.SplitN(tb.Name(), "/", 4)
+	if len(scenario) > 3 {
+		scenario = scenario[:3]
+	}
+	key := name + " for " + strings.Join(scenario, "/")
+	f := &privateServers
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if addr, ok := f.addrs[key]; ok {
+		return addr
+	}
+	srv := newServer()
+	if err := srv.Start(); err != nil {
+		tb.Fatalf("starting %s: %v", name, err)
+	}
+	if f.addrs == nil {
+		f.addrs = map[string]string{}
+	}
+	f.addrs[key] = srv.Addr()
+	tb.Cleanup(func() {
+		f.mu.Lock()
+		delete(f.addrs, key)
+		f.mu.Unlock()
+		srv.Close()
+	})
+	return srv.Addr()
+}
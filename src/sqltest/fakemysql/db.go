@@ -0,0 +1,548 @@
+package fakemysql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"sqltest/fakepg"
+)
+
+// A DB is a Handler keeping tables in memory, for tests that need a
+// server which stores what they write rather than a Script. It runs
+// each statement on a fakepg.DB, translated from the MySQL the sqltest
+// scenarios speak: ? placeholders, backquoted identifiers, strings in
+// single or double quotes with backslash escapes, the MySQL names of
+// column types, AUTO_INCREMENT, CREATE and DROP DATABASE, which make
+// schemas, and START TRANSACTION. SET is accepted and ignored, and so
+// are CHARACTER SET and COLLATE clauses. SELECT CONNECTION_ID() and KILL
+// work as in a Script, SHOW GLOBAL STATUS reports Prepared_stmt_count,
+// and SHOW INDEX lists indexes. The information_schema views tables and
+// columns are those of fakepg.
+//
+// As in MySQL, an error in a transaction undoes only the failed
+// statement, column names match whatever their case, a result column
+// is named as the query writes it, an INSERT reports the first ID it
+// generated, DATETIME, TIMESTAMP and TIME keep whole seconds unless
+// given a precision, a TIMESTAMP is shown in UTC, the session's time
+// zone, and BOOL is TINYINT. Unlike MySQL, text compares by its bytes, as in the
+// utf8mb4_bin collation.
+type DB struct {
+	pg *fakepg.DB
+}
+
+// NewDB returns an empty database.
+func NewDB() *DB {
+	pg := fakepg.NewDB()
+	pg.StatementRollback = true
+	pg.CaseInsensitiveColumns = true
+	return &DB{pg}
+}
+
+// NewSession implements Handler.
+func (db *DB) NewSession(c *Client) Session {
+	pc := &fakepg.Client{User: c.User, Database: c.Database, PID: int32(c.ID)}
+	return &dbSession{client: c, pg: db.pg.NewSession(pc)}
+}
+
+type dbSession struct {
+	client *Client
+	pg     fakepg.Session
+}
+
+func (s *dbSession) InTransaction() bool { return s.pg.TxStatus() != 'I' }
+func (s *dbSession) Close()              { s.pg.Close() }
+
+func (s *dbSession) Prepare(query string) (Statement, error) {
+	q := trimQuery(query)
+	if st, err := sessionStatement(s.client, q); st != nil || err != nil {
+		return st, err
+	}
+	words := strings.Fields(q)
+	switch kw := keywords(q); {
+	case strings.HasPrefix(kw, "SET "):
+		return &scriptStmt{&Response{}, 0}, nil
+	case kw == "START TRANSACTION":
+		q = "BEGIN"
+	case strings.HasPrefix(kw, "CREATE DATABASE "):
+		q = "CREATE SCHEMA " + strings.Join(words[2:], " ")
+	case strings.HasPrefix(kw, "DROP DATABASE "):
+		q = "DROP SCHEMA " + strings.Join(words[2:], " ") + " CASCADE"
+	case strings.HasPrefix(kw, "SHOW INDEX FROM "), strings.HasPrefix(kw, "SHOW INDEXES FROM "),
+		strings.HasPrefix(kw, "SHOW KEYS FROM "):
+		return s.showIndex(q, words[3:])
+	}
+	pq, n, err := translate(q)
+	if err != nil {
+		return nil, err
+	}
+	st, err := s.pg.Prepare(pq, nil)
+	if err != nil {
+		return nil, mysqlError(err)
+	}
+	if len(st.ParamTypes()) != n {
+		st.Close()
+		return nil, errorf(1210, "HY000", "Incorrect arguments to PREPARE")
+	}
+	var cols []Column
+	for _, c := range st.Columns() {
+		cols = append(cols, Column{c.Name, fieldType(c.Type)})
+	}
+	return &dbStmt{st, cols}, nil
+}
+
+// A dbStmt is a Statement of a DB session.
+type dbStmt struct {
+	pg   fakepg.Statement
+	cols []Column
+}
+
+func (st *dbStmt) NumParams() int    { return len(st.pg.ParamTypes()) }
+func (st *dbStmt) Columns() []Column { return st.cols }
+func (st *dbStmt) Close()            { st.pg.Close() }
+
+func (st *dbStmt) Exec(args []interface{}) (*Result, error) {
+	pargs := make([]interface{}, len(args))
+	for i, t := range st.pg.ParamTypes() {
+		v, err := pgValue(args[i], t)
+		if err != nil {
+			return nil, mysqlError(err)
+		}
+		pargs[i] = v
+	}
+	pres, err := st.pg.Exec(pargs)
+	if err != nil {
+		return nil, mysqlError(err)
+	}
+	res := &Result{InsertID: uint64(pres.Serial)}
+	if tag := strings.Fields(pres.Tag); len(tag) > 1 {
+		switch tag[0] {
+		case "INSERT", "UPDATE", "DELETE":
+			res.AffectedRows, _ = strconv.ParseUint(tag[len(tag)-1], 10, 64)
+		}
+	}
+	for _, row := range pres.Rows {
+		out := make([]interface{}, len(row))
+		for i, v := range row {
+			out[i] = mysqlValue(v, st.cols[i].Type)
+		}
+		res.Rows = append(res.Rows, out)
+	}
+	return res, nil
+}
+
+// showIndex returns the statement for SHOW INDEX q, whose words after
+// FROM are args: a table name and optionally FROM or IN a database.
+func (s *dbSession) showIndex(q string, args []string) (Statement, error) {
+	var name []string
+	switch {
+	case len(args) == 1:
+		name = strings.SplitN(args[0], ".", 2)
+	case len(args) == 3 && (strings.EqualFold(args[1], "FROM") || strings.EqualFold(args[1], "IN")):
+		name = []string{args[2], args[0]}
+	default:
+		return nil, errorf(1064, "42000", "You have an error in your SQL syntax near %q", q)
+	}
+	if len(name) == 1 {
+		name = []string{"public", name[0]}
+	}
+	for i, n := range name {
+		name[i] = strings.Trim(n, "`")
+	}
+	return &indexStmt{s, name[0], name[1]}, nil
+}
+
+// An indexStmt is SHOW INDEX FROM a table of a DB, giving the first
+// five columns MySQL does. The primary key's index is called PRIMARY,
+// and the others have the names fakepg gives them.
+type indexStmt struct {
+	s             *dbSession
+	schema, table string
+}
+
+var indexColumns = []Column{
+	{"Table", TypeVarString}, {"Non_unique", TypeLongLong}, {"Key_name", TypeVarString},
+	{"Seq_in_index", TypeLongLong}, {"Column_name", TypeVarString},
+}
+
+func (st *indexStmt) NumParams() int    { return 0 }
+func (st *indexStmt) Columns() []Column { return indexColumns }
+func (st *indexStmt) Close()            {}
+
+func (st *indexStmt) Exec([]interface{}) (*Result, error) {
+	quoted := `"` + strings.Replace(st.schema, `"`, `""`, -1) + `"."` + strings.Replace(st.table, `"`, `""`, -1) + `"`
+	if _, err := st.s.query("SELECT * FROM " + quoted + " LIMIT 0"); err != nil {
+		return nil, err
+	}
+	pk, err := st.s.query("SELECT constraint_name FROM information_schema.table_constraints "+
+		"WHERE table_schema = $1 AND table_name = $2 AND constraint_type = 'PRIMARY KEY'", st.schema, st.table)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := st.s.query("SELECT indexname, indexdef FROM pg_indexes WHERE schemaname = $1 AND tablename = $2 ORDER BY indexname",
+		st.schema, st.table)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	for _, primary := range []bool{true, false} {
+		for _, ix := range indexes {
+			name, def := ix[0].(string), ix[1].(string)
+			if (len(pk) > 0 && pk[0][0] == name) != primary {
+				continue
+			}
+			if primary {
+				name = "PRIMARY"
+			}
+			nonUnique := int64(1)
+			if strings.HasPrefix(def, "CREATE UNIQUE ") {
+				nonUnique = 0
+			}
+			for i, col := range indexDefColumns(def) {
+				res.Rows = append(res.Rows, []interface{}{st.table, nonUnique, name, int64(i + 1), col})
+			}
+		}
+	}
+	return res, nil
+}
+
+// indexDefColumns returns the columns listed at the end of def, a
+// CREATE INDEX statement as fakepg's pg_indexes shows it.
+func indexDefColumns(def string) []string {
+	list := def[strings.LastIndexByte(def, '(')+1 : len(def)-1]
+	var cols []string
+	for len(list) > 0 {
+		var col string
+		if list[0] == '"' {
+			end := 1
+			for ; end < len(list); end++ {
+				if list[end] == '"' {
+					if end+1 < len(list) && list[end+1] == '"' {
+						end++
+						continue
+					}
+					break
+				}
+			}
+			col = strings.Replace(list[1:end], `""`, `"`, -1)
+			list = list[end+1:]
+		} else {
+			end := strings.IndexByte(list, ',')
+			if end < 0 {
+				end = len(list)
+			}
+			col, list = list[:end], list[end:]
+		}
+		cols = append(cols, col)
+		list = strings.TrimPrefix(list, ", ")
+	}
+	return cols
+}
+
+// query runs q with args on the fakepg session, returning its rows.
+func (s *dbSession) query(q string, args ...interface{}) ([][]interface{}, error) {
+	st, err := s.pg.Prepare(q, nil)
+	if err != nil {
+		return nil, mysqlError(err)
+	}
+	defer st.Close()
+	res, err := st.Exec(args)
+	if err != nil {
+		return nil, mysqlError(err)
+	}
+	return res.Rows, nil
+}
+
+// fieldType returns the MySQL type sent for columns of type t.
+func fieldType(t fakepg.Oid) FieldType {
+	switch t {
+	case fakepg.BoolOid:
+		return TypeTiny
+	case fakepg.Int2Oid:
+		return TypeShort
+	case fakepg.Int4Oid:
+		return TypeLong
+	case fakepg.Int8Oid:
+		return TypeLongLong
+	case fakepg.Float4Oid:
+		return TypeFloat
+	case fakepg.Float8Oid:
+		return TypeDouble
+	case fakepg.NumericOid:
+		return TypeNewDecimal
+	case fakepg.ByteaOid:
+		return TypeBlob
+	case fakepg.DateOid:
+		return TypeDate
+	case fakepg.TimeOid:
+		return TypeTime
+	case fakepg.TimestampOid:
+		return TypeDateTime
+	case fakepg.TimestamptzOid:
+		return TypeTimestamp
+	}
+	return TypeVarString
+}
+
+// pgValue converts a parameter value for a parameter of type t. As in
+// MySQL, strings and blobs convert to each other byte for byte.
+func pgValue(v interface{}, t fakepg.Oid) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		if t == fakepg.ByteaOid {
+			return []byte(v), nil
+		}
+	case []byte:
+		if t != fakepg.ByteaOid {
+			return fakepg.Convert(string(v), t)
+		}
+	case time.Duration:
+		return fakepg.Convert(formatDuration(v), t)
+	}
+	return fakepg.Convert(v, t)
+}
+
+// mysqlValue converts a value of a fakepg result for a column of type t.
+func mysqlValue(v interface{}, t FieldType) interface{} {
+	switch v := v.(type) {
+	case nil, bool, int64, float64, string, []byte:
+		return v
+	case time.Time:
+		switch t {
+		case TypeTime:
+			// fakepg keeps times of day on 2000-01-01.
+			return v.Sub(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+		case TypeTimestamp:
+			// A TIMESTAMP is shown in the session's time zone, UTC.
+			return v.UTC()
+		}
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+// mysqlErrors gives the MySQL error number and SQLSTATE for SQLSTATEs
+// of fakepg errors.
+var mysqlErrors = map[string]Error{
+	"22001": {Number: 1406, State: "22001"}, // ER_DATA_TOO_LONG
+	"22003": {Number: 1264, State: "22003"}, // ER_WARN_DATA_OUT_OF_RANGE
+	"22012": {Number: 1365, State: "22012"}, // ER_DIVISION_BY_ZERO
+	"22021": {Number: 1366, State: "HY000"}, // ER_TRUNCATED_WRONG_VALUE_FOR_FIELD
+	"22P02": {Number: 1366, State: "HY000"},
+	"23502": {Number: 1048, State: "23000"}, // ER_BAD_NULL_ERROR
+	"23503": {Number: 1452, State: "23000"}, // ER_NO_REFERENCED_ROW_2
+	"23505": {Number: 1062, State: "23000"}, // ER_DUP_ENTRY
+	"2BP01": {Number: 3730, State: "HY000"}, // ER_FK_CANNOT_DROP_PARENT
+	"3B001": {Number: 1305, State: "42000"}, // ER_SP_DOES_NOT_EXIST
+	"3F000": {Number: 1049, State: "42000"}, // ER_BAD_DB_ERROR
+	"42701": {Number: 1060, State: "42S21"}, // ER_DUP_FIELDNAME
+	"40P01": {Number: 1213, State: "40001"}, // ER_LOCK_DEADLOCK
+	"42601": {Number: 1064, State: "42000"}, // ER_PARSE_ERROR
+	"42703": {Number: 1054, State: "42S22"}, // ER_BAD_FIELD_ERROR
+	"42P01": {Number: 1146, State: "42S02"}, // ER_NO_SUCH_TABLE
+	"42P06": {Number: 1007, State: "HY000"}, // ER_DB_CREATE_EXISTS
+	"42P07": {Number: 1050, State: "42S01"}, // ER_TABLE_EXISTS_ERROR
+}
+
+// mysqlError converts an error of fakepg to the nearest MySQL error,
+// keeping its message. Others are ER_UNKNOWN_ERROR.
+func mysqlError(err error) error {
+	e, ok := err.(*fakepg.Error)
+	if !ok {
+		return err
+	}
+	me, ok := mysqlErrors[e.Code]
+	switch {
+	case !ok:
+		me = Error{Number: 1105}
+	case e.Code == "23503" && strings.HasPrefix(e.Message, "update or delete"):
+		me.Number = 1451 // ER_ROW_IS_REFERENCED_2
+	}
+	me.Message = e.Message
+	return &me
+}
+
+// translate returns the Postgres for MySQL statement q, with $1, $2 and
+// so on for its ? placeholders, and the number of placeholders.
+func translate(q string) (string, int, error) {
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(q); {
+		switch c := q[i]; {
+		case c == '\'' || c == '"':
+			s, end, ok := unquote(q, i)
+			if !ok {
+				return "", 0, errorf(1064, "42000", "You have an error in your SQL syntax near %q", q[i:])
+			}
+			b.WriteString("'" + strings.Replace(s, "'", "''", -1) + "'")
+			i = end
+		case c == '`':
+			end := strings.IndexByte(q[i+1:], '`')
+			if end < 0 {
+				return "", 0, errorf(1064, "42000", "You have an error in your SQL syntax near %q", q[i:])
+			}
+			b.WriteString(`"` + strings.Replace(q[i+1:i+1+end], `"`, `""`, -1) + `"`)
+			i += end + 2
+		case c == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			i++
+		case isIdentStart(c):
+			end := i + 1
+			for end < len(q) && (isIdentStart(q[end]) || q[end] >= '0' && q[end] <= '9' || q[end] == '$') {
+				end++
+			}
+			i = translateWord(&b, q, q[i:end], end)
+		case c >= '0' && c <= '9':
+			// Copy numbers whole, so 1e5 is not taken for a word.
+			end := i + 1
+			for end < len(q) && (isIdentStart(q[end]) || q[end] >= '0' && q[end] <= '9' || q[end] == '.') {
+				end++
+			}
+			b.WriteString(q[i:end])
+			i = end
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String(), n, nil
+}
+
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+// columnTypes gives the Postgres type for MySQL types named
+// differently, and whether to drop the length or display width that
+// may follow the MySQL name.
+var columnTypes = map[string]struct {
+	pg         string
+	dropLength bool
+}{
+	"tinyint":    {"int2", true},
+	"bool":       {"int2", false},
+	"boolean":    {"int2", false},
+	"smallint":   {"int2", true},
+	"mediumint":  {"int4", true},
+	"int":        {"int4", true},
+	"integer":    {"int4", true},
+	"bigint":     {"int8", true},
+	"signed":     {"int8", false}, // in CAST
+	"float":      {"float4", true},
+	"double":     {"float8", true},
+	"datetime":   {"timestamp", false},
+	"timestamp":  {"timestamptz", false},
+	"time":       {"time", false},
+	"binary":     {"bytea", true},
+	"varbinary":  {"bytea", true},
+	"tinyblob":   {"bytea", false},
+	"blob":       {"bytea", true},
+	"mediumblob": {"bytea", false},
+	"longblob":   {"bytea", false},
+	"tinytext":   {"text", false},
+	"mediumtext": {"text", false},
+	"longtext":   {"text", false},
+}
+
+// serials gives the Postgres type of AUTO_INCREMENT integer columns.
+var serials = map[string]string{"int2": "smallserial", "int4": "serial", "int8": "bigserial"}
+
+// translateWord writes the translation of word, which ends at offset
+// end of q, and returns the offset in q to go on from.
+func translateWord(b *strings.Builder, q, word string, end int) int {
+	switch strings.ToLower(word) {
+	case "character":
+		if w, e := nextWord(q, end); strings.EqualFold(w, "set") {
+			return charsetClause(q, e)
+		}
+	case "charset", "collate":
+		return charsetClause(q, end)
+	}
+	ct, ok := columnTypes[strings.ToLower(word)]
+	if !ok {
+		b.WriteString(word)
+		return end
+	}
+	pg := ct.pg
+	rest := strings.TrimLeft(q[end:], " \t\r\n")
+	switch lw := strings.ToLower(word); {
+	case lw == "double" && len(rest) >= 9 && strings.EqualFold(rest[:9], "precision"):
+		end = len(q) - len(rest) + 9
+	case (lw == "datetime" || lw == "timestamp" || lw == "time") && !strings.HasPrefix(rest, "("):
+		// DATETIME, TIMESTAMP and TIME keep whole seconds unless given
+		// a precision.
+		pg += "(0)"
+	case ct.dropLength && strings.HasPrefix(rest, "("):
+		if i := strings.IndexByte(rest, ')'); i >= 0 {
+			end = len(q) - len(rest) + i + 1
+		}
+	}
+	rest = strings.TrimLeft(q[end:], " \t\r\n")
+	if serial, ok := serials[pg]; ok && len(rest) >= 14 && strings.EqualFold(rest[:14], "auto_increment") &&
+		(len(rest) == 14 || !isIdentStart(rest[14])) {
+		pg, end = serial, len(q)-len(rest)+14
+	}
+	b.WriteString(pg)
+	return end
+}
+
+// charsetClause drops the name ending a CHARACTER SET, CHARSET or
+// COLLATE clause, which starts at offset i of q, and returns the offset
+// after it. Text is stored as UTF-8 and compares by its bytes, as in the
+// utf8mb4_bin collation, whatever the clause.
+func charsetClause(q string, i int) int {
+	if _, end := nextWord(q, i); end > i {
+		return end
+	}
+	return i
+}
+
+// nextWord returns the word after any white space at offset i of q, and
+// the offset after it.
+func nextWord(q string, i int) (string, int) {
+	start := len(q) - len(strings.TrimLeft(q[i:], " \t\r\n"))
+	end := start
+	for end < len(q) && (isIdentStart(q[end]) || q[end] >= '0' && q[end] <= '9') {
+		end++
+	}
+	return q[start:end], end
+}
+
+// unquote reads the string literal starting at offset i of q, returning
+// its value and the offset after it. A quote inside the string is
+// written twice or escaped with a backslash.
+func unquote(q string, i int) (s string, end int, ok bool) {
+	quote := q[i]
+	var b strings.Builder
+	for i++; i < len(q); i++ {
+		c := q[i]
+		switch {
+		case c == '\\' && i+1 < len(q):
+			i++
+			switch c = q[i]; c {
+			case '0':
+				c = 0
+			case 'b':
+				c = '\b'
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'Z':
+				c = 0x1a
+			case '%', '_':
+				b.WriteByte('\\')
+			}
+		case c == quote && i+1 < len(q) && q[i+1] == quote:
+			i++
+		case c == quote:
+			return b.String(), i + 1, true
+		}
+		b.WriteByte(c)
+	}
+	return "", 0, false
+}
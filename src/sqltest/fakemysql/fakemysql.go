@@ -0,0 +1,131 @@
+// Package fakemysql is an in-process MySQL server speaking the client/
+// server protocol 4.1, for testing MySQL drivers where no database is
+// installed.
+//
+// A Server authenticates clients with the native password scramble and
+// hands their statements to a Handler, usually a Script of canned
+// responses. Statements arrive as text queries (COM_QUERY), answered
+// with text result sets, or as prepared statements (COM_STMT_PREPARE
+// and COM_STMT_EXECUTE), answered with binary ones. Payloads of 16MB
+// or more are split across packets and joined again as the protocol
+// requires.
+//
+// Values passed to and returned by handlers are nil or one of bool,
+// int64, float64, string, []byte, time.Time and time.Duration, the
+// last for TIME columns. Parameters of string types arrive as strings
+// and those of blob types as []byte.
+package fakemysql
+
+import "fmt"
+
+// A FieldType is a MySQL column type as sent on the wire.
+type FieldType byte
+
+const (
+	TypeTiny       FieldType = 0x01
+	TypeShort      FieldType = 0x02
+	TypeLong       FieldType = 0x03
+	TypeFloat      FieldType = 0x04
+	TypeDouble     FieldType = 0x05
+	TypeNull       FieldType = 0x06
+	TypeTimestamp  FieldType = 0x07
+	TypeLongLong   FieldType = 0x08
+	TypeInt24      FieldType = 0x09
+	TypeDate       FieldType = 0x0a
+	TypeTime       FieldType = 0x0b
+	TypeDateTime   FieldType = 0x0c
+	TypeYear       FieldType = 0x0d
+	TypeVarchar    FieldType = 0x0f
+	TypeNewDecimal FieldType = 0xf6
+	TypeTinyBlob   FieldType = 0xf9
+	TypeMediumBlob FieldType = 0xfa
+	TypeLongBlob   FieldType = 0xfb
+	TypeBlob       FieldType = 0xfc
+	TypeVarString  FieldType = 0xfd
+	TypeString     FieldType = 0xfe
+)
+
+// isBlob reports whether t holds binary strings.
+func (t FieldType) isBlob() bool {
+	return t >= TypeTinyBlob && t <= TypeBlob
+}
+
+// A Handler serves the clients of a Server.
+type Handler interface {
+	// NewSession is called for each client once it has authenticated.
+	NewSession(c *Client) Session
+}
+
+// A Session runs the statements of one client connection.
+type Session interface {
+	// Prepare parses a single SQL statement.
+	Prepare(query string) (Statement, error)
+
+	// InTransaction reports whether a transaction is open, which is
+	// sent to the client in the status flags of OK and EOF packets.
+	InTransaction() bool
+
+	// Close is called when the client disconnects.
+	Close()
+}
+
+// A Statement is a parsed statement, ready to run.
+type Statement interface {
+	// NumParams returns the number of ? placeholders.
+	NumParams() int
+
+	// Columns describes the rows Exec returns. It is nil for statements
+	// that return no rows.
+	Columns() []Column
+
+	// Exec runs the statement with a value for each parameter.
+	Exec(args []interface{}) (*Result, error)
+
+	// Close is called when the client closes the statement.
+	Close()
+}
+
+// A Column describes a column of a result set.
+type Column struct {
+	Name string
+	Type FieldType
+}
+
+// A Result is the outcome of running a statement.
+type Result struct {
+	Rows         [][]interface{}
+	AffectedRows uint64
+	InsertID     uint64
+}
+
+// An Error is sent to the client as an ERR packet. Errors of other types
+// are sent as error 1105 (ER_UNKNOWN_ERROR), SQLSTATE HY000.
+type Error struct {
+	Number  uint16
+	State   string // SQLSTATE; HY000 if empty
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Error %d (%s): %s", e.Number, e.state(), e.Message)
+}
+
+func (e *Error) state() string {
+	if e.State == "" {
+		return "HY000"
+	}
+	return e.State
+}
+
+func errorf(number uint16, state, format string, args ...interface{}) *Error {
+	return &Error{Number: number, State: state, Message: fmt.Sprintf(format, args...)}
+}
+
+// A Client is an authenticated connection to a Server.
+type Client struct {
+	User     string
+	Database string
+	ID       uint32 // connection ID reported to the client
+
+	srv *Server
+}
@@ -0,0 +1,535 @@
+package fakemysql
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	_ "code.google.com/p/go-mysql-driver/mysql"
+	_ "github.com/ziutek/mymysql/godrv"
+)
+
+// drivers are the MySQL drivers the tests run against a Server.
+var drivers = []struct {
+	name string // as registered with database/sql
+	dsn  func(addr, password string) string
+
+	// multiPacket reports whether the driver splits and joins payloads
+	// of 16MB or more; go-mysql-driver reads only their first packet.
+	multiPacket bool
+
+	// nullIsEmpty reports whether the driver returns NULLs of binary
+	// result sets as a nil []byte, which Scan takes for an empty value.
+	nullIsEmpty bool
+}{
+	{"mysql", func(addr, pw string) string { return fmt.Sprintf("alice:%s@tcp(%s)/test", pw, addr) }, false, true},
+	{"mymysql", func(addr, pw string) string { return fmt.Sprintf("tcp:%s*test/alice/%s", addr, pw) }, true, false},
+}
+
+// start starts a server for h, closed when t finishes.
+func start(t *testing.T, h Handler) *Server {
+	srv := &Server{Handler: h, Password: "secret"}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// open opens a handle on srv with the named driver, closed when t
+// finishes.
+func open(t *testing.T, srv *Server, driver, password string) *sql.DB {
+	for _, d := range drivers {
+		if d.name != driver {
+			continue
+		}
+		db, err := sql.Open(driver, d.dsn(srv.Addr(), password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	t.Fatalf("unknown driver %s", driver)
+	return nil
+}
+
+// echo is a Handler answering each statement with one row holding its
+// arguments, in VARCHAR columns.
+type echo struct{}
+
+func (echo) NewSession(*Client) Session { return echo{} }
+
+func (echo) Prepare(q string) (Statement, error) { return echoStmt(countParams(q)), nil }
+func (echo) InTransaction() bool                 { return false }
+func (echo) Close()                              {}
+
+type echoStmt int
+
+func (n echoStmt) NumParams() int { return int(n) }
+func (n echoStmt) Close()         {}
+
+func (n echoStmt) Columns() []Column {
+	var cols []Column
+	for i := 0; i < int(n); i++ {
+		cols = append(cols, Column{fmt.Sprint("c", i), TypeVarString})
+	}
+	return cols
+}
+
+func (n echoStmt) Exec(args []interface{}) (*Result, error) {
+	return &Result{Rows: [][]interface{}{args}}, nil
+}
+
+func TestAuth(t *testing.T) {
+	srv := start(t, NewScript())
+	for _, d := range drivers {
+		if err := open(t, srv, d.name, "secret").Ping(); err != nil {
+			t.Errorf("%s: connecting with the right password: %v", d.name, err)
+		}
+		err := open(t, srv, d.name, "wrong").Ping()
+		if err == nil || !strings.Contains(err.Error(), "1045") {
+			t.Errorf("%s: connecting with the wrong password: %v; want error 1045", d.name, err)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	s := NewScript()
+	s.On("SELECT name, age, score, photo, note FROM people WHERE age > ?", &Response{
+		Columns: []Column{{"name", TypeVarString}, {"age", TypeLongLong}, {"score", TypeDouble}, {"photo", TypeBlob}, {"note", TypeVarString}},
+		Rows:    [][]interface{}{{"bob", int64(42), 1.5, []byte{0, 0xff}, nil}},
+	})
+	s.On("DELETE FROM people WHERE age < ?", &Response{AffectedRows: 3})
+	s.On("INSERT INTO people (name) VALUES (?)", &Response{Err: &Error{Number: 1062, State: "23000", Message: "Duplicate entry 'bob' for key 'name'"}})
+	srv := start(t, s)
+	var want []string
+	for _, d := range drivers {
+		want = append(want,
+			"SELECT name, age, score, photo, note FROM people WHERE age > ?",
+			"START TRANSACTION",
+			"DELETE FROM people WHERE age < ?",
+			"INSERT INTO people (name) VALUES (?)",
+			"COMMIT",
+		)
+		db := open(t, srv, d.name, "secret")
+		var name string
+		var age int64
+		var score float64
+		var photo []byte
+		var note sql.NullString
+		if err := db.QueryRow("SELECT name, age, score, photo, note FROM people WHERE age > ?", 30).Scan(&name, &age, &score, &photo, &note); err != nil {
+			t.Errorf("%s: %v", d.name, err)
+		} else if name != "bob" || age != 42 || score != 1.5 || !bytes.Equal(photo, []byte{0, 0xff}) || note.Valid != d.nullIsEmpty {
+			t.Errorf("%s: got %q, %d, %g, %x, %v; want bob, 42, 1.5, 00ff, NULL", d.name, name, age, score, photo, note)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatalf("%s: %v", d.name, err)
+		}
+		if res, err := tx.Exec("DELETE FROM people WHERE age < ?", 18); err != nil {
+			t.Errorf("%s: %v", d.name, err)
+		} else if n, err := res.RowsAffected(); n != 3 {
+			t.Errorf("%s: %d rows affected, %v; want 3", d.name, n, err)
+		}
+		_, err = tx.Exec("INSERT INTO people (name) VALUES (?)", "bob")
+		if err == nil || !strings.Contains(err.Error(), "1062") {
+			t.Errorf("%s: scripted error: got %v; want 1062", d.name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Errorf("%s: %v", d.name, err)
+		}
+
+		if _, err := db.Exec("SELECT 1"); err == nil || !strings.Contains(err.Error(), "1235") {
+			t.Errorf("%s: query with no scripted response: got %v; want 1235", d.name, err)
+		}
+		want = append(want, "SELECT 1")
+	}
+	if got := s.Queries(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("recorded queries %q; want %q", got, want)
+	}
+}
+
+func TestKill(t *testing.T) {
+	srv := start(t, NewScript())
+	for _, d := range drivers {
+		victim, killer := open(t, srv, d.name, "secret"), open(t, srv, d.name, "secret")
+		victim.SetMaxOpenConns(1)
+		var id int64
+		if err := victim.QueryRow("SELECT CONNECTION_ID()").Scan(&id); err != nil {
+			t.Fatalf("%s: %v", d.name, err)
+		}
+		if _, err := killer.Exec(fmt.Sprintf("KILL %d", id)); err != nil {
+			t.Errorf("%s: KILL %d: %v", d.name, id, err)
+		}
+		if _, err := killer.Exec(fmt.Sprintf("KILL %d", id)); err == nil || !strings.Contains(err.Error(), "1094") {
+			t.Errorf("%s: KILL of a gone connection: got %v; want error 1094", d.name, err)
+		}
+	}
+}
+
+func TestPreparedStmtCount(t *testing.T) {
+	srv := start(t, NewScript())
+	for _, d := range drivers {
+		db := open(t, srv, d.name, "secret")
+		count := func() int {
+			var name string
+			var n int
+			if err := db.QueryRow("SHOW GLOBAL STATUS LIKE 'Prepared_stmt_count'").Scan(&name, &n); err != nil {
+				t.Fatalf("%s: %v", d.name, err)
+			}
+			return n
+		}
+		// mymysql prepares every query, including the count's own.
+		before := count()
+		stmt, err := db.Prepare("SELECT CONNECTION_ID()")
+		if err != nil {
+			t.Fatalf("%s: %v", d.name, err)
+		}
+		if n := count(); n != before+1 {
+			t.Errorf("%s: with a statement prepared, Prepared_stmt_count = %d; want %d", d.name, n, before+1)
+		}
+		stmt.Close()
+		if n := count(); n != before {
+			t.Errorf("%s: with the statement closed, Prepared_stmt_count = %d; want %d", d.name, n, before)
+		}
+	}
+}
+
+// A DB keeps what its clients write and, as MySQL does, undoes only
+// the failed statement of a transaction.
+func TestDB(t *testing.T) {
+	srv := start(t, NewDB())
+	for _, d := range drivers {
+		db := open(t, srv, d.name, "secret")
+		schema := "db_" + d.name
+		for _, q := range []string{
+			"CREATE DATABASE " + schema,
+			"CREATE TABLE " + schema + ".people (id INTEGER PRIMARY KEY, name VARCHAR(20), photo VARBINARY(100))",
+			"INSERT INTO " + schema + ".people (id, name) VALUES (1, 'it\\'s \"bob\"')",
+		} {
+			if _, err := db.Exec(q); err != nil {
+				t.Fatalf("%s: %s: %v", d.name, q, err)
+			}
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatalf("%s: %v", d.name, err)
+		}
+		insert := "INSERT INTO " + schema + ".people (id, name, photo) VALUES (?, ?, ?)"
+		if _, err := tx.Exec(insert, 2, "eve", []byte{0, 0xff}); err != nil {
+			t.Errorf("%s: %v", d.name, err)
+		}
+		if _, err := tx.Exec(insert, 1, "dup", nil); err == nil || !strings.Contains(err.Error(), "1062") {
+			t.Errorf("%s: duplicate key: got %v; want error 1062", d.name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Errorf("%s: %v", d.name, err)
+		}
+
+		var got []string
+		rows, err := db.Query("SELECT id, name, photo FROM "+schema+".people WHERE id > ? ORDER BY id", 0)
+		if err != nil {
+			t.Fatalf("%s: %v", d.name, err)
+		}
+		for rows.Next() {
+			var id int64
+			var name string
+			var photo []byte
+			if err := rows.Scan(&id, &name, &photo); err != nil {
+				t.Fatalf("%s: %v", d.name, err)
+			}
+			got = append(got, fmt.Sprintf("%d %s %x", id, name, photo))
+		}
+		if err := rows.Err(); err != nil {
+			t.Errorf("%s: %v", d.name, err)
+		}
+		want := `[1 it's "bob"  2 eve 00ff]`
+		if fmt.Sprint(got) != want {
+			t.Errorf("%s: got %v; want %v", d.name, got, want)
+		}
+		if _, err := db.Exec("DROP DATABASE " + schema); err != nil {
+			t.Errorf("%s: %v", d.name, err)
+		}
+	}
+}
+
+func TestShowIndex(t *testing.T) {
+	db := open(t, start(t, NewDB()), "mysql", "secret")
+	for _, q := range []string{
+		"CREATE DATABASE s",
+		"CREATE TABLE s.t (id BIGINT, `Seq` BIGINT, code BIGINT UNIQUE, PRIMARY KEY (id, seq))",
+		"CREATE INDEX t_code ON s.t (`seq`, code)",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	rows, err := db.Query("SHOW INDEX FROM t FROM s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var table, key, col string
+		var nonUnique, seq int
+		if err := rows.Scan(&table, &nonUnique, &key, &seq, &col); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s %d %s %d %s", table, nonUnique, key, seq, col))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := "[t 0 PRIMARY 1 id t 0 PRIMARY 2 Seq t 1 t_code 1 Seq t 1 t_code 2 code t 0 t_code_key 1 code]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if _, err := db.Exec("SHOW INDEX FROM s.none"); err == nil || !strings.Contains(err.Error(), "1146") {
+		t.Errorf("SHOW INDEX of a missing table: got %v; want error 1146", err)
+	}
+	if _, err := db.Exec("CREATE TABLE s.u (a BIGINT, `A` BIGINT)"); err == nil || !strings.Contains(err.Error(), "1060") {
+		t.Errorf("columns differing in case: got %v; want error 1060", err)
+	}
+}
+
+func TestConstraintErrors(t *testing.T) {
+	db := open(t, start(t, NewDB()), "mysql", "secret")
+	for _, q := range []string{
+		"CREATE DATABASE s",
+		"CREATE TABLE s.p (id BIGINT PRIMARY KEY)",
+		"CREATE TABLE s.c (pid BIGINT, FOREIGN KEY (pid) REFERENCES s.p (id))",
+		"INSERT INTO s.p VALUES (1)",
+		"INSERT INTO s.c VALUES (1)",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	for _, c := range []struct{ q, want string }{
+		{"INSERT INTO s.c VALUES (2)", "1452"},
+		{"DELETE FROM s.p", "1451"},
+		{"DROP TABLE s.p", "3730"},
+		{"SELECT 1 / 0", "1365"},
+	} {
+		if _, err := db.Exec(c.q); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v; want error %s", c.q, err, c.want)
+		}
+	}
+}
+
+// MySQL runs savepoint statements sent as text queries, as
+// go-mysql-driver sends statements without arguments, and refuses to
+// prepare them, as mymysql does every statement.
+func TestSavepoints(t *testing.T) {
+	srv := start(t, NewDB())
+	for _, d := range drivers {
+		db := open(t, srv, d.name, "secret")
+		schema := "sp_" + d.name
+		if _, err := db.Exec("CREATE DATABASE " + schema); err != nil {
+			t.Fatalf("%s: %v", d.name, err)
+		}
+		if _, err := db.Exec("CREATE TABLE " + schema + ".t (id BIGINT PRIMARY KEY)"); err != nil {
+			t.Fatalf("%s: %v", d.name, err)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatalf("%s: %v", d.name, err)
+		}
+		_, err = tx.Exec("SAVEPOINT a")
+		if d.name == "mymysql" {
+			if err == nil || !strings.Contains(err.Error(), "1295") {
+				t.Errorf("%s: prepared SAVEPOINT: got %v; want error 1295", d.name, err)
+			}
+			tx.Rollback()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", d.name, err)
+		}
+		for _, q := range []string{"INSERT INTO " + schema + ".t VALUES (1)", "ROLLBACK TO SAVEPOINT a", "RELEASE SAVEPOINT a"} {
+			if _, err := tx.Exec(q); err != nil {
+				t.Errorf("%s: %s: %v", d.name, q, err)
+			}
+		}
+		if _, err := tx.Exec("RELEASE SAVEPOINT a"); err == nil || !strings.Contains(err.Error(), "1305") {
+			t.Errorf("%s: released savepoint: got %v; want error 1305", d.name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Errorf("%s: %v", d.name, err)
+		}
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + schema + ".t").Scan(&n); err != nil || n != 0 {
+			t.Errorf("%s: got %d rows, %v; want none", d.name, n, err)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	for _, c := range []struct {
+		q, want string
+		params  int
+	}{
+		{"SELECT a FROM `t` WHERE b = ? AND c = ?", `SELECT a FROM "t" WHERE b = $1 AND c = $2`, 2},
+		{`SELECT 'a''b', 'c\'d', "e?", 'f\\g\nh'`, "SELECT 'a''b', 'c''d', 'e?', 'f\\g\nh'", 0},
+		{"CREATE TABLE t (a BOOL, b DOUBLE PRECISION, c FLOAT, d DATETIME, e DATETIME(3), f VARBINARY(16), g LONGBLOB, h INT(11))",
+			"CREATE TABLE t (a int2, b float8, c float4, d timestamp(0), e timestamp(3), f bytea, g bytea, h int4)", 0},
+		{"SELECT 1e5, x2double FROM t", "SELECT 1e5, x2double FROM t", 0},
+		{"CREATE TABLE t (id BIGINT AUTO_INCREMENT PRIMARY KEY, n INT(11) auto_increment)",
+			"CREATE TABLE t (id bigserial PRIMARY KEY, n serial)", 0},
+		{"CREATE TABLE t (a TIME, b TIME(6), c TIMESTAMP, d TIMESTAMP(3))",
+			"CREATE TABLE t (a time(0), b time(6), c timestamptz(0), d timestamptz(3))", 0},
+		{"CREATE TABLE t (s VARCHAR(100) CHARACTER SET utf8mb4, c CHAR(3) CHARSET latin1 COLLATE latin1_bin)",
+			"CREATE TABLE t (s VARCHAR(100) , c CHAR(3)  )", 0},
+		{"SELECT s FROM t ORDER BY s COLLATE utf8mb4_bin, character", "SELECT s FROM t ORDER BY s , character", 0},
+	} {
+		got, n, err := translate(c.q)
+		if err != nil || got != c.want || n != c.params {
+			t.Errorf("translate(%q) = %q, %d, %v; want %q, %d", c.q, got, n, err, c.want, c.params)
+		}
+	}
+	if _, _, err := translate("SELECT 'a"); err == nil {
+		t.Error("unterminated string translated")
+	}
+}
+
+// go-mysql-driver runs statements without arguments as text queries,
+// counting the rows of any result set they return as affected.
+func TestTextResultSet(t *testing.T) {
+	s := NewScript()
+	s.On("SELECT name, born, score FROM people", &Response{
+		Columns: []Column{{"name", TypeVarString}, {"born", TypeDateTime}, {"score", TypeDouble}},
+		Rows: [][]interface{}{
+			{"bob", time.Date(1970, 1, 2, 3, 4, 5, 0, time.UTC), 1.5},
+			{"eve", nil, nil},
+		},
+	})
+	db := open(t, start(t, s), "mysql", "secret")
+	res, err := db.Exec("SELECT name, born, score FROM people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := res.RowsAffected(); n != 2 {
+		t.Errorf("%d rows affected, %v; want 2", n, err)
+	}
+}
+
+func TestText(t *testing.T) {
+	at := time.Date(2012, 12, 21, 6, 30, 0, 123456789, time.UTC)
+	for _, c := range []struct {
+		v    interface{}
+		t    FieldType
+		want string
+	}{
+		{true, TypeTiny, "1"},
+		{int64(-7), TypeLongLong, "-7"},
+		{0.1, TypeDouble, "0.1"},
+		{float64(float32(0.1)), TypeFloat, "0.1"},
+		{at, TypeDateTime, "2012-12-21 06:30:00.123456"},
+		{at.Truncate(time.Second), TypeTimestamp, "2012-12-21 06:30:00"},
+		{at, TypeDate, "2012-12-21"},
+		{time.Time{}, TypeDateTime, "0000-00-00 00:00:00"},
+		{time.Time{}, TypeDate, "0000-00-00"},
+		{-(838*time.Hour + 59*time.Minute + 59*time.Second), TypeTime, "-838:59:59"},
+		{90*time.Minute + time.Microsecond, TypeTime, "01:30:00.000001"},
+	} {
+		if got, ok := text(c.v, c.t); !ok || string(got) != c.want {
+			t.Errorf("text(%#v, 0x%02x) = %q, %v; want %q", c.v, byte(c.t), got, ok, c.want)
+		}
+	}
+}
+
+// Each driver's arguments survive the trip to the server in their
+// binary encoding, and back again as text.
+func TestParams(t *testing.T) {
+	srv := start(t, echo{})
+	at := time.Date(2012, 12, 21, 6, 30, 15, 0, time.UTC)
+	for _, d := range drivers {
+		db := open(t, srv, d.name, "secret")
+		var got [7]sql.NullString
+		err := db.QueryRow("SELECT ?, ?, ?, ?, ?, ?, ?", int64(-42), 2.5, true, "it's", []byte("bin"), at, nil).
+			Scan(&got[0], &got[1], &got[2], &got[3], &got[4], &got[5], &got[6])
+		if err != nil {
+			t.Errorf("%s: %v", d.name, err)
+			continue
+		}
+		want := fmt.Sprintf("[{-42 true} {2.5 true} {1 true} {it's true} {bin true} {2012-12-21 06:30:15 true} { %v}]", d.nullIsEmpty)
+		if fmt.Sprint(got) != want {
+			t.Errorf("%s: got %v; want %v", d.name, got, want)
+		}
+	}
+}
+
+func TestPacketSplitting(t *testing.T) {
+	for _, n := range []int{0, 1, maxChunk - 1, maxChunk, maxChunk + 1, 2 * maxChunk} {
+		a, b := net.Pipe()
+		w := &conn{w: bufio.NewWriter(a)}
+		r := &conn{r: bufio.NewReader(b)}
+		p := bytes.Repeat([]byte{'x'}, n)
+		done := make(chan struct{})
+		go func() {
+			w.writePacket(p)
+			w.w.Flush()
+			a.Close()
+			close(done)
+		}()
+		got, err := r.readPacket()
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, p) {
+			t.Errorf("%d bytes: read %d bytes back", n, len(got))
+		}
+		if _, err := r.r.ReadByte(); err != io.EOF {
+			t.Errorf("%d bytes: data left after the payload", n)
+		}
+		<-done
+		if packets := n/maxChunk + 1; int(w.seq) != packets || r.seq != w.seq {
+			t.Errorf("%d bytes: sent %d packets, read %d; want %d", n, w.seq, r.seq, packets)
+		}
+	}
+}
+
+// A payload of 16MB or more fills more than one packet.
+func TestLargePayloads(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), (maxChunk+1<<20)/16)
+	s := NewScript()
+	s.On("SELECT photo FROM people", &Response{
+		Columns: []Column{{"photo", TypeLongBlob}},
+		Rows:    [][]interface{}{{big}},
+	})
+	scripted, echoed := start(t, s), start(t, echo{})
+	for _, d := range drivers {
+		var got []byte
+		err := open(t, scripted, d.name, "secret").QueryRow("SELECT photo FROM people").Scan(&got)
+		if err == nil && !bytes.Equal(got, big) {
+			t.Errorf("%s: read %d bytes; want %d", d.name, len(got), len(big))
+		}
+		var back string
+		err2 := open(t, echoed, d.name, "secret").QueryRow("SELECT ?", big).Scan(&back)
+		if err2 == nil && back != string(big) {
+			t.Errorf("%s: sent %d bytes, %d came back", d.name, len(big), len(back))
+		}
+		switch {
+		case d.multiPacket && (err != nil || err2 != nil):
+			t.Errorf("%s: reading: %v; writing: %v", d.name, err, err2)
+		case !d.multiPacket:
+			t.Logf("%s: reading: %v; writing: %v", d.name, err, err2)
+		}
+
+		// A driver losing track of the protocol leaves the server
+		// serving new connections.
+		var n int
+		if err := open(t, echoed, d.name, "secret").QueryRow("SELECT ?", 1).Scan(&n); err != nil || n != 1 {
+			t.Errorf("%s: after large payloads: got %d, %v; want 1", d.name, n, err)
+		}
+	}
+}
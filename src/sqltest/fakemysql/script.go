@@ -0,0 +1,219 @@
+package fakemysql
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Script is a Handler answering each statement with a Response set
+// for its text in advance. BEGIN, START TRANSACTION, COMMIT, ROLLBACK
+// and SET need no response; a Script tracks whether a transaction is
+// open for them. Neither do SELECT CONNECTION_ID() and KILL, which
+// disconnects the client with the given ID. Other statements with no
+// response fail with error 1235 (ER_NOT_SUPPORTED_YET).
+type Script struct {
+	mu        sync.Mutex
+	responses map[string]*Response
+	queries   []string
+}
+
+// A Response is how a Script answers a statement. The statement has
+// one parameter for each ? in it outside of quotes.
+type Response struct {
+	Columns      []Column
+	Rows         [][]interface{}
+	AffectedRows uint64
+	InsertID     uint64
+
+	Err *Error // if not nil, the statement fails with it when run
+}
+
+// NewScript returns a Script with no responses.
+func NewScript() *Script {
+	return &Script{responses: map[string]*Response{}}
+}
+
+// On sets the response to query. Queries match after removing leading
+// and trailing space and semicolons.
+func (s *Script) On(query string, r *Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[trimQuery(query)] = r
+}
+
+// Queries returns the statements the script's clients have prepared or
+// run, in order.
+func (s *Script) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+func trimQuery(q string) string {
+	return strings.TrimRight(strings.TrimSpace(q), "; \t\r\n")
+}
+
+// countParams counts the ? placeholders in q outside of quoted strings
+// and identifiers.
+func countParams(q string) int {
+	n := 0
+	var quote byte
+	for i := 0; i < len(q); i++ {
+		switch c := q[i]; {
+		case quote != 0:
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '?':
+			n++
+		}
+	}
+	return n
+}
+
+// NewSession implements Handler.
+func (s *Script) NewSession(c *Client) Session {
+	return &scriptSession{script: s, client: c}
+}
+
+type scriptSession struct {
+	script *Script
+	client *Client
+	mu     sync.Mutex
+	inTx   bool
+}
+
+func (ss *scriptSession) InTransaction() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.inTx
+}
+
+func (ss *scriptSession) Close() {}
+
+func (ss *scriptSession) Prepare(query string) (Statement, error) {
+	s := ss.script
+	q := trimQuery(query)
+	s.mu.Lock()
+	s.queries = append(s.queries, q)
+	r := s.responses[q]
+	s.mu.Unlock()
+	if r != nil {
+		return &scriptStmt{r, countParams(q)}, nil
+	}
+	switch kw := keywords(q); {
+	case kw == "BEGIN" || kw == "START TRANSACTION":
+		return &scriptTx{ss, true}, nil
+	case kw == "COMMIT" || kw == "ROLLBACK":
+		return &scriptTx{ss, false}, nil
+	case strings.HasPrefix(kw, "SET "):
+		return &scriptStmt{&Response{}, 0}, nil
+	}
+	if st, err := sessionStatement(ss.client, q); st != nil || err != nil {
+		return st, err
+	}
+	return nil, errorf(1235, "42000", "fakemysql: no response scripted for %q", q)
+}
+
+// keywords returns q in upper case with its words separated by single
+// spaces, for matching statements that are all keywords.
+func keywords(q string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(q), " "))
+}
+
+// sessionStatement returns the statement for q, trimmed, if it is SELECT
+// CONNECTION_ID(), KILL or SHOW GLOBAL STATUS LIKE 'Prepared_stmt_count',
+// which every Handler answers alike. It returns nil for other
+// statements.
+func sessionStatement(c *Client, q string) (Statement, error) {
+	switch kw := keywords(q); {
+	case kw == "SELECT CONNECTION_ID()":
+		return &scriptStmt{&Response{
+			Columns: []Column{{"CONNECTION_ID()", TypeLongLong}},
+			Rows:    [][]interface{}{{int64(c.ID)}},
+		}, 0}, nil
+	case strings.HasPrefix(kw, "KILL "):
+		id, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimPrefix(kw, "KILL "), "CONNECTION "), 10, 32)
+		if err != nil {
+			return nil, errorf(1064, "42000", "You have an error in your SQL syntax near %q", q)
+		}
+		return &scriptKill{c.srv, uint32(id)}, nil
+	case kw == "SHOW GLOBAL STATUS LIKE 'PREPARED_STMT_COUNT'":
+		return &scriptPrepared{c.srv}, nil
+	}
+	return nil, nil
+}
+
+type scriptStmt struct {
+	r      *Response
+	params int
+}
+
+func (st *scriptStmt) NumParams() int    { return st.params }
+func (st *scriptStmt) Columns() []Column { return st.r.Columns }
+func (st *scriptStmt) Close()            {}
+
+func (st *scriptStmt) Exec([]interface{}) (*Result, error) {
+	if st.r.Err != nil {
+		return nil, st.r.Err
+	}
+	return &Result{Rows: st.r.Rows, AffectedRows: st.r.AffectedRows, InsertID: st.r.InsertID}, nil
+}
+
+// A scriptTx starts or ends a transaction of a Script.
+type scriptTx struct {
+	ss    *scriptSession
+	begin bool
+}
+
+func (st *scriptTx) NumParams() int    { return 0 }
+func (st *scriptTx) Columns() []Column { return nil }
+func (st *scriptTx) Close()            {}
+
+func (st *scriptTx) Exec([]interface{}) (*Result, error) {
+	st.ss.mu.Lock()
+	defer st.ss.mu.Unlock()
+	st.ss.inTx = st.begin
+	return &Result{}, nil
+}
+
+// A scriptKill disconnects the client with the given ID.
+type scriptKill struct {
+	srv *Server
+	id  uint32
+}
+
+func (st *scriptKill) NumParams() int    { return 0 }
+func (st *scriptKill) Columns() []Column { return nil }
+func (st *scriptKill) Close()            {}
+
+func (st *scriptKill) Exec([]interface{}) (*Result, error) {
+	if !st.srv.Kill(st.id) {
+		return nil, errorf(1094, "HY000", "Unknown thread id: %d", st.id)
+	}
+	return &Result{}, nil
+}
+
+// A scriptPrepared reports the number of statements prepared on the
+// server as the Prepared_stmt_count status variable.
+type scriptPrepared struct {
+	srv *Server
+}
+
+func (st *scriptPrepared) NumParams() int { return 0 }
+func (st *scriptPrepared) Columns() []Column {
+	return []Column{{"Variable_name", TypeVarString}, {"Value", TypeVarString}}
+}
+func (st *scriptPrepared) Close() {}
+
+func (st *scriptPrepared) Exec([]interface{}) (*Result, error) {
+	st.srv.mu.Lock()
+	n := st.srv.prepared
+	st.srv.mu.Unlock()
+	return &Result{Rows: [][]interface{}{{"Prepared_stmt_count", strconv.Itoa(n)}}}, nil
+}
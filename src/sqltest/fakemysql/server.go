@@ -0,0 +1,1040 @@
+package fakemysql
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerVersion is reported to clients in the handshake.
+const ServerVersion = "5.6.51"
+
+// A Server accepts MySQL clients on a loopback TCP port.
+type Server struct {
+	Handler  Handler
+	Password string    // required of every user; if empty, any is accepted
+	Rand     io.Reader // source of password scrambles; crypto/rand.Reader if nil
+
+	ln       net.Listener
+	mu       sync.Mutex
+	conns    map[*conn]bool
+	nextID   uint32
+	prepared int // statements prepared on all connections and not closed
+	wg       sync.WaitGroup
+}
+
+// Start starts the server listening on an ephemeral port of 127.0.0.1.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	s.conns = map[*conn]bool{}
+	s.wg.Add(1)
+	go s.serve()
+	return nil
+}
+
+// random fills b from s.Rand.
+func (s *Server) random(b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+	io.ReadFull(r, b)
+}
+
+// addPrepared adds n to the count of prepared statements.
+func (s *Server) addPrepared(n int) {
+	s.mu.Lock()
+	s.prepared += n
+	s.mu.Unlock()
+}
+
+// Addr returns the host:port the server is listening on.
+func (s *Server) Addr() string { return s.ln.Addr().String() }
+
+// Close stops the server and closes every client connection.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.nc.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// Kill closes the connection with the given ID, as KILL does, and
+// reports whether there was one.
+func (s *Server) Kill(id uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		if c.id == id {
+			c.nc.Close()
+			delete(s.conns, c)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{
+			srv:   s,
+			nc:    nc,
+			r:     bufio.NewReader(nc),
+			w:     bufio.NewWriter(nc),
+			stmts: map[uint32]*stmt{},
+		}
+		s.mu.Lock()
+		s.conns[c] = true
+		s.nextID++
+		id := s.nextID
+		c.id = id
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			c.serve(id)
+			nc.Close()
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Capability flags.
+const (
+	clientLongPassword  = 0x00000001
+	clientFoundRows     = 0x00000002
+	clientLongFlag      = 0x00000004
+	clientConnectWithDB = 0x00000008
+	clientProtocol41    = 0x00000200
+	clientTransactions  = 0x00002000
+	clientSecureConn    = 0x00008000
+
+	serverCaps = clientLongPassword | clientFoundRows | clientLongFlag |
+		clientConnectWithDB | clientProtocol41 | clientTransactions |
+		clientSecureConn
+)
+
+// Server status flags.
+const (
+	statusInTrans    = 0x0001
+	statusAutocommit = 0x0002
+)
+
+// Commands.
+const (
+	comQuit        = 0x01
+	comInitDB      = 0x02
+	comQuery       = 0x03
+	comPing        = 0x0e
+	comStmtPrepare = 0x16
+	comStmtExecute = 0x17
+	comStmtClose   = 0x19
+	comStmtReset   = 0x1a
+)
+
+// Character sets.
+const (
+	charsetUTF8   = 33 // utf8_general_ci
+	charsetBinary = 63
+)
+
+// Column flags.
+const (
+	flagBlob   = 0x0010
+	flagBinary = 0x0080
+)
+
+// maxChunk is the largest payload sent in one packet; longer ones go on
+// in the packets that follow.
+const maxChunk = 0xffffff
+
+// maxPayload bounds the size of a payload from the client.
+const maxPayload = 1 << 26
+
+// A conn is one client connection.
+type conn struct {
+	srv *Server
+	id  uint32
+	nc  net.Conn
+	r   *bufio.Reader
+	w   *bufio.Writer
+	seq byte // sequence number of the next packet
+
+	client   *Client
+	sess     Session
+	stmts    map[uint32]*stmt // prepared statements, by ID
+	nextStmt uint32
+}
+
+// A stmt is a prepared statement.
+type stmt struct {
+	Statement
+	types []uint16 // parameter types last bound by the client
+}
+
+var (
+	errMalformed  = &Error{Number: 1835, Message: "Malformed communication packet"}
+	errOutOfOrder = &Error{Number: 1156, State: "08S01", Message: "Got packets out of order"}
+	errTooLarge   = &Error{Number: 1153, State: "08S01", Message: "Got a packet bigger than 'max_allowed_packet' bytes"}
+)
+
+// packet is an outgoing payload being built.
+type packet []byte
+
+func (p *packet) byte(b byte)        { *p = append(*p, b) }
+func (p *packet) bytes(b []byte)     { *p = append(*p, b...) }
+func (p *packet) cstring(s string)   { *p = append(append(*p, s...), 0) }
+func (p *packet) uint16(n uint16)    { *p = binary.LittleEndian.AppendUint16(*p, n) }
+func (p *packet) uint32(n uint32)    { *p = binary.LittleEndian.AppendUint32(*p, n) }
+func (p *packet) uint64(n uint64)    { *p = binary.LittleEndian.AppendUint64(*p, n) }
+func (p *packet) lenString(s string) { p.lenInt(uint64(len(s))); *p = append(*p, s...) }
+func (p *packet) lenBytes(b []byte)  { p.lenInt(uint64(len(b))); *p = append(*p, b...) }
+
+// lenInt appends a length-encoded integer.
+func (p *packet) lenInt(n uint64) {
+	switch {
+	case n < 251:
+		p.byte(byte(n))
+	case n < 1<<16:
+		p.byte(0xfc)
+		p.uint16(uint16(n))
+	case n < 1<<24:
+		p.byte(0xfd)
+		p.bytes([]byte{byte(n), byte(n >> 8), byte(n >> 16)})
+	default:
+		p.byte(0xfe)
+		p.uint64(n)
+	}
+}
+
+// reader decodes an incoming payload. A short payload sets err and makes
+// every later read return zero values.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil || n < 0 || len(r.b) < n {
+		r.err = errMalformed
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) cstring() string {
+	if i := bytes.IndexByte(r.b, 0); i >= 0 && r.err == nil {
+		s := string(r.b[:i])
+		r.b = r.b[i+1:]
+		return s
+	}
+	r.err = errMalformed
+	return ""
+}
+
+// lenInt reads a length-encoded integer.
+func (r *reader) lenInt() uint64 {
+	switch b := r.byte(); b {
+	case 0xfc:
+		return uint64(r.uint16())
+	case 0xfd:
+		if b := r.next(3); b != nil {
+			return uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16
+		}
+		return 0
+	case 0xfe:
+		return r.uint64()
+	case 0xfb, 0xff:
+		r.err = errMalformed
+		return 0
+	default:
+		return uint64(b)
+	}
+}
+
+func (r *reader) lenBytes() []byte {
+	n := r.lenInt()
+	if n > uint64(len(r.b)) {
+		r.err = errMalformed
+		return nil
+	}
+	return r.next(int(n))
+}
+
+// readPacket reads a payload, joining the packets it was split across,
+// and checks their sequence numbers.
+func (c *conn) readPacket() ([]byte, error) {
+	var payload []byte
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+			return nil, err
+		}
+		if hdr[3] != c.seq {
+			return nil, errOutOfOrder
+		}
+		c.seq++
+		n := int(hdr[0]) | int(hdr[1])<<8 | int(hdr[2])<<16
+		if len(payload)+n > maxPayload {
+			return nil, errTooLarge
+		}
+		start := len(payload)
+		payload = append(payload, make([]byte, n)...)
+		if _, err := io.ReadFull(c.r, payload[start:]); err != nil {
+			return nil, err
+		}
+		if n < maxChunk {
+			return payload, nil
+		}
+	}
+}
+
+// writePacket queues a payload to be written at the next flush, split
+// into packets of at most maxChunk bytes. A payload filling its last
+// packet is ended by an empty one.
+func (c *conn) writePacket(p []byte) {
+	for {
+		n := len(p)
+		if n > maxChunk {
+			n = maxChunk
+		}
+		c.w.Write([]byte{byte(n), byte(n >> 8), byte(n >> 16), c.seq})
+		c.w.Write(p[:n])
+		c.seq++
+		p = p[n:]
+		if n < maxChunk {
+			return
+		}
+	}
+}
+
+func (c *conn) status() uint16 {
+	if c.sess != nil && c.sess.InTransaction() {
+		return statusAutocommit | statusInTrans
+	}
+	return statusAutocommit
+}
+
+func (c *conn) ok(res *Result) {
+	p := packet{0}
+	p.lenInt(res.AffectedRows)
+	p.lenInt(res.InsertID)
+	p.uint16(c.status())
+	p.uint16(0) // warnings
+	c.writePacket(p)
+}
+
+func (c *conn) eof() {
+	p := packet{0xfe}
+	p.uint16(0) // warnings
+	p.uint16(c.status())
+	c.writePacket(p)
+}
+
+// sendError sends err to the client as an ERR packet.
+func (c *conn) sendError(err error) {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Number: 1105, Message: err.Error()}
+	}
+	p := packet{0xff}
+	p.uint16(e.Number)
+	p.byte('#')
+	p.bytes([]byte(e.state()))
+	p.bytes([]byte(e.Message))
+	c.writePacket(p)
+}
+
+// fatal sends an error; the connection is closed by the caller.
+func (c *conn) fatal(err error) {
+	c.sendError(err)
+	c.w.Flush()
+}
+
+func (c *conn) serve(id uint32) {
+	if !c.handshake(id) {
+		return
+	}
+	defer func() {
+		for _, st := range c.stmts {
+			st.Close()
+		}
+		c.srv.addPrepared(-len(c.stmts))
+		c.sess.Close()
+	}()
+	for {
+		c.seq = 0
+		b, err := c.readPacket()
+		if e, ok := err.(*Error); ok {
+			c.fatal(e)
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(b) == 0 {
+			c.fatal(errMalformed)
+			return
+		}
+		r := &reader{b: b[1:]}
+		switch b[0] {
+		case comQuit:
+			return
+		case comInitDB:
+			c.client.Database = string(r.b)
+			c.ok(&Result{})
+		case comPing, comStmtReset:
+			c.ok(&Result{})
+		case comQuery:
+			c.query(string(r.b))
+		case comStmtPrepare:
+			c.prepare(string(r.b))
+		case comStmtExecute:
+			c.execute(r)
+		case comStmtClose:
+			// Sent no response.
+			id := r.uint32()
+			if st := c.stmts[id]; st != nil {
+				st.Close()
+				delete(c.stmts, id)
+				c.srv.addPrepared(-1)
+			}
+		default:
+			c.sendError(&Error{Number: 1047, State: "08S01", Message: "Unknown command"})
+		}
+		if c.w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// handshake greets the client and checks its password, reporting
+// whether it may go on to send commands.
+func (c *conn) handshake(id uint32) bool {
+	scramble := make([]byte, 20)
+	c.srv.random(scramble)
+	for i, b := range scramble {
+		// Like MySQL, keep to printable ASCII.
+		scramble[i] = b%94 + 33
+	}
+	p := packet{10}
+	p.cstring(ServerVersion)
+	p.uint32(id)
+	p.bytes(scramble[:8])
+	p.byte(0)
+	p.uint16(serverCaps & 0xffff)
+	p.byte(charsetUTF8)
+	p.uint16(statusAutocommit)
+	p.uint16(serverCaps >> 16)
+	p.byte(byte(len(scramble) + 1))
+	p.bytes(make([]byte, 10))
+	p.bytes(scramble[8:])
+	p.byte(0)
+	c.writePacket(p)
+	if c.w.Flush() != nil {
+		return false
+	}
+
+	b, err := c.readPacket()
+	if err != nil {
+		return false
+	}
+	r := &reader{b: b}
+	flags := r.uint32()
+	r.next(4 + 1 + 23) // max packet size, character set and filler
+	user := r.cstring()
+	var auth []byte
+	if flags&clientSecureConn != 0 {
+		auth = r.next(int(r.byte()))
+	} else {
+		auth = []byte(r.cstring())
+	}
+	var db string
+	if flags&clientConnectWithDB != 0 {
+		db = r.cstring()
+	}
+	if r.err != nil || flags&clientProtocol41 == 0 {
+		c.fatal(&Error{Number: 1043, State: "08S01", Message: "Bad handshake"})
+		return false
+	}
+	if pw := c.srv.Password; pw != "" && !bytes.Equal(auth, scramblePassword(scramble, pw)) {
+		using := "NO"
+		if len(auth) > 0 {
+			using = "YES"
+		}
+		c.fatal(errorf(1045, "28000", "Access denied for user '%s'@'localhost' (using password: %s)", user, using))
+		return false
+	}
+	c.client = &Client{User: user, Database: db, ID: id, srv: c.srv}
+	c.sess = c.srv.Handler.NewSession(c.client)
+	c.ok(&Result{})
+	return c.w.Flush() == nil
+}
+
+// scramblePassword computes the native password response to scramble:
+// SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password))).
+func scramblePassword(scramble []byte, password string) []byte {
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.New()
+	h.Write(scramble)
+	h.Write(stage2[:])
+	out := h.Sum(nil)
+	for i := range out {
+		out[i] ^= stage1[i]
+	}
+	return out
+}
+
+// query runs a COM_QUERY, answering with a text result set.
+func (c *conn) query(q string) {
+	st, err := c.sess.Prepare(q)
+	if err != nil {
+		c.sendError(err)
+		return
+	}
+	defer st.Close()
+	if st.NumParams() > 0 {
+		c.sendError(errorf(1064, "42000", "You have an error in your SQL syntax near '?'"))
+		return
+	}
+	res, err := st.Exec(nil)
+	if err == nil {
+		err = c.sendResult(st.Columns(), res, false)
+	}
+	if err != nil {
+		c.sendError(err)
+	}
+}
+
+// prepare runs a COM_STMT_PREPARE.
+func (c *conn) prepare(q string) {
+	if !preparable(q) {
+		c.sendError(errorf(1295, "HY000", "This command is not supported in the prepared statement protocol yet"))
+		return
+	}
+	st, err := c.sess.Prepare(q)
+	if err != nil {
+		c.sendError(err)
+		return
+	}
+	c.nextStmt++
+	id := c.nextStmt
+	c.stmts[id] = &stmt{Statement: st}
+	c.srv.addPrepared(1)
+	cols := st.Columns()
+	n := st.NumParams()
+	p := packet{0}
+	p.uint32(id)
+	p.uint16(uint16(len(cols)))
+	p.uint16(uint16(n))
+	p.byte(0)
+	p.uint16(0) // warnings
+	c.writePacket(p)
+	if n > 0 {
+		params := make([]Column, n)
+		for i := range params {
+			params[i] = Column{"?", TypeVarString}
+		}
+		c.columns(params)
+	}
+	if len(cols) > 0 {
+		c.columns(cols)
+	}
+}
+
+// preparable reports whether MySQL would prepare q. Of the statements
+// it refuses to, only those naming savepoints are recognized.
+func preparable(q string) bool {
+	kw := keywords(trimQuery(q))
+	for _, prefix := range []string{"SAVEPOINT ", "ROLLBACK TO ", "ROLLBACK WORK TO ", "RELEASE SAVEPOINT "} {
+		if strings.HasPrefix(kw, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// execute runs a COM_STMT_EXECUTE, answering with a binary result set.
+func (c *conn) execute(r *reader) {
+	id := r.uint32()
+	r.next(1 + 4) // flags and iteration count
+	st := c.stmts[id]
+	if st == nil {
+		c.sendError(errorf(1243, "HY000", "Unknown prepared statement handler (%d) given to mysqld_stmt_execute", id))
+		return
+	}
+	args, err := st.bind(r)
+	if err == nil {
+		var res *Result
+		if res, err = st.Exec(args); err == nil {
+			err = c.sendResult(st.Columns(), res, true)
+		}
+	}
+	if err != nil {
+		c.sendError(err)
+	}
+}
+
+// bind decodes the parameter values of a COM_STMT_EXECUTE. Their types
+// are sent only when the client binds new ones.
+func (st *stmt) bind(r *reader) ([]interface{}, error) {
+	n := st.NumParams()
+	if n == 0 {
+		return nil, nil
+	}
+	nulls := r.next((n + 7) / 8)
+	if r.byte() == 1 {
+		st.types = make([]uint16, n)
+		for i := range st.types {
+			st.types[i] = r.uint16()
+		}
+	}
+	if r.err != nil || st.types == nil {
+		return nil, errMalformed
+	}
+	args := make([]interface{}, n)
+	for i, t := range st.types {
+		if nulls[i/8]&(1<<uint(i%8)) == 0 {
+			args[i] = r.value(FieldType(t), t&0x8000 != 0)
+		}
+	}
+	if r.err != nil || len(r.b) != 0 {
+		return nil, errMalformed
+	}
+	return args, nil
+}
+
+// value reads a binary parameter value of type t.
+func (r *reader) value(t FieldType, unsigned bool) interface{} {
+	switch t {
+	case TypeNull:
+		return nil
+	case TypeTiny:
+		b := r.byte()
+		if unsigned {
+			return int64(b)
+		}
+		return int64(int8(b))
+	case TypeShort, TypeYear:
+		n := r.uint16()
+		if unsigned {
+			return int64(n)
+		}
+		return int64(int16(n))
+	case TypeLong, TypeInt24:
+		n := r.uint32()
+		if unsigned {
+			return int64(n)
+		}
+		return int64(int32(n))
+	case TypeLongLong:
+		return int64(r.uint64())
+	case TypeFloat:
+		return float64(math.Float32frombits(r.uint32()))
+	case TypeDouble:
+		return math.Float64frombits(r.uint64())
+	case TypeDate, TypeDateTime, TypeTimestamp:
+		return r.time()
+	case TypeTime:
+		return r.duration()
+	}
+	b := r.lenBytes()
+	if t.isBlob() {
+		return append([]byte(nil), b...)
+	}
+	return string(b)
+}
+
+// time reads a binary DATE, DATETIME or TIMESTAMP. The zero date
+// 0000-00-00 is read as the zero time.Time.
+func (r *reader) time() time.Time {
+	b := r.next(int(r.byte()))
+	var v [11]byte
+	switch len(b) {
+	case 0:
+		return time.Time{}
+	case 4, 7, 11:
+		copy(v[:], b)
+	default:
+		r.err = errMalformed
+		return time.Time{}
+	}
+	return time.Date(int(binary.LittleEndian.Uint16(v[:])), time.Month(v[2]), int(v[3]),
+		int(v[4]), int(v[5]), int(v[6]), int(binary.LittleEndian.Uint32(v[7:]))*1000, time.UTC)
+}
+
+// duration reads a binary TIME.
+func (r *reader) duration() time.Duration {
+	b := r.next(int(r.byte()))
+	var v [12]byte
+	switch len(b) {
+	case 0:
+		return 0
+	case 8, 12:
+		copy(v[:], b)
+	default:
+		r.err = errMalformed
+		return 0
+	}
+	d := time.Duration(binary.LittleEndian.Uint32(v[1:]))*24*time.Hour +
+		time.Duration(v[5])*time.Hour + time.Duration(v[6])*time.Minute +
+		time.Duration(v[7])*time.Second +
+		time.Duration(binary.LittleEndian.Uint32(v[8:]))*time.Microsecond
+	if v[0] == 1 {
+		d = -d
+	}
+	return d
+}
+
+// sendResult sends res as an OK packet or, for statements with columns,
+// as a result set: binary for prepared statements, text otherwise. Its
+// rows are encoded once before anything is sent, so a value that does
+// not fit its column fails the statement cleanly, and again as each is
+// sent, so the encoded result is never held in memory whole.
+func (c *conn) sendResult(cols []Column, res *Result, prepared bool) error {
+	if cols == nil {
+		c.ok(res)
+		return nil
+	}
+	encode := textRow
+	if prepared {
+		encode = binaryRow
+	}
+	for i, row := range res.Rows {
+		if len(row) != len(cols) {
+			return fmt.Errorf("fakemysql: row %d has %d values for %d columns", i, len(row), len(cols))
+		}
+		if _, err := encode(cols, row); err != nil {
+			return err
+		}
+	}
+	var p packet
+	p.lenInt(uint64(len(cols)))
+	c.writePacket(p)
+	c.columns(cols)
+	for _, row := range res.Rows {
+		p, _ := encode(cols, row)
+		c.writePacket(p)
+	}
+	c.eof()
+	return nil
+}
+
+// columns sends a column definition for each of cols, then an EOF.
+func (c *conn) columns(cols []Column) {
+	for _, col := range cols {
+		charset, length, flags, decimals := col.Type.definition()
+		var p packet
+		p.lenString("def")
+		p.lenString(c.client.Database)
+		p.lenString("") // table
+		p.lenString("") // original table
+		p.lenString(col.Name)
+		p.lenString(col.Name)
+		p.byte(0x0c) // length of the fixed fields
+		p.uint16(charset)
+		p.uint32(length)
+		p.byte(byte(col.Type))
+		p.uint16(flags)
+		p.byte(decimals)
+		p.uint16(0) // filler
+		c.writePacket(p)
+	}
+	c.eof()
+}
+
+// definition returns the character set, display length, flags and
+// decimals MySQL describes a column of type t with.
+func (t FieldType) definition() (charset uint16, length uint32, flags uint16, decimals byte) {
+	switch t {
+	case TypeTiny:
+		return charsetBinary, 4, flagBinary, 0
+	case TypeShort, TypeYear:
+		return charsetBinary, 6, flagBinary, 0
+	case TypeInt24, TypeLong:
+		return charsetBinary, 11, flagBinary, 0
+	case TypeLongLong:
+		return charsetBinary, 20, flagBinary, 0
+	case TypeFloat:
+		return charsetBinary, 12, flagBinary, 31
+	case TypeDouble:
+		return charsetBinary, 22, flagBinary, 31
+	case TypeDate:
+		return charsetBinary, 10, flagBinary, 0
+	case TypeTime:
+		return charsetBinary, 10, flagBinary, 0
+	case TypeDateTime, TypeTimestamp:
+		return charsetBinary, 19, flagBinary, 0
+	case TypeTinyBlob:
+		return charsetBinary, 255, flagBlob | flagBinary, 0
+	case TypeBlob:
+		return charsetBinary, 65535, flagBlob | flagBinary, 0
+	case TypeMediumBlob:
+		return charsetBinary, 16777215, flagBlob | flagBinary, 0
+	case TypeLongBlob:
+		return charsetBinary, 4294967295, flagBlob | flagBinary, 0
+	}
+	return charsetUTF8, 255 * 3, 0, 0
+}
+
+func textRow(cols []Column, row []interface{}) (packet, error) {
+	var p packet
+	for i, v := range row {
+		if v == nil {
+			p.byte(0xfb)
+			continue
+		}
+		b, ok := text(v, cols[i].Type)
+		if !ok {
+			return nil, badValue(cols[i], v)
+		}
+		p.lenBytes(b)
+	}
+	return p, nil
+}
+
+func binaryRow(cols []Column, row []interface{}) (packet, error) {
+	p := packet{0}
+	p.bytes(make([]byte, (len(cols)+7+2)/8))
+	for i, v := range row {
+		if v == nil {
+			// The bitmap of NULLs starts at bit 2.
+			p[1+(i+2)/8] |= 1 << uint((i+2)%8)
+			continue
+		}
+		if err := p.value(cols[i], v); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func badValue(col Column, v interface{}) error {
+	return fmt.Errorf("fakemysql: cannot send %T in column %s of type 0x%02x", v, col.Name, byte(col.Type))
+}
+
+// value appends v in the binary encoding of col's type.
+func (p *packet) value(col Column, v interface{}) error {
+	switch col.Type {
+	case TypeTiny, TypeShort, TypeYear, TypeInt24, TypeLong, TypeLongLong:
+		var n int64
+		switch v := v.(type) {
+		case int64:
+			n = v
+		case bool:
+			if v {
+				n = 1
+			}
+		default:
+			return badValue(col, v)
+		}
+		switch col.Type {
+		case TypeTiny:
+			p.byte(byte(n))
+		case TypeShort, TypeYear:
+			p.uint16(uint16(n))
+		case TypeInt24, TypeLong:
+			p.uint32(uint32(n))
+		default:
+			p.uint64(uint64(n))
+		}
+	case TypeFloat, TypeDouble:
+		var f float64
+		switch v := v.(type) {
+		case float64:
+			f = v
+		case int64:
+			f = float64(v)
+		default:
+			return badValue(col, v)
+		}
+		if col.Type == TypeFloat {
+			p.uint32(math.Float32bits(float32(f)))
+		} else {
+			p.uint64(math.Float64bits(f))
+		}
+	case TypeDate, TypeDateTime, TypeTimestamp:
+		t, ok := v.(time.Time)
+		if !ok {
+			return badValue(col, v)
+		}
+		p.time(t, col.Type == TypeDate)
+	case TypeTime:
+		d, ok := v.(time.Duration)
+		if !ok {
+			return badValue(col, v)
+		}
+		p.duration(d)
+	default:
+		b, ok := text(v, col.Type)
+		if !ok {
+			return badValue(col, v)
+		}
+		p.lenBytes(b)
+	}
+	return nil
+}
+
+// time appends t as a binary DATE, DATETIME or TIMESTAMP. As MySQL does,
+// it leaves out a time of midnight and zero microseconds.
+func (p *packet) time(t time.Time, date bool) {
+	if t.IsZero() {
+		p.byte(0)
+		return
+	}
+	y, mo, d := t.Date()
+	h, mi, s := t.Clock()
+	us := t.Nanosecond() / 1000
+	n := byte(11)
+	switch {
+	case date || us == 0 && h == 0 && mi == 0 && s == 0:
+		n = 4
+	case us == 0:
+		n = 7
+	}
+	p.byte(n)
+	p.uint16(uint16(y))
+	p.byte(byte(mo))
+	p.byte(byte(d))
+	if n > 4 {
+		p.bytes([]byte{byte(h), byte(mi), byte(s)})
+	}
+	if n > 7 {
+		p.uint32(uint32(us))
+	}
+}
+
+// duration appends d as a binary TIME.
+func (p *packet) duration(d time.Duration) {
+	if d == 0 {
+		p.byte(0)
+		return
+	}
+	var neg byte
+	if d < 0 {
+		neg, d = 1, -d
+	}
+	days := d / (24 * time.Hour)
+	h, mi, s, us := d/time.Hour%24, d/time.Minute%60, d/time.Second%60, d/time.Microsecond%1e6
+	n := byte(12)
+	if us == 0 {
+		n = 8
+	}
+	p.byte(n)
+	p.byte(neg)
+	p.uint32(uint32(days))
+	p.bytes([]byte{byte(h), byte(mi), byte(s)})
+	if n > 8 {
+		p.uint32(uint32(us))
+	}
+}
+
+// text returns the text encoding of v in a column of type t.
+func text(v interface{}, t FieldType) ([]byte, bool) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return []byte("1"), true
+		}
+		return []byte("0"), true
+	case int64:
+		return strconv.AppendInt(nil, v, 10), true
+	case float64:
+		bits := 64
+		if t == TypeFloat {
+			bits = 32
+		}
+		return strconv.AppendFloat(nil, v, 'g', -1, bits), true
+	case string:
+		return []byte(v), true
+	case []byte:
+		return v, true
+	case time.Time:
+		layout := "2006-01-02 15:04:05"
+		switch {
+		case t == TypeDate:
+			layout = "2006-01-02"
+		case v.Nanosecond() >= 1000:
+			layout += ".000000"
+		}
+		if v.IsZero() {
+			// MySQL's zero date.
+			return []byte("0000-00-00 00:00:00.000000"[:len(layout)]), true
+		}
+		return []byte(v.Format(layout)), true
+	case time.Duration:
+		return []byte(formatDuration(v)), true
+	}
+	return nil, false
+}
+
+// formatDuration formats d as MySQL shows a TIME, such as -838:59:59.
+func formatDuration(d time.Duration) string {
+	sign := ""
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	s := fmt.Sprintf("%s%02d:%02d:%02d", sign, d/time.Hour, d/time.Minute%60, d/time.Second%60)
+	if us := d / time.Microsecond % 1e6; us != 0 {
+		s += fmt.Sprintf(".%06d", us)
+	}
+	return s
+}
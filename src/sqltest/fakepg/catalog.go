@@ -0,0 +1,128 @@
+package fakepg
+
+import (
+	"sort"
+	"strings"
+)
+
+// snapshot returns a table holding rows, for a view of the system
+// catalogs. The table is marked dropped, so that statements reading it
+// are planned, and take a new snapshot, each time they run.
+func snapshot(schema, name string, cols []*column, rows [][]interface{}) *table {
+	tbl := &table{schema: newSchema(schema), name: name, cols: cols, dropped: true}
+	for _, vals := range rows {
+		tbl.rows = append(tbl.rows, &version{table: tbl, vals: vals})
+	}
+	return tbl
+}
+
+// catalogColumns returns columns of type typ with the given names.
+func catalogColumns(typ Oid, names ...string) []*column {
+	var cols []*column
+	for _, name := range names {
+		cols = append(cols, &column{name: name, typ: typeName{oid: typ, length: -1}})
+	}
+	return cols
+}
+
+// catalogTable returns a snapshot of the catalog view called n, or nil
+// if there is none. The views are information_schema.tables, columns
+// and table_constraints, with the columns of each the scenarios read,
+// and pg_indexes.
+func (db *DB) catalogTable(n qname) *table {
+	var rows [][]interface{}
+	switch {
+	case n.schema == "information_schema" && n.name == "tables":
+		for _, tbl := range db.sortedTables() {
+			rows = append(rows, []interface{}{tbl.schema.name, tbl.name, "BASE TABLE"})
+		}
+		return snapshot(n.schema, n.name, catalogColumns(VarcharOid, "table_schema", "table_name", "table_type"), rows)
+	case n.schema == "information_schema" && n.name == "columns":
+		for _, tbl := range db.sortedTables() {
+			for i, col := range tbl.cols {
+				nullable := "YES"
+				if col.notNull {
+					nullable = "NO"
+				}
+				rows = append(rows, []interface{}{tbl.schema.name, tbl.name, col.name, int64(i + 1), col.typ.oid.String(), nullable})
+			}
+		}
+		cols := catalogColumns(VarcharOid, "table_schema", "table_name", "column_name")
+		cols = append(cols, catalogColumns(Int4Oid, "ordinal_position")...)
+		cols = append(cols, catalogColumns(VarcharOid, "data_type", "is_nullable")...)
+		return snapshot(n.schema, n.name, cols, rows)
+	case n.schema == "information_schema" && n.name == "table_constraints":
+		for _, tbl := range db.sortedTables() {
+			for _, ix := range tbl.indexes {
+				if kind := ix.constraint(); kind != "" {
+					rows = append(rows, []interface{}{tbl.schema.name, tbl.name, ix.name, kind})
+				}
+			}
+		}
+		return snapshot(n.schema, n.name, catalogColumns(VarcharOid, "table_schema", "table_name", "constraint_name", "constraint_type"), rows)
+	case n.name == "pg_indexes" && (n.schema == "" || n.schema == "pg_catalog"):
+		for _, tbl := range db.sortedTables() {
+			for _, ix := range tbl.indexes {
+				rows = append(rows, []interface{}{tbl.schema.name, tbl.name, ix.name, ix.definition()})
+			}
+		}
+		return snapshot("pg_catalog", n.name, catalogColumns(TextOid, "schemaname", "tablename", "indexname", "indexdef"), rows)
+	}
+	return nil
+}
+
+// sortedTables returns the tables of every schema, by schema and name.
+func (db *DB) sortedTables() []*table {
+	var tables []*table
+	for _, sch := range db.schemas {
+		for _, tbl := range sch.tables {
+			tables = append(tables, tbl)
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		a, b := tables[i], tables[j]
+		return a.schema.name < b.schema.name || a.schema.name == b.schema.name && a.name < b.name
+	})
+	return tables
+}
+
+// constraint returns the type of the constraint ix enforces, "" if it
+// was made by CREATE INDEX.
+func (ix *index) constraint() string {
+	switch {
+	case ix.primary:
+		return "PRIMARY KEY"
+	case ix.unique && strings.HasSuffix(ix.name, "_key"):
+		return "UNIQUE"
+	}
+	return ""
+}
+
+// definition returns the CREATE INDEX statement for ix, as pg_indexes
+// shows it.
+func (ix *index) definition() string {
+	var cols []string
+	for _, c := range ix.cols {
+		cols = append(cols, quoteIdent(ix.table.cols[c].name))
+	}
+	unique := ""
+	if ix.unique {
+		unique = "UNIQUE "
+	}
+	return "CREATE " + unique + "INDEX " + quoteIdent(ix.name) + " ON " + quoteIdent(ix.table.schema.name) + "." +
+		quoteIdent(ix.table.name) + " USING btree (" + strings.Join(cols, ", ") + ")"
+}
+
+// quoteIdent quotes name if it would not read back as itself unquoted,
+// as Postgres's quote_ident does.
+func quoteIdent(name string) string {
+	plain := name != "" && !reserved[name] && !isDigit(name[0])
+	for i := 0; i < len(name) && plain; i++ {
+		c := name[i]
+		plain = c == '_' || 'a' <= c && c <= 'z' || isDigit(c)
+	}
+	if plain {
+		return name
+	}
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
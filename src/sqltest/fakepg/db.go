@@ -0,0 +1,939 @@
+package fakepg
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A DB is a Handler keeping tables in memory. It runs the subset of SQL
+// the sqltest scenarios use: single-table SELECT, INSERT, UPDATE and
+// DELETE with RETURNING, CREATE and DROP of schemas, tables and indexes
+// with primary key, unique, not-null and foreign key constraints, the
+// last without ON DELETE or ON UPDATE actions, ALTER TABLE ... ADD
+// COLUMN, transactions and savepoints, SET and SHOW, LISTEN and NOTIFY,
+// and COPY FROM STDIN. The pg_prepared_statements view lists the names
+// of the session's prepared statements, and the pg_indexes view and the
+// information_schema views tables, columns and table_constraints
+// describe the tables.
+//
+// Concurrent transactions behave as in Postgres at the READ COMMITTED
+// isolation level: each statement sees the rows committed before it
+// started, and a change to a row another transaction has changed waits
+// for that transaction to end. Any error aborts the transaction block,
+// unless StatementRollback is set. DDL takes effect immediately and is
+// not rolled back.
+type DB struct {
+	// StatementRollback makes an error in a transaction block undo only
+	// the failed statement, as in MySQL, rather than abort the block. A
+	// deadlock still rolls back the whole transaction, ending the block.
+	StatementRollback bool
+
+	// CaseInsensitiveColumns makes column names match whatever their
+	// case, and keeps unquoted column names and aliases in the case
+	// they are written in, as in MySQL. Other names are still folded
+	// to lower case unless quoted.
+	CaseInsensitiveColumns bool
+
+	mu       sync.Mutex
+	ended    *sync.Cond // broadcast when a transaction commits or aborts
+	schemas  map[string]*schema
+	sessions map[*session]bool
+}
+
+// NewDB returns an empty database with only the schema public.
+func NewDB() *DB {
+	db := &DB{
+		schemas:  map[string]*schema{"public": newSchema("public")},
+		sessions: map[*session]bool{},
+	}
+	db.ended = sync.NewCond(&db.mu)
+	return db
+}
+
+type schema struct {
+	name    string
+	tables  map[string]*table
+	indexes map[string]*index
+}
+
+func newSchema(name string) *schema {
+	return &schema{name: name, tables: map[string]*table{}, indexes: map[string]*index{}}
+}
+
+type table struct {
+	schema  *schema
+	name    string
+	cols    []*column
+	rows    []*version // in insertion order, including dead ones
+	dead    int        // number of dead versions in rows
+	indexes []*index
+	fkeys   []*foreignKey
+	dropped bool // or replaced by ALTER TABLE
+	nocase  bool // column names match whatever their case
+}
+
+type column struct {
+	name    string
+	typ     typeName
+	notNull bool
+	def     *cexpr // DEFAULT expression, if any
+	seq     int64  // last value of a serial column
+}
+
+type index struct {
+	name    string
+	table   *table
+	cols    []int
+	unique  bool
+	primary bool
+
+	// For unique indexes, keys maps the key of each version that is
+	// not dead to the versions having it.
+	keys map[string][]*version
+}
+
+// A foreignKey requires the values of cols in each row of table to be
+// the key of a row in the unique index ref, unless part of them is NULL.
+type foreignKey struct {
+	name  string
+	table *table
+	cols  []int
+	ref   *index
+}
+
+// A version is one version of a row. Updates replace a row with a new
+// version, as in Postgres.
+type version struct {
+	table *table
+	vals  []interface{}
+	xmin  *tx      // transaction that created it, nil once committed
+	xmax  *tx      // transaction deleting it, nil if none
+	dead  bool     // deleted by a committed or created by an aborted transaction
+	next  *version // version an update replaced this one with
+}
+
+type tx struct {
+	pid      int32 // of the session running it
+	start    time.Time
+	created  []*version
+	deleted  []*version
+	notifies []notification
+	waiting  *tx // transaction this one is blocked on
+	done     bool
+
+	savepoints []savepoint
+}
+
+// A savepoint records how many versions a transaction had created and
+// deleted, and notifications queued, when it was taken.
+type savepoint struct {
+	name                       string
+	created, deleted, notifies int
+}
+
+type notification struct {
+	channel, payload string
+}
+
+// A delivery is a notification on its way to a listening client.
+type delivery struct {
+	to  *Client
+	pid int32
+	notification
+}
+
+var errAborted = &Error{
+	Code:    "25P02",
+	Message: "current transaction is aborted, commands ignored until end of transaction block",
+}
+
+func (db *DB) begin(pid int32) *tx {
+	return &tx{pid: pid, start: time.Now().Round(time.Microsecond)}
+}
+
+// visible reports whether t sees v.
+func (v *version) visible(t *tx) bool {
+	return !v.dead && (v.xmin == nil || v.xmin == t) && v.xmax != t
+}
+
+// commit makes the changes of t permanent and returns the notifications
+// to send.
+func (db *DB) commit(t *tx) []delivery {
+	for _, v := range t.created {
+		v.xmin = nil
+	}
+	for _, v := range t.deleted {
+		v.kill()
+	}
+	db.end(t)
+
+	var ds []delivery
+	for _, n := range t.notifies {
+		for s := range db.sessions {
+			if s.listen[n.channel] {
+				ds = append(ds, delivery{s.client, t.pid, n})
+			}
+		}
+	}
+	return ds
+}
+
+// abort undoes the changes of t.
+func (db *DB) abort(t *tx) {
+	db.undo(t, 0, 0)
+	db.end(t)
+}
+
+// undo undoes the changes t made after it had created and deleted the
+// given numbers of versions.
+func (db *DB) undo(t *tx, created, deleted int) {
+	for _, v := range t.created[created:] {
+		v.kill()
+	}
+	for _, v := range t.deleted[deleted:] {
+		if v.xmax == t {
+			v.xmax, v.next = nil, nil
+		}
+	}
+	t.created, t.deleted = t.created[:created], t.deleted[:deleted]
+}
+
+func (db *DB) end(t *tx) {
+	t.done = true
+	t.created, t.deleted = nil, nil
+	db.ended.Broadcast()
+}
+
+// wait blocks t until other ends, failing if that would deadlock.
+func (db *DB) wait(t, other *tx) {
+	for o := other; o != nil; o = o.waiting {
+		if o == t {
+			fail("40P01", "deadlock detected")
+		}
+	}
+	t.waiting = other
+	defer func() { t.waiting = nil }()
+	for !other.done {
+		db.ended.Wait()
+	}
+}
+
+// kill marks v dead, dropping it from its table's unique indexes.
+func (v *version) kill() {
+	if v.dead {
+		return
+	}
+	v.dead = true
+	v.xmin, v.xmax = nil, nil
+	tbl := v.table
+	for _, ix := range tbl.indexes {
+		if k, ok := ix.key(v.vals); ok && ix.unique {
+			ix.remove(k, v)
+		}
+	}
+	tbl.dead++
+	if tbl.dead >= 64 && tbl.dead*2 >= len(tbl.rows) {
+		live := make([]*version, 0, len(tbl.rows)-tbl.dead)
+		for _, v := range tbl.rows {
+			if !v.dead {
+				live = append(live, v)
+			}
+		}
+		tbl.rows, tbl.dead = live, 0
+	}
+}
+
+// key returns the key of vals in ix, and false if part of it is NULL,
+// which never conflicts.
+func (ix *index) key(vals []interface{}) (string, bool) {
+	return rowKey(ix.cols, vals)
+}
+
+// rowKey returns the key of the values of cols in vals, and false if
+// part of it is NULL.
+func rowKey(cols []int, vals []interface{}) (string, bool) {
+	var b strings.Builder
+	for _, i := range cols {
+		if vals[i] == nil {
+			return "", false
+		}
+		k := valueKey(vals[i])
+		b.WriteString(strconv.Itoa(len(k)))
+		b.WriteByte(':')
+		b.WriteString(k)
+	}
+	return b.String(), true
+}
+
+func (ix *index) remove(k string, v *version) {
+	vs := ix.keys[k]
+	for i, o := range vs {
+		if o == v {
+			vs = append(vs[:i], vs[i+1:]...)
+			break
+		}
+	}
+	if len(vs) == 0 {
+		delete(ix.keys, k)
+	} else {
+		ix.keys[k] = vs
+	}
+}
+
+// violation returns the error for inserting vals into ix when another
+// row has the same key.
+func (ix *index) violation(vals []interface{}) *Error {
+	e := errorf("23505", "duplicate key value violates unique constraint %q", ix.name)
+	e.Detail = "Key " + describeKey(ix.table, ix.cols, vals) + " already exists."
+	e.Schema, e.Table, e.Constraint = ix.table.schema.name, ix.table.name, ix.name
+	return e
+}
+
+// describeKey returns the values of cols in vals, a row of tbl, as
+// error details show them: (a, b)=(1, 2).
+func describeKey(tbl *table, cols []int, vals []interface{}) string {
+	var names, values []string
+	for _, i := range cols {
+		col := tbl.cols[i]
+		names = append(names, col.name)
+		values = append(values, toText(vals[i], col.typ.oid, time.UTC))
+	}
+	return "(" + strings.Join(names, ", ") + ")=(" + strings.Join(values, ", ") + ")"
+}
+
+// checkReference fails unless the row with vals that t inserts into the
+// table of fk refers to a row t sees, waiting for any transaction that
+// has inserted or deleted such a row to end.
+func (db *DB) checkReference(t *tx, fk *foreignKey, vals []interface{}) {
+	k, ok := rowKey(fk.cols, vals)
+	if !ok {
+		return
+	}
+retry:
+	for _, o := range fk.ref.keys[k] {
+		switch {
+		case o.dead || o.xmax == t:
+		case o.xmin != nil && o.xmin != t:
+			db.wait(t, o.xmin)
+			goto retry
+		case o.xmax != nil:
+			db.wait(t, o.xmax)
+			goto retry
+		default:
+			return
+		}
+	}
+	e := errorf("23503", "insert or update on table %q violates foreign key constraint %q", fk.table.name, fk.name)
+	e.Detail = "Key " + describeKey(fk.table, fk.cols, vals) + " is not present in table " + strconv.Quote(fk.ref.table.name) + "."
+	e.Schema, e.Table, e.Constraint = fk.table.schema.name, fk.table.name, fk.name
+	panic(e)
+}
+
+// checkReferenced fails if a row t sees refers to v, which t deletes or
+// updates to hold vals, nil for a delete, waiting for any transaction
+// that has inserted or deleted such a row to end.
+func (db *DB) checkReferenced(t *tx, v *version, vals []interface{}) {
+	for _, fk := range db.referencing(v.table) {
+		k, ok := fk.ref.key(v.vals)
+		if !ok {
+			continue
+		}
+		if vals != nil {
+			if nk, _ := fk.ref.key(vals); nk == k {
+				continue
+			}
+		}
+	retry:
+		for _, o := range fk.table.rows {
+			if ck, _ := rowKey(fk.cols, o.vals); o.dead || o.xmax == t || ck != k {
+				continue
+			}
+			switch {
+			case o.xmin != nil && o.xmin != t:
+				db.wait(t, o.xmin)
+				goto retry
+			case o.xmax != nil:
+				db.wait(t, o.xmax)
+				goto retry
+			}
+			e := errorf("23503", "update or delete on table %q violates foreign key constraint %q on table %q", v.table.name, fk.name, fk.table.name)
+			e.Detail = "Key " + describeKey(v.table, fk.ref.cols, v.vals) + " is still referenced from table " + strconv.Quote(fk.table.name) + "."
+			e.Schema, e.Table, e.Constraint = fk.table.schema.name, fk.table.name, fk.name
+			panic(e)
+		}
+	}
+}
+
+// referencing returns the foreign keys referring to tbl.
+func (db *DB) referencing(tbl *table) []*foreignKey {
+	var fks []*foreignKey
+	for _, sch := range db.schemas {
+		for _, o := range sch.tables {
+			for _, fk := range o.fkeys {
+				if fk.ref.table == tbl {
+					fks = append(fks, fk)
+				}
+			}
+		}
+	}
+	return fks
+}
+
+// insert adds a row to tbl as part of t, waiting for any transaction
+// that has inserted or deleted a row with the same unique key to end.
+func (db *DB) insert(t *tx, tbl *table, vals []interface{}) *version {
+	for i, col := range tbl.cols {
+		if col.notNull && vals[i] == nil {
+			var row []string
+			for j, v := range vals {
+				if v == nil {
+					row = append(row, "null")
+				} else {
+					row = append(row, toText(v, tbl.cols[j].typ.oid, time.UTC))
+				}
+			}
+			e := errorf("23502", "null value in column %q violates not-null constraint", col.name)
+			e.Detail = "Failing row contains (" + strings.Join(row, ", ") + ")."
+			e.Schema, e.Table, e.Column = tbl.schema.name, tbl.name, col.name
+			panic(e)
+		}
+	}
+	for _, fk := range tbl.fkeys {
+		db.checkReference(t, fk, vals)
+	}
+	for _, ix := range tbl.indexes {
+		k, ok := ix.key(vals)
+		if !ix.unique || !ok {
+			continue
+		}
+	retry:
+		for _, o := range ix.keys[k] {
+			switch {
+			case o.dead || o.xmax == t:
+			case o.xmin != nil && o.xmin != t:
+				db.wait(t, o.xmin)
+				goto retry
+			case o.xmax != nil:
+				db.wait(t, o.xmax)
+				goto retry
+			default:
+				panic(ix.violation(vals))
+			}
+		}
+	}
+	v := &version{table: tbl, vals: vals, xmin: t}
+	tbl.rows = append(tbl.rows, v)
+	for _, ix := range tbl.indexes {
+		if k, ok := ix.key(vals); ok && ix.unique {
+			ix.keys[k] = append(ix.keys[k], v)
+		}
+	}
+	t.created = append(t.created, v)
+	return v
+}
+
+// lock prepares v for an update or delete by t. If another transaction
+// is changing v, it waits for that to end and then, as Postgres does at
+// READ COMMITTED, goes on with the newest version of the row if it still
+// matches. It returns nil if no version of the row is left to change.
+func (db *DB) lock(t *tx, v *version, matches func(*version) bool) *version {
+	for v.xmax != nil && v.xmax != t {
+		db.wait(t, v.xmax)
+		if v.dead {
+			v = v.next
+			if v == nil || !v.visible(t) || !matches(v) {
+				return nil
+			}
+		}
+	}
+	return v
+}
+
+// update replaces v, locked by t, with a version holding vals.
+func (db *DB) update(t *tx, v *version, vals []interface{}) *version {
+	db.checkReferenced(t, v, vals)
+	v.xmax = t
+	t.deleted = append(t.deleted, v)
+	nv := db.insert(t, v.table, vals)
+	v.next = nv
+	return nv
+}
+
+func (db *DB) delete(t *tx, v *version) {
+	db.checkReferenced(t, v, nil)
+	v.xmax = t
+	t.deleted = append(t.deleted, v)
+}
+
+// schema returns the schema called name, "public" if empty.
+func (db *DB) schema(name string) *schema {
+	if name == "" {
+		name = "public"
+	}
+	s := db.schemas[name]
+	if s == nil {
+		fail("3F000", "schema %q does not exist", name)
+	}
+	return s
+}
+
+// table returns the table called n.
+func (db *DB) table(n qname) *table {
+	if s := db.schemas[orPublic(n.schema)]; s != nil {
+		if tbl := s.tables[n.name]; tbl != nil {
+			return tbl
+		}
+	}
+	fail("42P01", "relation %q does not exist", n.String())
+	panic("unreachable")
+}
+
+func orPublic(schema string) string {
+	if schema == "" {
+		return "public"
+	}
+	return schema
+}
+
+// named reports whether name is a name of the column col of tbl.
+func (tbl *table) named(col *column, name string) bool {
+	return col.name == name || tbl.nocase && strings.EqualFold(col.name, name)
+}
+
+// column returns the index of the column called name in tbl.
+func (tbl *table) column(name string) int {
+	for i, col := range tbl.cols {
+		if tbl.named(col, name) {
+			return i
+		}
+	}
+	fail("42703", "column %q of relation %q does not exist", name, tbl.name)
+	panic("unreachable")
+}
+
+// addIndex adds an index on cols to tbl, naming it after the table and
+// columns with suffix if name is empty.
+func (tbl *table) addIndex(name string, cols []string, unique, primary bool, suffix string) *index {
+	ix := &index{table: tbl, unique: unique, primary: primary}
+	for _, c := range cols {
+		ix.cols = append(ix.cols, tbl.column(c))
+	}
+	if name == "" {
+		base := tbl.name + "_" + suffix
+		if !primary {
+			base = tbl.name + "_" + strings.Join(cols, "_") + "_" + suffix
+		}
+		name = base
+		for n := 1; tbl.schema.indexes[name] != nil || tbl.schema.tables[name] != nil; n++ {
+			name = base + strconv.Itoa(n)
+		}
+	} else if tbl.schema.indexes[name] != nil || tbl.schema.tables[name] != nil {
+		fail("42P07", "relation %q already exists", name)
+	}
+	ix.name = name
+	if unique {
+		ix.keys = map[string][]*version{}
+		for _, v := range tbl.rows {
+			if v.dead {
+				continue
+			}
+			k, ok := ix.key(v.vals)
+			if !ok {
+				continue
+			}
+			for _, o := range ix.keys[k] {
+				if o.xmax == nil && v.xmax == nil {
+					e := ix.violation(v.vals)
+					e.Message = "could not create unique index " + strconv.Quote(name)
+					e.Detail = strings.Replace(e.Detail, "already exists", "is duplicated", 1)
+					panic(e)
+				}
+			}
+			ix.keys[k] = append(ix.keys[k], v)
+		}
+	}
+	tbl.indexes = append(tbl.indexes, ix)
+	tbl.schema.indexes[name] = ix
+	return ix
+}
+
+// addColumn replaces tbl in its schema by a copy with the column cd
+// added, set to its default in every row, so that statements planned
+// for tbl are planned again.
+func (tbl *table) addColumn(cd colDef, e *env) {
+	if cd.primaryKey || cd.unique || cd.references != nil || cd.typ.serial {
+		unsupported("ALTER TABLE ADD COLUMN with a key or serial column")
+	}
+	for _, col := range tbl.cols {
+		if tbl.named(col, cd.name) {
+			fail("42701", "column %q of relation %q already exists", cd.name, tbl.name)
+		}
+	}
+	col := newColumn(cd, tbl.name)
+	v := col.defaultValue(e)
+	if v == nil && col.notNull && len(tbl.rows) > tbl.dead {
+		fail("23502", "column %q of relation %q contains null values", cd.name, tbl.name)
+	}
+	alt := *tbl
+	alt.cols = append(append([]*column(nil), tbl.cols...), col)
+	for _, r := range alt.rows {
+		r.table = &alt
+		r.vals = append(r.vals, v)
+	}
+	for _, ix := range alt.indexes {
+		ix.table = &alt
+	}
+	for _, fk := range alt.fkeys {
+		fk.table = &alt
+	}
+	tbl.dropped = true
+	tbl.schema.tables[tbl.name] = &alt
+}
+
+// drop removes tbl and its indexes from its schema.
+func (tbl *table) drop() {
+	tbl.dropped = true
+	delete(tbl.schema.tables, tbl.name)
+	for _, ix := range tbl.indexes {
+		delete(tbl.schema.indexes, ix.name)
+	}
+}
+
+// NewSession implements Handler.
+func (db *DB) NewSession(c *Client) Session {
+	s := &session{db: db, client: c, loc: time.UTC, params: map[string]string{}, listen: map[string]bool{}}
+	for k, v := range c.Params {
+		if strings.EqualFold(k, "timezone") {
+			if loc, err := parseZone(v); err == nil {
+				s.loc = loc
+			}
+		}
+	}
+	db.mu.Lock()
+	db.sessions[s] = true
+	db.mu.Unlock()
+	return s
+}
+
+type session struct {
+	db     *DB
+	client *Client
+	tx     *tx  // open transaction block, if any
+	failed bool // the transaction block has failed
+	loc    *time.Location
+	params map[string]string // values changed with SET
+	listen map[string]bool
+}
+
+// preparedStatements returns a snapshot of the pg_prepared_statements
+// view, with only its name column.
+func (s *session) preparedStatements() *table {
+	var rows [][]interface{}
+	for _, name := range s.client.PreparedStatements() {
+		rows = append(rows, []interface{}{name})
+	}
+	return snapshot("pg_catalog", "pg_prepared_statements", catalogColumns(TextOid, "name"), rows)
+}
+
+func (s *session) TxStatus() byte {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	switch {
+	case s.failed:
+		return 'E'
+	case s.tx != nil:
+		return 'T'
+	}
+	return 'I'
+}
+
+func (s *session) Close() {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if s.tx != nil {
+		s.db.abort(s.tx)
+		s.tx = nil
+	}
+	delete(s.db.sessions, s)
+}
+
+// failBlock aborts the transaction block after err, if there is one.
+// The block stays failed until the client ends it or, if it has taken a
+// savepoint, rolls back to one, and keeps its changes until then. With
+// StatementRollback, only a deadlock aborts the block, which then ends.
+func (s *session) failBlock(err error) {
+	if s.tx == nil {
+		return
+	}
+	if s.db.StatementRollback {
+		if e, ok := err.(*Error); ok && e.Code == "40P01" {
+			s.db.abort(s.tx)
+			s.tx = nil
+		}
+		return
+	}
+	s.failed = true
+	if len(s.tx.savepoints) > 0 {
+		return // until ROLLBACK TO a savepoint recovers the block
+	}
+	s.db.abort(s.tx)
+	s.tx = nil
+}
+
+func (s *session) Prepare(query string, paramTypes []Oid) (Statement, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	st := &statement{sess: s, given: paramTypes}
+	err := catch(func() {
+		var err error
+		st.ast, err = parse(query, s.db.CaseInsensitiveColumns)
+		check(err)
+		if s.failed && !endsBlock(st.ast) {
+			panic(errAborted)
+		}
+		st.plan()
+	})
+	if err != nil {
+		s.failBlock(err)
+		return nil, err
+	}
+	return st, nil
+}
+
+// endsBlock reports whether ast is COMMIT, ROLLBACK or ROLLBACK TO, which
+// are allowed in a failed transaction block.
+func endsBlock(ast interface{}) bool {
+	t, ok := ast.(*txStmt)
+	return ok && (t.kind == "COMMIT" || t.kind == "ROLLBACK" || t.kind == "ROLLBACK TO")
+}
+
+// run runs fn in the session's transaction block, or in a transaction of
+// its own if there is none, and sends the notifications of a commit.
+func (s *session) run(fn func(t *tx, e *env) *Result) (res *Result, err error) {
+	db := s.db
+	var ds []delivery
+	e := &env{loc: s.loc, sess: s}
+	db.mu.Lock()
+	err = catch(func() {
+		if s.failed {
+			panic(errAborted)
+		}
+		t := s.tx
+		if t == nil {
+			t = db.begin(s.client.PID)
+			committed := false
+			defer func() {
+				if !committed {
+					db.abort(t)
+				}
+			}()
+			e.now = t.start
+			res = fn(t, e)
+			ds, committed = db.commit(t), true
+			return
+		}
+		e.now = t.start
+		created, deleted := len(t.created), len(t.deleted)
+		defer func() {
+			if v := recover(); v != nil {
+				db.undo(t, created, deleted) // the statement's changes
+				panic(v)
+			}
+		}()
+		res = fn(t, e)
+	})
+	if err != nil {
+		s.failBlock(err)
+	}
+	db.mu.Unlock()
+	deliver(ds)
+	for _, c := range e.terminate {
+		c.Terminate()
+	}
+	return res, err
+}
+
+func deliver(ds []delivery) {
+	for _, d := range ds {
+		d.to.Notify(d.pid, d.channel, d.payload)
+	}
+}
+
+// txControl runs BEGIN, COMMIT, ROLLBACK or a savepoint statement.
+func (s *session) txControl(st *txStmt) (*Result, error) {
+	db := s.db
+	db.mu.Lock()
+	var ds []delivery
+	res := &Result{Tag: st.kind}
+	switch kind := st.kind; {
+	case st.savepoint != "":
+		err := catch(func() { res = s.savepoint(st) })
+		if err != nil {
+			s.failBlock(err)
+		}
+		db.mu.Unlock()
+		return res, err
+	case kind == "BEGIN" && s.failed:
+		db.mu.Unlock()
+		return nil, errAborted
+	case kind == "BEGIN":
+		if s.tx == nil {
+			s.tx = db.begin(s.client.PID)
+		}
+	case s.failed:
+		s.failed = false
+		res.Tag = "ROLLBACK"
+		if s.tx != nil {
+			db.abort(s.tx)
+			s.tx = nil
+		}
+	case s.tx != nil && kind == "COMMIT":
+		ds = db.commit(s.tx)
+		s.tx = nil
+	case s.tx != nil:
+		db.abort(s.tx)
+		s.tx = nil
+	}
+	db.mu.Unlock()
+	deliver(ds)
+	return res, nil
+}
+
+// settings lists the run-time parameters SET accepts, with the name
+// they are reported to the client by, if they are.
+var settings = map[string]string{
+	"application_name":            "application_name",
+	"bytea_output":                "",
+	"client_encoding":             "client_encoding",
+	"client_min_messages":         "",
+	"datestyle":                   "DateStyle",
+	"extra_float_digits":          "",
+	"intervalstyle":               "IntervalStyle",
+	"lock_timeout":                "",
+	"search_path":                 "",
+	"standard_conforming_strings": "standard_conforming_strings",
+	"statement_timeout":           "",
+	"timezone":                    "TimeZone",
+}
+
+// defaultSettings are the values SHOW reports for parameters that were
+// not SET.
+var defaultSettings = map[string]string{
+	"application_name":            "",
+	"bytea_output":                "hex",
+	"client_encoding":             "UTF8",
+	"client_min_messages":         "notice",
+	"datestyle":                   "ISO, MDY",
+	"extra_float_digits":          "0",
+	"intervalstyle":               "postgres",
+	"lock_timeout":                "0",
+	"search_path":                 `"$user", public`,
+	"standard_conforming_strings": "on",
+	"statement_timeout":           "0",
+	"timezone":                    "UTC",
+}
+
+// savepoint runs SAVEPOINT, RELEASE SAVEPOINT or ROLLBACK TO SAVEPOINT,
+// the last of which undoes the changes made since the savepoint was
+// taken, keeping it, and recovers a failed block.
+func (s *session) savepoint(st *txStmt) *Result {
+	t := s.tx
+	if t == nil && !s.failed {
+		what := st.kind
+		if what != "SAVEPOINT" {
+			what += " SAVEPOINT"
+		}
+		fail("25P01", "%s can only be used in transaction blocks", what)
+	}
+	if s.failed && st.kind != "ROLLBACK TO" {
+		panic(errAborted)
+	}
+	if st.kind == "SAVEPOINT" {
+		t.savepoints = append(t.savepoints, savepoint{st.savepoint, len(t.created), len(t.deleted), len(t.notifies)})
+		return &Result{Tag: "SAVEPOINT"}
+	}
+	i := -1
+	if t != nil {
+		for i = len(t.savepoints) - 1; i >= 0 && t.savepoints[i].name != st.savepoint; i-- {
+		}
+	}
+	if i < 0 {
+		fail("3B001", "savepoint %q does not exist", st.savepoint)
+	}
+	sp := t.savepoints[i]
+	if st.kind == "RELEASE" {
+		t.savepoints = t.savepoints[:i]
+		return &Result{Tag: "RELEASE"}
+	}
+	s.db.undo(t, sp.created, sp.deleted)
+	t.notifies = t.notifies[:sp.notifies]
+	t.savepoints = t.savepoints[:i+1]
+	s.failed = false
+	return &Result{Tag: "ROLLBACK"}
+}
+
+func (s *session) set(st *setStmt) *Result {
+	if st.name == "" {
+		return &Result{Tag: "SET"} // SET TRANSACTION
+	}
+	report, ok := settings[st.name]
+	if !ok {
+		fail("42704", "unrecognized configuration parameter %q", st.name)
+	}
+	value := st.value
+	if value == "" {
+		value = defaultSettings[st.name]
+	}
+	if st.name == "timezone" {
+		loc, err := parseZone(value)
+		check(err)
+		s.loc = loc
+	}
+	s.params[st.name] = value
+	res := &Result{Tag: "SET"}
+	if report != "" {
+		res.Params = map[string]string{report: value}
+	}
+	return res
+}
+
+func (s *session) show(name string) *Result {
+	v, ok := s.params[name]
+	if !ok {
+		if v, ok = defaultSettings[name]; !ok {
+			fail("42704", "unrecognized configuration parameter %q", name)
+		}
+	}
+	return &Result{Rows: [][]interface{}{{v}}, Tag: "SHOW"}
+}
+
+// parseZone converts a TimeZone setting: a zone name, or a number of
+// hours east of UTC.
+func parseZone(v string) (*time.Location, error) {
+	if h, err := strconv.ParseFloat(v, 64); err == nil && h > -24 && h < 24 {
+		return time.FixedZone(v, int(h*3600)), nil
+	}
+	switch strings.ToLower(v) {
+	case "utc", "gmt", "z", "zulu", "localtime":
+		return time.UTC, nil
+	}
+	if loc, err := time.LoadLocation(v); err == nil && v != "" && v != "Local" {
+		return loc, nil
+	}
+	return nil, errorf("22023", "invalid value for parameter \"TimeZone\": %q", v)
+}
+
+func (s *session) setListen(st *listenStmt) *Result {
+	switch {
+	case !st.unlisten:
+		s.listen[st.channel] = true
+		return &Result{Tag: "LISTEN"}
+	case st.channel == "*":
+		s.listen = map[string]bool{}
+	default:
+		delete(s.listen, st.channel)
+	}
+	return &Result{Tag: "UNLISTEN"}
+}
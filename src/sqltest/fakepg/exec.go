@@ -0,0 +1,984 @@
+package fakepg
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A statement is a Statement of a DB session.
+type statement struct {
+	sess   *session
+	ast    interface{}
+	given  []Oid // parameter types given by the client
+	params []Oid
+	cols   []Column
+	tables []*table // tables the plan was made for
+
+	// exec runs the statement in t. It is nil for BEGIN, COMMIT and
+	// ROLLBACK, which control the transaction themselves.
+	exec func(t *tx, e *env) *Result
+}
+
+func (st *statement) ParamTypes() []Oid { return st.params }
+func (st *statement) Columns() []Column { return st.cols }
+func (st *statement) Close()            {}
+
+func (st *statement) Exec(args []interface{}) (*Result, error) {
+	if t, ok := st.ast.(*txStmt); ok {
+		return st.sess.txControl(t)
+	}
+	return st.sess.run(func(t *tx, e *env) *Result {
+		if st.stale() {
+			cols := st.cols
+			st.plan()
+			if !sameColumns(cols, st.cols) {
+				fail("0A000", "cached plan must not change result type")
+			}
+		}
+		e.args = args
+		return st.exec(t, e)
+	})
+}
+
+// stale reports whether a table the statement was planned for has been
+// dropped or altered, so that it must be planned again.
+func (st *statement) stale() bool {
+	for _, tbl := range st.tables {
+		if tbl.dropped {
+			return true
+		}
+	}
+	return false
+}
+
+func sameColumns(a, b []Column) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Type != b[i].Type {
+			return false
+		}
+	}
+	return true
+}
+
+// table looks up a table the statement uses.
+func (st *statement) table(n qname) *table {
+	var tbl *table
+	if n.name == "pg_prepared_statements" && (n.schema == "" || n.schema == "pg_catalog") {
+		tbl = st.sess.preparedStatements()
+	} else if tbl = st.sess.db.catalogTable(n); tbl == nil {
+		tbl = st.sess.db.table(n)
+	}
+	st.tables = append(st.tables, tbl)
+	return tbl
+}
+
+// plan compiles the statement, setting its parameter and result columns
+// and exec. The caller holds the DB lock.
+func (st *statement) plan() {
+	db, s := st.sess.db, st.sess
+	c := &compiler{params: append([]Oid(nil), st.given...)}
+	st.tables, st.cols = nil, nil
+	switch ast := st.ast.(type) {
+	case *selectStmt:
+		var rows func(t *tx, e *env) [][]interface{}
+		st.cols, rows = st.planSelect(c, ast)
+		st.exec = func(t *tx, e *env) *Result {
+			r := rows(t, e)
+			return &Result{Rows: r, Tag: "SELECT " + strconv.Itoa(len(r))}
+		}
+	case *insertStmt:
+		st.planInsert(c, ast)
+	case *updateStmt:
+		st.planUpdate(c, ast)
+	case *deleteStmt:
+		st.planDelete(c, ast)
+	case *copyStmt:
+		st.planCopy(ast)
+	case *createSchemaStmt:
+		st.exec = func(*tx, *env) *Result {
+			if db.schemas[ast.name] != nil {
+				if ast.ifNotExists {
+					return &Result{Tag: "CREATE SCHEMA"}
+				}
+				fail("42P06", "schema %q already exists", ast.name)
+			}
+			db.schemas[ast.name] = newSchema(ast.name)
+			return &Result{Tag: "CREATE SCHEMA"}
+		}
+	case *dropSchemaStmt:
+		st.exec = func(*tx, *env) *Result {
+			db.dropSchemas(ast)
+			return &Result{Tag: "DROP SCHEMA"}
+		}
+	case *createTableStmt:
+		st.exec = func(*tx, *env) *Result {
+			db.createTable(ast)
+			return &Result{Tag: "CREATE TABLE"}
+		}
+	case *dropTableStmt:
+		st.exec = func(*tx, *env) *Result {
+			db.dropTables(ast.names, ast.ifExists, ast.cascade)
+			return &Result{Tag: "DROP TABLE"}
+		}
+	case *alterTableStmt:
+		st.exec = func(t *tx, e *env) *Result {
+			db.table(ast.name).addColumn(ast.col, e)
+			return &Result{Tag: "ALTER TABLE"}
+		}
+	case *createIndexStmt:
+		st.exec = func(*tx, *env) *Result {
+			tbl := db.table(ast.table)
+			if ast.ifNotExists && tbl.schema.indexes[ast.name] != nil {
+				return &Result{Tag: "CREATE INDEX"}
+			}
+			tbl.addIndex(ast.name, ast.cols, ast.unique, false, "idx")
+			return &Result{Tag: "CREATE INDEX"}
+		}
+	case *dropIndexStmt:
+		st.exec = func(*tx, *env) *Result {
+			for _, n := range ast.names {
+				db.dropIndex(n, ast.ifExists)
+			}
+			return &Result{Tag: "DROP INDEX"}
+		}
+	case *setStmt:
+		st.exec = func(*tx, *env) *Result { return s.set(ast) }
+	case *showStmt:
+		st.cols = []Column{{ast.name, TextOid}}
+		st.exec = func(*tx, *env) *Result { return s.show(ast.name) }
+	case *listenStmt:
+		st.exec = func(*tx, *env) *Result { return s.setListen(ast) }
+	case *notifyStmt:
+		if len(ast.payload) >= 8000 {
+			fail("22023", "payload string too long")
+		}
+		st.exec = func(t *tx, e *env) *Result {
+			t.notifies = append(t.notifies, notification{ast.channel, ast.payload})
+			return &Result{Tag: "NOTIFY"}
+		}
+	}
+	st.params = c.paramTypes()
+}
+
+// typed gives an untyped string constant the type text, as Postgres
+// does for selected values.
+func typed(x cexpr) cexpr {
+	if x.typ == UnknownOid {
+		return implicit(x, TextOid, "")
+	}
+	return x
+}
+
+// condition compiles the boolean expression of a clause such as WHERE.
+func (c *compiler) condition(x expr, clause string) cexpr {
+	w := c.compile(x, BoolOid)
+	if w.typ == UnknownOid {
+		w = implicit(w, BoolOid, "")
+	}
+	if w.typ != BoolOid {
+		fail("42804", "argument of %s must be type boolean, not type %v", clause, w.typ)
+	}
+	return w
+}
+
+// items compiles a select list or RETURNING clause, expanding *.
+func (c *compiler) items(items []selectItem) []cexpr {
+	var out []cexpr
+	for _, it := range items {
+		if it.x == nil {
+			if c.scope.table == nil {
+				fail("42601", "SELECT * with no tables specified is not valid")
+			}
+			for _, col := range c.scope.table.cols {
+				out = append(out, c.compile(&colRef{name: col.name}, 0))
+			}
+			continue
+		}
+		x := typed(c.compile(it.x, 0))
+		if it.alias != "" {
+			x.name = it.alias
+		}
+		out = append(out, x)
+	}
+	return out
+}
+
+func columns(items []cexpr) []Column {
+	cols := make([]Column, len(items))
+	for i, x := range items {
+		cols[i] = Column{x.name, x.typ}
+	}
+	return cols
+}
+
+func evalAll(items []cexpr, e *env) []interface{} {
+	row := make([]interface{}, len(items))
+	for i, x := range items {
+		row[i] = x.eval(e)
+	}
+	return row
+}
+
+// A sortKey is an ORDER BY item, either an output column or an
+// expression over the table's columns.
+type sortKey struct {
+	out        int // output column, or -1
+	x          cexpr
+	desc       bool
+	nullsFirst bool
+}
+
+// planSelect compiles a SELECT, returning its result columns and a
+// function computing its rows.
+func (st *statement) planSelect(c *compiler, s *selectStmt) ([]Column, func(t *tx, e *env) [][]interface{}) {
+	var tbl *table
+	if s.from != nil {
+		tbl = st.table(s.from.name)
+		c.scope = scope{tbl, s.from.name.name}
+		if s.from.alias != "" {
+			c.scope.alias = s.from.alias
+		}
+	}
+	var where *cexpr
+	if s.where != nil {
+		w := c.condition(s.where, "WHERE")
+		where = &w
+	}
+	c.bareCols, c.aggOK = false, "SELECT"
+	items := c.items(s.items)
+	var keys []sortKey
+	for _, o := range s.orderBy {
+		k := sortKey{out: -1, desc: o.desc, nullsFirst: o.nullsFirst}
+		switch x := o.x.(type) {
+		case *literal:
+			if n, ok := x.v.(int64); ok {
+				if n < 1 || int(n) > len(items) {
+					fail("42P10", "ORDER BY position %d is not in select list", n)
+				}
+				k.out = int(n - 1)
+			}
+		case *colRef:
+			for i, it := range items {
+				if x.table == "" && (it.name == x.name || st.sess.db.CaseInsensitiveColumns && strings.EqualFold(it.name, x.name)) {
+					k.out = i
+					break
+				}
+			}
+		}
+		if k.out < 0 {
+			k.x = typed(c.compile(o.x, 0))
+		}
+		keys = append(keys, k)
+	}
+	aggs := c.aggs
+	if len(aggs) > 0 && c.bareCols {
+		fail("42803", "column must appear in the GROUP BY clause or be used in an aggregate function")
+	}
+	c.aggOK = ""
+	limit, offset := c.count(s.limit), c.count(s.offset)
+
+	run := func(t *tx, e *env) [][]interface{} {
+		type outRow struct{ vals, keys []interface{} }
+		var out []outRow
+		emit := func() {
+			r := outRow{vals: evalAll(items, e)}
+			for _, k := range keys {
+				if k.out >= 0 {
+					r.keys = append(r.keys, r.vals[k.out])
+				} else {
+					r.keys = append(r.keys, k.x.eval(e))
+				}
+			}
+			out = append(out, r)
+		}
+		var states []*aggState
+		for _, a := range aggs {
+			states = append(states, &aggState{a: a})
+		}
+		each := func() {
+			if where != nil && where.eval(e) != true {
+				return
+			}
+			if aggs == nil {
+				emit()
+				return
+			}
+			for _, s := range states {
+				s.add(e)
+			}
+		}
+		if tbl == nil {
+			each()
+		} else {
+			for _, v := range tbl.rows {
+				if v.visible(t) {
+					e.row = v.vals
+					each()
+				}
+			}
+		}
+		if aggs != nil {
+			e.row, e.aggs = nil, make([]interface{}, len(states))
+			for i, s := range states {
+				e.aggs[i] = s.result()
+			}
+			emit()
+		}
+
+		if s.distinct {
+			seen := map[string]bool{}
+			uniq := out[:0]
+			for _, r := range out {
+				var b strings.Builder
+				for _, v := range r.vals {
+					k := valueKey(v)
+					b.WriteString(strconv.Itoa(len(k)) + ":" + k)
+				}
+				if !seen[b.String()] {
+					seen[b.String()] = true
+					uniq = append(uniq, r)
+				}
+			}
+			out = uniq
+		}
+		if keys != nil {
+			sort.SliceStable(out, func(i, j int) bool {
+				for n, k := range keys {
+					if c := compareKeys(out[i].keys[n], out[j].keys[n], k); c != 0 {
+						return c < 0
+					}
+				}
+				return false
+			})
+		}
+		if n := offset.value(e, "OFFSET"); n > 0 {
+			if n > int64(len(out)) {
+				n = int64(len(out))
+			}
+			out = out[n:]
+		}
+		if n := limit.value(e, "LIMIT"); n >= 0 && n < int64(len(out)) {
+			out = out[:n]
+		}
+		rows := make([][]interface{}, len(out))
+		for i, r := range out {
+			rows[i] = r.vals
+		}
+		return rows
+	}
+	return columns(items), run
+}
+
+// compareKeys orders two values of an ORDER BY item.
+func compareKeys(a, b interface{}, k sortKey) int {
+	var c int
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil || b == nil:
+		if (a == nil) == k.nullsFirst {
+			return -1
+		}
+		return 1
+	default:
+		var err error
+		c, err = compare(a, b)
+		check(err)
+	}
+	if k.desc {
+		return -c
+	}
+	return c
+}
+
+// A rowCount is a compiled LIMIT or OFFSET.
+type rowCount struct {
+	x *cexpr
+}
+
+func (c *compiler) count(x expr) rowCount {
+	if x == nil {
+		return rowCount{}
+	}
+	n := c.compile(x, Int8Oid)
+	n = implicit(n, Int8Oid, "")
+	if n.typ.category() != catNumber {
+		fail("42804", "argument of LIMIT must be type bigint, not type %v", n.typ)
+	}
+	return rowCount{&n}
+}
+
+// value returns the count, -1 if there is none.
+func (r rowCount) value(e *env, clause string) int64 {
+	if r.x == nil {
+		return -1
+	}
+	v := r.x.eval(e)
+	if v == nil {
+		return -1
+	}
+	n, err := coerce(v, r.x.typ, Int8Oid, e.loc)
+	check(err)
+	if n.(int64) < 0 {
+		code := "2201W"
+		if clause == "OFFSET" {
+			code = "2201X"
+		}
+		fail(code, "%s must not be negative", clause)
+	}
+	return n.(int64)
+}
+
+// assign converts v, of type from, for storing in col.
+func (col *column) assign(v interface{}, from Oid, loc *time.Location) interface{} {
+	if v == nil {
+		return nil
+	}
+	to := col.typ.oid
+	if from != to && from != UnknownOid && to.category() != catString && from.category() != to.category() {
+		e := errorf("42804", "column %q is of type %v but expression is of type %v", col.name, to, from)
+		panic(e)
+	}
+	v, err := coerce(v, from, to, loc)
+	check(err)
+	return applyTypmod(v, col.typ, false)
+}
+
+// defaultValue returns the value of col in a row that does not set it.
+func (col *column) defaultValue(e *env) interface{} {
+	switch {
+	case col.def != nil:
+		return col.assign(col.def.eval(e), col.def.typ, e.loc)
+	case col.typ.serial:
+		col.seq++
+		v, err := checkIntRange(col.typ.oid, col.seq)
+		check(err)
+		if e.serial == 0 {
+			e.serial = col.seq
+		}
+		return v
+	}
+	return nil
+}
+
+// targets returns the indexes of the named columns of tbl, or of all of
+// them if names is nil.
+func targets(tbl *table, names []string) []int {
+	var cols []int
+	if names == nil {
+		for i := range tbl.cols {
+			cols = append(cols, i)
+		}
+		return cols
+	}
+	seen := map[int]bool{}
+	for _, name := range names {
+		i := tbl.column(name)
+		if seen[i] {
+			fail("42701", "column %q specified more than once", name)
+		}
+		seen[i] = true
+		cols = append(cols, i)
+	}
+	return cols
+}
+
+func (st *statement) planInsert(c *compiler, s *insertStmt) {
+	db := st.sess.db
+	tbl := st.table(s.table)
+	cols := targets(tbl, s.cols)
+
+	// rows holds the compiled VALUES, nil for DEFAULT.
+	var rows [][]*cexpr
+	for _, vals := range s.values {
+		if len(vals) > len(cols) {
+			fail("42601", "INSERT has more expressions than target columns")
+		}
+		if len(vals) < len(cols) && vals != nil {
+			fail("42601", "INSERT has more target columns than expressions")
+		}
+		row := make([]*cexpr, len(cols))
+		for i, v := range vals {
+			if v != nil {
+				x := c.compile(v, tbl.cols[cols[i]].typ.oid)
+				row[i] = &x
+			}
+		}
+		rows = append(rows, row)
+	}
+	var query func(t *tx, e *env) [][]interface{}
+	var queryCols []Column
+	if s.query != nil {
+		sub := &compiler{params: c.params}
+		queryCols, query = st.planSelect(sub, s.query)
+		c.params = sub.params
+		if len(queryCols) > len(cols) {
+			fail("42601", "INSERT has more expressions than target columns")
+		}
+		if len(queryCols) < len(cols) {
+			fail("42601", "INSERT has more target columns than expressions")
+		}
+	}
+	c.scope = scope{tbl, tbl.name}
+	returning := c.items(s.returning)
+	st.cols = columns(returning)
+
+	st.exec = func(t *tx, e *env) *Result {
+		res := &Result{}
+		n := 0
+		add := func(vals []interface{}, given []bool) {
+			for i, col := range tbl.cols {
+				if !given[i] {
+					vals[i] = col.defaultValue(e)
+				}
+			}
+			db.insert(t, tbl, vals)
+			n++
+			if returning != nil {
+				e.row = vals
+				res.Rows = append(res.Rows, evalAll(returning, e))
+			}
+		}
+		if query != nil {
+			for _, r := range query(t, e) {
+				vals, given := make([]interface{}, len(tbl.cols)), make([]bool, len(tbl.cols))
+				for i, col := range cols {
+					vals[col] = tbl.cols[col].assign(r[i], queryCols[i].Type, e.loc)
+					given[col] = true
+				}
+				add(vals, given)
+			}
+		}
+		for _, row := range rows {
+			vals, given := make([]interface{}, len(tbl.cols)), make([]bool, len(tbl.cols))
+			for i, x := range row {
+				if x != nil {
+					col := cols[i]
+					vals[col] = tbl.cols[col].assign(x.eval(e), x.typ, e.loc)
+					given[col] = true
+				}
+			}
+			add(vals, given)
+		}
+		res.Tag = "INSERT 0 " + strconv.Itoa(n)
+		res.Serial = e.serial
+		return res
+	}
+}
+
+func (st *statement) planUpdate(c *compiler, s *updateStmt) {
+	db := st.sess.db
+	tbl := st.table(s.table.name)
+	c.scope = scope{tbl, tbl.name}
+	if s.table.alias != "" {
+		c.scope.alias = s.table.alias
+	}
+	type assignment struct {
+		col int
+		x   cexpr
+	}
+	var sets []assignment
+	seen := map[int]bool{}
+	for _, set := range s.set {
+		i := tbl.column(set.col)
+		if seen[i] {
+			fail("42601", "multiple assignments to same column %q", set.col)
+		}
+		seen[i] = true
+		sets = append(sets, assignment{i, c.compile(set.x, tbl.cols[i].typ.oid)})
+	}
+	where := c.where(s.where)
+	returning := c.items(s.returning)
+	st.cols = columns(returning)
+
+	st.exec = func(t *tx, e *env) *Result {
+		res := &Result{}
+		n := 0
+		for _, v := range scan(t, tbl, where, e) {
+			if v = db.lock(t, v, matcher(where, e)); v == nil {
+				continue
+			}
+			e.row = v.vals
+			vals := append([]interface{}(nil), v.vals...)
+			for _, set := range sets {
+				vals[set.col] = tbl.cols[set.col].assign(set.x.eval(e), set.x.typ, e.loc)
+			}
+			nv := db.update(t, v, vals)
+			n++
+			if returning != nil {
+				e.row = nv.vals
+				res.Rows = append(res.Rows, evalAll(returning, e))
+			}
+		}
+		res.Tag = "UPDATE " + strconv.Itoa(n)
+		return res
+	}
+}
+
+func (st *statement) planDelete(c *compiler, s *deleteStmt) {
+	db := st.sess.db
+	tbl := st.table(s.table.name)
+	c.scope = scope{tbl, tbl.name}
+	if s.table.alias != "" {
+		c.scope.alias = s.table.alias
+	}
+	where := c.where(s.where)
+	returning := c.items(s.returning)
+	st.cols = columns(returning)
+
+	st.exec = func(t *tx, e *env) *Result {
+		res := &Result{}
+		n := 0
+		for _, v := range scan(t, tbl, where, e) {
+			if v = db.lock(t, v, matcher(where, e)); v == nil {
+				continue
+			}
+			db.delete(t, v)
+			n++
+			if returning != nil {
+				e.row = v.vals
+				res.Rows = append(res.Rows, evalAll(returning, e))
+			}
+		}
+		res.Tag = "DELETE " + strconv.Itoa(n)
+		return res
+	}
+}
+
+// where compiles an optional WHERE clause.
+func (c *compiler) where(x expr) *cexpr {
+	if x == nil {
+		return nil
+	}
+	w := c.condition(x, "WHERE")
+	return &w
+}
+
+// matcher returns a function reporting whether where holds for a row.
+func matcher(where *cexpr, e *env) func(*version) bool {
+	return func(v *version) bool {
+		if where == nil {
+			return true
+		}
+		e.row = v.vals
+		return where.eval(e) == true
+	}
+}
+
+// scan returns the versions of tbl that t sees and where holds for.
+// Unlike a SELECT, an UPDATE or DELETE may wait for other transactions,
+// so the result is a copy that concurrent changes to tbl do not affect.
+func scan(t *tx, tbl *table, where *cexpr, e *env) []*version {
+	var vs []*version
+	match := matcher(where, e)
+	for _, v := range tbl.rows {
+		if v.visible(t) && match(v) {
+			vs = append(vs, v)
+		}
+	}
+	return vs
+}
+
+func (st *statement) planCopy(s *copyStmt) {
+	db, sess := st.sess.db, st.sess
+	tbl := st.table(s.table)
+	cols := targets(tbl, s.cols)
+	st.exec = func(*tx, *env) *Result {
+		return &Result{
+			CopyColumns: len(cols),
+			CopyIn: func(data []byte) (string, error) {
+				res, err := sess.run(func(t *tx, e *env) *Result {
+					if st.stale() {
+						fail("42P01", "relation %q does not exist", s.table.String())
+					}
+					n := 0
+					for _, line := range copyLines(data) {
+						fields := strings.Split(line, "\t")
+						if len(fields) < len(cols) {
+							fail("22P04", "missing data for column %q", tbl.cols[cols[len(fields)]].name)
+						}
+						if len(fields) > len(cols) {
+							fail("22P04", "extra data after last expected column")
+						}
+						vals, given := make([]interface{}, len(tbl.cols)), make([]bool, len(tbl.cols))
+						for i, f := range fields {
+							col := cols[i]
+							given[col] = true
+							if f == `\N` {
+								continue
+							}
+							s := unescapeCopy(f)
+							check(checkText([]byte(s)))
+							vals[col] = tbl.cols[col].assign(s, UnknownOid, e.loc)
+						}
+						for i, col := range tbl.cols {
+							if !given[i] {
+								vals[i] = col.defaultValue(e)
+							}
+						}
+						db.insert(t, tbl, vals)
+						n++
+					}
+					return &Result{Tag: "COPY " + strconv.Itoa(n)}
+				})
+				if err != nil {
+					return "", err
+				}
+				return res.Tag, nil
+			},
+		}
+	}
+}
+
+// copyLines splits COPY text data into lines, stopping at the \. end
+// marker.
+func copyLines(data []byte) []string {
+	lines := strings.Split(string(data), "\n")
+	var out []string
+	for i, l := range lines {
+		l = strings.TrimSuffix(l, "\r")
+		if l == `\.` || l == "" && i == len(lines)-1 {
+			break
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+// unescapeCopy decodes the backslash escapes of a COPY text field.
+func unescapeCopy(f string) string {
+	if !strings.Contains(f, `\`) {
+		return f
+	}
+	var b strings.Builder
+	for i := 0; i < len(f); i++ {
+		if f[i] != '\\' || i+1 == len(f) {
+			b.WriteByte(f[i])
+			continue
+		}
+		i++
+		switch c := f[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case 'x':
+			j := i + 1
+			for j < len(f) && j < i+3 && isHex(f[j]) {
+				j++
+			}
+			n, err := strconv.ParseUint(f[i+1:j], 16, 8)
+			if err != nil {
+				b.WriteByte('x')
+				break
+			}
+			b.WriteByte(byte(n))
+			i = j - 1
+		default:
+			if '0' <= c && c <= '7' {
+				j := i
+				for j < len(f) && j < i+3 && '0' <= f[j] && f[j] <= '7' {
+					j++
+				}
+				n, _ := strconv.ParseUint(f[i:j], 8, 16)
+				b.WriteByte(byte(n))
+				i = j - 1
+				break
+			}
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func (db *DB) dropSchemas(s *dropSchemaStmt) {
+	for _, name := range s.names {
+		sch := db.schemas[name]
+		if sch == nil {
+			if s.ifExists {
+				continue
+			}
+			fail("3F000", "schema %q does not exist", name)
+		}
+		if len(sch.tables) > 0 && !s.cascade {
+			fail("2BP01", "cannot drop schema %s because other objects depend on it", name)
+		}
+		dropping := map[*table]bool{}
+		for _, tbl := range sch.tables {
+			dropping[tbl] = true
+		}
+		db.dropReferences(dropping, true)
+		for tbl := range dropping {
+			tbl.drop()
+		}
+		delete(db.schemas, name)
+	}
+}
+
+func (db *DB) createTable(s *createTableStmt) {
+	sch := db.schema(s.name.schema)
+	if sch.tables[s.name.name] != nil || sch.indexes[s.name.name] != nil {
+		if s.ifNotExists {
+			return
+		}
+		fail("42P07", "relation %q already exists", s.name.name)
+	}
+	tbl := &table{schema: sch, name: s.name.name, nocase: db.CaseInsensitiveColumns}
+	for _, cd := range s.cols {
+		for _, col := range tbl.cols {
+			if tbl.named(col, cd.name) {
+				fail("42701", "column %q specified more than once", cd.name)
+			}
+		}
+		tbl.cols = append(tbl.cols, newColumn(cd, tbl.name))
+	}
+	if s.primaryKey != nil {
+		for _, name := range s.primaryKey {
+			tbl.cols[tbl.column(name)].notNull = true
+		}
+		tbl.addIndex("", s.primaryKey, true, true, "pkey")
+	}
+	for _, u := range s.unique {
+		tbl.addIndex("", u, true, false, "key")
+	}
+	for _, fd := range s.foreignKeys {
+		tbl.addForeignKey(db, fd)
+	}
+	sch.tables[tbl.name] = tbl
+}
+
+// addForeignKey adds the foreign key fd to tbl, naming it after the
+// table and columns.
+func (tbl *table) addForeignKey(db *DB, fd foreignKeyDef) {
+	ref := tbl
+	if orPublic(fd.ref.table.schema) != tbl.schema.name || fd.ref.table.name != tbl.name {
+		ref = db.table(fd.ref.table)
+	}
+	fk := &foreignKey{name: tbl.name + "_" + strings.Join(fd.cols, "_") + "_fkey", table: tbl}
+	for _, c := range fd.cols {
+		fk.cols = append(fk.cols, tbl.column(c))
+	}
+	var refCols []int
+	for _, c := range fd.ref.cols {
+		refCols = append(refCols, ref.column(c))
+	}
+	for _, ix := range ref.indexes {
+		if ix.primary && fd.ref.cols == nil || ix.unique && sameInts(ix.cols, refCols) {
+			fk.ref = ix
+			break
+		}
+	}
+	if fk.ref == nil {
+		fail("42830", "there is no unique constraint matching given keys for referenced table %q", ref.name)
+	}
+	if len(fk.ref.cols) != len(fk.cols) {
+		fail("42830", "number of referencing and referenced columns for foreign key disagree")
+	}
+	tbl.fkeys = append(tbl.fkeys, fk)
+}
+
+func sameInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// dropTables drops the tables called names, failing if a table not
+// dropped with them refers to one unless cascade is set, in which case
+// the foreign keys of such tables are dropped instead.
+func (db *DB) dropTables(names []qname, ifExists, cascade bool) {
+	dropping := map[*table]bool{}
+	for _, n := range names {
+		sch := db.schemas[orPublic(n.schema)]
+		if sch == nil || sch.tables[n.name] == nil {
+			if ifExists {
+				continue
+			}
+			fail("42P01", "table %q does not exist", n.String())
+		}
+		dropping[sch.tables[n.name]] = true
+	}
+	db.dropReferences(dropping, cascade)
+	for tbl := range dropping {
+		tbl.drop()
+	}
+}
+
+// dropReferences drops the foreign keys of tables other than those in
+// dropping that refer to them, failing instead unless cascade is set.
+func (db *DB) dropReferences(dropping map[*table]bool, cascade bool) {
+	for tbl := range dropping {
+		for _, fk := range db.referencing(tbl) {
+			if dropping[fk.table] {
+				continue
+			}
+			if !cascade {
+				fail("2BP01", "cannot drop table %s because other objects depend on it", tbl.name)
+			}
+			for i, o := range fk.table.fkeys {
+				if o == fk {
+					fk.table.fkeys = append(fk.table.fkeys[:i], fk.table.fkeys[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+}
+
+// newColumn returns the column cd defines in the table called tbl.
+func newColumn(cd colDef, tbl string) *column {
+	col := &column{name: cd.name, typ: cd.typ, notNull: cd.notNull || cd.typ.serial}
+	if cd.defaultExpr != nil {
+		if cd.typ.serial {
+			fail("42601", "multiple default values specified for column %q of table %q", cd.name, tbl)
+		}
+		c := &compiler{}
+		x := typed(c.compile(cd.defaultExpr, cd.typ.oid))
+		if len(c.params) > 0 {
+			fail("42P02", "there is no parameter $1")
+		}
+		col.def = &x
+	}
+	return col
+}
+
+func (db *DB) dropIndex(n qname, ifExists bool) {
+	sch := db.schemas[orPublic(n.schema)]
+	if sch == nil || sch.indexes[n.name] == nil {
+		if ifExists {
+			return
+		}
+		fail("42704", "index %q does not exist", n.String())
+	}
+	ix := sch.indexes[n.name]
+	if ix.constraint() != "" {
+		fail("2BP01", "cannot drop index %s because constraint %s on table %s requires it", ix.name, ix.name, ix.table.name)
+	}
+	delete(sch.indexes, n.name)
+	tbl := ix.table
+	for i, o := range tbl.indexes {
+		if o == ix {
+			tbl.indexes = append(tbl.indexes[:i], tbl.indexes[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,924 @@
+package fakepg
+
+import (
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// An env is what compiled expressions are evaluated against.
+type env struct {
+	row  []interface{} // current row of the table read, if any
+	args []interface{} // statement parameters
+	aggs []interface{} // aggregate results, once computed
+	loc  *time.Location
+	now  time.Time
+	sess *session
+
+	// serial is the first value a serial column generated, 0 if none.
+	serial int64
+
+	// terminate holds the clients pg_terminate_backend has killed,
+	// which are disconnected once the statement is done.
+	terminate []*Client
+}
+
+// A cexpr is a compiled expression.
+type cexpr struct {
+	typ  Oid
+	name string // column name when selected, as Postgres derives it
+	eval func(e *env) interface{}
+}
+
+// An aggregate is a call of an aggregate function in a select list.
+type aggregate struct {
+	fn       string
+	arg      *cexpr // nil for count(*)
+	distinct bool
+	typ      Oid
+}
+
+// A scope is the table whose columns expressions may refer to.
+type scope struct {
+	table *table // nil for none
+	alias string // name the table is referred to by
+}
+
+// A compiler compiles the expressions of one statement, inferring the
+// types of its parameters from their context.
+type compiler struct {
+	scope  scope
+	params []Oid // 0 where not yet known
+
+	aggs     []*aggregate
+	aggOK    string // context aggregates are allowed in, or "" if not
+	inAgg    bool   // compiling an aggregate's argument
+	bareCols bool   // a column was referenced outside an aggregate
+}
+
+// fail aborts compilation or evaluation with an error.
+func fail(code, format string, args ...interface{}) {
+	panic(errorf(code, format, args...))
+}
+
+// check aborts with err if it is not nil.
+func check(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// paramTypes returns the statement's parameter types, text for those
+// whose type could not be inferred.
+func (c *compiler) paramTypes() []Oid {
+	for i, t := range c.params {
+		if t == 0 || t == UnknownOid {
+			c.params[i] = TextOid
+		}
+	}
+	return c.params
+}
+
+// isUntyped reports whether x is a parameter or string constant, whose
+// type comes from its context.
+func isUntyped(x expr) bool {
+	switch x := x.(type) {
+	case *paramRef:
+		return true
+	case *literal:
+		return x.typ == UnknownOid
+	}
+	return false
+}
+
+// compile compiles x. hint is the type the context expects, if known;
+// it becomes the type of parameters without one.
+func (c *compiler) compile(x expr, hint Oid) cexpr {
+	switch x := x.(type) {
+	case *compiled:
+		return x.x
+	case *literal:
+		v := x.v
+		return cexpr{x.typ, "?column?", func(*env) interface{} { return v }}
+	case *paramRef:
+		for len(c.params) < x.n {
+			c.params = append(c.params, 0)
+		}
+		i := x.n - 1
+		if c.params[i] == 0 {
+			c.params[i] = hint
+			if hint == 0 || hint == UnknownOid {
+				c.params[i] = TextOid
+			}
+		}
+		return cexpr{c.params[i], "?column?", func(e *env) interface{} { return e.args[i] }}
+	case *colRef:
+		return c.column(x)
+	case *unaryExpr:
+		return c.unary(x, hint)
+	case *binaryExpr:
+		return c.binary(x)
+	case *isNullExpr:
+		arg := c.compile(x.x, 0)
+		not := x.not
+		return cexpr{BoolOid, "?column?", func(e *env) interface{} {
+			return (arg.eval(e) == nil) != not
+		}}
+	case *inExpr:
+		return c.in(x)
+	case *castExpr:
+		arg := c.compile(x.x, x.typ.oid)
+		name := internalNames[x.typ.oid]
+		if _, ok := x.x.(*colRef); ok {
+			name = arg.name
+		}
+		typ := x.typ
+		return cexpr{typ.oid, name, func(e *env) interface{} {
+			v, err := coerce(arg.eval(e), arg.typ, typ.oid, e.loc)
+			check(err)
+			return applyTypmod(v, typ, true)
+		}}
+	case *funcExpr:
+		if aggregates[x.name] {
+			return c.aggregate(x)
+		}
+		return c.function(x, hint)
+	}
+	panic("fakepg: unknown expression type")
+}
+
+// internalNames are the type names Postgres uses for cast columns.
+var internalNames = map[Oid]string{
+	BoolOid: "bool", ByteaOid: "bytea", Int2Oid: "int2", Int4Oid: "int4",
+	Int8Oid: "int8", TextOid: "text", Float4Oid: "float4", Float8Oid: "float8",
+	VarcharOid: "varchar", DateOid: "date", TimeOid: "time",
+	TimestampOid: "timestamp", TimestamptzOid: "timestamptz", NumericOid: "numeric",
+}
+
+func (c *compiler) column(x *colRef) cexpr {
+	t := c.scope.table
+	if x.table != "" && (t == nil || x.table != c.scope.alias) {
+		fail("42P01", "missing FROM-clause entry for table %q", x.table)
+	}
+	if t != nil {
+		for i, col := range t.cols {
+			if t.named(col, x.name) {
+				if !c.inAgg {
+					c.bareCols = true
+				}
+				name := col.name
+				if t.nocase {
+					// MySQL names the result column as the query does.
+					name = x.name
+				}
+				return cexpr{col.typ.oid, name, func(e *env) interface{} { return e.row[i] }}
+			}
+		}
+	}
+	if x.table != "" {
+		fail("42703", "column %s.%s does not exist", x.table, x.name)
+	}
+	fail("42703", "column %q does not exist", x.name)
+	panic("unreachable")
+}
+
+// implicit converts x to type to, if it is an untyped string constant,
+// or else checks that it already has a type comparable with to.
+func implicit(x cexpr, to Oid, op string) cexpr {
+	if x.typ == to || to == UnknownOid {
+		return x
+	}
+	if x.typ == UnknownOid {
+		eval := x.eval
+		x.typ = to
+		x.eval = func(e *env) interface{} {
+			v, err := coerce(eval(e), UnknownOid, to, e.loc)
+			check(err)
+			return v
+		}
+		return x
+	}
+	if x.typ.category() != to.category() {
+		fail("42883", "operator does not exist: %v %s %v", x.typ, op, to)
+	}
+	return x
+}
+
+// pair compiles the operands of a binary operator, giving each untyped
+// operand the type of the other.
+func (c *compiler) pair(l, r expr, op string) (cexpr, cexpr) {
+	var cl, cr cexpr
+	if isUntyped(l) && !isUntyped(r) {
+		cr = c.compile(r, 0)
+		cl = c.compile(l, cr.typ)
+	} else {
+		cl = c.compile(l, 0)
+		cr = c.compile(r, cl.typ)
+	}
+	switch {
+	case cl.typ == UnknownOid && cr.typ == UnknownOid:
+		cl, cr = implicit(cl, TextOid, op), implicit(cr, TextOid, op)
+	case cl.typ == UnknownOid:
+		cl = implicit(cl, cr.typ, op)
+	default:
+		cr = implicit(cr, cl.typ, op)
+	}
+	if cl.typ.category() != cr.typ.category() || cl.typ.category() == catTime && (cl.typ == TimeOid) != (cr.typ == TimeOid) {
+		fail("42883", "operator does not exist: %v %s %v", cl.typ, op, cr.typ)
+	}
+	return cl, cr
+}
+
+func (c *compiler) unary(x *unaryExpr, hint Oid) cexpr {
+	if x.op == "not" {
+		arg := implicit(c.compile(x.x, BoolOid), BoolOid, "NOT")
+		if arg.typ != BoolOid {
+			fail("42804", "argument of NOT must be type boolean, not type %v", arg.typ)
+		}
+		return cexpr{BoolOid, "?column?", func(e *env) interface{} {
+			if v := arg.eval(e); v != nil {
+				return !v.(bool)
+			}
+			return nil
+		}}
+	}
+	arg := c.compile(x.x, hint)
+	if arg.typ == UnknownOid {
+		arg = implicit(arg, NumericOid, x.op)
+	}
+	if arg.typ.category() != catNumber {
+		fail("42883", "operator does not exist: %s %v", x.op, arg.typ)
+	}
+	if x.op == "+" {
+		return arg
+	}
+	typ := arg.typ
+	return cexpr{typ, "?column?", func(e *env) interface{} {
+		return arith("-", int64(0), arg.eval(e), typ)
+	}}
+}
+
+func (c *compiler) binary(x *binaryExpr) cexpr {
+	switch x.op {
+	case "and", "or":
+		l := implicit(c.compile(x.l, BoolOid), BoolOid, x.op)
+		r := implicit(c.compile(x.r, BoolOid), BoolOid, x.op)
+		if l.typ != BoolOid || r.typ != BoolOid {
+			fail("42804", "argument of %s must be type boolean", strings.ToUpper(x.op))
+		}
+		and := x.op == "and"
+		return cexpr{BoolOid, "?column?", func(e *env) interface{} {
+			a, b := l.eval(e), r.eval(e)
+			// With AND, false wins over NULL; with OR, true does.
+			if a == !and || b == !and {
+				return !and
+			}
+			if a == nil || b == nil {
+				return nil
+			}
+			return and
+		}}
+	case "||":
+		l := c.compile(x.l, TextOid)
+		r := c.compile(x.r, TextOid)
+		if l.typ == ByteaOid && r.typ == ByteaOid {
+			return cexpr{ByteaOid, "?column?", func(e *env) interface{} {
+				a, b := l.eval(e), r.eval(e)
+				if a == nil || b == nil {
+					return nil
+				}
+				return append(append([]byte{}, a.([]byte)...), b.([]byte)...)
+			}}
+		}
+		return cexpr{TextOid, "?column?", func(e *env) interface{} {
+			a, b := l.eval(e), r.eval(e)
+			if a == nil || b == nil {
+				return nil
+			}
+			return toText(a, l.typ, e.loc) + toText(b, r.typ, e.loc)
+		}}
+	case "like", "ilike":
+		l := implicit(c.compile(x.l, TextOid), TextOid, "~~")
+		r := implicit(c.compile(x.r, TextOid), TextOid, "~~")
+		if l.typ.category() != catString || r.typ.category() != catString {
+			fail("42883", "operator does not exist: %v ~~ %v", l.typ, r.typ)
+		}
+		fold := x.op == "ilike"
+		var (
+			lastPat string
+			lastRx  *regexp.Regexp
+		)
+		return cexpr{BoolOid, "?column?", func(e *env) interface{} {
+			s, pat := l.eval(e), r.eval(e)
+			if s == nil || pat == nil {
+				return nil
+			}
+			if lastRx == nil || pat.(string) != lastPat {
+				lastPat, lastRx = pat.(string), likeRegexp(pat.(string), fold)
+			}
+			return lastRx.MatchString(s.(string))
+		}}
+	case "=", "<>", "<", "<=", ">", ">=":
+		l, r := c.pair(x.l, x.r, x.op)
+		op := x.op
+		return cexpr{BoolOid, "?column?", func(e *env) interface{} {
+			a, b := l.eval(e), r.eval(e)
+			if a == nil || b == nil {
+				return nil
+			}
+			n, err := compare(a, b)
+			check(err)
+			switch op {
+			case "=":
+				return n == 0
+			case "<>":
+				return n != 0
+			case "<":
+				return n < 0
+			case "<=":
+				return n <= 0
+			case ">":
+				return n > 0
+			}
+			return n >= 0
+		}}
+	}
+	// Arithmetic.
+	l, r := c.pair(x.l, x.r, x.op)
+	if l.typ.category() != catNumber {
+		fail("42883", "operator does not exist: %v %s %v", l.typ, x.op, r.typ)
+	}
+	typ := l.typ
+	if numericRank(r.typ) > numericRank(typ) {
+		typ = r.typ
+	}
+	if typ == Float4Oid && l.typ != r.typ {
+		typ = Float8Oid
+	}
+	op := x.op
+	return cexpr{typ, "?column?", func(e *env) interface{} {
+		return arith(op, l.eval(e), r.eval(e), typ)
+	}}
+}
+
+// likeRegexp translates a LIKE pattern, with backslash as the escape
+// character, to a regular expression.
+func likeRegexp(pat string, fold bool) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	if fold {
+		b.WriteString("(?i)")
+	}
+	b.WriteString("(?s)")
+	for i := 0; i < len(pat); {
+		r, n := utf8.DecodeRuneInString(pat[i:])
+		i += n
+		switch r {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteString(".")
+		case '\\':
+			if i < len(pat) {
+				r, n = utf8.DecodeRuneInString(pat[i:])
+				i += n
+			}
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// toText returns the text form of v, of type t.
+func toText(v interface{}, t Oid, loc *time.Location) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := formatText(t, v, loc)
+	check(err)
+	return string(b)
+}
+
+// arith applies an arithmetic operator to a and b, converting both to
+// typ first. The conversion goes by the Go type of the values, so their
+// Oids need not be passed.
+func arith(op string, a, b interface{}, typ Oid) interface{} {
+	if a == nil || b == nil {
+		return nil
+	}
+	a, err := coerce(a, 0, typ, nil)
+	check(err)
+	b, err = coerce(b, 0, typ, nil)
+	check(err)
+	switch a := a.(type) {
+	case int64:
+		b := b.(int64)
+		var n int64
+		overflow := false
+		switch op {
+		case "+":
+			n = a + b
+			overflow = (n > a) != (b > 0)
+		case "-":
+			n = a - b
+			overflow = (n < a) != (b > 0)
+		case "*":
+			n = a * b
+			overflow = a != 0 && (n/a != b || a == -1 && b == math.MinInt64)
+		case "/", "%":
+			if b == 0 {
+				fail("22012", "division by zero")
+			}
+			if b == -1 {
+				// Avoid the overflow of MinInt64 / -1.
+				if op == "%" {
+					return int64(0)
+				}
+				n, overflow = -a, a == math.MinInt64
+			} else if op == "/" {
+				n = a / b
+			} else {
+				n = a % b
+			}
+		}
+		if overflow {
+			fail("22003", "%s out of range", typ)
+		}
+		v, err := checkIntRange(typ, n)
+		check(err)
+		return v
+	case float64:
+		b := b.(float64)
+		var f float64
+		switch op {
+		case "+":
+			f = a + b
+		case "-":
+			f = a - b
+		case "*":
+			f = a * b
+		case "/":
+			if b == 0 {
+				fail("22012", "division by zero")
+			}
+			f = a / b
+		case "%":
+			fail("42883", "operator does not exist: %v %% %v", typ, typ)
+		}
+		if math.IsInf(f, 0) && !math.IsInf(a, 0) && !math.IsInf(b, 0) {
+			fail("22003", "value out of range: overflow")
+		}
+		if typ == Float4Oid {
+			f = float64(float32(f))
+		}
+		return f
+	case numeric:
+		b := b.(numeric)
+		r := new(big.Rat)
+		scale := a.scale
+		if b.scale > scale {
+			scale = b.scale
+		}
+		switch op {
+		case "+":
+			r.Add(a.r, b.r)
+		case "-":
+			r.Sub(a.r, b.r)
+		case "*":
+			r.Mul(a.r, b.r)
+			scale = a.scale + b.scale
+		case "/", "%":
+			if b.r.Sign() == 0 {
+				fail("22012", "division by zero")
+			}
+			r.Quo(a.r, b.r)
+			if op == "%" {
+				q := new(big.Int).Quo(r.Num(), r.Denom())
+				r.Sub(a.r, new(big.Rat).Mul(new(big.Rat).SetInt(q), b.r))
+			} else if scale < 16 {
+				scale = 16
+			}
+		}
+		return numeric{r, scale}.round(scale)
+	}
+	panic("fakepg: arithmetic on " + typ.String())
+}
+
+func (c *compiler) in(x *inExpr) cexpr {
+	arg := c.compile(x.x, 0)
+	var list []cexpr
+	for _, item := range x.list {
+		l, r := c.pair(&compiled{arg}, item, "=")
+		arg = l
+		list = append(list, r)
+	}
+	not := x.not
+	return cexpr{BoolOid, "?column?", func(e *env) interface{} {
+		v := arg.eval(e)
+		if v == nil {
+			return nil
+		}
+		var result interface{} = false
+		for _, item := range list {
+			w := item.eval(e)
+			if w == nil {
+				result = nil
+				continue
+			}
+			n, err := compare(v, w)
+			check(err)
+			if n == 0 {
+				return !not
+			}
+		}
+		if result == nil {
+			return nil
+		}
+		return not
+	}}
+}
+
+// compiled wraps an already compiled expression so that it can be
+// compiled again, as the left operand of IN is for each list item.
+type compiled struct {
+	x cexpr
+}
+
+// aggregates are the supported aggregate functions.
+var aggregates = map[string]bool{"count": true, "sum": true, "min": true, "max": true, "avg": true}
+
+func (c *compiler) aggregate(x *funcExpr) cexpr {
+	if c.aggOK == "" {
+		fail("42803", "aggregate functions are not allowed here")
+	}
+	if c.inAgg {
+		fail("42803", "aggregate function calls cannot be nested")
+	}
+	a := &aggregate{fn: x.name, distinct: x.distinct}
+	switch {
+	case x.star && x.name == "count":
+		a.typ = Int8Oid
+	case len(x.args) != 1:
+		fail("42883", "function %s does not exist", x.name)
+	default:
+		c.inAgg = true
+		arg := c.compile(x.args[0], 0)
+		c.inAgg = false
+		if arg.typ == UnknownOid {
+			arg = implicit(arg, TextOid, "")
+		}
+		a.arg = &arg
+		a.typ = aggregateType(x.name, arg.typ)
+	}
+	i := len(c.aggs)
+	c.aggs = append(c.aggs, a)
+	return cexpr{a.typ, x.name, func(e *env) interface{} { return e.aggs[i] }}
+}
+
+func aggregateType(fn string, arg Oid) Oid {
+	switch fn {
+	case "count":
+		return Int8Oid
+	case "min", "max":
+		if arg.category() == catOther {
+			break
+		}
+		return arg
+	case "sum":
+		switch arg {
+		case Int2Oid, Int4Oid:
+			return Int8Oid
+		case Int8Oid, NumericOid:
+			return NumericOid
+		case Float4Oid, Float8Oid:
+			return arg
+		}
+	case "avg":
+		switch arg {
+		case Int2Oid, Int4Oid, Int8Oid, NumericOid:
+			return NumericOid
+		case Float4Oid, Float8Oid:
+			return Float8Oid
+		}
+	}
+	fail("42883", "function %s(%v) does not exist", fn, arg)
+	panic("unreachable")
+}
+
+// An aggState accumulates the input of an aggregate.
+type aggState struct {
+	a     *aggregate
+	count int64
+	v     interface{}
+	seen  map[string]bool // for DISTINCT
+}
+
+func (s *aggState) add(e *env) {
+	if s.a.arg == nil {
+		s.count++
+		return
+	}
+	v := s.a.arg.eval(e)
+	if v == nil {
+		return
+	}
+	if s.a.distinct {
+		k := valueKey(v)
+		if s.seen[k] {
+			return
+		}
+		if s.seen == nil {
+			s.seen = map[string]bool{}
+		}
+		s.seen[k] = true
+	}
+	s.count++
+	switch s.a.fn {
+	case "min", "max":
+		if s.v == nil {
+			s.v = v
+			return
+		}
+		n, err := compare(v, s.v)
+		check(err)
+		if n < 0 && s.a.fn == "min" || n > 0 && s.a.fn == "max" {
+			s.v = v
+		}
+	case "sum", "avg":
+		typ := s.a.typ
+		if s.a.fn == "avg" && typ == NumericOid {
+			v, _ = coerce(v, s.a.arg.typ, NumericOid, nil)
+		}
+		if s.v == nil {
+			s.v, _ = coerce(v, s.a.arg.typ, typ, nil)
+			return
+		}
+		s.v = arith("+", s.v, v, typ)
+	}
+}
+
+func (s *aggState) result() interface{} {
+	switch s.a.fn {
+	case "count":
+		return s.count
+	case "avg":
+		if s.v == nil {
+			return nil
+		}
+		if n, ok := s.v.(numeric); ok {
+			q := numeric{new(big.Rat).Quo(n.r, new(big.Rat).SetInt64(s.count)), 16}
+			if n.scale > 16 {
+				q.scale = n.scale
+			}
+			return q.round(q.scale)
+		}
+		return s.v.(float64) / float64(s.count)
+	}
+	return s.v
+}
+
+// functions maps the supported scalar functions to their compilers.
+var functions map[string]func(c *compiler, x *funcExpr, hint Oid) cexpr
+
+func init() {
+	functions = map[string]func(c *compiler, x *funcExpr, hint Oid) cexpr{
+		"coalesce":             (*compiler).coalesce,
+		"nullif":               (*compiler).nullif,
+		"length":               (*compiler).length,
+		"char_length":          (*compiler).length,
+		"character_length":     (*compiler).length,
+		"octet_length":         (*compiler).length,
+		"lower":                (*compiler).caseFunc,
+		"upper":                (*compiler).caseFunc,
+		"abs":                  (*compiler).abs,
+		"now":                  (*compiler).now,
+		"current_timestamp":    (*compiler).now,
+		"localtimestamp":       (*compiler).now,
+		"current_date":         (*compiler).now,
+		"pg_backend_pid":       (*compiler).backendPID,
+		"pg_terminate_backend": (*compiler).terminateBackend,
+	}
+}
+
+func (c *compiler) function(x *funcExpr, hint Oid) cexpr {
+	f, ok := functions[x.name]
+	if !ok || x.star || x.distinct {
+		fail("42883", "function %s does not exist", x.name)
+	}
+	return f(c, x, hint)
+}
+
+func (c *compiler) args(x *funcExpr, n int) []cexpr {
+	if len(x.args) != n {
+		fail("42883", "function %s with %d arguments does not exist", x.name, len(x.args))
+	}
+	var args []cexpr
+	for _, a := range x.args {
+		args = append(args, c.compile(a, 0))
+	}
+	return args
+}
+
+func (c *compiler) coalesce(x *funcExpr, hint Oid) cexpr {
+	if len(x.args) == 0 {
+		fail("42601", "syntax error at or near \")\"")
+	}
+	// The result has the type of the first typed argument.
+	typ := Oid(0)
+	for _, a := range x.args {
+		if !isUntyped(a) {
+			typ = c.compile(a, 0).typ
+			break
+		}
+	}
+	if typ == 0 {
+		typ = hint
+	}
+	var args []cexpr
+	for _, a := range x.args {
+		arg := c.compile(a, typ)
+		if typ == 0 || typ == UnknownOid {
+			typ = arg.typ
+		}
+		args = append(args, implicit(arg, typ, "COALESCE"))
+	}
+	if typ == UnknownOid {
+		typ = TextOid
+		for i := range args {
+			args[i] = implicit(args[i], TextOid, "COALESCE")
+		}
+	}
+	return cexpr{typ, x.name, func(e *env) interface{} {
+		for _, a := range args {
+			if v := a.eval(e); v != nil {
+				return v
+			}
+		}
+		return nil
+	}}
+}
+
+func (c *compiler) nullif(x *funcExpr, hint Oid) cexpr {
+	if len(x.args) != 2 {
+		fail("42883", "function nullif with %d arguments does not exist", len(x.args))
+	}
+	l, r := c.pair(x.args[0], x.args[1], "=")
+	return cexpr{l.typ, x.name, func(e *env) interface{} {
+		a, b := l.eval(e), r.eval(e)
+		if a != nil && b != nil {
+			if n, err := compare(a, b); err == nil && n == 0 {
+				return nil
+			}
+		}
+		return a
+	}}
+}
+
+func (c *compiler) length(x *funcExpr, hint Oid) cexpr {
+	arg := c.args(x, 1)[0]
+	if arg.typ == UnknownOid {
+		arg = implicit(arg, TextOid, "")
+	}
+	if arg.typ.category() != catString && arg.typ != ByteaOid {
+		fail("42883", "function %s(%v) does not exist", x.name, arg.typ)
+	}
+	octets := x.name == "octet_length"
+	return cexpr{Int4Oid, x.name, func(e *env) interface{} {
+		switch v := arg.eval(e).(type) {
+		case string:
+			if octets {
+				return int64(len(v))
+			}
+			return int64(utf8.RuneCountInString(v))
+		case []byte:
+			return int64(len(v))
+		}
+		return nil
+	}}
+}
+
+func (c *compiler) caseFunc(x *funcExpr, hint Oid) cexpr {
+	arg := implicit(c.args(x, 1)[0], TextOid, "")
+	if arg.typ.category() != catString {
+		fail("42883", "function %s(%v) does not exist", x.name, arg.typ)
+	}
+	upper := x.name == "upper"
+	return cexpr{TextOid, x.name, func(e *env) interface{} {
+		v, ok := arg.eval(e).(string)
+		switch {
+		case !ok:
+			return nil
+		case upper:
+			return strings.ToUpper(v)
+		}
+		return strings.ToLower(v)
+	}}
+}
+
+func (c *compiler) abs(x *funcExpr, hint Oid) cexpr {
+	arg := c.args(x, 1)[0]
+	if arg.typ == UnknownOid {
+		arg = implicit(arg, Float8Oid, "")
+	}
+	if arg.typ.category() != catNumber {
+		fail("42883", "function abs(%v) does not exist", arg.typ)
+	}
+	typ := arg.typ
+	return cexpr{typ, x.name, func(e *env) interface{} {
+		v := arg.eval(e)
+		if v == nil {
+			return nil
+		}
+		if n, err := compare(v, int64(0)); err == nil && n < 0 {
+			return arith("-", int64(0), v, typ)
+		}
+		return v
+	}}
+}
+
+func (c *compiler) now(x *funcExpr, hint Oid) cexpr {
+	c.args(x, 0)
+	name := x.name
+	switch name {
+	case "localtimestamp":
+		return cexpr{TimestampOid, name, func(e *env) interface{} { return wallUTC(e.now.In(e.loc)) }}
+	case "current_date":
+		return cexpr{DateOid, name, func(e *env) interface{} {
+			y, m, d := e.now.In(e.loc).Date()
+			return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		}}
+	}
+	return cexpr{TimestamptzOid, name, func(e *env) interface{} { return e.now }}
+}
+
+func (c *compiler) backendPID(x *funcExpr, hint Oid) cexpr {
+	c.args(x, 0)
+	return cexpr{Int4Oid, x.name, func(e *env) interface{} { return int64(e.sess.client.PID) }}
+}
+
+// terminateBackend compiles pg_terminate_backend(pid), which reports
+// whether a session has the process ID pid, and if so disconnects it.
+func (c *compiler) terminateBackend(x *funcExpr, hint Oid) cexpr {
+	if len(x.args) != 1 {
+		fail("42883", "function %s with %d arguments does not exist", x.name, len(x.args))
+	}
+	arg := implicit(c.compile(x.args[0], Int4Oid), Int4Oid, "")
+	if arg.typ.category() != catNumber {
+		fail("42883", "function %s(%v) does not exist", x.name, arg.typ)
+	}
+	return cexpr{BoolOid, x.name, func(e *env) interface{} {
+		pid, ok := arg.eval(e).(int64)
+		if !ok {
+			return nil
+		}
+		for s := range e.sess.db.sessions {
+			if int64(s.client.PID) == pid {
+				e.terminate = append(e.terminate, s.client)
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+// applyTypmod fits v to the length, precision or scale of typ. An
+// explicit cast truncates strings that are too long, while assignment
+// fails.
+func applyTypmod(v interface{}, typ typeName, explicit bool) interface{} {
+	if v == nil || typ.length < 0 {
+		return v
+	}
+	switch v := v.(type) {
+	case string:
+		if utf8.RuneCountInString(v) <= typ.length {
+			return v
+		}
+		if explicit {
+			return string([]rune(v)[:typ.length])
+		}
+		if trimmed := strings.TrimRight(v, " "); utf8.RuneCountInString(trimmed) <= typ.length {
+			return trimmed
+		}
+		fail("22001", "value too long for type character varying(%d)", typ.length)
+	case numeric:
+		n := v.round(typ.scale)
+		limit := new(big.Rat).SetFrac(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(typ.length-typ.scale)), nil), big.NewInt(1))
+		if new(big.Rat).Abs(n.r).Cmp(limit) >= 0 {
+			e := errorf("22003", "numeric field overflow")
+			e.Detail = "A field with precision " + strconv.Itoa(typ.length) + ", scale " + strconv.Itoa(typ.scale) +
+				" must round to an absolute value less than 10^" + strconv.Itoa(typ.length-typ.scale) + "."
+			panic(e)
+		}
+		return n
+	case time.Time:
+		return v.Round(time.Duration(math.Pow10(9 - typ.length)))
+	}
+	return v
+}
@@ -0,0 +1,223 @@
+// Package fakepg is an in-process PostgreSQL server speaking the v3
+// frontend/backend protocol, for testing Postgres drivers where no
+// database is installed.
+//
+// A Server authenticates clients (trust, cleartext or MD5 password) and
+// hands their statements to a Handler: either a Script of canned
+// responses or a DB, a tiny in-memory table engine that understands
+// enough SQL for the sqltest scenarios. The simple and extended query
+// protocols are supported, as are COPY FROM STDIN and LISTEN/NOTIFY.
+//
+// Values passed to and returned by handlers are nil or one of bool,
+// int64, float64, string, []byte and time.Time. Columns of type numeric
+// may also be given as strings.
+package fakepg
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// An Oid identifies a Postgres data type.
+type Oid uint32
+
+const (
+	BoolOid        Oid = 16
+	ByteaOid       Oid = 17
+	Int8Oid        Oid = 20
+	Int2Oid        Oid = 21
+	Int4Oid        Oid = 23
+	TextOid        Oid = 25
+	Float4Oid      Oid = 700
+	Float8Oid      Oid = 701
+	UnknownOid     Oid = 705
+	VarcharOid     Oid = 1043
+	DateOid        Oid = 1082
+	TimeOid        Oid = 1083
+	TimestampOid   Oid = 1114
+	TimestamptzOid Oid = 1184
+	NumericOid     Oid = 1700
+)
+
+var typeNames = map[Oid]string{
+	BoolOid:        "boolean",
+	ByteaOid:       "bytea",
+	Int8Oid:        "bigint",
+	Int2Oid:        "smallint",
+	Int4Oid:        "integer",
+	TextOid:        "text",
+	Float4Oid:      "real",
+	Float8Oid:      "double precision",
+	UnknownOid:     "unknown",
+	VarcharOid:     "character varying",
+	DateOid:        "date",
+	TimeOid:        "time without time zone",
+	TimestampOid:   "timestamp without time zone",
+	TimestamptzOid: "timestamp with time zone",
+	NumericOid:     "numeric",
+}
+
+// String returns the SQL name of the type.
+func (t Oid) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return "oid " + strconv.FormatUint(uint64(t), 10)
+}
+
+// size returns the type's length as reported in RowDescription, -1 for
+// variable-length types.
+func (t Oid) size() int16 {
+	switch t {
+	case BoolOid:
+		return 1
+	case Int2Oid:
+		return 2
+	case Int4Oid, Float4Oid, DateOid:
+		return 4
+	case Int8Oid, Float8Oid, TimeOid, TimestampOid, TimestamptzOid:
+		return 8
+	}
+	return -1
+}
+
+// A Handler serves the clients of a Server.
+type Handler interface {
+	// NewSession is called for each client once it has authenticated.
+	NewSession(c *Client) Session
+}
+
+// A Session runs the statements of one client connection.
+type Session interface {
+	// Prepare parses a single SQL statement. paramTypes holds the
+	// parameter types the client specified, 0 where it left them
+	// unspecified.
+	Prepare(query string, paramTypes []Oid) (Statement, error)
+
+	// TxStatus reports the transaction status sent in ReadyForQuery:
+	// 'I' when idle, 'T' in a transaction block and 'E' in a failed one.
+	TxStatus() byte
+
+	// Close is called when the client disconnects.
+	Close()
+}
+
+// A Statement is a parsed statement, ready to run.
+type Statement interface {
+	// ParamTypes returns the type of each parameter, $1 first.
+	ParamTypes() []Oid
+
+	// Columns describes the rows Exec returns. It is nil for statements
+	// that return no rows.
+	Columns() []Column
+
+	// Exec runs the statement. args holds a value for each parameter,
+	// already converted to the Go type for its Oid.
+	Exec(args []interface{}) (*Result, error)
+
+	// Close is called when the client closes the statement.
+	Close()
+}
+
+// A Column describes a column of a result set.
+type Column struct {
+	Name string
+	Type Oid
+}
+
+// A Result is the outcome of running a statement.
+type Result struct {
+	Rows [][]interface{}
+	Tag  string // command tag, e.g. "SELECT 2" or "INSERT 0 1"
+
+	// Serial is the first value a serial column generated for an
+	// INSERT, or 0 if it generated none. It is not sent to the client.
+	Serial int64
+
+	// Params lists run-time parameters the statement changed, which
+	// are reported to the client in ParameterStatus messages.
+	Params map[string]string
+
+	// CopyIn, if not nil, switches the client to COPY FROM STDIN for
+	// CopyColumns text columns. The data the client sends is passed to
+	// CopyIn once it is done, and the tag CopyIn returns replaces Tag.
+	CopyIn      func(data []byte) (tag string, err error)
+	CopyColumns int
+}
+
+// An Error is sent to the client as an ErrorResponse. Errors of other
+// types are sent with SQLSTATE XX000, internal_error.
+type Error struct {
+	Severity   string // ERROR if empty
+	Code       string // SQLSTATE
+	Message    string
+	Detail     string
+	Schema     string
+	Table      string
+	Column     string
+	Constraint string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s (SQLSTATE %s)", e.severity(), e.Message, e.Code)
+}
+
+func (e *Error) severity() string {
+	if e.Severity == "" {
+		return "ERROR"
+	}
+	return e.Severity
+}
+
+func errorf(code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// A Client is an authenticated connection to a Server.
+type Client struct {
+	User     string
+	Database string
+	Params   map[string]string // all startup parameters
+	PID      int32             // backend process ID reported to the client
+
+	c *conn
+}
+
+// Notify sends the client a NotificationResponse, as if the backend
+// with process ID pid had run NOTIFY channel, payload.
+func (c *Client) Notify(pid int32, channel, payload string) error {
+	m := newMsg('A')
+	m.int32(pid)
+	m.cstring(channel)
+	m.cstring(payload)
+	return c.c.sendNow(m)
+}
+
+// Terminate closes the client's connection with a FATAL error, as
+// pg_terminate_backend does.
+func (c *Client) Terminate() error {
+	c.c.sendNow(errorMsg(&Error{
+		Severity: "FATAL",
+		Code:     "57P01",
+		Message:  "terminating connection due to administrator command",
+	}))
+	return c.c.nc.Close()
+}
+
+// PreparedStatements returns the names of the client's named prepared
+// statements in order, or none for a Client not connected to a Server. A
+// Session may call it only while running one of the client's statements.
+func (c *Client) PreparedStatements() []string {
+	if c.c == nil {
+		return nil
+	}
+	var names []string
+	for name := range c.c.stmts {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
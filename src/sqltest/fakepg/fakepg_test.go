@@ -0,0 +1,517 @@
+package fakepg
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/lib/pq"
+)
+
+// start starts a server for h, closed when t finishes.
+func start(t *testing.T, h Handler, auth AuthMethod) *Server {
+	srv := &Server{Handler: h, Auth: auth, Password: "secret"}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// openPQ opens a pq handle on srv, closed when t finishes.
+func openPQ(t *testing.T, srv *Server, password string) *sql.DB {
+	host, port, _ := net.SplitHostPort(srv.Addr())
+	db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%s user=alice password=%s dbname=test sslmode=disable", host, port, password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// dialPGX connects to srv with pgx.
+func dialPGX(srv *Server, password string) (*pgx.Conn, error) {
+	host, port, _ := net.SplitHostPort(srv.Addr())
+	n, _ := strconv.Atoi(port)
+	return pgx.Connect(pgx.ConnConfig{Host: host, Port: uint16(n), User: "alice", Password: password, Database: "test"})
+}
+
+// connectPGX connects to srv with pgx, closing the connection when t
+// finishes.
+func connectPGX(t *testing.T, srv *Server) *pgx.Conn {
+	c, err := dialPGX(srv, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func isCode(err error, code string) bool {
+	e, ok := err.(*pq.Error)
+	return ok && string(e.Code) == code
+}
+
+func TestAuth(t *testing.T) {
+	for _, auth := range []AuthMethod{AuthTrust, AuthCleartext, AuthMD5} {
+		srv := start(t, NewDB(), auth)
+		// pq reports failures to connect as driver.ErrBadConn, so the
+		// error is checked with pgx.
+		if err := openPQ(t, srv, "secret").Ping(); err != nil {
+			t.Errorf("auth %d: connecting with the right password: %v", auth, err)
+		}
+		c, err := dialPGX(srv, "wrong")
+		if err == nil {
+			c.Close()
+		}
+		switch e, _ := err.(pgx.PgError); {
+		case auth == AuthTrust && err != nil:
+			t.Errorf("auth %d: connecting with no password required: %v", auth, err)
+		case auth != AuthTrust && e.Code != "28P01":
+			t.Errorf("auth %d: connecting with the wrong password: %v; want error 28P01", auth, err)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	s := NewScript()
+	s.On("SELECT name, age FROM people WHERE age > $1", &Response{
+		Params:  []Oid{Int4Oid},
+		Columns: []Column{{"name", TextOid}, {"age", Int4Oid}},
+		Rows:    [][]interface{}{{"bob", int64(42)}},
+	})
+	s.On("DELETE FROM people", &Response{Err: &Error{Code: "42501", Message: "permission denied"}})
+	c := connectPGX(t, start(t, s, AuthMD5))
+
+	// pgx interpolates arguments of unprepared queries itself.
+	if _, err := c.Prepare("older", "SELECT name, age FROM people WHERE age > $1"); err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	var age int32
+	if err := c.QueryRow("older", 30).Scan(&name, &age); err != nil {
+		t.Fatal(err)
+	}
+	if name != "bob" || age != 42 {
+		t.Errorf("got %q, %d; want bob, 42", name, age)
+	}
+
+	if _, err := c.Exec("begin"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.Exec("DELETE FROM people")
+	if e, ok := err.(pgx.PgError); !ok || e.Code != "42501" {
+		t.Errorf("scripted error: got %v; want 42501", err)
+	}
+	if tag, err := c.Exec("commit"); err != nil || tag != "ROLLBACK" {
+		t.Errorf("COMMIT of a failed block = %q, %v; want ROLLBACK", tag, err)
+	}
+	if _, err := c.Exec("SELECT 1"); err == nil {
+		t.Error("query with no scripted response succeeded")
+	}
+	if got := len(s.Queries()); got != 5 {
+		t.Errorf("recorded %d queries; want 5: %q", got, s.Queries())
+	}
+}
+
+func TestDB(t *testing.T) {
+	db := openPQ(t, start(t, NewDB(), AuthMD5), "secret")
+	for _, q := range []string{
+		"CREATE TABLE t (id serial PRIMARY KEY, name varchar(10) NOT NULL UNIQUE, score numeric(5, 2), at timestamptz DEFAULT now())",
+		"INSERT INTO t (name, score) VALUES ('a', 1.5), ('b', NULL), ('c', 2.25)",
+		"UPDATE t SET score = score * 2 WHERE name <> 'a'",
+		"DELETE FROM t WHERE name = 'a'",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	rows, err := db.Query("SELECT id, name, coalesce(score, -1) FROM t WHERE id > $1 ORDER BY 3 DESC", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for rows.Next() {
+		var id int
+		var name, score string
+		if err := rows.Scan(&id, &name, &score); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%d %s %s", id, name, score))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[3 c 4.50 2 b -1]" {
+		t.Errorf("got rows %q; want [3 c 4.50 2 b -1]", got)
+	}
+
+	_, err = db.Exec("INSERT INTO t (name) VALUES ($1)", "c")
+	if e, _ := err.(*pq.Error); !isCode(err, "23505") || e.Constraint != "t_name_key" || e.Table != "t" || e.Detail != "Key (name)=(c) already exists." {
+		t.Errorf("unique violation: got %#v", err)
+	}
+	_, err = db.Exec("INSERT INTO t (name) VALUES ($1)", "much too long")
+	if !isCode(err, "22001") {
+		t.Errorf("overlong varchar: got %v; want 22001", err)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	db := openPQ(t, start(t, NewDB(), AuthMD5), "secret")
+	if _, err := db.Exec("CREATE TABLE t (k int PRIMARY KEY, v int)"); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("INSERT INTO t VALUES (1, 1)"); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM t").Scan(&n); err != nil || n != 0 {
+		t.Errorf("uncommitted row seen outside the transaction: count %d, %v", n, err)
+	}
+
+	// A second insert of the same key waits for the first to end.
+	done := make(chan error)
+	go func() {
+		_, err := db.Exec("INSERT INTO t VALUES (1, 2)")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("conflicting insert did not wait: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := tx.Exec("INSERT INTO nope VALUES (1)"); err == nil {
+		t.Fatal("insert into a missing table succeeded")
+	}
+	if _, err := tx.Exec("SELECT 1"); !isCode(err, "25P02") {
+		t.Errorf("statement in failed transaction: got %v; want 25P02", err)
+	}
+	// The failed transaction was rolled back, letting the other insert in.
+	if err := <-done; err != nil {
+		t.Errorf("conflicting insert after rollback: %v", err)
+	}
+	tx.Rollback()
+	if err := db.QueryRow("SELECT v FROM t WHERE k = 1").Scan(&n); err != nil || n != 2 {
+		t.Errorf("got v = %d, %v; want 2", n, err)
+	}
+}
+
+func TestForeignKeys(t *testing.T) {
+	db := openPQ(t, start(t, NewDB(), AuthMD5), "secret")
+	for _, q := range []string{
+		"CREATE TABLE p (id int PRIMARY KEY)",
+		"CREATE TABLE c (id int PRIMARY KEY, pid int REFERENCES p, FOREIGN KEY (id) REFERENCES p (id))",
+		"INSERT INTO p VALUES (1), (2)",
+		"INSERT INTO c VALUES (1, 2), (2, NULL)",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	for _, tc := range []struct{ q, code string }{
+		{"INSERT INTO c VALUES (3, 1)", "23503"},
+		{"UPDATE c SET pid = 3", "23503"},
+		{"DELETE FROM p WHERE id = 2", "23503"},
+		{"UPDATE p SET id = 3 WHERE id = 1", "23503"},
+		{"DROP TABLE p", "2BP01"},
+		{"CREATE TABLE d (pid int REFERENCES p (nope))", "42703"},
+		{"CREATE TABLE d (pid int REFERENCES c (pid))", "42830"},
+	} {
+		if _, err := db.Exec(tc.q); !isCode(err, tc.code) {
+			t.Errorf("%s: got %v; want %s", tc.q, err, tc.code)
+		}
+	}
+
+	// A delete of the referenced row waits for the transaction that
+	// inserted a row referring to it.
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("DELETE FROM c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("DELETE FROM p WHERE id = 2"); err != nil {
+		t.Errorf("delete of a row referred to only by rows deleted first: %v", err)
+	}
+	if _, err := tx.Exec("INSERT INTO c VALUES (1, 1)"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := db.Exec("DELETE FROM p WHERE id = 1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("delete of a row referred to by an uncommitted one did not wait: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !isCode(err, "23503") {
+		t.Errorf("delete after commit: got %v; want 23503", err)
+	}
+	if _, err := db.Exec("DROP TABLE p CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO c VALUES (5, 5)"); err != nil {
+		t.Errorf("insert after the referenced table was dropped: %v", err)
+	}
+}
+
+func TestSavepoints(t *testing.T) {
+	db := openPQ(t, start(t, NewDB(), AuthMD5), "secret")
+	if _, err := db.Exec("CREATE TABLE t (k int PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("SAVEPOINT a"); !isCode(err, "25P01") {
+		t.Errorf("SAVEPOINT outside a transaction: got %v; want 25P01", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ q, code string }{
+		{"INSERT INTO t VALUES (1)", ""},
+		{"SAVEPOINT a", ""},
+		{"INSERT INTO t VALUES (2)", ""},
+		{"SAVEPOINT b", ""},
+		{"ROLLBACK TO SAVEPOINT a", ""},
+		{"RELEASE b", "3B001"},
+		{"ROLLBACK TO a", ""},
+		{"INSERT INTO t VALUES (1)", "23505"},
+		{"INSERT INTO t VALUES (3)", "25P02"},
+		{"ROLLBACK TO a", ""},
+		{"INSERT INTO t VALUES (3)", ""},
+		{"RELEASE SAVEPOINT a", ""},
+	} {
+		if _, err := tx.Exec(c.q); c.code == "" && err != nil || c.code != "" && !isCode(err, c.code) {
+			t.Fatalf("%s: got %v; want %q", c.q, err, c.code)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(queryStrings(t, db, "SELECT k FROM t ORDER BY k")); got != "[1 3]" {
+		t.Errorf("got rows %s; want [1 3]", got)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	srv := start(t, NewDB(), AuthMD5)
+	listener, notifier := connectPGX(t, srv), connectPGX(t, srv)
+	if err := listener.Listen("news"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := notifier.Exec("NOTIFY news, 'hello'"); err != nil {
+		t.Fatal(err)
+	}
+	n, err := listener.WaitForNotification(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Channel != "news" || n.Payload != "hello" || n.Pid != notifier.Pid {
+		t.Errorf("got notification %+v; want news, hello from %d", n, notifier.Pid)
+	}
+}
+
+func TestTerminateBackend(t *testing.T) {
+	srv := start(t, NewDB(), AuthMD5)
+	victim, killer := connectPGX(t, srv), connectPGX(t, srv)
+	var pid int32
+	if err := victim.QueryRow("SELECT pg_backend_pid()").Scan(&pid); err != nil {
+		t.Fatal(err)
+	}
+	if pid != victim.Pid {
+		t.Errorf("pg_backend_pid() = %d; want %d", pid, victim.Pid)
+	}
+	var ok bool
+	if err := killer.QueryRow("SELECT pg_terminate_backend($1)", pid).Scan(&ok); err != nil || !ok {
+		t.Fatalf("pg_terminate_backend(%d) = %v, %v; want true", pid, ok, err)
+	}
+	if _, err := victim.Exec("SELECT 1"); err == nil {
+		t.Error("terminated connection still runs statements")
+	}
+	if err := killer.QueryRow("SELECT pg_terminate_backend($1)", -1).Scan(&ok); err != nil || ok {
+		t.Errorf("pg_terminate_backend of no backend = %v, %v; want false", ok, err)
+	}
+}
+
+func TestCopyIn(t *testing.T) {
+	db := openPQ(t, start(t, NewDB(), AuthMD5), "secret")
+	if _, err := db.Exec("CREATE TABLE t (a int, b text)"); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := tx.Prepare(pq.CopyIn("t", "a", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range []interface{}{"x", nil, "tab\there"} {
+		if _, err := stmt.Exec(i, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	stmt.Close()
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	var b string
+	if err := db.QueryRow("SELECT count(b), max(b) FROM t").Scan(&n, &b); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || b != "x" {
+		t.Errorf("got count %d, max %q; want 2, x", n, b)
+	}
+}
+
+func TestPreparedStatements(t *testing.T) {
+	db := openPQ(t, start(t, NewDB(), AuthMD5), "secret")
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("CREATE TABLE t (id int, name text)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO t VALUES (1, 'a')"); err != nil {
+		t.Fatal(err)
+	}
+	count := func() int {
+		var n int
+		if err := db.QueryRow("SELECT count(*) FROM pg_prepared_statements").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	named, err := db.Prepare("SELECT id, name FROM t WHERE id = $1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	star, err := db.Prepare("SELECT * FROM t WHERE id = $1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("with two statements prepared, pg_prepared_statements has %d rows", n)
+	}
+
+	if _, err := db.Exec("ALTER TABLE t ADD COLUMN n int DEFAULT 7"); err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	if err := named.QueryRow(1).Scan(new(int), &name); err != nil || name != "a" {
+		t.Errorf("after ALTER TABLE, got %q, %v; want a", name, err)
+	}
+	if err := star.QueryRow(1).Scan(new(int), &name); !isCode(err, "0A000") {
+		t.Errorf("SELECT * after ALTER TABLE: got %v; want 0A000", err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT n FROM t").Scan(&n); err != nil || n != 7 {
+		t.Errorf("added column = %d, %v; want its default, 7", n, err)
+	}
+
+	named.Close()
+	star.Close()
+	if n := count(); n != 0 {
+		t.Errorf("with the statements closed, pg_prepared_statements has %d rows", n)
+	}
+}
+
+// queryStrings returns the rows of q, their columns joined by spaces.
+func queryStrings(t *testing.T, db *sql.DB, q string, args ...interface{}) []string {
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", q, err)
+	}
+	defer rows.Close()
+	cols, _ := rows.Columns()
+	var got []string
+	for rows.Next() {
+		vals := make([]sql.NullString, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		var row []string
+		for _, v := range vals {
+			row = append(row, v.String)
+		}
+		got = append(got, strings.Join(row, " "))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("%s: %v", q, err)
+	}
+	return got
+}
+
+func TestCatalog(t *testing.T) {
+	db := openPQ(t, start(t, NewDB(), AuthMD5), "secret")
+	for _, q := range []string{
+		"CREATE SCHEMA s",
+		`CREATE TABLE s.t (id int NOT NULL, "Seq" bigint, name text UNIQUE, PRIMARY KEY (id, "Seq"))`,
+		`CREATE INDEX t_name ON s.t (name, "Seq")`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	for _, c := range []struct {
+		q    string
+		want string
+	}{
+		{"SELECT table_name FROM information_schema.tables WHERE table_schema = $1", "[t]"},
+		{"SELECT column_name, data_type, is_nullable FROM information_schema.columns WHERE table_schema = $1 AND table_name = 't' ORDER BY ordinal_position",
+			"[id integer NO Seq bigint NO name text YES]"},
+		{"SELECT constraint_name, constraint_type FROM information_schema.table_constraints WHERE table_schema = $1 ORDER BY 1",
+			"[t_name_key UNIQUE t_pkey PRIMARY KEY]"},
+		{"SELECT indexdef FROM pg_indexes WHERE schemaname = $1 ORDER BY indexname", `[CREATE INDEX t_name ON s.t USING btree (name, "Seq") ` +
+			`CREATE UNIQUE INDEX t_name_key ON s.t USING btree (name) CREATE UNIQUE INDEX t_pkey ON s.t USING btree (id, "Seq")]`},
+	} {
+		if got := fmt.Sprint(queryStrings(t, db, c.q, "s")); got != c.want {
+			t.Errorf("%s:\ngot  %s\nwant %s", c.q, got, c.want)
+		}
+	}
+	if _, err := db.Exec("DROP INDEX s.t_name_key"); !isCode(err, "2BP01") {
+		t.Errorf("dropping the index of a constraint: got %v; want 2BP01", err)
+	}
+}
+
+func TestCaseInsensitiveColumns(t *testing.T) {
+	h := NewDB()
+	h.CaseInsensitiveColumns = true
+	db := openPQ(t, start(t, h, AuthMD5), "secret")
+	if _, err := db.Exec(`CREATE TABLE t (MixedCase int, "Quoted" int)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE u (a int, A int)`); !isCode(err, "42701") {
+		t.Errorf("columns differing in case: got %v; want 42701", err)
+	}
+	rows, err := db.Query("SELECT *, mixedcase, QUOTED AS Alias FROM T ORDER BY alias")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	cols, _ := rows.Columns()
+	if got, want := fmt.Sprint(cols), "[MixedCase Quoted mixedcase Alias]"; got != want {
+		t.Errorf("got columns %s; want %s", got, want)
+	}
+}
@@ -0,0 +1,251 @@
+package fakepg
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokIdent       tokenKind = iota // lower-cased unless quoted
+	tokQuotedIdent                  // "Name"
+	tokNumber
+	tokString // text holds the unescaped value
+	tokParam  // $1; text holds the number
+	tokOp     // punctuation and operators
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int // byte offset in the query
+}
+
+// is reports whether t is the unquoted keyword kw.
+func (t token) is(kw string) bool { return t.kind == tokIdent && t.text == kw }
+
+// twoCharOps are the operators of more than one character.
+var twoCharOps = []string{"<>", "!=", "<=", ">=", "||", "::"}
+
+// lex splits a query into tokens, dropping whitespace and comments.
+func lex(q string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+		case strings.HasPrefix(q[i:], "--"):
+			for i < len(q) && q[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(q[i:], "/*"):
+			depth := 0
+			j := i
+			for ; j < len(q); j++ {
+				if strings.HasPrefix(q[j:], "/*") {
+					depth++
+					j++
+				} else if strings.HasPrefix(q[j:], "*/") {
+					depth--
+					j++
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			if depth > 0 {
+				return nil, errorf("42601", "unterminated /* comment at or near %q", q[i:])
+			}
+			i = j + 1
+		case c == '\'':
+			s, n, err := lexString(q[i:], false)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{tokString, s, i})
+			i += n
+		case (c == 'e' || c == 'E') && i+1 < len(q) && q[i+1] == '\'':
+			s, n, err := lexString(q[i+1:], true)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkText([]byte(s)); err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{tokString, s, i})
+			i += n + 1
+		case c == '"':
+			var b strings.Builder
+			j := i + 1
+			for {
+				k := strings.IndexByte(q[j:], '"')
+				if k < 0 {
+					return nil, errorf("42601", "unterminated quoted identifier at or near %q", q[i:])
+				}
+				b.WriteString(q[j : j+k])
+				j += k + 1
+				if j < len(q) && q[j] == '"' {
+					b.WriteByte('"')
+					j++
+					continue
+				}
+				break
+			}
+			toks = append(toks, token{tokQuotedIdent, b.String(), i})
+			i = j
+		case c == '$' && i+1 < len(q) && isDigit(q[i+1]):
+			j := i + 1
+			for j < len(q) && isDigit(q[j]) {
+				j++
+			}
+			toks = append(toks, token{tokParam, q[i+1 : j], i})
+			i = j
+		case c == '$':
+			j := i + 1
+			for j < len(q) && isIdentChar(q[j]) && q[j] != '$' {
+				j++
+			}
+			if j >= len(q) || q[j] != '$' {
+				return nil, errorf("42601", "syntax error at or near \"$\"")
+			}
+			delim := q[i : j+1]
+			end := strings.Index(q[j+1:], delim)
+			if end < 0 {
+				return nil, errorf("42601", "unterminated dollar-quoted string at or near %q", q[i:])
+			}
+			toks = append(toks, token{tokString, q[j+1 : j+1+end], i})
+			i = j + 1 + end + len(delim)
+		case isDigit(c) || c == '.' && i+1 < len(q) && isDigit(q[i+1]):
+			j := i
+			for j < len(q) && isDigit(q[j]) {
+				j++
+			}
+			if j < len(q) && q[j] == '.' {
+				j++
+				for j < len(q) && isDigit(q[j]) {
+					j++
+				}
+			}
+			if j < len(q) && (q[j] == 'e' || q[j] == 'E') {
+				k := j + 1
+				if k < len(q) && (q[k] == '+' || q[k] == '-') {
+					k++
+				}
+				if k < len(q) && isDigit(q[k]) {
+					for k < len(q) && isDigit(q[k]) {
+						k++
+					}
+					j = k
+				}
+			}
+			toks = append(toks, token{tokNumber, q[i:j], i})
+			i = j
+		case isIdentStart(c):
+			j := i
+			for j < len(q) && isIdentChar(q[j]) {
+				j++
+			}
+			toks = append(toks, token{tokIdent, strings.ToLower(q[i:j]), i})
+			i = j
+		default:
+			op := q[i : i+1]
+			for _, o := range twoCharOps {
+				if strings.HasPrefix(q[i:], o) {
+					op = o
+				}
+			}
+			if !strings.Contains("(),.;*+-/%=<>[]:|!", op[:1]) {
+				r, _ := utf8.DecodeRuneInString(q[i:])
+				return nil, errorf("42601", "syntax error at or near %q", string(r))
+			}
+			toks = append(toks, token{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	return toks, nil
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+func isIdentStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c >= 0x80
+}
+func isIdentChar(c byte) bool { return isIdentStart(c) || isDigit(c) || c == '$' }
+
+// lexString reads a quoted string at the start of q, returning its value
+// and length. Backslash escapes are processed only in E'...' strings, as
+// with standard_conforming_strings on.
+func lexString(q string, escapes bool) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(q); i++ {
+		c := q[i]
+		switch {
+		case c == '\'':
+			if i+1 < len(q) && q[i+1] == '\'' {
+				b.WriteByte('\'')
+				i++
+				continue
+			}
+			return b.String(), i + 1, nil
+		case c == '\\' && escapes && i+1 < len(q):
+			i++
+			switch e := q[i]; e {
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'x':
+				j := i + 1
+				for j < len(q) && j < i+3 && isHex(q[j]) {
+					j++
+				}
+				if j == i+1 {
+					b.WriteByte('x')
+					break
+				}
+				n, _ := strconv.ParseUint(q[i+1:j], 16, 8)
+				b.WriteByte(byte(n))
+				i = j - 1
+			case 'u', 'U':
+				n := 4
+				if e == 'U' {
+					n = 8
+				}
+				if i+n >= len(q) {
+					return "", 0, errorf("22025", "invalid Unicode escape")
+				}
+				r, err := strconv.ParseUint(q[i+1:i+1+n], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(r)) {
+					return "", 0, errorf("22025", "invalid Unicode escape value")
+				}
+				b.WriteRune(rune(r))
+				i += n
+			default:
+				if '0' <= e && e <= '7' {
+					j := i
+					for j < len(q) && j < i+3 && '0' <= q[j] && q[j] <= '7' {
+						j++
+					}
+					n, _ := strconv.ParseUint(q[i:j], 8, 16)
+					b.WriteByte(byte(n))
+					i = j - 1
+					break
+				}
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errorf("42601", "unterminated quoted string at or near %q", q)
+}
+
+func isHex(c byte) bool { return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F' }
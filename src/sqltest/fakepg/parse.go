@@ -0,0 +1,1283 @@
+package fakepg
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The parser turns one SQL statement into one of the *Stmt types below.
+// It covers the subset of Postgres that DB executes: single-table
+// queries and data changes, simple DDL, transactions, SET, LISTEN/NOTIFY
+// and COPY FROM STDIN.
+
+// A qname is a possibly schema-qualified name.
+type qname struct {
+	schema, name string
+}
+
+func (n qname) String() string {
+	if n.schema == "" {
+		return n.name
+	}
+	return n.schema + "." + n.name
+}
+
+// A typeName is a column or cast type with its modifiers.
+type typeName struct {
+	oid    Oid
+	length int  // varchar length, numeric precision or time precision; -1 if none
+	scale  int  // numeric scale
+	serial bool // serial, bigserial or smallserial
+}
+
+func (t typeName) String() string {
+	switch {
+	case t.length < 0:
+		return t.oid.String()
+	case t.oid == NumericOid:
+		return "numeric(" + strconv.Itoa(t.length) + "," + strconv.Itoa(t.scale) + ")"
+	}
+	return t.oid.String() + "(" + strconv.Itoa(t.length) + ")"
+}
+
+type (
+	createSchemaStmt struct {
+		name        string
+		ifNotExists bool
+	}
+	dropSchemaStmt struct {
+		names    []string
+		ifExists bool
+		cascade  bool
+	}
+	createTableStmt struct {
+		name        qname
+		ifNotExists bool
+		cols        []colDef
+		primaryKey  []string
+		unique      [][]string
+		foreignKeys []foreignKeyDef
+	}
+	dropTableStmt struct {
+		names    []qname
+		ifExists bool
+		cascade  bool
+	}
+	alterTableStmt struct {
+		name qname
+		col  colDef // to add
+	}
+	createIndexStmt struct {
+		name        string // may be empty
+		unique      bool
+		ifNotExists bool
+		table       qname
+		cols        []string
+	}
+	dropIndexStmt struct {
+		names    []qname
+		ifExists bool
+	}
+	insertStmt struct {
+		table     qname
+		cols      []string // nil for all columns
+		values    [][]expr // nil entries stand for DEFAULT
+		query     *selectStmt
+		returning []selectItem
+	}
+	selectStmt struct {
+		distinct bool
+		items    []selectItem
+		from     *tableRef
+		where    expr
+		orderBy  []orderItem
+		limit    expr
+		offset   expr
+	}
+	updateStmt struct {
+		table     tableRef
+		set       []setClause
+		where     expr
+		returning []selectItem
+	}
+	deleteStmt struct {
+		table     tableRef
+		where     expr
+		returning []selectItem
+	}
+	txStmt struct {
+		kind      string // "BEGIN", "COMMIT", "ROLLBACK", "SAVEPOINT", "RELEASE" or "ROLLBACK TO"
+		savepoint string // name, for the last three
+	}
+	setStmt struct {
+		name, value string // value is empty for SET ... TO DEFAULT
+	}
+	showStmt struct {
+		name string
+	}
+	listenStmt struct {
+		channel  string
+		unlisten bool // UNLISTEN; channel is "*" for all
+	}
+	notifyStmt struct {
+		channel, payload string
+	}
+	copyStmt struct {
+		table qname
+		cols  []string
+	}
+)
+
+type colDef struct {
+	name        string
+	typ         typeName
+	notNull     bool
+	primaryKey  bool
+	unique      bool
+	defaultExpr expr
+	references  *reference
+}
+
+// A reference names the columns a foreign key refers to.
+type reference struct {
+	table qname
+	cols  []string // nil for the primary key
+}
+
+type foreignKeyDef struct {
+	cols []string
+	ref  reference
+}
+
+type tableRef struct {
+	name  qname
+	alias string
+}
+
+type selectItem struct {
+	x     expr   // nil for *
+	alias string // AS alias, if any
+}
+
+type orderItem struct {
+	x          expr
+	desc       bool
+	nullsFirst bool
+}
+
+type setClause struct {
+	col string
+	x   expr
+}
+
+// Expressions.
+type (
+	expr interface{}
+
+	literal struct {
+		v   interface{}
+		typ Oid
+	}
+	paramRef struct {
+		n int // 1-based
+	}
+	colRef struct {
+		table, name string
+	}
+	unaryExpr struct {
+		op string // "-", "+" or "not"
+		x  expr
+	}
+	binaryExpr struct {
+		op   string // an operator, "and", "or" or "like"
+		l, r expr
+	}
+	isNullExpr struct {
+		x   expr
+		not bool
+	}
+	inExpr struct {
+		x    expr
+		list []expr
+		not  bool
+	}
+	castExpr struct {
+		x   expr
+		typ typeName
+	}
+	funcExpr struct {
+		name     string
+		args     []expr
+		star     bool // count(*)
+		distinct bool
+	}
+)
+
+// reserved lists the keywords that cannot be used as bare column aliases
+// or unquoted names.
+var reserved = map[string]bool{
+	"all": true, "and": true, "as": true, "asc": true, "by": true, "cast": true,
+	"collate": true, "create": true, "default": true, "desc": true,
+	"distinct": true, "else": true,
+	"end": true, "false": true, "for": true, "from": true, "group": true,
+	"having": true, "in": true, "into": true, "is": true, "join": true,
+	"like": true, "limit": true, "not": true, "null": true, "offset": true,
+	"on": true, "or": true, "order": true, "primary": true, "returning": true,
+	"select": true, "set": true, "table": true, "then": true, "true": true,
+	"union": true, "unique": true, "values": true, "when": true, "where": true,
+	"with": true, "between": true, "isnull": true, "notnull": true,
+}
+
+type parser struct {
+	toks     []token
+	i        int
+	q        string
+	keepCase bool // see DB.CaseInsensitiveColumns
+}
+
+// parse parses a single SQL statement, keeping the case of unquoted
+// column names and aliases if keepCase is set.
+func parse(q string, keepCase bool) (interface{}, error) {
+	toks, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+	for len(toks) > 0 && toks[len(toks)-1].kind == tokOp && toks[len(toks)-1].text == ";" {
+		toks = toks[:len(toks)-1]
+	}
+	p := &parser{toks: toks, q: q, keepCase: keepCase}
+	var st interface{}
+	err = catch(func() {
+		st = p.statement()
+		if p.i < len(p.toks) {
+			p.fail()
+		}
+	})
+	return st, err
+}
+
+// catch runs fn, turning a panic with an *Error into a returned error.
+// Any other panic is a bug in the fake and is not recovered.
+func catch(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+	fn()
+	return nil
+}
+
+func (p *parser) peek() token {
+	if p.i < len(p.toks) {
+		return p.toks[p.i]
+	}
+	return token{kind: tokOp, pos: len(p.q)}
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	if p.i < len(p.toks) {
+		p.i++
+	}
+	return t
+}
+
+// fail reports a syntax error at the next token.
+func (p *parser) fail() {
+	if p.i >= len(p.toks) {
+		panic(errorf("42601", "syntax error at end of input"))
+	}
+	panic(errorf("42601", "syntax error at or near %q", p.toks[p.i].text))
+}
+
+// unsupported reports valid SQL that the parser does not handle.
+func unsupported(what string) {
+	panic(errorf("0A000", "%s is not supported", what))
+}
+
+// accept consumes the next token if it is the keyword or operator s.
+func (p *parser) accept(s string) bool {
+	t := p.peek()
+	if t.is(s) || t.kind == tokOp && t.text == s && s != "" {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(s string) {
+	if !p.accept(s) {
+		p.fail()
+	}
+}
+
+// acceptSeq consumes the keywords in words if all of them come next.
+func (p *parser) acceptSeq(words ...string) bool {
+	for j, w := range words {
+		if p.i+j >= len(p.toks) || !p.toks[p.i+j].is(w) {
+			return false
+		}
+	}
+	p.i += len(words)
+	return true
+}
+
+// ident consumes a name, quoted or not.
+func (p *parser) ident() string {
+	t := p.peek()
+	if t.kind == tokQuotedIdent || t.kind == tokIdent && !reserved[t.text] {
+		p.i++
+		return t.text
+	}
+	p.fail()
+	return ""
+}
+
+// columnName consumes the name of a column or alias, which keeps the
+// case it is written in if p.keepCase is set.
+func (p *parser) columnName() string {
+	t := p.peek()
+	p.ident()
+	return p.written(t)
+}
+
+// written returns the name t as written if p.keepCase is set, and as
+// lexed otherwise.
+func (p *parser) written(t token) string {
+	if !p.keepCase || t.kind != tokIdent {
+		return t.text
+	}
+	end := t.pos
+	for end < len(p.q) && isIdentChar(p.q[end]) {
+		end++
+	}
+	return p.q[t.pos:end]
+}
+
+func (p *parser) qname() qname {
+	n := qname{name: p.ident()}
+	if p.accept(".") {
+		n.schema, n.name = n.name, p.ident()
+	}
+	return n
+}
+
+func (p *parser) identList() []string {
+	p.expect("(")
+	var names []string
+	for {
+		names = append(names, p.ident())
+		if !p.accept(",") {
+			break
+		}
+	}
+	p.expect(")")
+	return names
+}
+
+func (p *parser) statement() interface{} {
+	t := p.next()
+	switch {
+	case t.is("select"):
+		return p.selectRest()
+	case t.is("insert"):
+		return p.insert()
+	case t.is("update"):
+		return p.update()
+	case t.is("delete"):
+		return p.delete()
+	case t.is("create"):
+		return p.create()
+	case t.is("drop"):
+		return p.drop()
+	case t.is("alter"):
+		p.expect("table")
+		s := &alterTableStmt{name: p.qname()}
+		p.expect("add")
+		p.accept("column")
+		s.col = p.colDef()
+		return s
+	case t.is("begin"):
+		if !p.accept("work") {
+			p.accept("transaction")
+		}
+		p.txModes()
+		return &txStmt{kind: "BEGIN"}
+	case t.is("start"):
+		p.expect("transaction")
+		p.txModes()
+		return &txStmt{kind: "BEGIN"}
+	case t.is("commit"), t.is("end"):
+		if !p.accept("work") {
+			p.accept("transaction")
+		}
+		return &txStmt{kind: "COMMIT"}
+	case t.is("rollback"), t.is("abort"):
+		if !p.accept("work") {
+			p.accept("transaction")
+		}
+		if p.accept("to") {
+			p.accept("savepoint")
+			return &txStmt{kind: "ROLLBACK TO", savepoint: p.ident()}
+		}
+		return &txStmt{kind: "ROLLBACK"}
+	case t.is("set"):
+		return p.set()
+	case t.is("show"):
+		name := p.ident()
+		if name == "time" {
+			p.expect("zone")
+			name = "timezone"
+		}
+		return &showStmt{strings.ToLower(name)}
+	case t.is("listen"):
+		return &listenStmt{channel: p.ident()}
+	case t.is("unlisten"):
+		if p.accept("*") {
+			return &listenStmt{channel: "*", unlisten: true}
+		}
+		return &listenStmt{channel: p.ident(), unlisten: true}
+	case t.is("notify"):
+		n := &notifyStmt{channel: p.ident()}
+		if p.accept(",") {
+			if s := p.next(); s.kind == tokString {
+				n.payload = s.text
+			} else {
+				p.i--
+				p.fail()
+			}
+		}
+		return n
+	case t.is("copy"):
+		c := &copyStmt{table: p.qname()}
+		if p.peek().text == "(" {
+			c.cols = p.identList()
+		}
+		p.expect("from")
+		p.expect("stdin")
+		return c
+	case t.is("savepoint"):
+		return &txStmt{kind: "SAVEPOINT", savepoint: p.ident()}
+	case t.is("release"):
+		p.accept("savepoint")
+		return &txStmt{kind: "RELEASE", savepoint: p.ident()}
+	}
+	p.i--
+	p.fail()
+	return nil
+}
+
+// txModes skips the transaction modes of BEGIN, which DB ignores.
+func (p *parser) txModes() {
+	for p.i < len(p.toks) {
+		p.next()
+	}
+}
+
+func (p *parser) set() interface{} {
+	if !p.accept("session") {
+		p.accept("local")
+	}
+	if p.accept("transaction") {
+		p.txModes()
+		return &setStmt{}
+	}
+	var name string
+	if p.acceptSeq("time", "zone") {
+		name = "timezone"
+	} else {
+		name = strings.ToLower(p.ident())
+		if !p.accept("to") {
+			p.expect("=")
+		}
+	}
+	if p.accept("default") || p.accept("local") {
+		return &setStmt{name: name}
+	}
+	var parts []string
+	for p.i < len(p.toks) {
+		t := p.next()
+		if t.kind == tokOp && t.text == "," {
+			continue
+		}
+		if t.kind == tokOp && t.text == "-" {
+			n := p.next()
+			if n.kind != tokNumber {
+				p.i--
+				p.fail()
+			}
+			t.text = "-" + n.text
+		}
+		parts = append(parts, t.text)
+	}
+	if len(parts) == 0 {
+		p.fail()
+	}
+	return &setStmt{name: name, value: strings.Join(parts, ", ")}
+}
+
+func (p *parser) create() interface{} {
+	switch {
+	case p.accept("schema"):
+		s := &createSchemaStmt{ifNotExists: p.acceptSeq("if", "not", "exists")}
+		s.name = p.ident()
+		return s
+	case p.accept("table"):
+		return p.createTable()
+	case p.accept("unique"):
+		p.expect("index")
+		return p.createIndex(true)
+	case p.accept("index"):
+		return p.createIndex(false)
+	}
+	p.fail()
+	return nil
+}
+
+func (p *parser) createTable() *createTableStmt {
+	s := &createTableStmt{ifNotExists: p.acceptSeq("if", "not", "exists")}
+	s.name = p.qname()
+	p.expect("(")
+	for {
+		if p.accept("constraint") {
+			p.ident()
+		}
+		switch {
+		case p.acceptSeq("primary", "key"):
+			if s.primaryKey != nil {
+				panic(errorf("42P16", "multiple primary keys for table %q are not allowed", s.name.name))
+			}
+			s.primaryKey = p.identList()
+		case p.accept("unique"):
+			s.unique = append(s.unique, p.identList())
+		case p.acceptSeq("foreign", "key"):
+			cols := p.identList()
+			p.expect("references")
+			s.foreignKeys = append(s.foreignKeys, foreignKeyDef{cols, p.reference()})
+		case p.peek().is("check"):
+			unsupported("CHECK constraints")
+		default:
+			c := p.colDef()
+			if c.primaryKey {
+				if s.primaryKey != nil {
+					panic(errorf("42P16", "multiple primary keys for table %q are not allowed", s.name.name))
+				}
+				s.primaryKey = []string{c.name}
+			}
+			if c.unique {
+				s.unique = append(s.unique, []string{c.name})
+			}
+			if c.references != nil {
+				s.foreignKeys = append(s.foreignKeys, foreignKeyDef{[]string{c.name}, *c.references})
+			}
+			s.cols = append(s.cols, c)
+		}
+		if !p.accept(",") {
+			break
+		}
+	}
+	p.expect(")")
+	return s
+}
+
+func (p *parser) colDef() colDef {
+	c := colDef{name: p.columnName(), typ: p.typeName()}
+	for {
+		if p.accept("constraint") {
+			p.ident()
+		}
+		switch {
+		case p.acceptSeq("not", "null"):
+			c.notNull = true
+		case p.accept("null"):
+		case p.acceptSeq("primary", "key"):
+			c.primaryKey = true
+		case p.accept("unique"):
+			c.unique = true
+		case p.accept("default"):
+			c.defaultExpr = p.expr()
+		case p.accept("references"):
+			r := p.reference()
+			c.references = &r
+		case p.peek().is("check"):
+			unsupported("CHECK constraints")
+		default:
+			return c
+		}
+	}
+}
+
+// reference parses the table and columns after REFERENCES.
+func (p *parser) reference() reference {
+	r := reference{table: p.qname()}
+	if p.peek().text == "(" {
+		r.cols = p.identList()
+	}
+	if p.peek().is("on") || p.peek().is("match") {
+		unsupported("referential actions")
+	}
+	return r
+}
+
+// typeName parses a type, mapping its SQL spellings to an Oid.
+func (p *parser) typeName() typeName {
+	t := typeName{length: -1}
+	name := p.ident()
+	switch name {
+	case "smallint", "int2":
+		t.oid = Int2Oid
+	case "int", "integer", "int4":
+		t.oid = Int4Oid
+	case "bigint", "int8":
+		t.oid = Int8Oid
+	case "smallserial", "serial2":
+		t.oid, t.serial = Int2Oid, true
+	case "serial", "serial4":
+		t.oid, t.serial = Int4Oid, true
+	case "bigserial", "serial8":
+		t.oid, t.serial = Int8Oid, true
+	case "real", "float4":
+		t.oid = Float4Oid
+	case "float8":
+		t.oid = Float8Oid
+	case "float":
+		t.oid = Float8Oid
+		if p.accept("(") {
+			if n := p.intArg(); n <= 24 {
+				t.oid = Float4Oid
+			}
+			p.expect(")")
+		}
+	case "double":
+		p.expect("precision")
+		t.oid = Float8Oid
+	case "numeric", "decimal":
+		t.oid = NumericOid
+		if p.accept("(") {
+			t.length = p.intArg()
+			if p.accept(",") {
+				t.scale = p.intArg()
+			}
+			p.expect(")")
+			if t.length < 1 || t.length > 1000 || t.scale > t.length {
+				panic(errorf("22023", "invalid NUMERIC type modifier"))
+			}
+		}
+	case "text":
+		t.oid = TextOid
+	case "varchar", "character", "char":
+		if name != "varchar" {
+			p.expect("varying")
+		}
+		t.oid = VarcharOid
+		if p.accept("(") {
+			t.length = p.intArg()
+			p.expect(")")
+		}
+	case "bytea":
+		t.oid = ByteaOid
+	case "boolean", "bool":
+		t.oid = BoolOid
+	case "date":
+		t.oid = DateOid
+	case "time", "timestamp", "timestamptz":
+		t.oid = TimeOid
+		switch name {
+		case "timestamp":
+			t.oid = TimestampOid
+		case "timestamptz":
+			t.oid = TimestamptzOid
+		}
+		if p.accept("(") {
+			t.length = p.intArg()
+			p.expect(")")
+			if t.length > 6 {
+				t.length = 6
+			}
+		}
+		switch {
+		case t.oid == TimestamptzOid:
+		case p.acceptSeq("with", "time", "zone"):
+			if t.oid == TimeOid {
+				unsupported("time with time zone")
+			}
+			t.oid = TimestamptzOid
+		default:
+			p.acceptSeq("without", "time", "zone")
+		}
+	default:
+		panic(errorf("42704", "type %q does not exist", name))
+	}
+	if p.peek().text == "[" {
+		unsupported("array types")
+	}
+	return t
+}
+
+func (p *parser) intArg() int {
+	t := p.next()
+	n, err := strconv.Atoi(t.text)
+	if t.kind != tokNumber || err != nil {
+		p.i--
+		p.fail()
+	}
+	return n
+}
+
+func (p *parser) createIndex(unique bool) *createIndexStmt {
+	s := &createIndexStmt{unique: unique, ifNotExists: p.acceptSeq("if", "not", "exists")}
+	if !p.peek().is("on") {
+		s.name = p.ident()
+	}
+	p.expect("on")
+	s.table = p.qname()
+	s.cols = p.identList()
+	return s
+}
+
+func (p *parser) drop() interface{} {
+	switch {
+	case p.accept("schema"):
+		s := &dropSchemaStmt{ifExists: p.acceptSeq("if", "exists")}
+		for {
+			s.names = append(s.names, p.ident())
+			if !p.accept(",") {
+				break
+			}
+		}
+		s.cascade = p.accept("cascade")
+		if !s.cascade {
+			p.accept("restrict")
+		}
+		return s
+	case p.accept("table"):
+		s := &dropTableStmt{ifExists: p.acceptSeq("if", "exists")}
+		s.names = p.qnames()
+		s.cascade = p.accept("cascade")
+		if !s.cascade {
+			p.accept("restrict")
+		}
+		return s
+	case p.accept("index"):
+		s := &dropIndexStmt{ifExists: p.acceptSeq("if", "exists")}
+		s.names = p.qnames()
+		if !p.accept("cascade") {
+			p.accept("restrict")
+		}
+		return s
+	}
+	p.fail()
+	return nil
+}
+
+func (p *parser) qnames() []qname {
+	var names []qname
+	for {
+		names = append(names, p.qname())
+		if !p.accept(",") {
+			return names
+		}
+	}
+}
+
+func (p *parser) insert() *insertStmt {
+	p.expect("into")
+	s := &insertStmt{table: p.qname()}
+	if p.peek().text == "(" {
+		s.cols = p.identList()
+	}
+	switch {
+	case p.accept("values"):
+		for {
+			p.expect("(")
+			var row []expr
+			for {
+				if p.accept("default") {
+					row = append(row, nil)
+				} else {
+					row = append(row, p.expr())
+				}
+				if !p.accept(",") {
+					break
+				}
+			}
+			p.expect(")")
+			s.values = append(s.values, row)
+			if !p.accept(",") {
+				break
+			}
+		}
+	case p.accept("select"):
+		s.query = p.selectRest()
+	case p.acceptSeq("default", "values"):
+		s.values = [][]expr{nil}
+	default:
+		p.fail()
+	}
+	if p.peek().is("on") {
+		unsupported("ON CONFLICT")
+	}
+	s.returning = p.returning()
+	return s
+}
+
+func (p *parser) returning() []selectItem {
+	if !p.accept("returning") {
+		return nil
+	}
+	return p.selectItems()
+}
+
+func (p *parser) tableRef() tableRef {
+	r := tableRef{name: p.qname()}
+	if p.accept("as") {
+		r.alias = p.ident()
+	} else if t := p.peek(); t.kind == tokQuotedIdent || t.kind == tokIdent && !reserved[t.text] {
+		r.alias = p.ident()
+	}
+	return r
+}
+
+func (p *parser) update() *updateStmt {
+	s := &updateStmt{table: p.tableRef()}
+	p.expect("set")
+	for {
+		c := setClause{col: p.ident()}
+		p.expect("=")
+		c.x = p.expr()
+		s.set = append(s.set, c)
+		if !p.accept(",") {
+			break
+		}
+	}
+	if p.peek().is("from") {
+		unsupported("UPDATE ... FROM")
+	}
+	if p.accept("where") {
+		s.where = p.expr()
+	}
+	s.returning = p.returning()
+	return s
+}
+
+func (p *parser) delete() *deleteStmt {
+	p.expect("from")
+	s := &deleteStmt{table: p.tableRef()}
+	if p.peek().is("using") {
+		unsupported("DELETE ... USING")
+	}
+	if p.accept("where") {
+		s.where = p.expr()
+	}
+	s.returning = p.returning()
+	return s
+}
+
+// selectRest parses a SELECT statement after the SELECT keyword.
+func (p *parser) selectRest() *selectStmt {
+	s := &selectStmt{}
+	if p.accept("distinct") {
+		if p.peek().is("on") {
+			unsupported("DISTINCT ON")
+		}
+		s.distinct = true
+	} else {
+		p.accept("all")
+	}
+	s.items = p.selectItems()
+	if p.accept("from") {
+		r := p.tableRef()
+		s.from = &r
+		if t := p.peek(); t.text == "," || t.is("join") || t.is("inner") || t.is("left") || t.is("right") || t.is("full") || t.is("cross") || t.is("natural") {
+			unsupported("joins")
+		}
+	}
+	if p.accept("where") {
+		s.where = p.expr()
+	}
+	if p.peek().is("group") || p.peek().is("having") {
+		unsupported(strings.ToUpper(p.peek().text))
+	}
+	if p.peek().is("union") || p.peek().is("intersect") || p.peek().is("except") {
+		unsupported(strings.ToUpper(p.peek().text))
+	}
+	if p.acceptSeq("order", "by") {
+		for {
+			o := orderItem{x: p.expr()}
+			if p.accept("desc") {
+				o.desc = true
+			} else {
+				p.accept("asc")
+			}
+			o.nullsFirst = o.desc
+			if p.accept("nulls") {
+				if p.accept("first") {
+					o.nullsFirst = true
+				} else {
+					p.expect("last")
+					o.nullsFirst = false
+				}
+			}
+			s.orderBy = append(s.orderBy, o)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	for {
+		switch {
+		case p.accept("limit"):
+			if !p.accept("all") {
+				s.limit = p.expr()
+			}
+			continue
+		case p.accept("offset"):
+			s.offset = p.expr()
+			if !p.accept("rows") {
+				p.accept("row")
+			}
+			continue
+		}
+		break
+	}
+	if p.peek().is("for") {
+		unsupported("FOR UPDATE")
+	}
+	return s
+}
+
+func (p *parser) selectItems() []selectItem {
+	var items []selectItem
+	for {
+		var item selectItem
+		if !p.accept("*") {
+			item.x = p.expr()
+			if p.accept("as") {
+				item.alias = p.columnName()
+			} else if t := p.peek(); t.kind == tokQuotedIdent || t.kind == tokIdent && !reserved[t.text] {
+				item.alias = p.columnName()
+			}
+		}
+		items = append(items, item)
+		if !p.accept(",") {
+			return items
+		}
+	}
+}
+
+// expr parses an expression. The methods below handle one level of
+// operator precedence each, lowest first, as in Postgres.
+func (p *parser) expr() expr { return p.or() }
+
+func (p *parser) or() expr {
+	x := p.and()
+	for p.accept("or") {
+		x = &binaryExpr{"or", x, p.and()}
+	}
+	return x
+}
+
+func (p *parser) and() expr {
+	x := p.not()
+	for p.accept("and") {
+		x = &binaryExpr{"and", x, p.not()}
+	}
+	return x
+}
+
+func (p *parser) not() expr {
+	if p.accept("not") {
+		return &unaryExpr{"not", p.not()}
+	}
+	return p.is()
+}
+
+func (p *parser) is() expr {
+	x := p.comparison()
+	for {
+		switch {
+		case p.accept("isnull"):
+			x = &isNullExpr{x: x}
+		case p.accept("notnull"):
+			x = &isNullExpr{x: x, not: true}
+		case p.accept("is"):
+			not := p.accept("not")
+			switch {
+			case p.accept("null"):
+				x = &isNullExpr{x, not}
+			case p.accept("true"), p.accept("false"):
+				v := p.toks[p.i-1].is("true")
+				var cmp expr = &binaryExpr{"=", x, &literal{v, BoolOid}}
+				cmp = &funcExpr{name: "coalesce", args: []expr{cmp, &literal{false, BoolOid}}}
+				if not {
+					cmp = &unaryExpr{"not", cmp}
+				}
+				x = cmp
+			default:
+				p.fail()
+			}
+		default:
+			return x
+		}
+	}
+}
+
+func (p *parser) comparison() expr {
+	x := p.like()
+	for {
+		t := p.peek()
+		switch t.text {
+		case "=", "<>", "!=", "<", "<=", ">", ">=":
+			if t.kind != tokOp {
+				return x
+			}
+			p.i++
+			op := t.text
+			if op == "!=" {
+				op = "<>"
+			}
+			x = &binaryExpr{op, x, p.like()}
+		default:
+			return x
+		}
+	}
+}
+
+func (p *parser) like() expr {
+	x := p.other()
+	for {
+		not := false
+		if p.peek().is("not") && p.i+1 < len(p.toks) {
+			if n := p.toks[p.i+1]; n.is("like") || n.is("in") || n.is("between") || n.is("ilike") {
+				p.i++
+				not = true
+			}
+		}
+		switch {
+		case p.accept("like"), p.accept("ilike"):
+			op := p.toks[p.i-1].text
+			x = &binaryExpr{op, x, p.other()}
+			if not {
+				x = &unaryExpr{"not", x}
+			}
+		case p.accept("in"):
+			p.expect("(")
+			if p.peek().is("select") {
+				unsupported("subqueries")
+			}
+			in := &inExpr{x: x, not: not}
+			for {
+				in.list = append(in.list, p.expr())
+				if !p.accept(",") {
+					break
+				}
+			}
+			p.expect(")")
+			x = in
+		case p.accept("between"):
+			lo := p.other()
+			p.expect("and")
+			hi := p.other()
+			x = &binaryExpr{"and", &binaryExpr{">=", x, lo}, &binaryExpr{"<=", x, hi}}
+			if not {
+				x = &unaryExpr{"not", x}
+			}
+		default:
+			return x
+		}
+	}
+}
+
+func (p *parser) other() expr {
+	x := p.additive()
+	for p.accept("||") {
+		x = &binaryExpr{"||", x, p.additive()}
+	}
+	return x
+}
+
+func (p *parser) additive() expr {
+	x := p.multiplicative()
+	for {
+		switch {
+		case p.accept("+"):
+			x = &binaryExpr{"+", x, p.multiplicative()}
+		case p.accept("-"):
+			x = &binaryExpr{"-", x, p.multiplicative()}
+		default:
+			return x
+		}
+	}
+}
+
+func (p *parser) multiplicative() expr {
+	x := p.unary()
+	for {
+		switch {
+		case p.accept("*"):
+			x = &binaryExpr{"*", x, p.unary()}
+		case p.accept("/"):
+			x = &binaryExpr{"/", x, p.unary()}
+		case p.accept("%"):
+			x = &binaryExpr{"%", x, p.unary()}
+		default:
+			return x
+		}
+	}
+}
+
+func (p *parser) unary() expr {
+	switch {
+	case p.accept("-"):
+		if t := p.peek(); t.kind == tokNumber {
+			p.i++
+			return p.castSuffix(numberLiteral("-" + t.text))
+		}
+		return &unaryExpr{"-", p.unary()}
+	case p.accept("+"):
+		return &unaryExpr{"+", p.unary()}
+	}
+	return p.castSuffix(p.primary())
+}
+
+func (p *parser) castSuffix(x expr) expr {
+	for p.accept("::") {
+		x = &castExpr{x, p.typeName()}
+	}
+	if p.accept("collate") {
+		// Text compares by its bytes, as in the C collation, whatever
+		// the collation.
+		switch name := p.ident(); name {
+		case "C", "POSIX", "default":
+		default:
+			panic(errorf("42704", "collation %q for encoding \"UTF8\" does not exist", name))
+		}
+	}
+	return x
+}
+
+// numberLiteral types a numeric constant as Postgres does: integer if
+// it fits in 32 bits, bigint if in 64 and numeric otherwise.
+func numberLiteral(s string) *literal {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if int64(int32(n)) == n {
+			return &literal{n, Int4Oid}
+		}
+		return &literal{n, Int8Oid}
+	}
+	v, err := parseNumeric(s)
+	if err != nil {
+		panic(err)
+	}
+	return &literal{v, NumericOid}
+}
+
+// typedLiterals are the types that may prefix a string constant, as in
+// DATE '2001-02-03'.
+var typedLiterals = map[string]bool{
+	"date": true, "time": true, "timestamp": true, "timestamptz": true,
+	"int": true, "integer": true, "bigint": true, "numeric": true, "text": true,
+	"bytea": true, "boolean": true, "real": true, "double": true, "varchar": true,
+}
+
+func (p *parser) primary() expr {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return numberLiteral(t.text)
+	case tokString:
+		return &literal{t.text, UnknownOid}
+	case tokParam:
+		n, err := strconv.Atoi(t.text)
+		if err != nil || n < 1 || n > 65535 {
+			panic(errorf("42P02", "there is no parameter $%s", t.text))
+		}
+		return &paramRef{n}
+	case tokOp:
+		if t.text == "(" {
+			if p.peek().is("select") {
+				unsupported("subqueries")
+			}
+			x := p.expr()
+			p.expect(")")
+			return x
+		}
+	case tokQuotedIdent:
+		return p.nameRest(t)
+	case tokIdent:
+		switch t.text {
+		case "null":
+			return &literal{nil, UnknownOid}
+		case "true", "false":
+			return &literal{t.text == "true", BoolOid}
+		case "cast":
+			p.expect("(")
+			x := p.expr()
+			p.expect("as")
+			typ := p.typeName()
+			p.expect(")")
+			return &castExpr{x, typ}
+		case "current_timestamp", "localtimestamp", "current_date":
+			if p.peek().text != "(" {
+				return &funcExpr{name: t.text}
+			}
+		case "case", "exists", "array", "interval":
+			unsupported(strings.ToUpper(t.text))
+		}
+		if typedLiterals[t.text] && p.peek().kind == tokString || t.text == "double" && p.peek().is("precision") {
+			p.i--
+			typ := p.typeName()
+			s := p.next()
+			if s.kind != tokString {
+				p.i--
+				p.fail()
+			}
+			return &castExpr{&literal{s.text, UnknownOid}, typ}
+		}
+		if reserved[t.text] {
+			break
+		}
+		return p.nameRest(t)
+	}
+	p.i--
+	p.fail()
+	return nil
+}
+
+// nameRest parses a column reference or function call starting with
+// the name t, which has already been consumed.
+func (p *parser) nameRest(t token) expr {
+	if p.accept(".") {
+		if p.accept("*") {
+			unsupported("table.*")
+		}
+		return &colRef{table: t.text, name: p.columnName()}
+	}
+	if p.peek().text != "(" || p.peek().kind != tokOp {
+		return &colRef{name: p.written(t)}
+	}
+	p.i++
+	f := &funcExpr{name: t.text}
+	if p.accept("*") {
+		f.star = true
+		p.expect(")")
+		return f
+	}
+	if p.accept(")") {
+		return f
+	}
+	f.distinct = p.accept("distinct")
+	for {
+		f.args = append(f.args, p.expr())
+		if !p.accept(",") {
+			break
+		}
+	}
+	p.expect(")")
+	return f
+}
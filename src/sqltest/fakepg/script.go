@@ -0,0 +1,163 @@
+package fakepg
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Script is a Handler answering each statement with a Response set
+// for its text in advance. BEGIN, COMMIT and ROLLBACK need no response;
+// a Script tracks the transaction status for them, and a block fails
+// when a response with an Err is run in it. Other statements with no
+// response fail with SQLSTATE 0A000.
+type Script struct {
+	mu        sync.Mutex
+	responses map[string]*Response
+	queries   []string
+}
+
+// A Response is how a Script answers a statement.
+type Response struct {
+	// Params are the types of the statement's parameters. If nil, the
+	// statement has one text parameter for each $n in it.
+	Params []Oid
+
+	Columns []Column
+	Rows    [][]interface{}
+	Tag     string // defaults to "SELECT n" for responses with Columns
+
+	Err *Error // if not nil, the statement fails with it when run
+}
+
+// NewScript returns a Script with no responses.
+func NewScript() *Script {
+	return &Script{responses: map[string]*Response{}}
+}
+
+// On sets the response to query. Queries match after removing leading
+// and trailing space and semicolons.
+func (s *Script) On(query string, r *Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[trimQuery(query)] = r
+}
+
+// Queries returns the statements the script's clients have prepared or
+// run, in order.
+func (s *Script) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+func trimQuery(q string) string {
+	return strings.TrimRight(strings.TrimSpace(q), "; \t\r\n")
+}
+
+// NewSession implements Handler.
+func (s *Script) NewSession(*Client) Session {
+	return &scriptSession{script: s}
+}
+
+type scriptSession struct {
+	script *Script
+	mu     sync.Mutex
+	status byte
+}
+
+func (ss *scriptSession) TxStatus() byte {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.status == 0 {
+		return 'I'
+	}
+	return ss.status
+}
+
+func (ss *scriptSession) Close() {}
+
+func (ss *scriptSession) Prepare(query string, paramTypes []Oid) (Statement, error) {
+	s := ss.script
+	q := trimQuery(query)
+	s.mu.Lock()
+	s.queries = append(s.queries, q)
+	r := s.responses[q]
+	s.mu.Unlock()
+	if r == nil {
+		if ast, err := parse(q, false); err == nil {
+			if t, ok := ast.(*txStmt); ok && t.savepoint == "" {
+				return &scriptTx{ss, t.kind}, nil
+			}
+		}
+		return nil, errorf("0A000", "fakepg: no response scripted for %q", q)
+	}
+	params := r.Params
+	if params == nil {
+		toks, err := lex(q)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range toks {
+			if t.kind != tokParam {
+				continue
+			}
+			n, _ := strconv.Atoi(t.text)
+			for len(params) < n {
+				params = append(params, TextOid)
+			}
+		}
+	}
+	return &scriptStmt{ss, r, params}, nil
+}
+
+type scriptStmt struct {
+	ss     *scriptSession
+	r      *Response
+	params []Oid
+}
+
+func (st *scriptStmt) ParamTypes() []Oid { return st.params }
+func (st *scriptStmt) Columns() []Column { return st.r.Columns }
+func (st *scriptStmt) Close()            {}
+
+func (st *scriptStmt) Exec([]interface{}) (*Result, error) {
+	if st.r.Err != nil {
+		st.ss.mu.Lock()
+		if st.ss.status == 'T' {
+			st.ss.status = 'E'
+		}
+		st.ss.mu.Unlock()
+		return nil, st.r.Err
+	}
+	tag := st.r.Tag
+	if tag == "" && st.r.Columns != nil {
+		tag = "SELECT " + strconv.Itoa(len(st.r.Rows))
+	}
+	return &Result{Rows: st.r.Rows, Tag: tag}, nil
+}
+
+// A scriptTx is a BEGIN, COMMIT or ROLLBACK run by a Script.
+type scriptTx struct {
+	ss   *scriptSession
+	kind string
+}
+
+func (st *scriptTx) ParamTypes() []Oid { return nil }
+func (st *scriptTx) Columns() []Column { return nil }
+func (st *scriptTx) Close()            {}
+
+func (st *scriptTx) Exec([]interface{}) (*Result, error) {
+	st.ss.mu.Lock()
+	defer st.ss.mu.Unlock()
+	tag := st.kind
+	switch {
+	case st.kind == "BEGIN":
+		st.ss.status = 'T'
+	case st.ss.status == 'E':
+		st.ss.status, tag = 'I', "ROLLBACK"
+	default:
+		st.ss.status = 'I'
+	}
+	return &Result{Tag: tag}, nil
+}
@@ -0,0 +1,856 @@
+package fakepg
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// AuthMethod is how a Server authenticates its clients.
+type AuthMethod int
+
+const (
+	AuthTrust     AuthMethod = iota // no password
+	AuthCleartext                   // AuthenticationCleartextPassword
+	AuthMD5                         // AuthenticationMD5Password
+)
+
+// ServerVersion is reported to clients in the server_version parameter.
+const ServerVersion = "9.6.24"
+
+// A Server accepts Postgres clients on a loopback TCP port.
+type Server struct {
+	Handler  Handler
+	Auth     AuthMethod
+	Password string    // required of every user unless Auth is AuthTrust
+	Rand     io.Reader // source of salts and cancellation keys; crypto/rand.Reader if nil
+
+	ln      net.Listener
+	mu      sync.Mutex
+	conns   map[*conn]bool
+	nextPID int32
+	wg      sync.WaitGroup
+}
+
+// Start starts the server listening on an ephemeral port of 127.0.0.1.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	s.conns = map[*conn]bool{}
+	s.wg.Add(1)
+	go s.serve()
+	return nil
+}
+
+// random fills b from s.Rand.
+func (s *Server) random(b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+	io.ReadFull(r, b)
+}
+
+// Addr returns the host:port the server is listening on.
+func (s *Server) Addr() string { return s.ln.Addr().String() }
+
+// Close stops the server and closes every client connection.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.nc.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{
+			srv:     s,
+			nc:      nc,
+			r:       bufio.NewReader(nc),
+			w:       bufio.NewWriter(nc),
+			stmts:   map[string]Statement{},
+			portals: map[string]*portal{},
+		}
+		s.mu.Lock()
+		s.conns[c] = true
+		s.nextPID++
+		pid := 1000 + s.nextPID
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			c.serve(pid)
+			nc.Close()
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Protocol codes sent in place of a version in the startup packet.
+const (
+	protocolVersion3 = 196608
+	sslRequestCode   = 80877103
+	cancelCode       = 80877102
+)
+
+// maxMessage bounds the size of a message from the client.
+const maxMessage = 1 << 30
+
+// A conn is one client connection.
+type conn struct {
+	srv *Server
+	nc  net.Conn
+	r   *bufio.Reader
+
+	wmu sync.Mutex // guards w, so notifications go out between messages
+	w   *bufio.Writer
+
+	client  *Client
+	sess    Session
+	stmts   map[string]Statement // prepared statements, by name
+	portals map[string]*portal
+}
+
+// A portal is a statement bound to its parameters.
+type portal struct {
+	stmt    Statement
+	args    []interface{}
+	formats []int16 // result column formats
+	res     *Result // set once executed; sent rows are removed
+}
+
+// msg is an outgoing message being built.
+type msg []byte
+
+func newMsg(typ byte) *msg {
+	m := msg{typ, 0, 0, 0, 0}
+	return &m
+}
+
+func (m *msg) byte(b byte)      { *m = append(*m, b) }
+func (m *msg) bytes(b []byte)   { *m = append(*m, b...) }
+func (m *msg) cstring(s string) { *m = append(append(*m, s...), 0) }
+func (m *msg) int16(n int)      { *m = binary.BigEndian.AppendUint16(*m, uint16(n)) }
+func (m *msg) int32(n int32)    { *m = binary.BigEndian.AppendUint32(*m, uint32(n)) }
+
+// finish fills in the message length and returns the message.
+func (m *msg) finish() []byte {
+	binary.BigEndian.PutUint32((*m)[1:], uint32(len(*m)-1))
+	return *m
+}
+
+// reader decodes an incoming message body. A short message sets err and
+// makes every later read return zero values.
+type reader struct {
+	b   []byte
+	err error
+}
+
+var errShort = errors.New("fakepg: message too short")
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil || n < 0 || len(r.b) < n {
+		r.err = errShort
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) int16() int {
+	if b := r.next(2); b != nil {
+		return int(int16(binary.BigEndian.Uint16(b)))
+	}
+	return 0
+}
+
+func (r *reader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *reader) cstring() string {
+	for i, c := range r.b {
+		if c == 0 {
+			s := string(r.b[:i])
+			r.b = r.b[i+1:]
+			return s
+		}
+	}
+	r.err = errShort
+	return ""
+}
+
+// send queues m to be written at the next flush.
+func (c *conn) send(m *msg) {
+	c.wmu.Lock()
+	c.w.Write(m.finish())
+	c.wmu.Unlock()
+}
+
+// sendNow writes m and flushes it, whatever the client is doing.
+func (c *conn) sendNow(m *msg) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.w.Write(m.finish())
+	return c.w.Flush()
+}
+
+func (c *conn) flush() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.w.Flush()
+}
+
+func errorMsg(e *Error) *msg {
+	m := newMsg('E')
+	for _, f := range []struct {
+		code byte
+		v    string
+	}{
+		{'S', e.severity()},
+		{'V', e.severity()},
+		{'C', e.Code},
+		{'M', e.Message},
+		{'D', e.Detail},
+		{'s', e.Schema},
+		{'t', e.Table},
+		{'c', e.Column},
+		{'n', e.Constraint},
+	} {
+		if f.v != "" {
+			m.byte(f.code)
+			m.cstring(f.v)
+		}
+	}
+	m.byte(0)
+	return m
+}
+
+// sendError sends err to the client as an ErrorResponse.
+func (c *conn) sendError(err error) {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Code: "XX000", Message: err.Error()}
+	}
+	c.send(errorMsg(e))
+}
+
+func (c *conn) readyForQuery() {
+	m := newMsg('Z')
+	m.byte(c.sess.TxStatus())
+	c.send(m)
+	c.flush()
+}
+
+// readMsg reads a typed message from the client.
+func (c *conn) readMsg() (byte, *reader, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(binary.BigEndian.Uint32(hdr[1:])) - 4
+	if n < 0 || n > maxMessage {
+		return 0, nil, fmt.Errorf("fakepg: bad message length %d", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], &reader{b: body}, nil
+}
+
+// readStartup reads an untyped startup-phase packet.
+func (c *conn) readStartup() (*reader, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint32(hdr[:])) - 4
+	if n < 4 || n > 10000 {
+		return nil, fmt.Errorf("fakepg: bad startup packet length %d", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return nil, err
+	}
+	return &reader{b: body}, nil
+}
+
+// fatal sends a FATAL error; the connection is closed by the caller.
+func (c *conn) fatal(code, format string, args ...interface{}) {
+	e := errorf(code, format, args...)
+	e.Severity = "FATAL"
+	c.sendNow(errorMsg(e))
+}
+
+func (c *conn) serve(pid int32) {
+	if !c.startup(pid) {
+		return
+	}
+	defer c.sess.Close()
+	skipToSync := false // after an error in the extended protocol
+	for {
+		typ, r, err := c.readMsg()
+		if err != nil {
+			return
+		}
+		if skipToSync && typ != 'S' && typ != 'X' {
+			continue
+		}
+		switch typ {
+		case 'Q':
+			c.simpleQuery(r.cstring())
+			c.readyForQuery()
+		case 'P', 'B', 'D', 'E', 'C':
+			if err := c.extended(typ, r); err != nil {
+				c.sendError(err)
+				skipToSync = true
+			}
+		case 'H':
+			c.flush()
+		case 'S':
+			skipToSync = false
+			c.readyForQuery()
+		case 'X':
+			return
+		case 'd', 'c', 'f':
+			// Copy messages outside of COPY are ignored.
+		default:
+			c.fatal("08P01", "invalid frontend message type %d", typ)
+			return
+		}
+	}
+}
+
+// startup runs the startup and authentication phases, reporting whether
+// the client may go on to send queries.
+func (c *conn) startup(pid int32) bool {
+	var r *reader
+	for {
+		var err error
+		if r, err = c.readStartup(); err != nil {
+			return false
+		}
+		code := r.int32()
+		if code == sslRequestCode {
+			c.nc.Write([]byte{'N'})
+			continue
+		}
+		if code == cancelCode {
+			return false
+		}
+		if code != protocolVersion3 {
+			c.fatal("0A000", "unsupported frontend protocol %d.%d", code>>16, code&0xffff)
+			return false
+		}
+		break
+	}
+	params := map[string]string{}
+	for {
+		k := r.cstring()
+		if k == "" || r.err != nil {
+			break
+		}
+		params[k] = r.cstring()
+	}
+	user := params["user"]
+	if user == "" {
+		c.fatal("28000", "no PostgreSQL user name specified in startup packet")
+		return false
+	}
+	if !c.authenticate(user) {
+		return false
+	}
+	db := params["database"]
+	if db == "" {
+		db = user
+	}
+	c.client = &Client{User: user, Database: db, Params: params, PID: pid, c: c}
+	c.sess = c.srv.Handler.NewSession(c.client)
+
+	m := newMsg('R')
+	m.int32(0)
+	c.send(m)
+	appName := params["application_name"]
+	for _, p := range [][2]string{
+		{"application_name", appName},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"integer_datetimes", "on"},
+		{"IntervalStyle", "postgres"},
+		{"is_superuser", "on"},
+		{"server_encoding", "UTF8"},
+		{"server_version", ServerVersion},
+		{"session_authorization", user},
+		{"standard_conforming_strings", "on"},
+		{"TimeZone", "UTC"},
+	} {
+		c.paramStatus(p[0], p[1])
+	}
+	key := make([]byte, 4)
+	c.srv.random(key)
+	m = newMsg('K')
+	m.int32(pid)
+	m.bytes(key)
+	c.send(m)
+	c.readyForQuery()
+	return true
+}
+
+func (c *conn) paramStatus(name, value string) {
+	m := newMsg('S')
+	m.cstring(name)
+	m.cstring(value)
+	c.send(m)
+}
+
+// authenticate asks for and checks the user's password.
+func (c *conn) authenticate(user string) bool {
+	s := c.srv
+	if s.Auth == AuthTrust {
+		return true
+	}
+	m := newMsg('R')
+	want := s.Password
+	if s.Auth == AuthMD5 {
+		salt := make([]byte, 4)
+		s.random(salt)
+		m.int32(5)
+		m.bytes(salt)
+		want = "md5" + md5Hex(md5Hex(s.Password+user)+string(salt))
+	} else {
+		m.int32(3)
+	}
+	if c.sendNow(m) != nil {
+		return false
+	}
+	typ, r, err := c.readMsg()
+	if err != nil {
+		return false
+	}
+	if typ != 'p' {
+		c.fatal("08P01", "expected password response, got message type %d", typ)
+		return false
+	}
+	if r.cstring() != want {
+		c.fatal("28P01", "password authentication failed for user %q", user)
+		return false
+	}
+	return true
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// simpleQuery runs each statement of a Query message in turn, stopping
+// at the first error.
+func (c *conn) simpleQuery(q string) {
+	if !utf8.ValidString(q) {
+		c.sendError(invalidUTF8([]byte(q)))
+		return
+	}
+	stmts, err := splitStatements(q)
+	if err != nil {
+		c.sendError(err)
+		return
+	}
+	if len(stmts) == 0 {
+		c.send(newMsg('I'))
+		return
+	}
+	for _, q := range stmts {
+		if c.deallocate(q) {
+			continue
+		}
+		st, err := c.sess.Prepare(q, nil)
+		if err != nil {
+			c.sendError(err)
+			return
+		}
+		if n := len(st.ParamTypes()); n > 0 {
+			st.Close()
+			c.sendError(errorf("42P02", "there is no parameter $%d", n))
+			return
+		}
+		if cols := st.Columns(); cols != nil {
+			c.rowDescription(cols, nil)
+		}
+		res, err := st.Exec(nil)
+		st.Close()
+		if err == nil {
+			err = c.sendResult(st.Columns(), nil, res, 0)
+		}
+		if err != nil {
+			c.sendError(err)
+			return
+		}
+	}
+}
+
+// deallocate handles DEALLOCATE, which acts on the connection's
+// prepared statements rather than on the session, and reports whether
+// q was one.
+func (c *conn) deallocate(q string) bool {
+	toks, err := lex(q)
+	if err != nil || len(toks) < 2 || !toks[0].is("deallocate") {
+		return false
+	}
+	toks = toks[1:]
+	if toks[0].is("prepare") {
+		toks = toks[1:]
+	}
+	if len(toks) != 1 || (toks[0].kind != tokIdent && toks[0].kind != tokQuotedIdent) {
+		return false
+	}
+	if toks[0].is("all") {
+		for name, st := range c.stmts {
+			st.Close()
+			delete(c.stmts, name)
+		}
+		c.commandComplete("DEALLOCATE ALL")
+		return true
+	}
+	name := toks[0].text
+	st, ok := c.stmts[name]
+	if !ok {
+		c.sendError(errorf("26000", "prepared statement %q does not exist", name))
+		return true
+	}
+	st.Close()
+	delete(c.stmts, name)
+	c.commandComplete("DEALLOCATE")
+	return true
+}
+
+func (c *conn) commandComplete(tag string) {
+	m := newMsg('C')
+	m.cstring(tag)
+	c.send(m)
+}
+
+// rowDescription describes cols, in the given formats (all text if nil).
+func (c *conn) rowDescription(cols []Column, formats []int16) {
+	m := newMsg('T')
+	m.int16(len(cols))
+	for i, col := range cols {
+		typ := col.Type
+		if typ == UnknownOid {
+			typ = TextOid
+		}
+		m.cstring(col.Name)
+		m.int32(0) // table OID
+		m.int16(0) // attribute number
+		m.int32(int32(typ))
+		m.int16(int(typ.size()))
+		m.int32(-1) // type modifier
+		m.int16(int(format(formats, i)))
+	}
+	c.send(m)
+}
+
+// format returns the format code for column i: formats may hold one
+// code per column, a single code for all of them, or none for text.
+func format(formats []int16, i int) int16 {
+	switch len(formats) {
+	case 0:
+		return 0
+	case 1:
+		return formats[0]
+	}
+	if i < len(formats) {
+		return formats[i]
+	}
+	return 0
+}
+
+// sendResult sends the rows of res from row start on, handling COPY
+// FROM STDIN if res asks for it, and then its command tag. If maxRows
+// is positive and more rows remain after that many, it sends
+// PortalSuspended instead and returns errSuspended.
+func (c *conn) sendResult(cols []Column, formats []int16, res *Result, maxRows int) error {
+	for name, v := range res.Params {
+		c.paramStatus(name, v)
+	}
+	if res.CopyIn != nil {
+		tag, err := c.copyIn(res)
+		if err != nil {
+			return err
+		}
+		c.commandComplete(tag)
+		return nil
+	}
+	for n := 0; len(res.Rows) > 0; n++ {
+		if maxRows > 0 && n == maxRows {
+			c.send(newMsg('s'))
+			return errSuspended
+		}
+		if err := c.dataRow(cols, formats, res.Rows[0]); err != nil {
+			return err
+		}
+		res.Rows = res.Rows[1:]
+	}
+	c.commandComplete(res.Tag)
+	return nil
+}
+
+var errSuspended = errors.New("fakepg: portal suspended")
+
+func (c *conn) dataRow(cols []Column, formats []int16, row []interface{}) error {
+	if len(row) != len(cols) {
+		return fmt.Errorf("fakepg: row has %d values for %d columns", len(row), len(cols))
+	}
+	m := newMsg('D')
+	m.int16(len(row))
+	for i, v := range row {
+		if v == nil {
+			m.int32(-1)
+			continue
+		}
+		var b []byte
+		var err error
+		if format(formats, i) == 1 {
+			b, err = encodeBinary(cols[i].Type, v)
+		} else {
+			b, err = formatText(cols[i].Type, v, time.UTC)
+		}
+		if err != nil {
+			return err
+		}
+		m.int32(int32(len(b)))
+		m.bytes(b)
+	}
+	c.send(m)
+	return nil
+}
+
+// copyIn runs the COPY FROM STDIN sub-protocol.
+func (c *conn) copyIn(res *Result) (string, error) {
+	m := newMsg('G')
+	m.byte(0)
+	m.int16(res.CopyColumns)
+	for i := 0; i < res.CopyColumns; i++ {
+		m.int16(0)
+	}
+	c.send(m)
+	c.flush()
+	var data []byte
+	for {
+		typ, r, err := c.readMsg()
+		if err != nil {
+			return "", err
+		}
+		switch typ {
+		case 'd':
+			data = append(data, r.b...)
+		case 'c':
+			return res.CopyIn(data)
+		case 'f':
+			return "", errorf("57014", "COPY from stdin failed: %s", r.cstring())
+		case 'H', 'S':
+		default:
+			return "", errorf("08P01", "unexpected message type 0x%02x during COPY from stdin", typ)
+		}
+	}
+}
+
+// extended handles a message of the extended query protocol.
+func (c *conn) extended(typ byte, r *reader) error {
+	switch typ {
+	case 'P':
+		name, q := r.cstring(), r.cstring()
+		types := make([]Oid, r.int16())
+		for i := range types {
+			types[i] = Oid(r.int32())
+		}
+		if r.err != nil {
+			return errorf("08P01", "invalid Parse message")
+		}
+		if !utf8.ValidString(q) {
+			return invalidUTF8([]byte(q))
+		}
+		if _, ok := c.stmts[name]; ok && name != "" {
+			return errorf("42P05", "prepared statement %q already exists", name)
+		}
+		st, err := c.sess.Prepare(q, types)
+		if err != nil {
+			return err
+		}
+		if old, ok := c.stmts[name]; ok {
+			old.Close()
+		}
+		c.stmts[name] = st
+		c.send(newMsg('1'))
+	case 'B':
+		return c.bind(r)
+	case 'D':
+		kind, name := r.byte(), r.cstring()
+		if kind == 'S' {
+			st, ok := c.stmts[name]
+			if !ok {
+				return errorf("26000", "prepared statement %q does not exist", name)
+			}
+			m := newMsg('t')
+			m.int16(len(st.ParamTypes()))
+			for _, t := range st.ParamTypes() {
+				m.int32(int32(t))
+			}
+			c.send(m)
+			c.describeRows(st.Columns(), nil)
+			return nil
+		}
+		p, ok := c.portals[name]
+		if !ok {
+			return errorf("34000", "portal %q does not exist", name)
+		}
+		c.describeRows(p.stmt.Columns(), p.formats)
+	case 'E':
+		name, maxRows := r.cstring(), r.int32()
+		p, ok := c.portals[name]
+		if !ok {
+			return errorf("34000", "portal %q does not exist", name)
+		}
+		if p.res == nil {
+			res, err := p.stmt.Exec(p.args)
+			if err != nil {
+				return err
+			}
+			p.res = res
+		}
+		err := c.sendResult(p.stmt.Columns(), p.formats, p.res, int(maxRows))
+		if err == errSuspended {
+			return nil
+		}
+		return err
+	case 'C':
+		kind, name := r.byte(), r.cstring()
+		if kind == 'S' {
+			if st, ok := c.stmts[name]; ok {
+				st.Close()
+				delete(c.stmts, name)
+			}
+		} else {
+			delete(c.portals, name)
+		}
+		c.send(newMsg('3'))
+	}
+	return nil
+}
+
+func (c *conn) describeRows(cols []Column, formats []int16) {
+	if cols == nil {
+		c.send(newMsg('n'))
+		return
+	}
+	c.rowDescription(cols, formats)
+}
+
+// bind handles a Bind message, decoding its parameters into Go values.
+func (c *conn) bind(r *reader) error {
+	pname, name := r.cstring(), r.cstring()
+	st, ok := c.stmts[name]
+	if !ok {
+		return errorf("26000", "prepared statement %q does not exist", name)
+	}
+	paramFormats := make([]int16, r.int16())
+	for i := range paramFormats {
+		paramFormats[i] = int16(r.int16())
+	}
+	types := st.ParamTypes()
+	n := r.int16()
+	if r.err == nil && n != len(types) {
+		return errorf("08P01", "bind message supplies %d parameters, but prepared statement %q requires %d", n, name, len(types))
+	}
+	args := make([]interface{}, n)
+	for i := range args {
+		size := r.int32()
+		if size < 0 {
+			continue
+		}
+		b := r.next(int(size))
+		if r.err != nil {
+			break
+		}
+		v, err := decodeParam(types[i], format(paramFormats, i), b)
+		if err != nil {
+			return err
+		}
+		args[i] = v
+	}
+	formats := make([]int16, r.int16())
+	for i := range formats {
+		formats[i] = int16(r.int16())
+	}
+	if r.err != nil {
+		return errorf("08P01", "invalid Bind message")
+	}
+	c.portals[pname] = &portal{stmt: st, args: args, formats: formats}
+	c.send(newMsg('2'))
+	return nil
+}
+
+// splitStatements splits a simple Query message into its statements,
+// dropping empty ones.
+func splitStatements(q string) ([]string, error) {
+	toks, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+	var stmts []string
+	start := -1
+	for _, t := range toks {
+		if t.kind == tokOp && t.text == ";" {
+			if start >= 0 {
+				stmts = append(stmts, strings.TrimSpace(q[start:t.pos]))
+			}
+			start = -1
+			continue
+		}
+		if start < 0 {
+			start = t.pos
+		}
+	}
+	if start >= 0 {
+		stmts = append(stmts, strings.TrimSpace(q[start:]))
+	}
+	return stmts, nil
+}
@@ -0,0 +1,765 @@
+package fakepg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// category groups the types that convert and compare with each other.
+type category int
+
+const (
+	catOther category = iota
+	catBool
+	catNumber
+	catString
+	catBytea
+	catTime
+)
+
+func (t Oid) category() category {
+	switch t {
+	case BoolOid:
+		return catBool
+	case Int2Oid, Int4Oid, Int8Oid, Float4Oid, Float8Oid, NumericOid:
+		return catNumber
+	case TextOid, VarcharOid, UnknownOid:
+		return catString
+	case ByteaOid:
+		return catBytea
+	case DateOid, TimeOid, TimestampOid, TimestamptzOid:
+		return catTime
+	}
+	return catOther
+}
+
+// numericRank orders the number types by how wide they are, for the
+// result type of arithmetic.
+func numericRank(t Oid) int {
+	switch t {
+	case Int2Oid:
+		return 1
+	case Int4Oid:
+		return 2
+	case Int8Oid:
+		return 3
+	case NumericOid:
+		return 4
+	case Float4Oid:
+		return 5
+	case Float8Oid:
+		return 6
+	}
+	return 0
+}
+
+// numeric is a value of type numeric: an exact decimal shown with scale
+// digits after the point.
+type numeric struct {
+	r     *big.Rat
+	scale int
+}
+
+func (n numeric) String() string { return n.r.FloatString(n.scale) }
+
+func (n numeric) float() float64 {
+	f, _ := n.r.Float64()
+	return f
+}
+
+var numericSyntax = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?$`)
+
+func parseNumeric(s string) (numeric, error) {
+	s = strings.TrimSpace(s)
+	m := numericSyntax.FindStringSubmatch(s)
+	if m == nil {
+		return numeric{}, errorf("22P02", "invalid input syntax for type numeric: %q", s)
+	}
+	scale := 0
+	if i := strings.IndexByte(m[1], '.'); i >= 0 {
+		scale = len(m[1]) - i - 1
+	}
+	if m[2] != "" {
+		exp, _ := strconv.Atoi(m[2][1:])
+		if scale -= exp; scale < 0 {
+			scale = 0
+		}
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return numeric{}, errorf("22P02", "invalid input syntax for type numeric: %q", s)
+	}
+	return numeric{r, scale}, nil
+}
+
+func intNumeric(n int64) numeric { return numeric{new(big.Rat).SetInt64(n), 0} }
+
+// round returns n rounded to scale digits after the point, halves away
+// from zero.
+func (n numeric) round(scale int) numeric {
+	r, _ := new(big.Rat).SetString(n.r.FloatString(scale))
+	return numeric{r, scale}
+}
+
+// invalidUTF8 is the error for text that is not valid UTF-8 or contains
+// NUL, which Postgres cannot store.
+func invalidUTF8(b []byte) *Error {
+	i := 0
+	for i < len(b) {
+		r, n := utf8.DecodeRune(b[i:])
+		if r == 0 || r == utf8.RuneError && n <= 1 {
+			break
+		}
+		i += n
+	}
+	bad := "0x00"
+	if i < len(b) {
+		bad = fmt.Sprintf("0x%02x", b[i])
+	}
+	return errorf("22021", `invalid byte sequence for encoding "UTF8": %s`, bad)
+}
+
+func checkText(b []byte) error {
+	if !utf8.Valid(b) || bytes.IndexByte(b, 0) >= 0 {
+		return invalidUTF8(b)
+	}
+	return nil
+}
+
+// decodeParam converts a parameter value sent in a Bind message.
+func decodeParam(t Oid, format int16, b []byte) (interface{}, error) {
+	if format == 1 {
+		return decodeBinary(t, b)
+	}
+	if err := checkText(b); err != nil {
+		return nil, err
+	}
+	return parseText(t, string(b), time.UTC)
+}
+
+// parseText converts the text form of a value of type t. Times without
+// a zone are taken to be in loc.
+func parseText(t Oid, s string, loc *time.Location) (interface{}, error) {
+	switch t {
+	case BoolOid:
+		switch strings.ToLower(strings.TrimSpace(s)) {
+		case "t", "true", "y", "yes", "on", "1":
+			return true, nil
+		case "f", "false", "n", "no", "off", "0":
+			return false, nil
+		}
+	case Int2Oid, Int4Oid, Int8Oid:
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err == nil {
+			return checkIntRange(t, n)
+		}
+		if err.(*strconv.NumError).Err == strconv.ErrRange {
+			return nil, errorf("22003", "value %q is out of range for type %v", s, t)
+		}
+	case Float4Oid, Float8Oid:
+		bits := 64
+		if t == Float4Oid {
+			bits = 32
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), bits)
+		if err == nil {
+			return f, nil
+		}
+		if err.(*strconv.NumError).Err == strconv.ErrRange {
+			return nil, errorf("22003", "%q is out of range for type %v", s, t)
+		}
+	case NumericOid:
+		return parseNumeric(s)
+	case ByteaOid:
+		return parseBytea(s)
+	case DateOid, TimeOid, TimestampOid, TimestamptzOid:
+		return parseTime(t, s, loc)
+	default:
+		return s, nil
+	}
+	return nil, errorf("22P02", "invalid input syntax for type %v: %q", t, s)
+}
+
+func checkIntRange(t Oid, n int64) (interface{}, error) {
+	switch {
+	case t == Int2Oid && (n < math.MinInt16 || n > math.MaxInt16):
+		return nil, errorf("22003", "smallint out of range")
+	case t == Int4Oid && (n < math.MinInt32 || n > math.MaxInt32):
+		return nil, errorf("22003", "integer out of range")
+	}
+	return n, nil
+}
+
+// parseBytea accepts both the hex and the escape input formats.
+func parseBytea(s string) ([]byte, error) {
+	if strings.HasPrefix(s, `\x`) {
+		b, err := hex.DecodeString(s[2:])
+		if err != nil {
+			return nil, errorf("22023", "invalid hexadecimal data: %v", err)
+		}
+		return b, nil
+	}
+	b := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '\\' {
+			b = append(b, '\\')
+			i++
+			continue
+		}
+		if i+3 >= len(s) {
+			return nil, errorf("22P02", "invalid input syntax for type bytea")
+		}
+		n, err := strconv.ParseUint(s[i+1:i+4], 8, 8)
+		if err != nil {
+			return nil, errorf("22P02", "invalid input syntax for type bytea")
+		}
+		b = append(b, byte(n))
+		i += 3
+	}
+	return b, nil
+}
+
+var (
+	timestampSyntax = regexp.MustCompile(`^(\d{4,})-(\d{1,2})-(\d{1,2})(?:[T ](\d{1,2}):(\d{2})(?::(\d{2})(?:\.(\d+))?)?)?\s*(Z|z|UTC|[+-]\d{1,2}(?::?\d{2}){0,2})?$`)
+	timeSyntax      = regexp.MustCompile(`^(\d{1,2}):(\d{2})(?::(\d{2})(?:\.(\d+))?)?$`)
+)
+
+// parseTime converts the text form of a date or time. Like Postgres, it
+// rounds to microseconds and ignores any zone given for a type without
+// one, and any date given for a time of day.
+func parseTime(t Oid, s string, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	bad := errorf("22007", "invalid input syntax for type %v: %q", t, s)
+	midnight := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	if t == TimeOid {
+		if m := timeSyntax.FindStringSubmatch(s); m != nil {
+			return clock(midnight, m[1], m[2], m[3], m[4], s)
+		}
+		m := timestampSyntax.FindStringSubmatch(s)
+		if m == nil || m[4] == "" {
+			return time.Time{}, bad
+		}
+		return clock(midnight, m[4], m[5], m[6], m[7], s)
+	}
+	m := timestampSyntax.FindStringSubmatch(s)
+	if m == nil {
+		return time.Time{}, bad
+	}
+	year, _ := strconv.Atoi(m[1])
+	month, _ := strconv.Atoi(m[2])
+	day, _ := strconv.Atoi(m[3])
+	date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if date.Year() != year || int(date.Month()) != month || date.Day() != day {
+		return time.Time{}, errorf("22008", "date/time field value out of range: %q", s)
+	}
+	if t == DateOid {
+		return date, nil
+	}
+	v, err := clock(date, m[4], m[5], m[6], m[7], s)
+	if err != nil || t == TimestampOid {
+		return v, err
+	}
+	zone := loc
+	switch z := m[8]; z {
+	case "":
+	case "Z", "z", "UTC":
+		zone = time.UTC
+	default:
+		digits := strings.Replace(z[1:], ":", "", -1)
+		if len(digits)%2 == 1 {
+			digits = "0" + digits
+		}
+		off := 0
+		for i, mul := 0, 3600; i < len(digits); i, mul = i+2, mul/60 {
+			n, _ := strconv.Atoi(digits[i : i+2])
+			off += n * mul
+		}
+		if z[0] == '-' {
+			off = -off
+		}
+		zone = time.FixedZone("", off)
+	}
+	return time.Date(v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), v.Second(), v.Nanosecond(), zone), nil
+}
+
+// clock sets the time of day of date from the hour, minute, second and
+// fraction strings.
+func clock(date time.Time, hh, mm, ss, frac, s string) (time.Time, error) {
+	if hh == "" {
+		return date, nil
+	}
+	h, _ := strconv.Atoi(hh)
+	min, _ := strconv.Atoi(mm)
+	sec, _ := strconv.Atoi(ss)
+	if h > 24 || min > 59 || sec > 60 || h == 24 && (min > 0 || sec > 0 || frac != "") {
+		return time.Time{}, errorf("22008", "date/time field value out of range: %q", s)
+	}
+	ns := 0
+	if frac != "" {
+		for len(frac) < 9 {
+			frac += "0"
+		}
+		ns, _ = strconv.Atoi(frac[:9])
+	}
+	v := date.Add(time.Duration(h)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second + time.Duration(ns))
+	return v.Round(time.Microsecond), nil
+}
+
+// formatText returns the text form of v as a value of type t, showing
+// times with a zone in loc.
+func formatText(t Oid, v interface{}, loc *time.Location) ([]byte, error) {
+	switch v := normalize(v).(type) {
+	case bool:
+		if v {
+			return []byte("t"), nil
+		}
+		return []byte("f"), nil
+	case int64:
+		return strconv.AppendInt(nil, v, 10), nil
+	case float64:
+		return []byte(formatFloat(v, t)), nil
+	case numeric:
+		return []byte(v.String()), nil
+	case []byte:
+		if t == ByteaOid {
+			return []byte(`\x` + hex.EncodeToString(v)), nil
+		}
+		return v, nil
+	case string:
+		if t == ByteaOid {
+			return []byte(`\x` + hex.EncodeToString([]byte(v))), nil
+		}
+		return []byte(v), nil
+	case time.Time:
+		return []byte(formatTime(t, v, loc)), nil
+	}
+	return nil, fmt.Errorf("fakepg: cannot send %T as %v", v, t)
+}
+
+func formatFloat(f float64, t Oid) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case t == Float4Oid:
+		return strconv.FormatFloat(f, 'g', -1, 32)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func formatTime(t Oid, v time.Time, loc *time.Location) string {
+	switch t {
+	case DateOid:
+		return v.Format("2006-01-02")
+	case TimeOid:
+		return v.Format("15:04:05.999999")
+	case TimestamptzOid:
+		v = v.In(loc)
+		s := v.Format("2006-01-02 15:04:05.999999-07")
+		if _, off := v.Zone(); off%3600 != 0 {
+			s = v.Format("2006-01-02 15:04:05.999999-07:00")
+		}
+		return s
+	}
+	return v.Format("2006-01-02 15:04:05.999999")
+}
+
+// normalize converts the Go types a Script may use to those handlers
+// work with.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	}
+	return v
+}
+
+// pgEpoch is the zero of binary dates and timestamps.
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// encodeBinary returns the binary form of v as a value of type t.
+func encodeBinary(t Oid, v interface{}) ([]byte, error) {
+	v = normalize(v)
+	var b []byte
+	switch t {
+	case BoolOid:
+		if v, ok := v.(bool); ok {
+			if v {
+				return []byte{1}, nil
+			}
+			return []byte{0}, nil
+		}
+	case Int2Oid:
+		if v, ok := v.(int64); ok {
+			return binary.BigEndian.AppendUint16(b, uint16(v)), nil
+		}
+	case Int4Oid:
+		if v, ok := v.(int64); ok {
+			return binary.BigEndian.AppendUint32(b, uint32(v)), nil
+		}
+	case Int8Oid:
+		if v, ok := v.(int64); ok {
+			return binary.BigEndian.AppendUint64(b, uint64(v)), nil
+		}
+	case Float4Oid:
+		if v, ok := v.(float64); ok {
+			return binary.BigEndian.AppendUint32(b, math.Float32bits(float32(v))), nil
+		}
+	case Float8Oid:
+		if v, ok := v.(float64); ok {
+			return binary.BigEndian.AppendUint64(b, math.Float64bits(v)), nil
+		}
+	case ByteaOid, TextOid, VarcharOid, UnknownOid:
+		switch v := v.(type) {
+		case []byte:
+			return v, nil
+		case string:
+			return []byte(v), nil
+		}
+	case DateOid:
+		if v, ok := v.(time.Time); ok {
+			days := v.Sub(pgEpoch) / (24 * time.Hour)
+			return binary.BigEndian.AppendUint32(b, uint32(days)), nil
+		}
+	case TimeOid:
+		if v, ok := v.(time.Time); ok {
+			h, m, s := v.Clock()
+			us := int64(h*3600+m*60+s)*1e6 + int64(v.Nanosecond()/1e3)
+			return binary.BigEndian.AppendUint64(b, uint64(us)), nil
+		}
+	case TimestampOid, TimestamptzOid:
+		if v, ok := v.(time.Time); ok {
+			if t == TimestampOid {
+				v = wallUTC(v)
+			}
+			return binary.BigEndian.AppendUint64(b, uint64(microsSince(pgEpoch, v))), nil
+		}
+	default:
+		return nil, errorf("0A000", "binary output for type %v is not supported", t)
+	}
+	return nil, fmt.Errorf("fakepg: cannot send %T as %v", v, t)
+}
+
+// decodeBinary converts a value in binary format.
+func decodeBinary(t Oid, b []byte) (interface{}, error) {
+	size := map[Oid]int{BoolOid: 1, Int2Oid: 2, Int4Oid: 4, Float4Oid: 4, DateOid: 4, Int8Oid: 8, Float8Oid: 8, TimeOid: 8, TimestampOid: 8, TimestamptzOid: 8}
+	if n, ok := size[t]; ok && len(b) != n {
+		return nil, errorf("22P03", "incorrect binary data format in bind parameter")
+	}
+	switch t {
+	case BoolOid:
+		return b[0] != 0, nil
+	case Int2Oid:
+		return int64(int16(binary.BigEndian.Uint16(b))), nil
+	case Int4Oid:
+		return int64(int32(binary.BigEndian.Uint32(b))), nil
+	case Int8Oid:
+		return int64(binary.BigEndian.Uint64(b)), nil
+	case Float4Oid:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case Float8Oid:
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case ByteaOid:
+		return append([]byte{}, b...), nil
+	case TextOid, VarcharOid, UnknownOid:
+		if err := checkText(b); err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case DateOid:
+		return pgEpoch.AddDate(0, 0, int(int32(binary.BigEndian.Uint32(b)))), nil
+	case TimeOid:
+		return pgEpoch.Add(time.Duration(binary.BigEndian.Uint64(b)) * time.Microsecond), nil
+	case TimestampOid, TimestamptzOid:
+		us := int64(binary.BigEndian.Uint64(b))
+		return pgEpoch.Add(time.Duration(us/1e6)*time.Second + time.Duration(us%1e6)*time.Microsecond), nil
+	}
+	return nil, errorf("0A000", "binary input for type %v is not supported", t)
+}
+
+func microsSince(epoch, t time.Time) int64 {
+	d := t.Unix() - epoch.Unix()
+	return d*1e6 + int64(t.Nanosecond()/1e3)
+}
+
+// wallUTC returns the time in UTC with the same clock reading as t.
+func wallUTC(t time.Time) time.Time {
+	y, mo, d := t.Date()
+	h, mi, s := t.Clock()
+	return time.Date(y, mo, d, h, mi, s, t.Nanosecond(), time.UTC)
+}
+
+// coerce converts v, a value of type from, to type to, as an assignment
+// or cast does. Times without a zone are taken to be in loc.
+func coerce(v interface{}, from, to Oid, loc *time.Location) (interface{}, error) {
+	v = normalize(v)
+	if v == nil || from == to && to != Float4Oid {
+		return v, nil
+	}
+	cannot := errorf("42846", "cannot cast type %v to %v", from, to)
+	if s, ok := v.(string); ok && to.category() != catString {
+		return parseText(to, s, loc)
+	}
+	switch to {
+	case TextOid, VarcharOid, UnknownOid:
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+		b, err := formatText(from, v, loc)
+		return string(b), err
+	case BoolOid:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+		if n, ok := v.(int64); ok && from.category() == catNumber {
+			return n != 0, nil
+		}
+	case Int2Oid, Int4Oid, Int8Oid:
+		switch v := v.(type) {
+		case int64:
+			return checkIntRange(to, v)
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) || math.Abs(v) >= 1<<63 {
+				return nil, errorf("22003", "%v out of range", to)
+			}
+			return checkIntRange(to, int64(math.RoundToEven(v)))
+		case numeric:
+			n := v.round(0).r.Num()
+			if !n.IsInt64() {
+				return nil, errorf("22003", "%v out of range", to)
+			}
+			return checkIntRange(to, n.Int64())
+		case bool:
+			if v {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		}
+	case Float4Oid, Float8Oid:
+		var f float64
+		switch v := v.(type) {
+		case int64:
+			f = float64(v)
+		case float64:
+			f = v
+		case numeric:
+			f = v.float()
+		default:
+			return nil, cannot
+		}
+		if to == Float4Oid {
+			f32 := float32(f)
+			if math.IsInf(float64(f32), 0) && !math.IsInf(f, 0) {
+				return nil, errorf("22003", "value out of range: overflow")
+			}
+			f = float64(f32)
+		}
+		return f, nil
+	case NumericOid:
+		switch v := v.(type) {
+		case int64:
+			return intNumeric(v), nil
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, errorf("22P02", "cannot convert %v to numeric", formatFloat(v, from))
+			}
+			return parseNumeric(strconv.FormatFloat(v, 'f', -1, 64))
+		case numeric:
+			return v, nil
+		}
+	case ByteaOid:
+		if b, ok := v.([]byte); ok {
+			return b, nil
+		}
+	case DateOid, TimeOid, TimestampOid, TimestamptzOid:
+		tv, ok := v.(time.Time)
+		if !ok {
+			return nil, cannot
+		}
+		if from == TimestamptzOid {
+			tv = wallUTC(tv.In(loc))
+		}
+		switch to {
+		case DateOid:
+			y, m, d := tv.Date()
+			return time.Date(y, m, d, 0, 0, 0, 0, time.UTC), nil
+		case TimeOid:
+			h, m, s := tv.Clock()
+			return time.Date(2000, 1, 1, h, m, s, tv.Nanosecond(), time.UTC), nil
+		case TimestamptzOid:
+			if from != TimestamptzOid {
+				y, mo, d := tv.Date()
+				h, mi, s := tv.Clock()
+				return time.Date(y, mo, d, h, mi, s, tv.Nanosecond(), loc), nil
+			}
+			return v, nil
+		}
+		return tv, nil
+	}
+	return nil, cannot
+}
+
+// Convert converts v, nil or one of bool, int64, float64, string,
+// []byte and time.Time, to the Go type of values of type t, as casting
+// it would. It lets handlers of other protocols pass their parameters
+// to a DB.
+func Convert(v interface{}, t Oid) (interface{}, error) {
+	from := TextOid
+	switch v.(type) {
+	case bool:
+		from = BoolOid
+	case int64:
+		from = Int8Oid
+	case float64:
+		from = Float8Oid
+	case []byte:
+		from = ByteaOid
+	case time.Time:
+		from = TimestampOid
+	}
+	return coerce(v, from, t, time.UTC)
+}
+
+// valueKey returns a string equal for two non-NULL values exactly when
+// they compare equal, for unique indexes, DISTINCT and the like.
+func valueKey(v interface{}) string {
+	switch v := v.(type) {
+	case int64:
+		return "i" + strconv.FormatInt(v, 10)
+	case float64:
+		if v == 0 {
+			v = 0 // -0 equals 0
+		}
+		return "f" + strconv.FormatFloat(v, 'g', -1, 64)
+	case numeric:
+		return "n" + v.r.RatString()
+	case string:
+		return "s" + v
+	case []byte:
+		return "b" + string(v)
+	case bool:
+		return "t" + strconv.FormatBool(v)
+	case time.Time:
+		return "d" + v.UTC().Format(time.RFC3339Nano)
+	}
+	panic(errorf("XX000", "unexpected value %T", v))
+}
+
+// compare orders two non-NULL values of types that compare with each
+// other. NaN sorts above every other float, as in Postgres.
+func compare(a, b interface{}) (int, error) {
+	switch a := a.(type) {
+	case int64:
+		switch b := b.(type) {
+		case int64:
+			return cmpInt(a, b), nil
+		case float64:
+			return cmpFloat(float64(a), b), nil
+		case numeric:
+			return intNumeric(a).r.Cmp(b.r), nil
+		}
+	case float64:
+		switch b := b.(type) {
+		case int64:
+			return cmpFloat(a, float64(b)), nil
+		case float64:
+			return cmpFloat(a, b), nil
+		case numeric:
+			return cmpFloat(a, b.float()), nil
+		}
+	case numeric:
+		switch b := b.(type) {
+		case int64:
+			return a.r.Cmp(intNumeric(b).r), nil
+		case float64:
+			return cmpFloat(a.float(), b), nil
+		case numeric:
+			return a.r.Cmp(b.r), nil
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), nil
+		}
+	case []byte:
+		if b, ok := b.([]byte); ok {
+			return bytes.Compare(a, b), nil
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0, nil
+			case b:
+				return -1, nil
+			}
+			return 1, nil
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			switch {
+			case a.Before(b):
+				return -1, nil
+			case a.After(b):
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	return 0, fmt.Errorf("fakepg: cannot compare %T with %T", a, b)
+}
+
+func cmpInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func cmpFloat(a, b float64) int {
+	switch {
+	case math.IsNaN(a) && math.IsNaN(b):
+		return 0
+	case math.IsNaN(a):
+		return 1
+	case math.IsNaN(b):
+		return -1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,385 @@
+// Package faultproxy is a TCP proxy that injects network faults between
+// a database driver and its server, real or fake.
+//
+// A Proxy forwards the bytes of each connection unchanged until a Fault
+// armed on it strikes. Faults are placed by byte count in one direction
+// of the connection: a fault with After 3 on ToClient strikes after the
+// next 3 bytes from the server have been forwarded, which is partway
+// through the header of a reply in both the Postgres and MySQL
+// protocols. Faults are armed on new connections by the Proxy's Faults
+// schedule and on open ones by Inject. Each strikes once. A Proxy's Tap
+// sees every byte it forwards, for recording sessions.
+package faultproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Direction is the way bytes flow through a proxied connection.
+type Direction int
+
+const (
+	ToServer Direction = iota // from the driver to the server
+	ToClient                  // from the server to the driver
+)
+
+func (d Direction) String() string {
+	if d == ToServer {
+		return "to server"
+	}
+	return "to client"
+}
+
+// An Action is what happens when a fault strikes.
+type Action int
+
+const (
+	// Delay holds the rest of the bytes for the fault's Delay.
+	Delay Action = iota
+
+	// Corrupt flips the bits of Mask in the next byte.
+	Corrupt
+
+	// Truncate closes both sides of the connection normally, as if
+	// the peer had exited, dropping the rest of the bytes.
+	Truncate
+
+	// Reset aborts both sides of the connection with a TCP reset.
+	Reset
+
+	// HalfClose shuts down the connection in the fault's direction
+	// only: the receiver reads end of file, while its own writes keep
+	// reaching the other side.
+	HalfClose
+)
+
+var actionNames = []string{"delay", "corrupt", "truncate", "reset", "half-close"}
+
+func (a Action) String() string {
+	if int(a) < len(actionNames) {
+		return actionNames[a]
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// A Fault is a misbehavior of the network.
+type Fault struct {
+	Dir    Direction
+	After  int64 // bytes forwarded in Dir, once armed, before it strikes
+	Action Action
+	Delay  time.Duration // for Delay
+	Mask   byte          // for Corrupt; 0xff if zero
+}
+
+func (f Fault) String() string {
+	s := fmt.Sprintf("%v %v after %d bytes", f.Action, f.Dir, f.After)
+	switch f.Action {
+	case Delay:
+		s += fmt.Sprintf(" for %v", f.Delay)
+	case Corrupt:
+		s += fmt.Sprintf(" with mask %#02x", f.mask())
+	}
+	return s
+}
+
+func (f Fault) mask() byte {
+	if f.Mask == 0 {
+		return 0xff
+	}
+	return f.Mask
+}
+
+// A Proxy accepts connections on a loopback TCP port and forwards each
+// to Target.
+type Proxy struct {
+	Target string // host:port of the server
+
+	// Faults, if not nil, is called for each connection accepted, the
+	// first being 0. The faults it returns are armed from the start of
+	// the connection.
+	Faults func(n int) []Fault
+
+	// Tap, if not nil, is called with the bytes of the nth connection
+	// as they are forwarded in direction d, and with nil once that
+	// direction ends. Calls for one direction of a connection are made
+	// in order, from one goroutine.
+	Tap func(n int, d Direction, b []byte)
+
+	ln       net.Listener
+	mu       sync.Mutex
+	links    map[*link]bool
+	accepted int
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// Start starts the proxy listening on an ephemeral port of 127.0.0.1.
+func (p *Proxy) Start() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	p.ln = ln
+	p.links = map[*link]bool{}
+	p.wg.Add(1)
+	go p.serve()
+	return nil
+}
+
+// Addr returns the host:port the proxy is listening on.
+func (p *Proxy) Addr() string { return p.ln.Addr().String() }
+
+// Close stops the proxy and closes every connection.
+func (p *Proxy) Close() error {
+	err := p.ln.Close()
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.CloseConns()
+	p.wg.Wait()
+	return err
+}
+
+// Accepted returns the number of connections the proxy has accepted.
+func (p *Proxy) Accepted() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.accepted
+}
+
+// Inject arms faults on every open connection, counting their After
+// from the bytes forwarded so far.
+func (p *Proxy) Inject(faults ...Fault) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for l := range p.links {
+		l.arm(faults)
+	}
+}
+
+// CloseConns aborts every open connection with a TCP reset, as a server
+// killing its sessions would.
+func (p *Proxy) CloseConns() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for l := range p.links {
+		l.close(true)
+	}
+}
+
+func (p *Proxy) serve() {
+	defer p.wg.Done()
+	for {
+		client, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		n := p.accepted
+		p.accepted++
+		p.mu.Unlock()
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.proxy(client, n)
+		}()
+	}
+}
+
+// proxy forwards the nth connection accepted, client, until both sides
+// of it are closed.
+func (p *Proxy) proxy(client net.Conn, n int) {
+	server, err := net.Dial("tcp", p.Target)
+	if err != nil {
+		client.Close()
+		return
+	}
+	l := &link{conns: [2]net.Conn{ToServer: server, ToClient: client}, n: n, tap: p.Tap}
+	if p.Faults != nil {
+		l.arm(p.Faults(n))
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		l.close(false)
+		return
+	}
+	p.links[l] = true
+	p.mu.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		l.pump(ToClient)
+		done <- true
+	}()
+	l.pump(ToServer)
+	<-done
+	l.close(false)
+
+	p.mu.Lock()
+	delete(p.links, l)
+	p.mu.Unlock()
+}
+
+// A link is a proxied connection: the driver's and the server's ends,
+// indexed by the direction of the bytes written to them.
+type link struct {
+	conns [2]net.Conn
+	n     int                                // accepted as the nth connection
+	tap   func(n int, d Direction, b []byte) // the Proxy's Tap
+
+	mu     sync.Mutex
+	pos    [2]int64   // bytes forwarded in each direction
+	faults [2][]armed // pending in each direction, by position
+	ended  [2]bool    // directions whose end was tapped
+	closed bool
+}
+
+// An armed fault strikes once the bytes forwarded in its direction
+// reach at.
+type armed struct {
+	at int64
+	f  Fault
+}
+
+func (l *link) arm(faults []Fault) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, f := range faults {
+		d := f.Dir
+		l.faults[d] = append(l.faults[d], armed{l.pos[d] + f.After, f})
+		sort.SliceStable(l.faults[d], func(i, j int) bool { return l.faults[d][i].at < l.faults[d][j].at })
+	}
+}
+
+// next returns the first fault in direction d striking within the next
+// n bytes, removing it.
+func (l *link) next(d Direction, n int) (armed, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.faults[d]) == 0 || l.faults[d][0].at >= l.pos[d]+int64(n) {
+		return armed{}, false
+	}
+	a := l.faults[d][0]
+	l.faults[d] = l.faults[d][1:]
+	return a, true
+}
+
+// write forwards b in direction d.
+func (l *link) write(d Direction, b []byte) error {
+	n, err := l.conns[d].Write(b)
+	if l.tap != nil && n > 0 {
+		l.tap(l.n, d, b[:n])
+	}
+	l.mu.Lock()
+	l.pos[d] += int64(len(b))
+	l.mu.Unlock()
+	return err
+}
+
+// end taps the end of each of dirs not already ended.
+func (l *link) end(dirs ...Direction) {
+	if l.tap == nil {
+		return
+	}
+	var ended []Direction
+	l.mu.Lock()
+	for _, d := range dirs {
+		if !l.ended[d] {
+			l.ended[d] = true
+			ended = append(ended, d)
+		}
+	}
+	l.mu.Unlock()
+	for _, d := range ended {
+		l.tap(l.n, d, nil)
+	}
+}
+
+// pump forwards bytes in direction d until the source reaches end of
+// file or a fault ends the connection.
+func (l *link) pump(d Direction) {
+	src := l.conns[1-d]
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 && !l.forward(d, buf[:n]) {
+			return
+		}
+		if err != nil {
+			l.closeWrite(d)
+			return
+		}
+	}
+}
+
+// forward writes b in direction d, striking the faults that fall within
+// it. It reports whether the connection is still up in that direction.
+func (l *link) forward(d Direction, b []byte) bool {
+	for len(b) > 0 {
+		a, ok := l.next(d, len(b))
+		if !ok {
+			return l.write(d, b) == nil
+		}
+		l.mu.Lock()
+		k := a.at - l.pos[d]
+		l.mu.Unlock()
+		if k < 0 {
+			k = 0
+		}
+		if l.write(d, b[:k]) != nil {
+			return false
+		}
+		b = b[k:]
+		switch a.f.Action {
+		case Delay:
+			time.Sleep(a.f.Delay)
+		case Corrupt:
+			b[0] ^= a.f.mask()
+		case Truncate:
+			l.close(false)
+			return false
+		case Reset:
+			l.close(true)
+			return false
+		case HalfClose:
+			l.closeWrite(d)
+			io.Copy(io.Discard, l.conns[1-d])
+			return false
+		}
+	}
+	return true
+}
+
+// close closes both sides of l, aborting them with a reset if abort is
+// set.
+func (l *link) close(abort bool) {
+	defer l.end(ToServer, ToClient)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	for _, c := range l.conns {
+		if tc, ok := c.(*net.TCPConn); ok && abort {
+			tc.SetLinger(0)
+		}
+		c.Close()
+	}
+}
+
+// closeWrite shuts down l in direction d, unless l is already closed.
+func (l *link) closeWrite(d Direction) {
+	defer l.end(d)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.conns[d].(*net.TCPConn).CloseWrite()
+	}
+}
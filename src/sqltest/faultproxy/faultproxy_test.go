@@ -0,0 +1,235 @@
+package faultproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// echoServer starts a server echoing whatever its clients send, closed
+// when t finishes. Each client's bytes are also sent on the returned
+// channel once the client shuts down its side.
+func echoServer(t *testing.T) (addr string, received chan []byte) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received = make(chan []byte, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var got []byte
+				buf := make([]byte, 1024)
+				for {
+					n, err := c.Read(buf)
+					got = append(got, buf[:n]...)
+					c.Write(buf[:n])
+					if err != nil {
+						received <- got
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+// start starts a proxy to target, closed when t finishes.
+func start(t *testing.T, target string, faults func(int) []Fault) *Proxy {
+	p := &Proxy{Target: target, Faults: faults}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// dial connects to p with a deadline, closed when t finishes.
+func dial(t *testing.T, p *Proxy) net.Conn {
+	c, err := net.Dial("tcp", p.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// roundTrip sends msg on c and reads the echo until end of file, an
+// error or len(msg) bytes.
+func roundTrip(t *testing.T, c net.Conn, msg string) (string, error) {
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	n, err := io.ReadFull(c, buf)
+	return string(buf[:n]), err
+}
+
+func once(faults ...Fault) func(int) []Fault {
+	return func(n int) []Fault {
+		if n == 0 {
+			return faults
+		}
+		return nil
+	}
+}
+
+func TestForward(t *testing.T) {
+	addr, _ := echoServer(t)
+	p := start(t, addr, nil)
+	for i := 0; i < 2; i++ {
+		if got, err := roundTrip(t, dial(t, p), "hello"); got != "hello" || err != nil {
+			t.Errorf("got %q, %v; want hello", got, err)
+		}
+	}
+	if n := p.Accepted(); n != 2 {
+		t.Errorf("accepted %d connections; want 2", n)
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	addr, _ := echoServer(t)
+	p := start(t, addr, once(
+		Fault{Dir: ToServer, After: 1, Action: Corrupt, Mask: 0x20},
+		Fault{Dir: ToClient, After: 3, Action: Corrupt, Mask: 0x20},
+	))
+	if got, err := roundTrip(t, dial(t, p), "hello"); got != "hElLo" || err != nil {
+		t.Errorf("got %q, %v; want hElLo", got, err)
+	}
+	if got, err := roundTrip(t, dial(t, p), "hello"); got != "hello" || err != nil {
+		t.Errorf("second connection: got %q, %v; want hello", got, err)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	addr, _ := echoServer(t)
+	const d = 200 * time.Millisecond
+	p := start(t, addr, once(Fault{Dir: ToClient, After: 2, Action: Delay, Delay: d}))
+	c := dial(t, p)
+	start := time.Now()
+	if got, err := roundTrip(t, c, "hello"); got != "hello" || err != nil {
+		t.Errorf("got %q, %v; want hello", got, err)
+	}
+	if elapsed := time.Since(start); elapsed < d {
+		t.Errorf("round trip took %v; want at least %v", elapsed, d)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	addr, _ := echoServer(t)
+	p := start(t, addr, once(Fault{Dir: ToClient, After: 3, Action: Truncate}))
+	got, err := roundTrip(t, dial(t, p), "hello")
+	if got != "hel" || err != io.ErrUnexpectedEOF {
+		t.Errorf("got %q, %v; want hel, unexpected EOF", got, err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	addr, _ := echoServer(t)
+	p := start(t, addr, once(Fault{Dir: ToServer, After: 0, Action: Reset}))
+	_, err := roundTrip(t, dial(t, p), "hello")
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("got %v; want connection reset", err)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	addr, received := echoServer(t)
+	p := start(t, addr, once(Fault{Dir: ToClient, After: 0, Action: HalfClose}))
+	c := dial(t, p)
+	if got, err := roundTrip(t, c, "hello"); got != "" || err != io.EOF {
+		t.Errorf("got %q, %v; want end of file", got, err)
+	}
+	// The client's side still reaches the server.
+	if _, err := c.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+	c.(*net.TCPConn).CloseWrite()
+	select {
+	case got := <-received:
+		if string(got) != "hello world" {
+			t.Errorf("server received %q; want hello world", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server never saw the client close")
+	}
+}
+
+// Faults injected into an open connection count from the bytes already
+// forwarded.
+func TestInject(t *testing.T) {
+	addr, _ := echoServer(t)
+	p := start(t, addr, nil)
+	c := dial(t, p)
+	if got, err := roundTrip(t, c, "hello"); got != "hello" || err != nil {
+		t.Fatalf("got %q, %v; want hello", got, err)
+	}
+	p.Inject(Fault{Dir: ToClient, After: 1, Action: Corrupt, Mask: 0x20})
+	if got, err := roundTrip(t, c, "hello"); got != "hEllo" || err != nil {
+		t.Errorf("got %q, %v; want hEllo", got, err)
+	}
+	p.CloseConns()
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) && err != io.EOF {
+		t.Errorf("after CloseConns, read: %v; want connection reset", err)
+	}
+}
+
+// The tap sees the bytes of each connection in each direction, as they
+// reach the receiver, then the end of each direction.
+func TestTap(t *testing.T) {
+	type key struct {
+		n int
+		d Direction
+	}
+	var (
+		mu     sync.Mutex
+		tapped = map[key]string{}
+	)
+	addr, _ := echoServer(t)
+	p := &Proxy{
+		Target: addr,
+		Faults: once(Fault{Dir: ToClient, After: 1, Action: Corrupt, Mask: 0x20}),
+		Tap: func(n int, d Direction, b []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			if b == nil {
+				b = []byte("$")
+			}
+			tapped[key{n, d}] += string(b)
+		},
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"hello", "world"} {
+		c := dial(t, p)
+		if _, err := roundTrip(t, c, msg); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	p.Close()
+	want := map[key]string{
+		{0, ToServer}: "hello$",
+		{0, ToClient}: "hEllo$",
+		{1, ToServer}: "world$",
+		{1, ToClient}: "world$",
+	}
+	for k, w := range want {
+		if got := tapped[k]; got != w {
+			t.Errorf("connection %d %v: tapped %q; want %q", k.n, k.d, got, w)
+		}
+	}
+}
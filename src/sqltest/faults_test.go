@@ -0,0 +1,185 @@
+package sqltest
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"sqltest/faultproxy"
+)
+
+func init() {
+	registerScenario("NetFaults", testNetFaults, 0)
+}
+
+// A proxiedTester can open its database through a fault proxy.
+type proxiedTester interface {
+	// OpenProxied is like Open, but the handle's connections go through
+	// a proxy, which is closed when tb finishes.
+	OpenProxied(tb testing.TB) (*sql.DB, *faultproxy.Proxy)
+}
+
+// startProxy starts a proxy to target, closed when tb finishes. It
+// skips tb when sessions are traced, as a replayed session cannot be
+// faulted.
+func startProxy(tb testing.TB, target string) *faultproxy.Proxy {
+	if tracing() {
+		tb.Skip("faults are not traced")
+	}
+	p := &faultproxy.Proxy{Target: target}
+	if err := p.Start(); err != nil {
+		tb.Fatalf("starting fault proxy: %v", err)
+	}
+	tb.Cleanup(func() { p.Close() })
+	return p
+}
+
+// faultTimeout bounds a statement run on a faulty connection. The
+// faults delay nothing for nearly that long, so a statement taking
+// longer is hung.
+const faultTimeout = 10 * time.Second
+
+// netFaults returns the faults injected into a connection between two
+// statements, striking during the next. checked is the offset in a
+// server reply of a byte the driver must check.
+func netFaults(checked int64) []faultproxy.Fault {
+	return []faultproxy.Fault{
+		{Dir: faultproxy.ToClient, After: 3, Action: faultproxy.Delay, Delay: 100 * time.Millisecond},
+		{Dir: faultproxy.ToServer, After: 0, Action: faultproxy.Reset},
+		{Dir: faultproxy.ToServer, After: 2, Action: faultproxy.Truncate},
+		{Dir: faultproxy.ToServer, After: 2, Action: faultproxy.HalfClose},
+		{Dir: faultproxy.ToClient, After: 0, Action: faultproxy.Reset},
+		{Dir: faultproxy.ToClient, After: 3, Action: faultproxy.Reset},
+		{Dir: faultproxy.ToClient, After: 3, Action: faultproxy.Truncate},
+		{Dir: faultproxy.ToClient, After: 0, Action: faultproxy.HalfClose},
+		{Dir: faultproxy.ToClient, After: checked, Action: faultproxy.Corrupt},
+	}
+}
+
+// queryInts returns the integer column of the rows of query.
+func queryInts(db *sql.DB, query string) ([]int64, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ns []int64
+	for rows.Next() {
+		var n int64
+		if err := rows.Scan(&n); err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	return ns, rows.Err()
+}
+
+// within runs fn, failing t if it panics or is still running after
+// faultTimeout, when release is called to unblock it. within reports
+// whether fn returned normally.
+func within(t *testing.T, release func(), what string, fn func()) bool {
+	done := make(chan interface{}, 1)
+	go func() {
+		defer func() { done <- recover() }()
+		fn()
+	}()
+	select {
+	case v := <-done:
+		if v != nil {
+			t.Errorf("%s panicked: %v", what, v)
+			return false
+		}
+		return true
+	case <-time.After(faultTimeout):
+	}
+	t.Errorf("%s hung for %v", what, faultTimeout)
+	release()
+	select {
+	case <-done:
+	case <-time.After(faultTimeout):
+		t.Fatalf("%s still hung after its connections were reset", what)
+	}
+	return false
+}
+
+// poisons reports whether a driver with quirks is known to keep using
+// a connection broken by f.
+func poisons(f faultproxy.Fault, quirks quirk) bool {
+	switch f.Action {
+	case faultproxy.Delay:
+		return false
+	case faultproxy.Corrupt:
+		return quirks&quirkDesyncedConnReused != 0
+	}
+	return quirks&quirkBrokenConnReused != 0
+}
+
+// checkNetFault injects f into the connection db holds through p and
+// runs query, which returns the integers want, once during the fault
+// and twice after it. During the fault, the driver may fail the query
+// with any error, or succeed by way of a fresh connection, but may not
+// hang, panic or return wrong rows. After it, the queries must succeed:
+// a driver that returned the broken connection to the pool instead of
+// driver.ErrBadConn fails them, as documented by its quirks.
+func checkNetFault(t *testing.T, db *sql.DB, p *faultproxy.Proxy, f faultproxy.Fault, quirks quirk, query string, want []int64) {
+	db.SetMaxOpenConns(1)
+	if got, err := queryInts(db, query); err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("before the fault: got %v, %v; want %v", got, err, want)
+	}
+	conns := p.Accepted()
+	p.Inject(f)
+	var got []int64
+	var err error
+	if !within(t, p.CloseConns, "query during the fault", func() { got, err = queryInts(db, query) }) {
+		return
+	}
+	switch {
+	case err != nil:
+		t.Logf("%v: %v", f, err)
+	case fmt.Sprint(got) != fmt.Sprint(want):
+		t.Errorf("%v: got %v; want %v or an error", f, got, want)
+	case p.Accepted() > conns:
+		t.Logf("%v: succeeded on a new connection", f)
+	default:
+		t.Logf("%v: succeeded", f)
+	}
+	if f.Action == faultproxy.Delay && err != nil {
+		t.Errorf("%v: delaying a reply failed the query", f)
+	}
+	if poisons(f, quirks) {
+		if err == nil {
+			return
+		}
+		within(t, p.CloseConns, "query after the fault", func() { got, err = queryInts(db, query) })
+		if err == nil {
+			t.Errorf("%v: the driver no longer reuses the broken connection; remove its quirk", f)
+		}
+		return
+	}
+	for i := 0; i < 2; i++ {
+		within(t, p.CloseConns, "query after the fault", func() { got, err = queryInts(db, query) })
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%v: query %d after the fault: got %v, %v; want %v", f, i+1, got, err, want)
+		}
+	}
+}
+
+func testNetFaults(t params) {
+	pt, ok := t.dbType.(proxiedTester)
+	if !ok {
+		t.Skip("driver does not connect over TCP")
+	}
+	tbl := t.table("faults")
+	t.mustExec("CREATE TABLE " + tbl + " (id INTEGER PRIMARY KEY)")
+	for id := 1; id <= 3; id++ {
+		t.mustExec(t.q("INSERT INTO "+tbl+" (id) VALUES (?)"), id)
+	}
+	for _, f := range netFaults(t.dialect().checkedOffset) {
+		f := f
+		t.Run(f.String(), func(tt *testing.T) {
+			db, p := pt.OpenProxied(tt)
+			checkNetFault(tt, db, p, f, t.drv.quirks, "SELECT id FROM "+tbl+" ORDER BY id", []int64{1, 2, 3})
+		})
+	}
+}
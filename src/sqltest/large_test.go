@@ -0,0 +1,176 @@
+package sqltest
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func init() {
+	registerScenario("LargeResult", testLargeResult, 0)
+}
+
+// largeConfig sizes a LargeResult run. The defaults can be overridden
+// with GOSQLTEST_LARGE_ROWS, GOSQLTEST_LARGE_BLOBS and, for each driver,
+// GOSQLTEST_<NAME>_MAX_HEAP_MB.
+type largeConfig struct {
+	rows    int   // narrow rows
+	blobs   int   // rows of blobSize bytes
+	maxHeap int64 // bytes the live heap may grow by while scanning
+}
+
+const blobSize = 10 << 20
+
+// largeConfigFromEnv returns the configuration for the named driver. The
+// default ceiling is doubled for fakes, whose server buffers rows in the
+// same heap as the driver.
+func largeConfigFromEnv(driver string, fake bool) (largeConfig, error) {
+	cfg := largeConfig{rows: 1 << 20, blobs: 256, maxHeap: 128 << 20}
+	if fake {
+		cfg.maxHeap *= 2
+	}
+	for _, v := range []struct {
+		name string
+		n    *int
+	}{
+		{"GOSQLTEST_LARGE_ROWS", &cfg.rows},
+		{"GOSQLTEST_LARGE_BLOBS", &cfg.blobs},
+	} {
+		if s := os.Getenv(v.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return cfg, fmt.Errorf("bad %s %q", v.name, s)
+			}
+			*v.n = n
+		}
+	}
+	name := "GOSQLTEST_" + strings.ToUpper(strings.Replace(driver, "-", "_", -1)) + "_MAX_HEAP_MB"
+	if s := os.Getenv(name); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("bad %s %q", name, s)
+		}
+		cfg.maxHeap = int64(n) << 20
+	}
+	return cfg, nil
+}
+
+// liveHeap returns the bytes of heap in use after a garbage collection.
+func liveHeap() int64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int64(ms.HeapAlloc)
+}
+
+// fillTable inserts rows with IDs 1 to n into tbl, whose row with ID 1
+// must already exist, doubling them with INSERT ... SELECT to spare n
+// round trips. cols lists the columns other than id to copy.
+func fillTable(t params, tbl, cols string, n int) {
+	for have := 1; have < n; have *= 2 {
+		t.mustExec(t.q("INSERT INTO "+tbl+" (id"+cols+") SELECT id + ?"+cols+" FROM "+tbl+" WHERE id <= ?"), have, n-have)
+	}
+}
+
+// scanPeak runs query and calls scan for each row, returning the rows
+// read and the most the live heap grew by, sampled every sampleEvery
+// rows.
+func scanPeak(t params, query string, sampleEvery int, scan func(*sql.Rows) error) (n int, peak int64) {
+	base := liveHeap()
+	rows, err := t.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			t.Fatalf("row %d: %v", n+1, err)
+		}
+		n++
+		if n%sampleEvery == 0 {
+			if grown := liveHeap() - base; grown > peak {
+				peak = grown
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("after row %d: %v", n, err)
+	}
+	return n, peak
+}
+
+// testLargeResult scans a result set of many narrow rows and one of
+// large rows, failing if the heap grows beyond a ceiling while it does:
+// the driver must stream rows rather than read the whole result first.
+// Memory a driver allocates outside the Go heap, as go-sqlite3 does in
+// C, is not seen.
+//
+// Drivers with quirkBuffersResults read only twice the ceiling's worth
+// of large rows, and must exceed it.
+func testLargeResult(t params) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	_, fake := t.dbType.(*fakeDB)
+	cfg, err := largeConfigFromEnv(t.drv.name, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := t.dialect()
+
+	narrow := t.table("narrow")
+	t.mustExec("CREATE TABLE " + narrow + " (id " + d.bigint + ")")
+	t.mustExec("INSERT INTO " + narrow + " (id) VALUES (1)")
+	fillTable(t, narrow, "", cfg.rows)
+	var sum int64
+	n, peak := scanPeak(t, "SELECT id FROM "+narrow, 1<<16, func(rows *sql.Rows) error {
+		var id int64
+		err := rows.Scan(&id)
+		sum += id
+		return err
+	})
+	if want := int64(cfg.rows) * int64(cfg.rows+1) / 2; n != cfg.rows || sum != want {
+		t.Errorf("read %d narrow rows with IDs summing to %d; want %d, %d", n, sum, cfg.rows, want)
+	}
+	buffers := t.hasQuirk(quirkBuffersResults)
+	switch {
+	case buffers:
+		t.Logf("%d narrow rows: heap grew by %d MB", n, peak>>20)
+	case peak > cfg.maxHeap:
+		t.Errorf("%d narrow rows: heap grew by %d MB; want at most %d MB", n, peak>>20, cfg.maxHeap>>20)
+	}
+
+	wide := t.table("wide")
+	t.mustExec("CREATE TABLE " + wide + " (id " + d.bigint + ", b " + d.blobType(blobSize) + ")")
+	t.mustExec(t.q("INSERT INTO "+wide+" (id, b) VALUES (1, ?)"), make([]byte, blobSize))
+	want := cfg.blobs
+	if buffers && int64(want) > 2*cfg.maxHeap/blobSize {
+		want = int(2 * cfg.maxHeap / blobSize)
+	}
+	fillTable(t, wide, ", b", want)
+	n, peak = scanPeak(t, "SELECT b FROM "+wide, 1, func(rows *sql.Rows) error {
+		var b sql.RawBytes
+		if err := rows.Scan(&b); err != nil {
+			return err
+		}
+		if len(b) != blobSize {
+			return fmt.Errorf("read %d bytes; want %d", len(b), blobSize)
+		}
+		return nil
+	})
+	if n != want {
+		t.Errorf("read %d large rows; want %d", n, want)
+	}
+	switch {
+	case buffers && peak <= cfg.maxHeap:
+		t.Errorf("%d large rows: heap grew by only %d MB; driver is listed as buffering results, remove quirkBuffersResults", n, peak>>20)
+	case buffers:
+		t.Logf("%d large rows: heap grew by %d MB, as documented", n, peak>>20)
+	case peak > cfg.maxHeap:
+		t.Errorf("%d large rows: heap grew by %d MB; want at most %d MB", n, peak>>20, cfg.maxHeap>>20)
+	}
+}
@@ -0,0 +1,316 @@
+package sqltest
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+)
+
+func init() {
+	registerScenario("NullScan", testNullScan, 0)
+	registerScenario("NullIntoPlain", testNullIntoPlain, 0)
+	registerScenario("NullVersusEmpty", testNullVersusEmpty, 0)
+	registerScenario("NullAggregate", testNullAggregate, 0)
+	registerScenario("NullPredicate", testNullPredicate, 0)
+}
+
+// nullTable creates a table with a nullable column of each common type
+// and fills it, binding nil for every column of row 1, zero values in
+// row 2 and non-zero values in row 3. It returns the table name.
+func nullTable(t params) string {
+	d := t.dialect()
+	tbl := t.table("nulls")
+	t.mustExec(fmt.Sprintf("CREATE TABLE %s (id INTEGER PRIMARY KEY, s VARCHAR(50), i %s, f %s, b %s, bin %s)",
+		tbl, d.bigint, d.double, d.boolean, d.blobType(16)))
+	insert := t.q("INSERT INTO " + tbl + " (id, s, i, f, b, bin) VALUES (?, ?, ?, ?, ?, ?)")
+	if !t.hasQuirk(quirkNilArgPanics) {
+		t.mustExec(insert, 1, nil, nil, nil, nil, nil)
+	} else if panics(func() { t.DB.Exec(insert, 1, nil, nil, nil, nil, nil) }) {
+		t.mustExec("INSERT INTO " + tbl + " (id) VALUES (1)")
+	} else {
+		t.Errorf("binding nil did not panic; driver is listed as panicking, remove quirkNilArgPanics")
+	}
+	t.mustExec(insert, 2, "", 0, 0.0, false, []byte{})
+	t.mustExec(insert, 3, "x", 7, 1.5, true, []byte{1, 2})
+	return tbl
+}
+
+// panics reports whether fn panics.
+func panics(fn func()) (panicked bool) {
+	defer func() { panicked = recover() != nil }()
+	fn()
+	return false
+}
+
+func testNullScan(t params) {
+	t.Parallel()
+	tbl := nullTable(t)
+	var (
+		s sql.NullString
+		i sql.NullInt64
+		f sql.NullFloat64
+		b sql.NullBool
+	)
+	ps := new(string)
+	if t.hasQuirk(quirkNullIsEmptyBytes) {
+		checkNullIsEmptyBytes(t, tbl)
+	} else {
+		bin := []byte("not nil")
+		var any interface{} = "not nil"
+		err := t.QueryRow(t.q("SELECT s, i, f, b, s, bin, i FROM "+tbl+" WHERE id = ?"), 1).
+			Scan(&s, &i, &f, &b, &ps, &bin, &any)
+		if err != nil {
+			t.Fatalf("scanning NULLs: %v", err)
+		}
+		if s.Valid || i.Valid || f.Valid || b.Valid {
+			t.Errorf("NULL scanned as valid: NullString %v, NullInt64 %v, NullFloat64 %v, NullBool %v", s, i, f, b)
+		}
+		if ps != nil {
+			t.Errorf("NULL into *string = %q; want nil pointer", *ps)
+		}
+		if bin != nil {
+			t.Errorf("NULL into []byte = %#v; want nil", bin)
+		}
+		if any != nil {
+			t.Errorf("NULL into interface{} = %#v; want nil", any)
+		}
+	}
+
+	err := t.QueryRow(t.q("SELECT s, i, f, b, s FROM "+tbl+" WHERE id = ?"), 3).Scan(&s, &i, &f, &b, &ps)
+	if err != nil {
+		t.Fatalf("scanning values: %v", err)
+	}
+	if !s.Valid || s.String != "x" || !i.Valid || i.Int64 != 7 || !f.Valid || f.Float64 != 1.5 || !b.Valid || !b.Bool {
+		t.Errorf("scanned %v, %v, %v, %v; want valid x, 7, 1.5, true", s, i, f, b)
+	}
+	if ps == nil || *ps != "x" {
+		t.Errorf("*string = %v; want pointer to %q", ps, "x")
+	}
+}
+
+// checkNullIsEmptyBytes checks that the NULLs of row 1 of tbl, filled
+// by nullTable, read as a driver with quirkNullIsEmptyBytes returns them:
+// as empty bytes, which are an empty string to NullString and *string,
+// nil to []byte and []byte(nil) to interface{}, and fail to convert to a
+// number or bool.
+func checkNullIsEmptyBytes(t params, tbl string) {
+	const listed = "driver is listed as returning empty bytes, remove quirkNullIsEmptyBytes"
+	scan := func(col string, dest interface{}) error {
+		return t.QueryRow(t.q("SELECT "+col+" FROM "+tbl+" WHERE id = ?"), 1).Scan(dest)
+	}
+	var s sql.NullString
+	if err := scan("s", &s); err != nil || !s.Valid || s.String != "" {
+		t.Errorf("NULL into NullString = %v, %v; %s", s, err, listed)
+	}
+	for _, c := range []struct {
+		col  string
+		dest interface{}
+	}{
+		{"i", new(sql.NullInt64)},
+		{"f", new(sql.NullFloat64)},
+		{"b", new(sql.NullBool)},
+	} {
+		if err := scan(c.col, c.dest); err == nil {
+			t.Errorf("NULL %s into %T = %v; %s", c.col, c.dest, c.dest, listed)
+		}
+	}
+	var ps *string
+	if err := scan("s", &ps); err != nil {
+		t.Errorf("NULL into *string: %v", err)
+	} else if ps == nil || *ps != "" {
+		t.Errorf("NULL into *string = %v; want pointer to empty string, as %s", ps, listed)
+	}
+	bin := []byte("not nil")
+	if err := scan("bin", &bin); err != nil || bin != nil {
+		t.Errorf("NULL into []byte = %#v, %v; want nil", bin, err)
+	}
+	var any interface{} = "not nil"
+	if err := scan("i", &any); err != nil {
+		t.Errorf("NULL into interface{}: %v", err)
+	} else if b, ok := any.([]byte); !ok || b != nil {
+		t.Errorf("NULL into interface{} = %#v; want []byte(nil), as %s", any, listed)
+	}
+}
+
+// testNullIntoPlain checks the database/sql contract that scanning NULL
+// into a destination which cannot represent it is an error.
+func testNullIntoPlain(t params) {
+	t.Parallel()
+	tbl := nullTable(t)
+	for _, c := range []struct {
+		col  string
+		dest interface{}
+	}{
+		{"s", new(string)},
+		{"i", new(int64)},
+		{"f", new(float64)},
+		{"b", new(bool)},
+	} {
+		err := t.QueryRow(t.q("SELECT "+c.col+" FROM "+tbl+" WHERE id = ?"), 1).Scan(c.dest)
+		if err == nil && c.col == "s" && t.hasQuirk(quirkNullIsEmptyBytes) {
+			continue // NULL arrives as an empty string, as NullScan checks
+		}
+		if err == nil {
+			t.Errorf("scanning NULL %s into %T succeeded with %#v; want error", c.col, c.dest, c.dest)
+		}
+	}
+}
+
+// testNullVersusEmpty checks that an empty string or blob is not confused
+// with NULL: NULL scans into a nil []byte, empty into a non-nil one.
+func testNullVersusEmpty(t params) {
+	t.Parallel()
+	if t.dialect().emptyStringIsNull {
+		t.Skip("backend stores empty strings as NULL")
+	}
+	tbl := nullTable(t)
+	for _, col := range []string{"s", "bin"} {
+		var null, empty []byte
+		if err := t.QueryRow(t.q("SELECT "+col+" FROM "+tbl+" WHERE id = ?"), 1).Scan(&null); err != nil {
+			t.Fatalf("scanning NULL %s: %v", col, err)
+		}
+		if err := t.QueryRow(t.q("SELECT "+col+" FROM "+tbl+" WHERE id = ?"), 2).Scan(&empty); err != nil {
+			t.Fatalf("scanning empty %s: %v", col, err)
+		}
+		if null != nil {
+			t.Errorf("NULL %s into []byte = %#v; want nil", col, null)
+		}
+		if col == "bin" && t.hasQuirk(quirkEmptyBlobIsNull) {
+			if empty != nil {
+				t.Errorf("empty bin into []byte = %#v; driver is listed as storing NULL, remove quirkEmptyBlobIsNull", empty)
+			}
+			continue
+		}
+		if empty == nil || len(empty) != 0 {
+			t.Errorf("empty %s into []byte = %#v; want []byte{}", col, empty)
+		}
+
+		var ns sql.NullString
+		if err := t.QueryRow(t.q("SELECT "+col+" FROM "+tbl+" WHERE id = ?"), 2).Scan(&ns); err != nil {
+			t.Fatalf("scanning empty %s: %v", col, err)
+		}
+		if !ns.Valid || ns.String != "" {
+			t.Errorf("empty %s into NullString = %#v; want valid empty string", col, ns)
+		}
+	}
+}
+
+func testNullAggregate(t params) {
+	t.Parallel()
+	tbl := nullTable(t)
+	var (
+		count, countI int64
+		sum, max      sql.NullInt64
+	)
+	// SUM of integers is a DECIMAL in MySQL.
+	sumI := "SUM(i)"
+	if t.hasQuirk(quirkDecimalUnreadable) {
+		// The failed read leaves the connection unusable, so it is
+		// made on a handle of its own.
+		var v sql.NullString
+		if err := t.dbType.Open(t).QueryRow("SELECT SUM(i) FROM " + tbl).Scan(&v); err == nil {
+			t.Errorf("SUM(i) read as %v; driver is listed as failing to read DECIMAL, remove quirkDecimalUnreadable", v)
+		}
+		sumI = "CAST(SUM(i) AS SIGNED)"
+	}
+	err := t.QueryRow("SELECT COUNT(*), COUNT(i), "+sumI+", MAX(i) FROM "+tbl).Scan(&count, &countI, &sum, &max)
+	if err != nil {
+		t.Fatalf("aggregate query: %v", err)
+	}
+	if count != 3 || countI != 2 {
+		t.Errorf("COUNT(*), COUNT(i) = %d, %d; want 3, 2", count, countI)
+	}
+	if !sum.Valid || sum.Int64 != 7 || !max.Valid || max.Int64 != 7 {
+		t.Errorf("SUM(i), MAX(i) = %v, %v; want 7, 7", sum, max)
+	}
+
+	// aggregates scans the SUM(i) and MAX(i) query returns for arg,
+	// after the columns in dest, as "NULL" or their value. A driver
+	// with quirkNullIsEmptyBytes returns NULL as empty bytes, which only
+	// a NullString takes, so for it they are read as strings, and an
+	// empty one is NULL.
+	aggregates := func(over, query string, arg interface{}, dest ...interface{}) (sum, max string) {
+		if !t.hasQuirk(quirkNullIsEmptyBytes) {
+			var sum, max sql.NullInt64
+			if err := t.QueryRow(query, arg).Scan(append(dest, &sum, &max)...); err != nil {
+				t.Fatalf("aggregate over %s: %v", over, err)
+			}
+			format := func(v sql.NullInt64) string {
+				if !v.Valid {
+					return "NULL"
+				}
+				return strconv.FormatInt(v.Int64, 10)
+			}
+			return format(sum), format(max)
+		}
+		var sumS, maxS sql.NullString
+		if err := t.QueryRow(query, arg).Scan(append(dest, &sumS, &maxS)...); err != nil {
+			t.Fatalf("aggregate over %s: %v", over, err)
+		}
+		format := func(v sql.NullString) string {
+			switch {
+			case !v.Valid:
+				t.Errorf("aggregate over %s read as NULL; driver is listed as returning empty bytes, remove quirkNullIsEmptyBytes", over)
+				return "NULL"
+			case v.String == "":
+				return "NULL"
+			}
+			return v.String
+		}
+		return format(sumS), format(maxS)
+	}
+
+	// Aggregates over no rows are NULL, except COUNT.
+	sumV, maxV := aggregates("no rows", t.q("SELECT COUNT(i), "+sumI+", MAX(i) FROM "+tbl+" WHERE id > ?"), 100, &countI)
+	if countI != 0 || sumV != "NULL" || maxV != "NULL" {
+		t.Errorf("over no rows, COUNT(i), SUM(i), MAX(i) = %d, %s, %s; want 0, NULL, NULL", countI, sumV, maxV)
+	}
+
+	// Aggregates over only NULLs are NULL too.
+	sumV, maxV = aggregates("NULL", t.q("SELECT "+sumI+", MAX(i) FROM "+tbl+" WHERE id = ?"), 1)
+	if sumV != "NULL" || maxV != "NULL" {
+		t.Errorf("over NULL, SUM(i), MAX(i) = %s, %s; want NULL, NULL", sumV, maxV)
+	}
+}
+
+func testNullPredicate(t params) {
+	t.Parallel()
+	tbl := nullTable(t)
+	count := func(where string, args ...interface{}) int64 {
+		var n int64
+		if err := t.QueryRow(t.q("SELECT COUNT(*) FROM "+tbl+" WHERE "+where), args...).Scan(&n); err != nil {
+			t.Fatalf("WHERE %s: %v", where, err)
+		}
+		return n
+	}
+	if n := count("i IS NULL AND id >= ?", 0); n != 1 {
+		t.Errorf("IS NULL matched %d rows; want 1", n)
+	}
+	if n := count("i IS NOT NULL AND id >= ?", 0); n != 2 {
+		t.Errorf("IS NOT NULL matched %d rows; want 2", n)
+	}
+	// NULL never compares equal, not even to a bound nil.
+	switch {
+	case t.hasQuirk(quirkLoneNilArgFails):
+		if err := t.QueryRow(t.q("SELECT COUNT(*) FROM "+tbl+" WHERE i = ?"), nil).Scan(new(int64)); err == nil {
+			t.Errorf("binding nil alone succeeded; driver is listed as failing, remove quirkLoneNilArgFails")
+		}
+	case !t.hasQuirk(quirkNilArgPanics):
+		if n := count("i = ?", nil); n != 0 {
+			t.Errorf("i = nil matched %d rows; want 0", n)
+		}
+		if n := count("s = ?", nil); n != 0 {
+			t.Errorf("s = nil matched %d rows; want 0", n)
+		}
+	case !panics(func() { t.QueryRow(t.q("SELECT COUNT(*) FROM "+tbl+" WHERE i = ?"), nil) }):
+		t.Errorf("binding nil did not panic; driver is listed as panicking, remove quirkNilArgPanics")
+	}
+
+	var v int64
+	if err := t.QueryRow(t.q("SELECT COALESCE(i, ?) FROM "+tbl+" WHERE id = ?"), 42, 1).Scan(&v); err != nil {
+		t.Fatalf("COALESCE: %v", err)
+	}
+	if v != 42 {
+		t.Errorf("COALESCE(NULL, 42) = %d; want 42", v)
+	}
+}
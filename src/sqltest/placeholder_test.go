@@ -0,0 +1,296 @@
+package sqltest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A placeholder is a bind parameter found in a query.
+type placeholder struct {
+	start, end int // offsets in the query
+	style      placeholderStyle
+	n          int    // number, for placeholderDollar and placeholderColon
+	name       string // name, for placeholderNamed
+}
+
+// scanPlaceholders returns the bind parameters of query, skipping
+// quoted strings, E'...' strings with backslash escapes, dollar-quoted
+// bodies, quoted and backquoted identifiers, -- and /* */ comments, the
+// Postgres ?| and ?& operators, :: casts and colons inside words or
+// array subscripts, such as a[1:2]. Outside E'...' strings, a backslash
+// escapes nothing, as in standard SQL, unless backslash is set, as for
+// MySQL, where it escapes the next character of any quoted string.
+func scanPlaceholders(query string, backslash bool) ([]placeholder, error) {
+	var ps []placeholder
+	// skipTo returns the offset after the first end at or after i, and
+	// fails if there is none.
+	skipTo := func(i int, end, what string) (int, error) {
+		j := strings.Index(query[i:], end)
+		if j < 0 {
+			return 0, fmt.Errorf("unterminated %s at offset %d of %q", what, i, query)
+		}
+		return i + j + len(end), nil
+	}
+	// quoted returns the offset after the quoted text starting at i,
+	// where the quote is escaped by doubling it, or by a backslash if
+	// backslash is set.
+	quoted := func(i int, backslash bool, what string) (int, error) {
+		q := query[i]
+		for j := i + 1; j < len(query); j++ {
+			switch c := query[j]; {
+			case backslash && c == '\\':
+				j++
+			case c == q && j+1 < len(query) && query[j+1] == q:
+				j++
+			case c == q:
+				return j + 1, nil
+			}
+		}
+		return 0, fmt.Errorf("unterminated %s at offset %d of %q", what, i, query)
+	}
+
+	var err error
+	for i := 0; i < len(query); {
+		c := query[i]
+		next := byte(0)
+		if i+1 < len(query) {
+			next = query[i+1]
+		}
+		switch {
+		case c == '\'':
+			i, err = quoted(i, backslash, "string")
+		case c == '"':
+			i, err = quoted(i, backslash, "quoted identifier")
+		case c == '`':
+			i, err = quoted(i, false, "quoted identifier")
+		case c == '-' && next == '-':
+			if j := strings.IndexByte(query[i:], '\n'); j >= 0 {
+				i += j + 1
+			} else {
+				i = len(query)
+			}
+		case c == '/' && next == '*':
+			i, err = blockComment(query, i)
+		case c == '$' && isDigit(next):
+			j := digitsEnd(query, i+1)
+			n, _ := strconv.Atoi(query[i+1 : j])
+			ps = append(ps, placeholder{start: i, end: j, style: placeholderDollar, n: n})
+			i = j
+		case c == '$':
+			// A dollar quote is $$ or $tag$, where a tag is a word.
+			j := i + 1
+			for j < len(query) && isWordByte(query[j]) && query[j] != '$' {
+				j++
+			}
+			if j < len(query) && query[j] == '$' {
+				tag := query[i : j+1]
+				i, err = skipTo(j+1, tag, "dollar-quoted string")
+			} else {
+				i++
+			}
+		case c == '?' && (next == '|' || next == '&'):
+			i += 2
+		case c == '?':
+			ps = append(ps, placeholder{start: i, end: i + 1, style: placeholderQuestion})
+			i++
+		case c == ':' && (next == ':' || next == '='):
+			i += 2
+		case c == ':' && i > 0 && (isWordByte(query[i-1]) || query[i-1] == ']' || query[i-1] == ')'):
+			i++
+		case c == ':' && isDigit(next):
+			j := digitsEnd(query, i+1)
+			n, _ := strconv.Atoi(query[i+1 : j])
+			ps = append(ps, placeholder{start: i, end: j, style: placeholderColon, n: n})
+			i = j
+		case c == ':' && isWordStart(next):
+			j := wordEnd(query, i+1)
+			ps = append(ps, placeholder{start: i, end: j, style: placeholderNamed, name: query[i+1 : j]})
+			i = j
+		case isWordStart(c):
+			j := wordEnd(query, i)
+			if j == i+1 && (c == 'E' || c == 'e') && j < len(query) && query[j] == '\'' {
+				j, err = quoted(j, true, "string")
+			}
+			i = j
+		case isDigit(c):
+			// A number, which may run into letters as in 1e5.
+			i = wordEnd(query, i)
+		default:
+			i++
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// blockComment returns the offset after the comment starting at offset
+// i of query. As in Postgres, comments nest.
+func blockComment(query string, i int) (int, error) {
+	depth := 0
+	for j := i; j+1 < len(query); j++ {
+		switch query[j : j+2] {
+		case "/*":
+			depth++
+			j++
+		case "*/":
+			depth--
+			j++
+			if depth == 0 {
+				return j + 1, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unterminated comment at offset %d of %q", i, query)
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// isWordStart reports whether c starts a keyword or identifier. Bytes of
+// non-ASCII characters count as letters.
+func isWordStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= 0x80
+}
+
+// isWordByte reports whether c may go on a keyword or identifier.
+func isWordByte(c byte) bool { return isWordStart(c) || isDigit(c) || c == '$' }
+
+func digitsEnd(s string, i int) int {
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return i
+}
+
+func wordEnd(s string, i int) int {
+	for i < len(s) && isWordByte(s[i]) {
+		i++
+	}
+	return i
+}
+
+// rewritePlaceholders converts the bind parameters of query, which must
+// all be in one style, to the style to. Numbered parameters keep their
+// numbers and named ones are numbered in order of first use; converting
+// to placeholderNamed names them p1, p2 and so on. Converting to
+// placeholderQuestion fails unless the parameters are numbered 1, 2, 3
+// in order, as ? cannot repeat or reorder arguments. Backslashes in
+// quoted strings are escapes if backslash is set, as in scanPlaceholders.
+func rewritePlaceholders(query string, to placeholderStyle, backslash bool) (string, error) {
+	ps, err := scanPlaceholders(query, backslash)
+	if err != nil {
+		return "", err
+	}
+	if len(ps) == 0 {
+		return query, nil
+	}
+	from := ps[0].style
+	for _, p := range ps[1:] {
+		if p.style != from {
+			return "", fmt.Errorf("query mixes %v and %v placeholders: %q", from, p.style, query)
+		}
+	}
+	if from == to {
+		return query, nil
+	}
+
+	var (
+		b     strings.Builder
+		last  int
+		names = map[string]int{}
+	)
+	for i, p := range ps {
+		n := p.n
+		switch p.style {
+		case placeholderQuestion:
+			n = i + 1
+		case placeholderNamed:
+			if n = names[p.name]; n == 0 {
+				n = len(names) + 1
+				names[p.name] = n
+			}
+		}
+		b.WriteString(query[last:p.start])
+		switch to {
+		case placeholderQuestion:
+			if n != i+1 {
+				return "", fmt.Errorf("cannot convert %s to ?, which would reorder or repeat arguments: %q", query[p.start:p.end], query)
+			}
+			b.WriteString("?")
+		case placeholderDollar:
+			b.WriteString("$" + strconv.Itoa(n))
+		case placeholderColon:
+			b.WriteString(":" + strconv.Itoa(n))
+		case placeholderNamed:
+			b.WriteString(":p" + strconv.Itoa(n))
+		}
+		last = p.end
+	}
+	b.WriteString(query[last:])
+	return b.String(), nil
+}
+
+func TestRewritePlaceholders(t *testing.T) {
+	const (
+		q = placeholderQuestion
+		d = placeholderDollar
+		c = placeholderColon
+		n = placeholderNamed
+	)
+	tests := []struct {
+		query     string
+		to        placeholderStyle
+		backslash bool
+		want      string // "" if the rewrite must fail
+	}{
+		{"SELECT a FROM t WHERE b = ? AND c = ?", d, false, "SELECT a FROM t WHERE b = $1 AND c = $2"},
+		{"SELECT a FROM t WHERE b = ? AND c = ?", c, false, "SELECT a FROM t WHERE b = :1 AND c = :2"},
+		{"SELECT a FROM t WHERE b = ? AND c = ?", n, false, "SELECT a FROM t WHERE b = :p1 AND c = :p2"},
+		{"SELECT a FROM t WHERE b = ? AND c = ?", q, false, "SELECT a FROM t WHERE b = ? AND c = ?"},
+		{"SELECT $2, $1, $2", c, false, "SELECT :2, :1, :2"},
+		{"SELECT :1, :2", d, false, "SELECT $1, $2"},
+		{"SELECT :1, :2", q, false, "SELECT ?, ?"},
+		{"SELECT $2, $1", q, false, ""},
+		{"SELECT :b, :a, :b", d, false, "SELECT $1, $2, $1"},
+		{"SELECT :b, :a, :b", q, false, ""},
+		{"SELECT :a, :b", q, false, "SELECT ?, ?"},
+		{"SELECT ?, $1", d, false, ""},
+		{"SELECT :1, :a", d, false, ""},
+
+		// Not placeholders.
+		{"SELECT '?', 'it''s ?', ? FROM t", d, false, "SELECT '?', 'it''s ?', $1 FROM t"},
+		{`SELECT "a?""b", ? FROM t`, d, false, `SELECT "a?""b", $1 FROM t`},
+		{"SELECT `a?`, ? FROM t", d, false, "SELECT `a?`, $1 FROM t"},
+		{"SELECT ? -- why?\n, ? /* what? /* nested? */ still? */", d, false, "SELECT $1 -- why?\n, $2 /* what? /* nested? */ still? */"},
+		{"SELECT $$it's ?$$, $tag$ $1 $$ ? $tag$, ?", d, false, "SELECT $$it's ?$$, $tag$ $1 $$ ? $tag$, $1"},
+		{`SELECT E'\'?', ?`, d, false, `SELECT E'\'?', $1`},
+		{"SELECT j ?| ?, j ?& ? FROM t", d, false, "SELECT j ?| $1, j ?& $2 FROM t"},
+		{"SELECT ?::int, a[1:2], f(x):b, a$1, 1e5 FROM t", c, false, "SELECT :1::int, a[1:2], f(x):b, a$1, 1e5 FROM t"},
+		{"SELECT :x::int", d, false, "SELECT $1::int"},
+
+		{"SELECT 'a", d, false, ""},
+		{`SELECT "a`, d, false, ""},
+		{"SELECT /* a", d, false, ""},
+		{"SELECT $q$ a", d, false, ""},
+
+		// MySQL's backslash escapes.
+		{`SELECT 'it\'s ?', ? FROM t`, d, true, `SELECT 'it\'s ?', $1 FROM t`},
+		{`SELECT "a\"?", 'b\\', ? FROM t`, d, true, `SELECT "a\"?", 'b\\', $1 FROM t`},
+		{`SELECT 'it\'s ?', ? FROM t`, q, true, `SELECT 'it\'s ?', ? FROM t`},
+		{"SELECT `a\\`, ? FROM t", d, true, "SELECT `a\\`, $1 FROM t"},
+		{`SELECT 'a\', ? FROM t`, d, false, `SELECT 'a\', $1 FROM t`},
+		{`SELECT 'a\', ? FROM t`, d, true, ""},
+	}
+	for _, tt := range tests {
+		got, err := rewritePlaceholders(tt.query, tt.to, tt.backslash)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("rewritePlaceholders(%q, %v, %v) = %q; want an error", tt.query, tt.to, tt.backslash, got)
+		case tt.want != "" && (err != nil || got != tt.want):
+			t.Errorf("rewritePlaceholders(%q, %v, %v) = %q, %v; want %q", tt.query, tt.to, tt.backslash, got, err, tt.want)
+		}
+	}
+}
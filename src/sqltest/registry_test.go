@@ -0,0 +1,128 @@
+package sqltest
+
+import (
+	"strings"
+	"testing"
+)
+
+// capability is a set of optional features a backend supports, as listed
+// in its Dialect. Scenarios that rely on one are skipped for drivers
+// without it.
+type capability uint
+
+const (
+	capLastInsertId     capability = 1 << iota // Result.LastInsertId works
+	capReturning                               // INSERT ... RETURNING
+	capSavepoints                              // SAVEPOINT and ROLLBACK TO
+	capReleaseSavepoint                        // RELEASE SAVEPOINT
+	capMultiResultSets                         // one query may return several result sets
+)
+
+var capNames = []string{"LastInsertId", "RETURNING", "savepoints", "RELEASE SAVEPOINT", "multiple result sets"}
+
+func (c capability) String() string {
+	var names []string
+	for i, name := range capNames {
+		if c&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// quirk is a known deviation of a driver from database/sql conventions.
+// Scenarios assert the documented behavior for drivers with a quirk, so a
+// driver fix shows up as a failure prompting the quirk's removal.
+type quirk uint
+
+const (
+	quirkEmptyBlobIsNull    quirk = 1 << iota // binds []byte{} as NULL
+	quirkNilArgPanics                         // panics binding a nil argument
+	quirkBusyCommitKeepsTx                    // a COMMIT failing on a lock leaves the transaction open
+	quirkBrokenConnReused                     // returns a connection failing with an I/O error to the pool
+	quirkDesyncedConnReused                   // returns a connection to the pool after a malformed reply
+	quirkIdleConnLossFails                    // fails the first statement on a connection lost while idle
+	quirkNullIsEmptyBytes                     // returns NULL as an empty []byte rather than nil
+	quirkLoneNilArgFails                      // fails a statement whose only argument is nil
+	quirkDecimalUnreadable                    // fails reading DECIMAL results, desynchronizing the connection
+	quirkZeroRowsNoResult                     // fails RowsAffected and LastInsertId of statements changing no rows
+	quirkTextExecNoResult                     // fails RowsAffected and LastInsertId of statements without arguments
+	quirkBuffersResults                       // reads a whole result set into memory before returning its first row
+	quirkResultIsLive                         // a Result reports the latest statement run on its connection
+	quirkStmtCloseFreesRows                   // frees a statement closed with Rows open, which then read freed memory
+	quirkStmtCloseEndsRows                    // ends the Rows of a statement closed while they are open, without an error
+	quirkStmtCloseDesyncs                     // closing a statement with Rows open loses a row and desynchronizes the connection
+	quirkTextEndsAtNul                        // reads text only up to its first NUL byte
+	quirkAlwaysPrepares                       // prepares every statement, so MySQL refuses SAVEPOINT and others it cannot prepare
+	quirkQueryPrepares                        // prepares every query, so MySQL refuses several statements in one
+	quirkFirstResultSetOnly                   // fails reading past the first result set of a query
+)
+
+// A driverInfo describes a database/sql driver registered with the suite.
+type driverInfo struct {
+	name   string // subtest name, e.g. "pq"
+	tester Tester // sets up the database for each scenario
+	quirks quirk
+}
+
+// A scenario is a test run once against every registered driver.
+type scenario struct {
+	name  string
+	fn    func(params)
+	needs capability // skip drivers missing any of these
+}
+
+var (
+	drivers   []*driverInfo
+	scenarios []*scenario
+)
+
+// registerDriver adds d to the set of drivers every scenario runs against.
+func registerDriver(d *driverInfo) {
+	for _, o := range drivers {
+		if o.name == d.name {
+			panic("sqltest: driver " + d.name + " registered twice")
+		}
+	}
+	drivers = append(drivers, d)
+}
+
+// registerScenario adds a scenario that TestAll runs as the subtest
+// "<name>/<driver>".
+func registerScenario(name string, fn func(params), needs capability) {
+	for _, s := range scenarios {
+		if s.name == name {
+			panic("sqltest: scenario " + name + " registered twice")
+		}
+	}
+	scenarios = append(scenarios, &scenario{name, fn, needs})
+}
+
+// TestAll runs every registered scenario against every registered driver.
+// Use -run 'TestAll/Blobs/' or -run 'TestAll//pq' to select a subset.
+func TestAll(t *testing.T) {
+	for _, s := range scenarios {
+		s := s
+		t.Run(s.name, func(t *testing.T) {
+			for _, d := range drivers {
+				d := d
+				t.Run(d.name, func(t *testing.T) {
+					defer record(t, s.name, d.name)
+					runScenario(t, s, d)
+				})
+			}
+		})
+	}
+}
+
+// runScenario runs s against d, skipping t if d's backend lacks a
+// capability s needs.
+func runScenario(t *testing.T, s *scenario, d *driverInfo) {
+	if missing := s.needs &^ d.tester.Dialect().caps; missing != 0 {
+		t.Skipf("%s does not support %v", d.name, missing)
+	}
+	d.tester.RunTest(t, func(p params) {
+		p.drv = d
+		s.fn(p)
+	})
+}
@@ -0,0 +1,143 @@
+package sqltest
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"text/tabwriter"
+	"time"
+)
+
+// outcome is the result of one scenario against one driver.
+type outcome string
+
+const (
+	outcomePass outcome = "pass"
+	outcomeFail outcome = "FAIL"
+	outcomeSkip outcome = "skip"
+)
+
+var results = struct {
+	sync.Mutex
+	m map[string]map[string]outcome // scenario => driver => outcome
+}{m: map[string]map[string]outcome{}}
+
+// record notes the outcome of t, the subtest running scenario against
+// driver. It must be deferred at the top of the subtest so it also runs
+// after t.Skip and t.Fatal.
+func record(t *testing.T, scenario, driver string) {
+	o := outcomePass
+	switch {
+	case t.Failed():
+		o = outcomeFail
+	case t.Skipped():
+		o = outcomeSkip
+	}
+	results.Lock()
+	defer results.Unlock()
+	if results.m[scenario] == nil {
+		results.m[scenario] = map[string]outcome{}
+	}
+	results.m[scenario][driver] = o
+}
+
+// printSummary writes a scenario × driver matrix of the recorded
+// outcomes, so a green run that skipped everything is easy to spot.
+func printSummary() {
+	results.Lock()
+	defer results.Unlock()
+	if len(results.m) == 0 {
+		return
+	}
+	counts := map[outcome]int{}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "\nsqltest summary:")
+	fmt.Fprint(w, "scenario")
+	for _, d := range drivers {
+		fmt.Fprintf(w, "\t%s", d.name)
+	}
+	fmt.Fprintln(w)
+	for _, s := range scenarios {
+		row, ok := results.m[s.name]
+		if !ok {
+			continue
+		}
+		fmt.Fprint(w, s.name)
+		for _, d := range drivers {
+			o, ok := row[d.name]
+			if !ok {
+				o = "-"
+			}
+			counts[o]++
+			fmt.Fprintf(w, "\t%s", o)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+	fmt.Printf("%d passed, %d failed, %d skipped\n", counts[outcomePass], counts[outcomeFail], counts[outcomeSkip])
+	if counts[outcomePass] == 0 && counts[outcomeFail] == 0 {
+		fmt.Println("WARNING: no scenario ran against any driver")
+	}
+}
+
+// required reports whether GOSQLTEST_REQUIRE lists the named driver or
+// its kind of server. For example, GOSQLTEST_REQUIRE=pq,mysql requires
+// lib/pq and both MySQL drivers.
+func required(name, server string) bool {
+	for _, r := range strings.Split(os.Getenv("GOSQLTEST_REQUIRE"), ",") {
+		r = strings.TrimSpace(r)
+		if r != "" && (strings.EqualFold(r, name) || strings.EqualFold(r, server)) {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownRequired returns the names in GOSQLTEST_REQUIRE that are
+// neither a registered driver nor the kind of server one uses.
+func unknownRequired() []string {
+	var unknown []string
+	for _, r := range strings.Split(os.Getenv("GOSQLTEST_REQUIRE"), ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		found := false
+		for _, d := range drivers {
+			s, ok := d.tester.(*serverDB)
+			if strings.EqualFold(r, d.name) || ok && strings.EqualFold(r, s.server) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, r)
+		}
+	}
+	return unknown
+}
+
+// unavailable skips t because the server behind the named driver can't
+// be used, or fails t if that driver is required.
+func unavailable(t testing.TB, name, server, reason string) {
+	t.Helper()
+	if required(name, server) {
+		t.Fatalf("%s is required by GOSQLTEST_REQUIRE but unavailable: %s", name, reason)
+	}
+	t.Skip(reason)
+}
+
+func TestMain(m *testing.M) {
+	if unknown := unknownRequired(); len(unknown) > 0 {
+		fmt.Fprintf(os.Stderr, "sqltest: GOSQLTEST_REQUIRE names unknown drivers or servers: %s\n", strings.Join(unknown, ", "))
+		os.Exit(2)
+	}
+	// The records of timeZonesExpected hold for a time.Local of UTC,
+	// which keeps its name so drivers' times in it still read as "l".
+	time.Local = time.FixedZone("Local", 0)
+	code := m.Run()
+	printSummary()
+	os.Exit(code)
+}
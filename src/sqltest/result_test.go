@@ -0,0 +1,178 @@
+package sqltest
+
+import (
+	"context"
+	"database/sql"
+)
+
+func init() {
+	registerScenario("RowsAffected", testRowsAffected, 0)
+	registerScenario("LastInsertId", testLastInsertId, 0)
+	registerScenario("ResultKept", testResultKept, 0)
+}
+
+// checkRowsAffected runs query on e and checks that it affects want
+// rows. Drivers with quirkZeroRowsNoResult must fail to count zero rows,
+// and those with quirkTextExecNoResult any rows of a statement without
+// arguments.
+func checkRowsAffected(t params, e execer, want int64, query string, args ...interface{}) {
+	res, err := e.ExecContext(context.Background(), t.q(query), args...)
+	if err != nil {
+		t.Fatalf("%s %v: %v", query, args, err)
+	}
+	n, err := res.RowsAffected()
+	switch {
+	case want == 0 && t.hasQuirk(quirkZeroRowsNoResult):
+		if err == nil {
+			t.Errorf("%s %v: %d rows affected; driver is listed as failing, remove quirkZeroRowsNoResult", query, args, n)
+		}
+	case len(args) == 0 && t.hasQuirk(quirkTextExecNoResult):
+		if err == nil {
+			t.Errorf("%s: %d rows affected; driver is listed as failing, remove quirkTextExecNoResult", query, n)
+		}
+	case err != nil:
+		t.Errorf("%s %v: RowsAffected: %v", query, args, err)
+	case n != want:
+		t.Errorf("%s %v: %d rows affected; want %d", query, args, n, want)
+	}
+}
+
+// execer is implemented by *sql.DB, *sql.Conn and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func testRowsAffected(t params) {
+	t.Parallel()
+	tbl := t.table("affected")
+	t.mustExec("CREATE TABLE " + tbl + " (id INTEGER PRIMARY KEY, n INTEGER)")
+	for id := 1; id <= 5; id++ {
+		checkRowsAffected(t, t.DB, 1, "INSERT INTO "+tbl+" (id, n) VALUES (?, ?)", id, id)
+	}
+	// The UPDATEs change every row they match, as MySQL counts only
+	// rows whose values change.
+	for _, c := range []struct {
+		query string
+		arg   int
+		want  int64
+	}{
+		{"UPDATE " + tbl + " SET n = n + 1 WHERE id > ?", 100, 0},
+		{"UPDATE " + tbl + " SET n = n + 1 WHERE id = ?", 1, 1},
+		{"UPDATE " + tbl + " SET n = n + 1 WHERE id > ?", 2, 3},
+		{"DELETE FROM " + tbl + " WHERE id > ?", 100, 0},
+		{"DELETE FROM " + tbl + " WHERE id = ?", 1, 1},
+		{"INSERT INTO " + tbl + " (id, n) SELECT id + 10, n FROM " + tbl + " WHERE id > ?", 100, 0},
+		{"INSERT INTO " + tbl + " (id, n) SELECT id + 10, n FROM " + tbl + " WHERE id > ?", 2, 3},
+		{"DELETE FROM " + tbl + " WHERE id > ?", 10, 3},
+	} {
+		checkRowsAffected(t, t.DB, c.want, c.query, c.arg)
+	}
+	// Statements without arguments may take another path in the driver.
+	checkRowsAffected(t, t.DB, 4, "DELETE FROM "+tbl)
+}
+
+// testLastInsertId checks the IDs LastInsertId reports for rows numbered
+// by the backend, and that backends without capLastInsertId fail it
+// rather than make one up.
+func testLastInsertId(t params) {
+	t.Parallel()
+	d := t.dialect()
+	tbl := t.table("ids")
+	t.mustExec("CREATE TABLE " + tbl + " (id " + d.autoIncrement + ", name VARCHAR(50))")
+	insert := t.q("INSERT INTO " + tbl + " (name) VALUES (?)")
+	if d.caps&capLastInsertId == 0 {
+		if id, err := t.mustExec(insert, "alice").LastInsertId(); err == nil {
+			t.Errorf("LastInsertId = %d; backend is listed without capLastInsertId, want an error", id)
+		}
+		return
+	}
+	idOf := func(name string) int64 {
+		var id int64
+		if err := t.QueryRow(t.q("SELECT id FROM "+tbl+" WHERE name = ?"), name).Scan(&id); err != nil {
+			t.Fatalf("ID of %s: %v", name, err)
+		}
+		return id
+	}
+	for _, name := range []string{"alice", "bob"} {
+		id, err := t.mustExec(insert, name).LastInsertId()
+		if err != nil {
+			t.Fatalf("LastInsertId of %s: %v", name, err)
+		}
+		if want := idOf(name); id != want {
+			t.Errorf("LastInsertId of %s = %d; want %d", name, id, want)
+		}
+	}
+
+	bob := idOf("bob")
+	id, err := t.mustExec(t.q("INSERT INTO "+tbl+" (name) SELECT name FROM "+tbl+" WHERE id <= ?"), bob).LastInsertId()
+	if err != nil {
+		t.Fatalf("LastInsertId of INSERT ... SELECT: %v", err)
+	}
+	var first, last int64
+	if err := t.QueryRow(t.q("SELECT MIN(id), MAX(id) FROM "+tbl+" WHERE id > ?"), bob).Scan(&first, &last); err != nil {
+		t.Fatal(err)
+	}
+	want, which := last, "last"
+	if d.firstInsertId {
+		want, which = first, "first"
+	}
+	if id != want {
+		t.Errorf("LastInsertId of INSERT ... SELECT = %d; want %d, the %s row's", id, want, which)
+	}
+}
+
+// testResultKept checks that a Result keeps reporting its own statement
+// once another has run on the same connection.
+func testResultKept(t params) {
+	t.Parallel()
+	d := t.dialect()
+	ctx := context.Background()
+	c, err := t.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	tbl := t.table("kept")
+	t.mustExec("CREATE TABLE " + tbl + " (id " + d.autoIncrement + ", n INTEGER)")
+	insert := t.q("INSERT INTO " + tbl + " (n) VALUES (?)")
+	for n := 1; n <= 3; n++ {
+		if _, err := c.ExecContext(ctx, insert, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := c.ExecContext(ctx, insert, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, idErr := res.LastInsertId()
+	if d.caps&capLastInsertId != 0 {
+		if idErr != nil {
+			t.Errorf("LastInsertId: %v", idErr)
+		} else if id != 4 {
+			t.Errorf("LastInsertId of the fourth row = %d; want 4", id)
+		}
+	}
+	if _, err := c.ExecContext(ctx, insert, 5); err != nil {
+		t.Fatal(err)
+	}
+	checkRowsAffected(t, c, 5, "UPDATE "+tbl+" SET n = n + 1 WHERE n > ?", 0)
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		t.Fatalf("RowsAffected: %v", err)
+	}
+	later, err := res.LastInsertId()
+	if err != nil && idErr == nil {
+		t.Errorf("LastInsertId after later statements: %v; it was %d before them", err, id)
+	}
+	switch {
+	case t.hasQuirk(quirkResultIsLive):
+		if n == 1 && later == id {
+			t.Errorf("INSERT still reports its own result after later statements; driver is listed as reporting the latest, remove quirkResultIsLive")
+		}
+	case n != 1:
+		t.Errorf("INSERT reports %d rows affected after an UPDATE; want 1", n)
+	case d.caps&capLastInsertId != 0 && err == nil && later != id:
+		t.Errorf("INSERT reports ID %d after another INSERT; want %d", later, id)
+	}
+}
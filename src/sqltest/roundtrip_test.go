@@ -0,0 +1,384 @@
+package sqltest
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	registerScenario("RoundTrip", testRoundTrip, 0)
+}
+
+// A roundTripCase is a value stored in a column and read back.
+type roundTripCase struct {
+	name string
+	col  func(*Dialect) string // column type for v
+	v    interface{}
+}
+
+func bigintCol(d *Dialect) string    { return d.bigint }
+func doubleCol(d *Dialect) string    { return d.double }
+func floatCol(d *Dialect) string     { return d.float }
+func boolCol(d *Dialect) string      { return d.boolean }
+func textCol(d *Dialect) string      { return d.text }
+func timestampCol(d *Dialect) string { return d.timestamp }
+
+func blobCol(size int) func(*Dialect) string {
+	return func(d *Dialect) string { return d.blobType(size) }
+}
+
+var roundTripCases = func() []roundTripCase {
+	big := make([]byte, 1<<20+1)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	cases := []roundTripCase{
+		{"int64 max", bigintCol, int64(math.MaxInt64)},
+		{"int64 min", bigintCol, int64(math.MinInt64)},
+		{"float64 pi", doubleCol, math.Pi},
+		{"float64 max", doubleCol, math.MaxFloat64},
+		{"float64 tiny", doubleCol, math.SmallestNonzeroFloat64},
+		{"float64 NaN", doubleCol, math.NaN()},
+		{"float64 +Inf", doubleCol, math.Inf(1)},
+		{"float64 -Inf", doubleCol, math.Inf(-1)},
+		{"float32 pi", floatCol, float32(math.Pi)},
+		{"float32 max", floatCol, float32(math.MaxFloat32)},
+		{"float32 NaN", floatCol, float32(math.NaN())},
+		{"float32 +Inf", floatCol, float32(math.Inf(1))},
+		{"float32 -Inf", floatCol, float32(math.Inf(-1))},
+		{"bool true", boolCol, true},
+		{"bool false", boolCol, false},
+		{"string empty", textCol, ""},
+		{"string NULL", textCol, nil},
+		{"string UTF-8", textCol, "héllo, 世界 ☃"},
+		{"string invalid UTF-8", textCol, "a\xff\xfeb"},
+		{"blob empty", blobCol(16), []byte{}},
+		{"blob 1MB", blobCol(len(big)), big},
+		{"time UTC", timestampCol, time.Date(2013, 5, 6, 7, 8, 9, 0, time.UTC)},
+		{"time UTC ns", timestampCol, time.Date(2013, 5, 6, 7, 8, 9, 123456789, time.UTC)},
+		{"time +05:30 µs", timestampCol, time.Date(2013, 5, 6, 7, 8, 9, 123456000, time.FixedZone("IST", 5*3600+1800))},
+	}
+	if ny, err := time.LoadLocation("America/New_York"); err == nil {
+		cases = append(cases, roundTripCase{"time New_York ms", timestampCol, time.Date(2013, 7, 4, 12, 0, 0, 5e6, ny)})
+	}
+	return cases
+}()
+
+// roundTripTargets are the destinations each stored value is scanned
+// into. Each returns a fresh pointer to pass to Scan.
+var roundTripTargets = []struct {
+	name string
+	new  func() interface{}
+}{
+	{"NullString", func() interface{} { return new(sql.NullString) }},
+	{"NullInt64", func() interface{} { return new(sql.NullInt64) }},
+	{"NullFloat64", func() interface{} { return new(sql.NullFloat64) }},
+	{"NullBool", func() interface{} { return new(sql.NullBool) }},
+	{"NullTime", func() interface{} { return new(sql.NullTime) }},
+	{"interface{}", func() interface{} { return new(interface{}) }},
+}
+
+// Round trip results, as shown in the table testRoundTrip logs.
+const (
+	rtNA    = "-" // the Go value itself doesn't convert to the target
+	rtExact = "="
+	rtLossy = "~"
+	rtError = "E"
+)
+
+// roundTripExpected records, for each driver, the rows of its round trip
+// table that aren't exact wherever applicable, as cells separated by
+// spaces. A result worse than recorded fails the scenario; one better is
+// logged, so the record can be tightened. Drivers of a server have no
+// record until someone runs them against one, since what a server keeps
+// depends on its version and settings, such as its time zone; their
+// tables are only logged.
+var roundTripExpected = map[string]map[string]string{
+	"sqlite": {
+		"float64 NaN":      "~~ -- ~~ -- -- ~~",
+		"float32 NaN":      "~~ -- ~~ -- -- ~~",
+		"bool true":        "~~ -- -- == -- ~~",
+		"bool false":       "~~ -- -- == -- ~~",
+		"blob empty":       "~~ -- -- -- -- ~~",
+		"time UTC":         "~~ -- -- -- ~~ ~~",
+		"time UTC ns":      "~~ -- -- -- ~~ ~~",
+		"time +05:30 µs":   "~~ -- -- -- ~~ ~~",
+		"time New_York ms": "~~ -- -- -- ~~ ~~",
+	},
+	"pq-fake": {
+		"float64 tiny":         "~~ -- ~~ -- -- ~~",
+		"string invalid UTF-8": "EE -- -- -- -- EE",
+		"time UTC ns":          "~~ -- -- -- ~~ ~~",
+		"time +05:30 µs":       "~~ -- -- -- ~~ ~~",
+		"time New_York ms":     "~~ -- -- -- ~~ ~~",
+	},
+	"pgx-fake": {
+		"float64 NaN":          "=E -- =E -- -- =E",
+		"float64 +Inf":         "=E -- =E -- -- =E",
+		"float64 -Inf":         "=E -- =E -- -- =E",
+		"float32 pi":           "~~ -- ~~ -- -- ~~",
+		"float32 max":          "~~ -- ~~ -- -- ~~",
+		"float32 NaN":          "=E -- =E -- -- ~E",
+		"float32 +Inf":         "EE -- EE -- -- EE",
+		"float32 -Inf":         "=E -- =E -- -- ~E",
+		"string invalid UTF-8": "EE -- -- -- -- EE",
+		"time UTC ns":          "~~ -- -- -- ~~ ~~",
+		"time +05:30 µs":       "~~ -- -- -- ~~ ~~",
+		"time New_York ms":     "~~ -- -- -- ~~ ~~",
+	},
+	"mymysql-fake": {
+		"bool true":        "~- -- -- =- -- ~-",
+		"bool false":       "~- -- -- =- -- ~-",
+		"time UTC ns":      "~- -- -- -- ~- ~-",
+		"time +05:30 µs":   "~- -- -- -- ~- ~-",
+		"time New_York ms": "~- -- -- -- ~- ~-",
+	},
+	"gomysql-fake": {
+		"int64 max":        "=- =- =- -- -- ~-",
+		"int64 min":        "=- =- =- -- -- ~-",
+		"float64 pi":       "=- -- =- -- -- ~-",
+		"float64 max":      "~- -- =- -- -- ~-",
+		"float64 tiny":     "~- -- =- -- -- ~-",
+		"float64 NaN":      "=- -- =- -- -- ~-",
+		"float64 +Inf":     "=- -- =- -- -- ~-",
+		"float64 -Inf":     "=- -- =- -- -- ~-",
+		"float32 pi":       "~- -- ~- -- -- ~-",
+		"float32 max":      "~- -- ~- -- -- ~-",
+		"float32 NaN":      "=- -- =- -- -- ~-",
+		"float32 +Inf":     "=- -- =- -- -- ~-",
+		"float32 -Inf":     "=- -- =- -- -- ~-",
+		"bool true":        "~- -- -- =- -- ~-",
+		"bool false":       "~- -- -- =- -- ~-",
+		"string NULL":      "~- E- E- E- E- ~-",
+		"time UTC":         "~- -- -- -- E- ~-",
+		"time UTC ns":      "~- -- -- -- E- ~-",
+		"time +05:30 µs":   "~- -- -- -- E- ~-",
+		"time New_York ms": "~- -- -- -- E- ~-",
+	},
+}
+
+// rtRank orders round trip results from best to worst.
+var rtRank = map[byte]int{rtExact[0]: 0, rtLossy[0]: 1, rtError[0]: 2}
+
+// checkRoundTrip compares the cells of the row for the named case with
+// the expected ones, or with exact results if none are recorded.
+func checkRoundTrip(t params, name, cells, expected string) {
+	if expected == "" {
+		expected = strings.NewReplacer(rtLossy, rtExact, rtError, rtExact).Replace(cells)
+	}
+	for i, target := range roundTripTargets {
+		for j, path := range []string{"prepared", "direct"} {
+			k := 3*i + j
+			got, want := cells[k], expected[k]
+			switch {
+			case got == want:
+			case got == rtNA[0] || want == rtNA[0]:
+				t.Errorf("%s, %s, into %s: got %c; recorded %c", name, path, target.name, got, want)
+			case rtRank[got] > rtRank[want]:
+				t.Errorf("%s, %s, into %s: got %c; recorded %c", name, path, target.name, got, want)
+			default:
+				t.Logf("%s, %s, into %s: got %c, better than the recorded %c", name, path, target.name, got, want)
+			}
+		}
+	}
+}
+
+// scanned returns the value held by dest, a pointer returned by one of
+// roundTripTargets.
+func scanned(dest interface{}) interface{} {
+	if p, ok := dest.(*interface{}); ok {
+		return *p
+	}
+	v, _ := dest.(driver.Valuer).Value()
+	return v
+}
+
+// want returns what scanning v straight into a fresh target would give,
+// without a database in between, and false if that conversion fails.
+func want(newTarget func() interface{}, v interface{}) (interface{}, bool) {
+	dv, err := driver.DefaultParameterConverter.ConvertValue(v)
+	if err != nil {
+		return nil, false
+	}
+	dest := newTarget()
+	if s, ok := dest.(sql.Scanner); ok {
+		if err := s.Scan(dv); err != nil {
+			return nil, false
+		}
+		return scanned(dest), true
+	}
+	return dv, true
+}
+
+// sameValue reports whether a and b are the same value. []byte and string
+// with the same bytes are equal, as are two NaNs; times must agree on both
+// the instant and the UTC offset.
+func sameValue(a, b interface{}) bool {
+	switch a := a.(type) {
+	case nil:
+		return b == nil
+	case []byte, string:
+		ab, aok := asBytes(a)
+		bb, bok := asBytes(b)
+		return aok && bok && bytes.Equal(ab, bb)
+	case float64:
+		bf, ok := b.(float64)
+		return ok && (a == bf || math.IsNaN(a) && math.IsNaN(bf))
+	case time.Time:
+		bt, ok := b.(time.Time)
+		if !ok || !a.Equal(bt) {
+			return false
+		}
+		_, aoff := a.Zone()
+		_, boff := bt.Zone()
+		return aoff == boff
+	}
+	return a == b
+}
+
+func asBytes(v interface{}) ([]byte, bool) {
+	switch v := v.(type) {
+	case []byte:
+		return v, true
+	case string:
+		return []byte(v), true
+	}
+	return nil, false
+}
+
+// testRoundTrip stores each roundTripCase through a prepared statement
+// and through DB.Exec with arguments, scans it back into every
+// roundTripTargets entry, and logs a table of the results for the
+// driver, one cell per target with the prepared result first: "=" exact,
+// "~" lossy, "E" error, "-" not applicable. The DB.Exec result is not
+// applicable for drivers that prepare it too. Run with -v to see it.
+// Each row is checked against roundTripExpected if the driver has a
+// record there. On backends that store the empty string as NULL, it
+// must come back NULL.
+func testRoundTrip(t params) {
+	t.Parallel()
+	expected, recorded := roundTripExpected[t.drv.name]
+	directPrepares := t.hasQuirk(quirkAlwaysPrepares | quirkQueryPrepares)
+	var (
+		table   strings.Builder
+		details []string
+	)
+	w := tabwriter.NewWriter(&table, 0, 8, 1, ' ', 0)
+	fmt.Fprint(w, "value")
+	for _, target := range roundTripTargets {
+		fmt.Fprintf(w, "\t%s", target.name)
+	}
+	fmt.Fprintln(w)
+
+	for i, c := range roundTripCases {
+		if c.v == nil && t.hasQuirk(quirkNilArgPanics) {
+			details = append(details, c.name+": skipped, the driver panics binding nil")
+			continue
+		}
+		tbl := t.table(fmt.Sprintf("rt%d", i))
+		t.mustExec(fmt.Sprintf("CREATE TABLE %s (id INTEGER PRIMARY KEY, v %s)", tbl, c.col(t.dialect())))
+		insert := t.q("INSERT INTO " + tbl + " (id, v) VALUES (?, ?)")
+
+		// Row 1 goes through an explicitly prepared statement, row 2
+		// through DB.Exec, which drivers may run without preparing.
+		// Drivers with quirkAlwaysPrepares or quirkQueryPrepares prepare
+		// it anyway, so its result would repeat the prepared one.
+		var insertErr [2]error
+		if stmt, err := t.Prepare(insert); err != nil {
+			insertErr[0] = err
+		} else {
+			_, insertErr[0] = stmt.Exec(1, c.v)
+			stmt.Close()
+		}
+		_, insertErr[1] = t.Exec(insert, 2, c.v)
+		if s, ok := c.v.(string); ok && s == "" && t.dialect().emptyStringIsNull {
+			checkEmptyIsNull(t, tbl, insertErr)
+		}
+
+		fmt.Fprint(w, c.name)
+		var row []string
+		for _, target := range roundTripTargets {
+			ref, ok := want(target.new, c.v)
+			cell := ""
+			for id, path := range []string{"prepared", "direct"} {
+				if !ok || path == "direct" && directPrepares {
+					cell += rtNA
+					continue
+				}
+				err := insertErr[id]
+				dest := target.new()
+				if err == nil {
+					err = t.QueryRow(t.q("SELECT v FROM "+tbl+" WHERE id = ?"), id+1).Scan(dest)
+				}
+				switch {
+				case err != nil:
+					cell += rtError
+					details = append(details, fmt.Sprintf("%s, %s, into %s: %v", c.name, path, target.name, err))
+				case !sameValue(ref, scanned(dest)):
+					cell += rtLossy
+					details = append(details, fmt.Sprintf("%s, %s, into %s: got %s; want %s",
+						c.name, path, target.name, abbrev(scanned(dest)), abbrev(ref)))
+				default:
+					cell += rtExact
+				}
+			}
+			fmt.Fprintf(w, "\t%s", cell)
+			row = append(row, cell)
+		}
+		fmt.Fprintln(w)
+		if recorded {
+			checkRoundTrip(t, c.name, strings.Join(row, " "), expected[c.name])
+		}
+	}
+	w.Flush()
+	t.Logf("round trip results (prepared, then direct: DB.Exec with arguments):\n%s", table.String())
+	if !recorded {
+		t.Logf("%s has no record in roundTripExpected: results not checked", t.drv.name)
+	}
+	for _, d := range details {
+		t.Log(d)
+	}
+}
+
+// checkEmptyIsNull checks that both rows of tbl, given the empty string
+// without the errors in insertErr, hold NULL.
+func checkEmptyIsNull(t params, tbl string, insertErr [2]error) {
+	for id, err := range insertErr {
+		if err != nil {
+			continue
+		}
+		var v sql.NullString
+		if err := t.QueryRow(t.q("SELECT v FROM "+tbl+" WHERE id = ?"), id+1).Scan(&v); err != nil {
+			t.Errorf("reading the empty string back: %v", err)
+		} else if v.Valid {
+			t.Errorf("empty string read back as %q; the dialect records it is stored as NULL", v.String)
+		}
+	}
+}
+
+// abbrev formats v for a log line, truncating long values before
+// formatting them.
+func abbrev(v interface{}) string {
+	const max = 80
+	switch b := v.(type) {
+	case []byte:
+		if len(b) > max {
+			v = b[:max]
+		}
+	case string:
+		if len(b) > max {
+			v = b[:max]
+		}
+	}
+	s := fmt.Sprintf("%T(%#v)", v, v)
+	if len(s) > max {
+		s = s[:max-3] + "..."
+	}
+	return s
+}
@@ -0,0 +1,134 @@
+package sqltest
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+func init() {
+	registerScenario("RowsEarlyClose", testRowsEarlyClose, 0)
+	registerScenario("TxRowsEarlyClose", testTxRowsEarlyClose, 0)
+}
+
+// earlyCloseTimeout bounds closing a Rows partway through and running
+// the next statement on its connection, which may first have to read
+// the rest of the rows.
+const earlyCloseTimeout = 5 * time.Second
+
+const earlyCloseRows = 10000
+
+// rowsTable creates a table holding IDs 1 to earlyCloseRows and returns
+// its name.
+func rowsTable(t params) string {
+	tbl := t.table("rows")
+	t.mustExec("CREATE TABLE " + tbl + " (id " + t.dialect().bigint + ")")
+	t.mustExec("INSERT INTO " + tbl + " (id) VALUES (1)")
+	fillTable(t, tbl, "", earlyCloseRows)
+	return tbl
+}
+
+// closeEarly reads the first n of the IDs query returns in order and
+// closes the Rows, then calls next, which is to run statements on the
+// same connection. Closing and next must together take less than
+// earlyCloseTimeout.
+func closeEarly(t params, query func() (*sql.Rows, error), n int, next func() error) {
+	rows, err := query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		var id int64
+		if !rows.Next() {
+			t.Fatalf("rows ended after %d: %v", i-1, rows.Err())
+		}
+		if err := rows.Scan(&id); err != nil || id != int64(i) {
+			t.Fatalf("row %d: got %d, %v", i, id, err)
+		}
+	}
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		if err := rows.Close(); err != nil {
+			done <- fmt.Errorf("Close: %v", err)
+			return
+		}
+		done <- next()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("after closing at row %d: %v", n, err)
+		}
+		t.Logf("closing at row %d and going on took %v", n, time.Since(start))
+	case <-time.After(earlyCloseTimeout):
+		t.Fatalf("closing at row %d and going on hung for %v", n, earlyCloseTimeout)
+	}
+}
+
+// checkCount returns an error unless q, a COUNT query, returns want.
+func checkCount(q *sql.Row, want int) error {
+	var n int
+	if err := q.Scan(&n); err != nil {
+		return err
+	}
+	if n != want {
+		return fmt.Errorf("counted %d rows; want %d", n, want)
+	}
+	return nil
+}
+
+// testRowsEarlyClose closes Rows partway through, with the pool down to
+// one connection so that the next query must reuse theirs, both for a
+// query and for a prepared statement, which must remain usable.
+func testRowsEarlyClose(t params) {
+	t.Parallel()
+	tbl := rowsTable(t)
+	t.SetMaxOpenConns(1)
+	sel := t.q("SELECT id FROM " + tbl + " WHERE id >= ? ORDER BY id")
+	stmt, err := t.Prepare(sel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	count := func() error {
+		return checkCount(t.QueryRow("SELECT COUNT(*) FROM "+tbl), earlyCloseRows)
+	}
+	for _, n := range []int{1, earlyCloseRows / 2, earlyCloseRows} {
+		closeEarly(t, func() (*sql.Rows, error) { return t.Query(sel, 1) }, n, count)
+		closeEarly(t, func() (*sql.Rows, error) { return stmt.Query(1) }, n, func() error {
+			var id int64
+			if err := stmt.QueryRow(earlyCloseRows).Scan(&id); err != nil || id != earlyCloseRows {
+				return fmt.Errorf("statement run again: got %d, %v; want %d", id, err, earlyCloseRows)
+			}
+			return nil
+		})
+	}
+}
+
+// testTxRowsEarlyClose closes Rows partway through inside a transaction,
+// which must then go on and commit.
+func testTxRowsEarlyClose(t params) {
+	t.Parallel()
+	tbl := rowsTable(t)
+	t.SetMaxOpenConns(1)
+	tx, err := t.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	sel := t.q("SELECT id FROM " + tbl + " WHERE id >= ? ORDER BY id")
+	const keep = earlyCloseRows / 2
+	closeEarly(t, func() (*sql.Rows, error) { return tx.Query(sel, 1) }, 1, func() error {
+		if _, err := tx.Exec(t.q("DELETE FROM "+tbl+" WHERE id > ?"), keep); err != nil {
+			return err
+		}
+		return checkCount(tx.QueryRow("SELECT COUNT(*) FROM "+tbl), keep)
+	})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if n := countRows(t, t.DB, tbl); n != keep {
+		t.Errorf("after commit, count = %d; want %d", n, keep)
+	}
+}
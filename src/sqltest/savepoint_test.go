@@ -0,0 +1,151 @@
+package sqltest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+func init() {
+	registerScenario("Savepoint", testSavepoint, capSavepoints)
+	registerScenario("SavepointAfterError", testSavepointAfterError, capSavepoints)
+}
+
+// takeSavepoint runs SAVEPOINT name in tx, the way an application
+// without driver support for savepoints must, and reports whether the
+// driver let it, which drivers with quirkAlwaysPrepares do not on MySQL.
+func takeSavepoint(t params, tx *sql.Tx, name string) bool {
+	_, err := tx.Exec("SAVEPOINT " + name)
+	switch {
+	case err == nil && t.hasQuirk(quirkAlwaysPrepares):
+		t.Errorf("SAVEPOINT %s succeeded; remove quirkAlwaysPrepares", name)
+	case err == nil:
+	case t.hasQuirk(quirkAlwaysPrepares):
+		t.Logf("SAVEPOINT %s fails, as documented: %v", name, err)
+		return false
+	default:
+		t.Fatalf("SAVEPOINT %s: %v", name, err)
+	}
+	return true
+}
+
+// txIDs returns the IDs of the rows of tbl that q sees, in order.
+func txIDs(t params, q queryer, tbl string) string {
+	rows, err := q.QueryContext(context.Background(), "SELECT id FROM "+tbl+" ORDER BY id")
+	if err != nil {
+		t.Fatalf("reading %s: %v", tbl, err)
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(ids)
+}
+
+// testSavepoint rolls back to nested savepoints, checking that the
+// transaction keeps exactly the rows inserted before each, and, where
+// the backend can, releases one, keeping the rows inserted after it.
+func testSavepoint(t params) {
+	t.Parallel()
+	tbl := txTable(t)
+	insert := t.q("INSERT INTO " + tbl + " (id, name) VALUES (?, ?)")
+	tx, err := t.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	mustTxExec := func(q string, args ...interface{}) {
+		if _, err := tx.Exec(q, args...); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	mustTxExec(insert, 1, "bob")
+	if !takeSavepoint(t, tx, "a") {
+		return
+	}
+	mustTxExec(insert, 2, "alice")
+	takeSavepoint(t, tx, "b")
+	mustTxExec(insert, 3, "carol")
+	if got := txIDs(t, tx, tbl); got != "[1 2 3]" {
+		t.Errorf("before rollback, rows %s; want [1 2 3]", got)
+	}
+	mustTxExec("ROLLBACK TO SAVEPOINT b")
+	if got := txIDs(t, tx, tbl); got != "[1 2]" {
+		t.Errorf("after ROLLBACK TO b, rows %s; want [1 2]", got)
+	}
+	mustTxExec("ROLLBACK TO SAVEPOINT a")
+	if got := txIDs(t, tx, tbl); got != "[1]" {
+		t.Errorf("after ROLLBACK TO a, rows %s; want [1]", got)
+	}
+	mustTxExec(insert, 4, "dave")
+	if t.dialect().caps&capReleaseSavepoint != 0 {
+		takeSavepoint(t, tx, "c")
+		mustTxExec(insert, 5, "eve")
+		mustTxExec("RELEASE SAVEPOINT c")
+	}
+	if got := txIDs(t, t.DB, tbl); got != "[]" {
+		t.Errorf("outside the transaction, rows %s; want none", got)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	want := "[1 4]"
+	if t.dialect().caps&capReleaseSavepoint != 0 {
+		want = "[1 4 5]"
+	}
+	if got := txIDs(t, t.DB, tbl); got != want {
+		t.Errorf("after commit, rows %s; want %s", got, want)
+	}
+}
+
+// testSavepointAfterError rolls back to a savepoint after a duplicate
+// key. On backends where an error aborts the transaction, as on
+// Postgres, statements fail until then; afterwards the transaction goes
+// on, keeping what it did before the savepoint, and commits.
+func testSavepointAfterError(t params) {
+	t.Parallel()
+	tbl := txTable(t)
+	insert := t.q("INSERT INTO " + tbl + " (id, name) VALUES (?, ?)")
+	tx, err := t.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(insert, 1, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if !takeSavepoint(t, tx, "a") {
+		return
+	}
+	if _, err := tx.Exec(insert, 1, "dup"); err == nil {
+		t.Fatal("duplicate primary key insert succeeded")
+	}
+	if t.dialect().errorAbortsTx {
+		if _, err := tx.Exec(insert, 2, "alice"); err == nil {
+			t.Error("statement after an error succeeded; want the transaction aborted")
+		}
+	}
+	if _, err := tx.Exec("ROLLBACK TO SAVEPOINT a"); err != nil {
+		t.Fatalf("ROLLBACK TO SAVEPOINT after an error: %v", err)
+	}
+	if _, err := tx.Exec(insert, 2, "alice"); err != nil {
+		t.Fatalf("statement after ROLLBACK TO SAVEPOINT: %v", err)
+	}
+	if got := txIDs(t, tx, tbl); got != "[1 2]" {
+		t.Errorf("inside the transaction, rows %s; want [1 2]", got)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if got := txIDs(t, t.DB, tbl); got != "[1 2]" {
+		t.Errorf("after commit, rows %s; want [1 2]", got)
+	}
+}
@@ -0,0 +1,375 @@
+package sqltest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+)
+
+func init() {
+	registerScenario("StmtChurn", testStmtChurn, 0)
+	registerScenario("StmtPooled", testStmtPooled, 0)
+	registerScenario("StmtAfterAlter", testStmtAfterAlter, 0)
+	registerScenario("StmtCloseOpenRows", testStmtCloseOpenRows, 0)
+}
+
+const (
+	stmtChurn  = 1000 // statements prepared and closed in a row
+	stmtConns  = 8    // connections a pooled statement is prepared on
+	stmtRounds = 64   // pooled statements prepared and closed in a row
+
+	// stmtLeakMin is the fewest statements a scenario must prepare for
+	// a server-wide count of prepared statements to be compared.
+	stmtLeakMin = 500
+)
+
+// queryer is implemented by *sql.DB, *sql.Conn and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// preparedStmts returns the number of statements prepared on the server,
+// in q's session if the backend counts them per session, or -1 if it
+// does not tell.
+func preparedStmts(t params, q queryer) int {
+	d := t.dialect()
+	if d.preparedStmts == "" {
+		return -1
+	}
+	rows, err := q.QueryContext(context.Background(), d.preparedStmts)
+	if err != nil {
+		t.Fatalf("counting prepared statements: %v", err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		t.Fatalf("counting prepared statements: %v", err)
+	}
+	if !rows.Next() {
+		t.Fatalf("counting prepared statements: no rows: %v", rows.Err())
+	}
+	var n int
+	dest := make([]interface{}, len(cols))
+	for i := range dest {
+		dest[i] = new(sql.RawBytes)
+	}
+	dest[len(dest)-1] = &n
+	if err := rows.Scan(dest...); err != nil {
+		t.Fatalf("counting prepared statements: %v", err)
+	}
+	return n
+}
+
+// stmtsOnPool is preparedStmts summed over the size connections of t's
+// pool, which must be limited to that many and keep them all idle.
+func stmtsOnPool(t params, size int) int {
+	if !t.dialect().sessionStmts {
+		return preparedStmts(t, t.DB)
+	}
+	var conns []*sql.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	total := 0
+	for i := 0; i < size; i++ {
+		c, err := t.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+		n := preparedStmts(t, c)
+		if n < 0 {
+			return n
+		}
+		total += n
+	}
+	return total
+}
+
+// checkStmtLeaks fails t if more statements are prepared on the server
+// after than before a scenario prepared n and closed them all. A count
+// of the whole server includes the statements of scenarios running
+// alongside, so it is only compared for n of at least stmtLeakMin, and
+// must grow by n/2 to count as a leak.
+func checkStmtLeaks(t params, before, after, n int) {
+	switch {
+	case before < 0:
+		t.Logf("backend does not count prepared statements")
+	case t.dialect().sessionStmts:
+		if after > before {
+			t.Errorf("%d statements prepared before preparing and closing %d, %d after; want no more", before, n, after)
+		}
+	case n < stmtLeakMin:
+		t.Logf("%d statements too few to compare with the server's count", n)
+	case after-before >= n/2:
+		t.Errorf("%d statements prepared on the server before preparing and closing %d, %d after", before, n, after)
+	}
+}
+
+// stmtTable creates a table holding IDs 1 to n and returns its name.
+func stmtTable(t params, n int) string {
+	tbl := t.table("stmts")
+	t.mustExec("CREATE TABLE " + tbl + " (id " + t.dialect().bigint + ")")
+	t.mustExec("INSERT INTO " + tbl + " (id) VALUES (1)")
+	fillTable(t, tbl, "", n)
+	return tbl
+}
+
+// testStmtChurn prepares, runs and closes statements one after another
+// on a connection, alone and in a transaction, which must leave none
+// prepared on the server.
+func testStmtChurn(t params) {
+	t.Parallel()
+	tbl := stmtTable(t, 10)
+	ctx := context.Background()
+	c, err := t.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sel := t.q("SELECT id FROM " + tbl + " WHERE id = ?")
+	run := func(prepare func() (*sql.Stmt, error), i int) {
+		stmt, err := prepare()
+		if err != nil {
+			t.Fatalf("preparing statement %d: %v", i, err)
+		}
+		var id int
+		if err := stmt.QueryRow(1 + i%10).Scan(&id); err != nil || id != 1+i%10 {
+			t.Fatalf("statement %d: got %d, %v; want %d", i, id, err, 1+i%10)
+		}
+		if err := stmt.Close(); err != nil {
+			t.Fatalf("closing statement %d: %v", i, err)
+		}
+	}
+
+	before := preparedStmts(t, c)
+	for i := 0; i < stmtChurn; i++ {
+		run(func() (*sql.Stmt, error) { return c.PrepareContext(ctx, sel) }, i)
+	}
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for i := 0; i < stmtChurn; i++ {
+		run(func() (*sql.Stmt, error) { return tx.Prepare(sel) }, i)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	checkStmtLeaks(t, before, preparedStmts(t, c), 2*stmtChurn)
+}
+
+// testStmtPooled runs statements prepared on the pool from several
+// connections at once, which database/sql prepares them on in turn,
+// and closes them, which must close them on every connection.
+func testStmtPooled(t params) {
+	t.Parallel()
+	const rows = 100
+	tbl := stmtTable(t, rows)
+	t.SetMaxOpenConns(stmtConns)
+	t.SetMaxIdleConns(stmtConns)
+	before := stmtsOnPool(t, stmtConns)
+	for r := 0; r < stmtRounds; r++ {
+		stmt, err := t.Prepare(t.q("SELECT id FROM " + tbl + " WHERE id >= ? ORDER BY id"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Rows held open at once each need a connection of their own.
+		var open []*sql.Rows
+		for i := 1; i <= stmtConns; i++ {
+			rs, err := stmt.Query(i)
+			if err != nil {
+				t.Fatalf("round %d, query %d: %v", r, i, err)
+			}
+			open = append(open, rs)
+			var id int
+			if !rs.Next() {
+				t.Fatalf("round %d, query %d: no rows: %v", r, i, rs.Err())
+			}
+			if err := rs.Scan(&id); err != nil || id != i {
+				t.Fatalf("round %d, query %d: got %d, %v; want %d", r, i, id, err, i)
+			}
+		}
+		for _, rs := range open {
+			rs.Close()
+		}
+		var wg sync.WaitGroup
+		for g := 0; g < 2*stmtConns; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 4; i++ {
+					want := 1 + (g*4+i)%rows
+					var id int
+					if err := stmt.QueryRow(want).Scan(&id); err != nil || id != want {
+						t.Errorf("round %d: got %d, %v; want %d", r, id, err, want)
+						return
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		if err := stmt.Close(); err != nil {
+			t.Fatalf("round %d: Close: %v", r, err)
+		}
+	}
+	checkStmtLeaks(t, before, stmtsOnPool(t, stmtConns), stmtRounds*stmtConns)
+}
+
+// testStmtAfterAlter runs statements prepared on the pool and on a
+// connection after a column was added to their table. They name their
+// columns, as the columns of SELECT * then differ between backends.
+func testStmtAfterAlter(t params) {
+	t.Parallel()
+	ctx := context.Background()
+	tbl := t.table("altered")
+	t.mustExec("CREATE TABLE " + tbl + " (id INTEGER PRIMARY KEY, name VARCHAR(20))")
+	sel := t.q("SELECT name FROM " + tbl + " WHERE id = ?")
+	ins, err := t.Prepare(t.q("INSERT INTO " + tbl + " (id, name) VALUES (?, ?)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ins.Close()
+	pooled, err := t.Prepare(sel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooled.Close()
+	c, err := t.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	pinned, err := c.PrepareContext(ctx, sel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pinned.Close()
+
+	check := func(when string, id int, name string) {
+		if _, err := ins.Exec(id, name); err != nil {
+			t.Fatalf("INSERT %s: %v", when, err)
+		}
+		for _, s := range []struct {
+			name string
+			stmt *sql.Stmt
+		}{{"pooled", pooled}, {"pinned", pinned}} {
+			var got string
+			if err := s.stmt.QueryRow(id).Scan(&got); err != nil || got != name {
+				t.Errorf("%s SELECT %s: got %q, %v; want %q", s.name, when, got, err, name)
+			}
+		}
+	}
+	check("before ALTER TABLE", 1, "a")
+	t.mustExec("ALTER TABLE " + tbl + " ADD extra INTEGER DEFAULT 7")
+	check("after ALTER TABLE", 2, "b")
+
+	var extra int
+	if err := t.QueryRow(t.q("SELECT extra FROM "+tbl+" WHERE id = ?"), 1).Scan(&extra); err != nil || extra != 7 {
+		t.Errorf("added column = %d, %v; want its default, 7", extra, err)
+	}
+}
+
+// testStmtCloseOpenRows closes statements while Rows from them are
+// open. database/sql defers closing a statement prepared on the pool
+// until its Rows are closed, but closes one prepared on a Conn at once:
+// the driver must then either finish the Rows or fail them, and leave
+// the connection usable.
+func testStmtCloseOpenRows(t params) {
+	t.Parallel()
+	const rows, read = 100, 10
+	tbl := stmtTable(t, rows)
+	t.SetMaxOpenConns(1)
+	ctx := context.Background()
+	sel := t.q("SELECT id FROM " + tbl + " WHERE id >= ? ORDER BY id")
+	// readRows reads the IDs from the first read onwards, calling
+	// stop after read of them, and returns how many it read.
+	readRows := func(rs *sql.Rows, stop func()) (int, error) {
+		n := 0
+		for rs.Next() {
+			var id int
+			if err := rs.Scan(&id); err != nil {
+				return n, err
+			}
+			n++
+			if id != n {
+				return n, fmt.Errorf("row %d has ID %d", n, id)
+			}
+			if n == read {
+				stop()
+			}
+		}
+		return n, rs.Err()
+	}
+	before := stmtsOnPool(t, 1)
+
+	stmt, err := t.Prepare(sel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := stmt.Query(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := readRows(rs, func() {
+		if err := stmt.Close(); err != nil {
+			t.Errorf("closing pooled statement with Rows open: %v", err)
+		}
+	})
+	if err != nil || n != rows {
+		t.Errorf("read %d rows of a closed pooled statement, %v; want %d", n, err, rows)
+	}
+	rs.Close()
+	if _, err := stmt.Query(1); err == nil {
+		t.Errorf("closed pooled statement ran again")
+	}
+
+	c, err := t.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if t.hasQuirk(quirkStmtCloseFreesRows) {
+		t.Logf("not closing a statement on a Conn with Rows open: driver frees them")
+	} else {
+		stmt, err := c.PrepareContext(ctx, sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs, err := stmt.QueryContext(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var closeErr error
+		n, err := readRows(rs, func() { closeErr = stmt.Close() })
+		rs.Close()
+		t.Logf("Close with Rows open: %v; then read %d rows: %v", closeErr, n, err)
+		switch {
+		case t.hasQuirk(quirkStmtCloseEndsRows):
+			if err != nil || n != read {
+				t.Errorf("read %d rows, %v; driver is listed as ending them at %d, remove quirkStmtCloseEndsRows", n, err, read)
+			}
+		case t.hasQuirk(quirkStmtCloseDesyncs):
+			if closeErr == nil || err == nil {
+				t.Errorf("Close: %v, then read %d rows: %v; driver is listed as losing a row, remove quirkStmtCloseDesyncs", closeErr, n, err)
+			}
+			// The connection waits for replies already read, so it
+			// is discarded.
+			c.Raw(func(interface{}) error { return driver.ErrBadConn })
+		case err == nil && n != rows:
+			t.Errorf("statement closed on a Conn: read %d rows without error; want %d", n, rows)
+		}
+		if !t.hasQuirk(quirkStmtCloseDesyncs) {
+			if err := checkCount(c.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+tbl), rows); err != nil {
+				t.Errorf("connection after closing a statement with Rows open: %v", err)
+			}
+		}
+	}
+	c.Close()
+	checkStmtLeaks(t, before, stmtsOnPool(t, 1), 2)
+}
@@ -0,0 +1,385 @@
+package sqltest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	registerScenario("Stress", testStress, 0)
+}
+
+// stressConfig controls a stress run. The defaults can be overridden
+// with GOSQLTEST_STRESS_GOROUTINES and GOSQLTEST_STRESS_DURATION.
+type stressConfig struct {
+	goroutines int
+	duration   time.Duration
+	rows       int // rows in the read-only table
+}
+
+func stressConfigFromEnv() (stressConfig, error) {
+	cfg := stressConfig{goroutines: 8, duration: time.Second, rows: 100}
+	if s := os.Getenv("GOSQLTEST_STRESS_GOROUTINES"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("bad GOSQLTEST_STRESS_GOROUTINES %q", s)
+		}
+		cfg.goroutines = n
+	}
+	if s := os.Getenv("GOSQLTEST_STRESS_DURATION"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return cfg, fmt.Errorf("bad GOSQLTEST_STRESS_DURATION %q: %v", s, err)
+		}
+		cfg.duration = d
+	}
+	return cfg, nil
+}
+
+// A stress runs a mixed workload against a *sql.DB from many goroutines
+// and counts what happens. Errors are expected under contention and are
+// only counted; wrong data and leaked connections are corruption.
+type stress struct {
+	db  *sql.DB
+	ro  string // read-only table of (id, val) with val "v<id>"
+	rw  string // table of (id, n) that transactions update
+	cfg stressConfig
+	sel *sql.Stmt // prepared lookup by id in ro
+
+	// selectVal looks up a row of ro by id and update increments one
+	// of rw, in the backend's placeholder style.
+	selectVal, update string
+
+	ops  []stressOp
+	errs struct {
+		sync.Mutex
+		sample map[string]string // op => first error seen
+	}
+	corrupt struct {
+		sync.Mutex
+		reports []string
+	}
+
+	// busyCommitKeepsTx is set for drivers with quirkBusyCommitKeepsTx.
+	// Their connections are rolled back after a failed COMMIT, counting
+	// in keptTx those the rollback shows to have been left in the
+	// transaction.
+	busyCommitKeepsTx bool
+	keptTx            int64 // updated atomically
+}
+
+// A stressOp is one kind of work done by the stress goroutines.
+type stressOp struct {
+	name     string
+	fn       func(s *stress, r *rand.Rand) error
+	ok, errs int64 // updated atomically
+}
+
+// newStress creates and fills ro and rw, which must not exist yet.
+func newStress(tb testing.TB, db *sql.DB, d *Dialect, ro, rw string, cfg stressConfig) (*stress, error) {
+	s := &stress{
+		db: db, ro: ro, rw: rw, cfg: cfg,
+		selectVal: d.q(tb, "SELECT val FROM "+ro+" WHERE id = ?"),
+		update:    d.q(tb, "UPDATE "+rw+" SET n = n + 1 WHERE id = ?"),
+	}
+	for _, q := range []string{
+		"CREATE TABLE " + ro + " (id INTEGER PRIMARY KEY, val VARCHAR(20))",
+		"CREATE TABLE " + rw + " (id INTEGER PRIMARY KEY, n INTEGER)",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			return nil, fmt.Errorf("%s: %v", q, err)
+		}
+	}
+	for id := 0; id < cfg.rows; id++ {
+		if _, err := db.Exec(d.q(tb, "INSERT INTO "+ro+" (id, val) VALUES (?, ?)"), id, stressVal(id)); err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec(d.q(tb, "INSERT INTO "+rw+" (id, n) VALUES (?, ?)"), id, 0); err != nil {
+			return nil, err
+		}
+	}
+	sel, err := db.Prepare(s.selectVal)
+	if err != nil {
+		return nil, err
+	}
+	s.sel = sel
+	s.errs.sample = map[string]string{}
+	s.ops = []stressOp{
+		{name: "QueryRow", fn: (*stress).queryRow},
+		{name: "PreparedQueryRow", fn: (*stress).preparedQueryRow},
+		{name: "Tx", fn: (*stress).tx},
+		{name: "OpenRows", fn: (*stress).openRows},
+		{name: "RowsCloseRace", fn: (*stress).rowsCloseRace},
+		{name: "StmtCloseRace", fn: (*stress).stmtCloseRace},
+	}
+	return s, nil
+}
+
+func stressVal(id int) string { return "v" + strconv.Itoa(id) }
+
+// corruption records that the driver returned something it must not.
+func (s *stress) corruption(format string, args ...interface{}) {
+	s.corrupt.Lock()
+	defer s.corrupt.Unlock()
+	if len(s.corrupt.reports) < 20 {
+		s.corrupt.reports = append(s.corrupt.reports, fmt.Sprintf(format, args...))
+	}
+}
+
+// checkVal reports corruption if val isn't what row id holds.
+func (s *stress) checkVal(op string, id int, val string) {
+	if want := stressVal(id); val != want {
+		s.corruption("%s: row %d has val %q; want %q", op, id, val, want)
+	}
+}
+
+func (s *stress) queryRow(r *rand.Rand) error {
+	id := r.Intn(s.cfg.rows)
+	var val string
+	if err := s.db.QueryRow(s.selectVal, id).Scan(&val); err != nil {
+		return err
+	}
+	s.checkVal("QueryRow", id, val)
+	return nil
+}
+
+func (s *stress) preparedQueryRow(r *rand.Rand) error {
+	id := r.Intn(s.cfg.rows)
+	var val string
+	if err := s.sel.QueryRow(id).Scan(&val); err != nil {
+		return err
+	}
+	s.checkVal("PreparedQueryRow", id, val)
+	return nil
+}
+
+// tx reads and updates a row in a transaction, then commits or rolls
+// back at random. It holds a connection of its own, so it can repair
+// one that a failed COMMIT left in the transaction.
+func (s *stress) tx(r *rand.Rand) error {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	id := r.Intn(s.cfg.rows)
+	var val string
+	if err := tx.QueryRow(s.selectVal, id).Scan(&val); err != nil {
+		return err
+	}
+	s.checkVal("Tx", id, val)
+	if _, err := tx.Exec(s.update, id); err != nil {
+		return err
+	}
+	if r.Intn(2) == 0 {
+		return tx.Rollback()
+	}
+	err = tx.Commit()
+	if err != nil && s.busyCommitKeepsTx {
+		if _, rerr := conn.ExecContext(ctx, "ROLLBACK"); rerr == nil {
+			atomic.AddInt64(&s.keptTx, 1)
+		}
+	}
+	return err
+}
+
+// openRows leaves a Rows open part way through while issuing another
+// query, then finishes iterating.
+func (s *stress) openRows(r *rand.Rand) error {
+	rows, err := s.db.Query("SELECT id, val FROM " + s.ro + " ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	stop := r.Intn(s.cfg.rows)
+	n := 0
+	for rows.Next() {
+		var id int
+		var val string
+		if err := rows.Scan(&id, &val); err != nil {
+			return err
+		}
+		if id != n {
+			s.corruption("OpenRows: row %d has id %d", n, id)
+		}
+		s.checkVal("OpenRows", id, val)
+		n++
+		if n == stop {
+			if err := s.queryRow(r); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if n != s.cfg.rows {
+		s.corruption("OpenRows: read %d rows; want %d", n, s.cfg.rows)
+	}
+	return nil
+}
+
+// rowsCloseRace closes a Rows from another goroutine while it is being
+// iterated. Whatever rows are read before the close must be correct.
+func (s *stress) rowsCloseRace(r *rand.Rand) error {
+	rows, err := s.db.Query("SELECT id, val FROM " + s.ro)
+	if err != nil {
+		return err
+	}
+	delay := time.Duration(r.Intn(100)) * time.Microsecond
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		time.Sleep(delay)
+		rows.Close()
+	}()
+	for rows.Next() {
+		var id int
+		var val string
+		if err := rows.Scan(&id, &val); err != nil {
+			break // closed underneath us
+		}
+		s.checkVal("RowsCloseRace", id, val)
+	}
+	<-done
+	return nil
+}
+
+// stmtCloseRace closes a statement while another goroutine is querying
+// through it. Queries may fail but must not return wrong data.
+func (s *stress) stmtCloseRace(r *rand.Rand) error {
+	stmt, err := s.db.Prepare(s.selectVal)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			id := r.Intn(s.cfg.rows)
+			var val string
+			if stmt.QueryRow(id).Scan(&val) == nil {
+				s.checkVal("StmtCloseRace", id, val)
+			}
+		}
+	}()
+	err = stmt.Close()
+	<-done
+	return err
+}
+
+// run starts cfg.goroutines workers doing random ops until cfg.duration
+// has passed, then checks that the pool is healthy.
+func (s *stress) run() {
+	deadline := time.Now().Add(s.cfg.duration)
+	var wg sync.WaitGroup
+	for g := 0; g < s.cfg.goroutines; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for time.Now().Before(deadline) {
+				op := &s.ops[r.Intn(len(s.ops))]
+				if err := op.fn(s, r); err != nil {
+					atomic.AddInt64(&op.errs, 1)
+					s.errs.Lock()
+					if _, ok := s.errs.sample[op.name]; !ok {
+						s.errs.sample[op.name] = err.Error()
+					}
+					s.errs.Unlock()
+				} else {
+					atomic.AddInt64(&op.ok, 1)
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+	s.sel.Close()
+
+	if in := s.db.Stats().InUse; in != 0 {
+		s.corruption("%d connections still in use after all workers returned", in)
+	}
+	// Every pooled connection must still answer correctly. They are all
+	// held at once, so that each check gets a different one.
+	ctx := context.Background()
+	var conns []*sql.Conn
+	for i := s.db.Stats().OpenConnections; i > 0; i-- {
+		conn, err := s.db.Conn(ctx)
+		if err != nil {
+			s.corruption("taking pooled connection %d after stress: %v", len(conns), err)
+			break
+		}
+		conns = append(conns, conn)
+	}
+	for i, conn := range conns {
+		id := i % s.cfg.rows
+		var val string
+		if err := conn.QueryRowContext(ctx, s.selectVal, id).Scan(&val); err != nil {
+			s.corruption("pooled connection %d unusable after stress: %v", i, err)
+		} else {
+			s.checkVal(fmt.Sprintf("pooled connection %d", i), id, val)
+		}
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// report formats throughput and error counts per op.
+func (s *stress) report() string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "op\tok\terrors\tops/s\tfirst error")
+	for i := range s.ops {
+		op := &s.ops[i]
+		rate := float64(op.ok+op.errs) / s.cfg.duration.Seconds()
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.0f\t%s\n", op.name, op.ok, op.errs, rate, s.errs.sample[op.name])
+	}
+	w.Flush()
+	return b.String()
+}
+
+func testStress(t params) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	skipTraced(t.T, "its goroutines share the pool in no fixed order")
+	cfg, err := stressConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newStress(t, t.DB, t.dialect(), t.table("stress_ro"), t.table("stress_rw"), cfg)
+	if err != nil {
+		t.Fatalf("setting up stress tables: %v", err)
+	}
+	s.busyCommitKeepsTx = t.hasQuirk(quirkBusyCommitKeepsTx)
+	s.run()
+	t.Logf("%d goroutines for %v:\n%s", cfg.goroutines, cfg.duration, s.report())
+	if s.keptTx > 0 {
+		t.Logf("%d failed COMMITs left their transaction open, as documented", s.keptTx)
+	}
+	for _, c := range s.corrupt.reports {
+		t.Errorf("corruption: %s", c)
+	}
+	for i := range s.ops {
+		if op := &s.ops[i]; op.ok == 0 && op.errs > 0 {
+			t.Errorf("%s never succeeded; first error: %s", op.name, s.errs.sample[op.name])
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package sqltest
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	registerScenario("TimeZones", testTimeZones, 0)
+}
+
+// A timeKind is a kind of column holding times.
+type timeKind struct {
+	name string
+	col  func(*Dialect) string // column type, "" if the backend has none
+}
+
+var timeKinds = []timeKind{
+	{"date", func(d *Dialect) string { return d.date }},
+	{"time", func(d *Dialect) string { return d.timeOfDay }},
+	{"timestamp", timestampCol},
+	{"timestamptz", func(d *Dialect) string { return d.timestamptz }},
+}
+
+// timeZones are the locations of the stored times, each with a time of
+// day whose date in UTC differs from its own, except in UTC, so that a
+// date taken from the wrong clock shows.
+var timeZones = func() []struct {
+	name string
+	at   time.Time
+} {
+	zones := []struct {
+		name string
+		at   time.Time
+	}{
+		{"UTC", time.Date(2013, 7, 4, 23, 8, 9, 0, time.UTC)},
+		{"+05:30", time.Date(2013, 7, 4, 1, 8, 9, 0, time.FixedZone("IST", 5*3600+1800))},
+	}
+	// New York observes daylight saving time in July.
+	if ny, err := time.LoadLocation("America/New_York"); err == nil {
+		zones = append(zones, struct {
+			name string
+			at   time.Time
+		}{"New_York", time.Date(2013, 7, 4, 23, 8, 9, 0, ny)})
+	}
+	return zones
+}()
+
+// timePrecisions are the fractions of a second added to each of
+// timeZones, one column of the table testTimeZones logs each.
+var timePrecisions = []struct {
+	name string
+	frac time.Duration
+}{
+	{"ns", 123456789},
+	{"µs", 123456000},
+	{"s", 0},
+}
+
+// A time zone result is a cell of two characters, the first saying what
+// became of the value and the second what came back:
+//
+//	=  the date, time of day or instant stored
+//	r  the same, rounded or truncated to a coarser precision
+//	s  shifted: the wall clock of another zone, such as the stored
+//	   time's own for an instant, or UTC's for a date or time of day
+//	x  shifted and rounded
+//	?  another value
+//
+//	=  a time.Time in the stored time's Location
+//	u  a time.Time in UTC
+//	l  a time.Time in time.Local
+//	o  a time.Time in another Location, such as an unnamed fixed zone
+//	t  text
+//	i  an integer, taken as a time of day in nanoseconds
+//
+// "EE" is an error and "NN" a NULL read back.
+const (
+	tzExact = "=="
+	tzError = "EE"
+	tzNull  = "NN"
+)
+
+// timeZonesExpected records, for each driver, the results of each row
+// of its time zone table, named by column kind and zone, as cells
+// separated by spaces, one per entry of timePrecisions. A row missing
+// from the record must be exact. Results other than recorded fail the
+// scenario, unless exact. Drivers of a server have no record until
+// someone runs them against one, since what it reads back depends on
+// the server's settings, such as its time zone; they fail only on an
+// error or another value. The records hold for a process whose
+// time.Local is UTC, as the fake servers' session time zone is, which
+// TestMain pins it to.
+var timeZonesExpected = map[string]map[string]string{
+	// go-sqlite3 stores a time.Time argument as NULL.
+	"sqlite": {
+		"date UTC":           "NN NN NN",
+		"date +05:30":        "NN NN NN",
+		"date New_York":      "NN NN NN",
+		"time UTC":           "NN NN NN",
+		"time +05:30":        "NN NN NN",
+		"time New_York":      "NN NN NN",
+		"timestamp UTC":      "NN NN NN",
+		"timestamp +05:30":   "NN NN NN",
+		"timestamp New_York": "NN NN NN",
+	},
+	// Postgres rounds to microseconds. pq sends the stored time's
+	// offset, which the types without a zone drop, and reads dates and
+	// timestamps in an unnamed zone and times of day in UTC.
+	"pq-fake": {
+		"date UTC":             "=o =o =o",
+		"date +05:30":          "=o =o =o",
+		"date New_York":        "=o =o =o",
+		"time UTC":             "r= == ==",
+		"time +05:30":          "ru =u =u",
+		"time New_York":        "ru =u =u",
+		"timestamp UTC":        "ro =o =o",
+		"timestamp +05:30":     "xo so so",
+		"timestamp New_York":   "xo so so",
+		"timestamptz UTC":      "r= == ==",
+		"timestamptz +05:30":   "ru =u =u",
+		"timestamptz New_York": "ru =u =u",
+	},
+	// pgx truncates to microseconds itself, reads dates and timestamps
+	// in time.Local and times of day as text.
+	"pgx-fake": {
+		"date UTC":             "=l =l =l",
+		"date +05:30":          "=l =l =l",
+		"date New_York":        "=l =l =l",
+		"time UTC":             "rt =t =t",
+		"time +05:30":          "rt =t =t",
+		"time New_York":        "rt =t =t",
+		"timestamp UTC":        "rl =l =l",
+		"timestamp +05:30":     "xl sl sl",
+		"timestamp New_York":   "xl sl sl",
+		"timestamptz UTC":      "rl =l =l",
+		"timestamptz +05:30":   "rl =l =l",
+		"timestamptz New_York": "rl =l =l",
+	},
+	// mymysql sends a fraction of a second as nanoseconds, with its
+	// first byte overwritten by the seconds, and reads microseconds as
+	// nanoseconds. It sends the stored time's wall clock, and reads
+	// times in time.Local and times of day as a time.Duration. DATETIME
+	// keeps whole seconds.
+	"mymysql-fake": {
+		"date UTC":             "=l =l =l",
+		"date +05:30":          "=l =l =l",
+		"date New_York":        "=l =l =l",
+		"time UTC":             "?i ?i =i",
+		"time +05:30":          "?i ?i =i",
+		"time New_York":        "?i ?i =i",
+		"timestamp UTC":        "rl rl =l",
+		"timestamp +05:30":     "xl xl sl",
+		"timestamp New_York":   "xl xl sl",
+		"timestamptz UTC":      "?l ?l =l",
+		"timestamptz +05:30":   "?l ?l sl",
+		"timestamptz New_York": "?l ?l sl",
+	},
+	// go-mysql-driver sends the stored time's wall clock without its
+	// fraction of a second, and without parseTime in the DSN reads
+	// text.
+	"gomysql-fake": {
+		"date UTC":             "=t =t =t",
+		"date +05:30":          "=t =t =t",
+		"date New_York":        "=t =t =t",
+		"time UTC":             "rt rt =t",
+		"time +05:30":          "rt rt =t",
+		"time New_York":        "rt rt =t",
+		"timestamp UTC":        "rt rt =t",
+		"timestamp +05:30":     "xt xt st",
+		"timestamp New_York":   "xt xt st",
+		"timestamptz UTC":      "rt rt =t",
+		"timestamptz +05:30":   "xt xt st",
+		"timestamptz New_York": "xt xt st",
+	},
+}
+
+// wallUTC returns the wall clock of t read as a time in UTC.
+func wallUTC(t time.Time) time.Time {
+	y, mo, d := t.Date()
+	h, mi, s := t.Clock()
+	return time.Date(y, mo, d, h, mi, s, t.Nanosecond(), time.UTC)
+}
+
+// timePart returns the part of a time a column of the given kind keeps,
+// and whether that is an instant rather than a wall clock reading.
+func timePart(kind string) (part func(time.Time) time.Time, instant bool) {
+	switch kind {
+	case "date":
+		return func(t time.Time) time.Time {
+			y, mo, d := t.Date()
+			return time.Date(y, mo, d, 0, 0, 0, 0, time.UTC)
+		}, false
+	case "time":
+		return func(t time.Time) time.Time {
+			h, mi, s := t.Clock()
+			return time.Date(2000, 1, 1, h, mi, s, t.Nanosecond(), time.UTC)
+		}, false
+	}
+	return func(t time.Time) time.Time { return t }, true
+}
+
+// sameTime returns the first character of the cell for got, read back
+// from a column of the given kind where want was stored. A date or time
+// of day is shifted if it is that of want in UTC, and an instant if it
+// has the wall clock of want in another zone.
+func sameTime(kind string, got, want time.Time) string {
+	part, instant := timePart(kind)
+	match := func(g, w time.Time) string {
+		if part(g).Equal(part(w)) {
+			return "="
+		}
+		for _, d := range []time.Duration{time.Microsecond, time.Millisecond, time.Second} {
+			if part(g).Equal(part(w.Truncate(d))) || part(g).Equal(part(w.Round(d))) {
+				return "r"
+			}
+		}
+		return ""
+	}
+	g, w, sg, sw := got, want, wallUTC(got), wallUTC(want)
+	if !instant {
+		g, w, sw = sg, sw, want.UTC()
+	}
+	if m := match(g, w); m != "" {
+		return m
+	}
+	switch match(sg, sw) {
+	case "=":
+		return "s"
+	case "r":
+		return "x"
+	}
+	return "?"
+}
+
+// timeResult returns the cell for v, read back from a column of the
+// given kind where want was stored.
+func timeResult(kind string, v interface{}, want time.Time) string {
+	switch v := v.(type) {
+	case nil:
+		return tzNull
+	case time.Time:
+		loc := "o"
+		switch v.Location().String() {
+		case want.Location().String():
+			loc = "="
+		case "UTC":
+			loc = "u"
+		case "Local":
+			loc = "l"
+		}
+		return sameTime(kind, v, want) + loc
+	case int64:
+		got := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(v))
+		return sameTime(kind, got, want) + "i"
+	case []byte, string:
+		b, _ := asBytes(v)
+		for _, layout := range []string{"2006-01-02 15:04:05.999999999", "2006-01-02", "15:04:05.999999999"} {
+			if got, err := time.Parse(layout, string(b)); err == nil {
+				return sameTime(kind, got, want) + "t"
+			}
+		}
+		return "?t"
+	}
+	return "??"
+}
+
+// testTimeZones stores times in each of timeZones, at each of
+// timePrecisions, in each kind of time column the backend has, and reads
+// them back as the driver returns them. It logs a table of the results
+// and details of those not exact, which are checked against the
+// driver's record in timeZonesExpected if it has one, and otherwise fail
+// only if an error or another value: a rounded or shifted time is stored
+// without an error, and the Location read back is seldom the one stored.
+func testTimeZones(t params) {
+	t.Parallel()
+	d := t.dialect()
+	expected, recorded := timeZonesExpected[t.drv.name]
+	var (
+		table   strings.Builder
+		details []string
+	)
+	w := tabwriter.NewWriter(&table, 0, 8, 1, ' ', 0)
+	fmt.Fprint(w, "column")
+	for _, p := range timePrecisions {
+		fmt.Fprintf(w, "\t%s", p.name)
+	}
+	fmt.Fprintln(w)
+
+	for _, kind := range timeKinds {
+		col := kind.col(d)
+		if col == "" {
+			continue
+		}
+		tbl := t.table("tz" + kind.name)
+		t.mustExec("CREATE TABLE " + tbl + " (id INTEGER PRIMARY KEY, v " + col + ")")
+		insert := t.q("INSERT INTO " + tbl + " (id, v) VALUES (?, ?)")
+		id := 0
+		for _, z := range timeZones {
+			row := kind.name + " " + z.name
+			fmt.Fprint(w, row)
+			var cells []string
+			for _, p := range timePrecisions {
+				id++
+				want := z.at.Add(p.frac)
+				var got interface{}
+				_, err := t.Exec(insert, id, want)
+				if err == nil {
+					err = t.QueryRow(t.q("SELECT v FROM "+tbl+" WHERE id = ?"), id).Scan(&got)
+				}
+				cell := tzError
+				if err == nil {
+					cell = timeResult(kind.name, got, want)
+				}
+				var detail string
+				switch {
+				case err != nil:
+					detail = fmt.Sprintf("%s, %s: %v", row, p.name, err)
+				case cell != tzExact:
+					detail = fmt.Sprintf("%s, %s: stored %v, read %s", row, p.name, want, showTime(got))
+				}
+				if !recorded && (cell == tzError || cell[0] == '?') {
+					t.Errorf("%s; %s has no record in timeZonesExpected", detail, t.drv.name)
+				} else if detail != "" {
+					details = append(details, detail)
+				}
+				fmt.Fprintf(w, "\t%s", cell)
+				cells = append(cells, cell)
+			}
+			fmt.Fprintln(w)
+			if recorded {
+				checkTimeZones(t, row, cells, expected[row])
+			}
+		}
+	}
+	w.Flush()
+	t.Logf("time zone results (value, what came back):\n%s", table.String())
+	if !recorded {
+		t.Logf("%s has no record in timeZonesExpected: only errors and other values checked", t.drv.name)
+	}
+	for _, d := range details {
+		t.Log(d)
+	}
+}
+
+// checkTimeZones compares the cells of a row with those recorded, or
+// with exact results if none are.
+func checkTimeZones(t params, row string, cells []string, recorded string) {
+	want := strings.Fields(recorded)
+	for i, p := range timePrecisions {
+		rec := tzExact
+		if i < len(want) {
+			rec = want[i]
+		}
+		switch got := cells[i]; {
+		case got == rec:
+		case got == tzExact:
+			t.Logf("%s, %s: exact, better than the recorded %s", row, p.name, rec)
+		default:
+			t.Errorf("%s, %s: got %s; recorded %s", row, p.name, got, rec)
+		}
+	}
+}
+
+// showTime formats v, a value read back, for a log line, with its
+// Location if it is a time.Time.
+func showTime(v interface{}) string {
+	switch v := v.(type) {
+	case time.Time:
+		return fmt.Sprintf("%v in %q", v, v.Location())
+	case []byte:
+		return fmt.Sprintf("%q", v)
+	}
+	return abbrev(v)
+}
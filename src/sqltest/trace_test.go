@@ -0,0 +1,603 @@
+package sqltest
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sqltest/faultproxy"
+)
+
+// Protocol traces. With GOSQLTEST_RECORD set to a directory, each
+// scenario of a driver whose database is reached over TCP, the fakes
+// included, runs through a faultproxy.Proxy whose Tap records the bytes
+// of every connection, and the session is written as a transcript to
+// <dir>/<driver>/<scenario>.trace. With GOSQLTEST_REPLAY set to such a
+// directory, a replay server stands in for the database, playing the
+// server's side of each transcript back to the driver and failing the
+// test where the driver sends other bytes than it recorded.
+var (
+	recordDir = os.Getenv("GOSQLTEST_RECORD")
+	replayDir = os.Getenv("GOSQLTEST_REPLAY")
+)
+
+// committedTraces holds the transcripts committed with the suite, those
+// of the drivers run against the fake servers, which TestReplay plays
+// back.
+const committedTraces = "testdata/traces"
+
+// tracing reports whether sessions are being recorded or replayed.
+func tracing() bool { return recordDir != "" || replayDir != "" }
+
+// traceLimit bounds the bytes of a session worth a transcript, keeping
+// transcripts small enough to commit. Longer ones, such as LargeResult's
+// and StmtChurn's, are not recorded.
+const traceLimit = 64 << 10
+
+// replayTimeout bounds the wait for bytes the driver sent in the
+// recording.
+const replayTimeout = 10 * time.Second
+
+// An addrTester reaches its database at a TCP address, which its driver
+// can be sent to dial in place of another.
+type addrTester interface {
+	// Addr returns the address of the database, starting it or
+	// skipping tb as needed.
+	Addr(tb testing.TB) string
+
+	// OpenAt is like Open, but the driver dials addr instead.
+	OpenAt(tb testing.TB, addr string) *sql.DB
+}
+
+// openTraced is tester.Open, except that a session of an addrTester is
+// recorded to GOSQLTEST_RECORD or replayed from GOSQLTEST_REPLAY.
+func openTraced(tester Tester, t *testing.T) *sql.DB {
+	at, ok := tester.(addrTester)
+	if !ok || !tracing() {
+		return tester.Open(t)
+	}
+	if recordDir != "" && replayDir != "" {
+		t.Fatal("GOSQLTEST_RECORD and GOSQLTEST_REPLAY are both set")
+	}
+	if replayDir != "" {
+		file := filepath.Join(replayDir, traceFile(t.Name()))
+		data, err := os.ReadFile(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			t.Skipf("no trace recorded in %s", file)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr, err := parseTrace(data)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		return at.OpenAt(t, startReplay(t, tr).Addr())
+	}
+
+	target := at.Addr(t)
+	tr := &trace{}
+	t.Cleanup(func() { writeTrace(t, tr) })
+	p := &faultproxy.Proxy{Target: target, Tap: tr.tap}
+	if err := p.Start(); err != nil {
+		t.Fatalf("starting tracing proxy: %v", err)
+	}
+	t.Cleanup(func() {
+		tr.wait(time.Second)
+		p.Close()
+	})
+	return at.OpenAt(t, p.Addr())
+}
+
+// skipTraced skips tb when sessions are traced, as its session differs
+// from run to run for the given reason.
+func skipTraced(tb testing.TB, reason string) {
+	if tracing() {
+		tb.Skipf("not traced: %s", reason)
+	}
+}
+
+// traceFile returns the transcript's path, relative to the trace
+// directory, for the test with the given name: <driver>/<scenario>.trace
+// for a scenario of TestAll or TestReplay.
+func traceFile(name string) string {
+	if elems := strings.Split(name, "/"); len(elems) == 3 && (elems[0] == "TestAll" || elems[0] == "TestReplay") {
+		return filepath.Join(elems[2], elems[1]+".trace")
+	}
+	return filepath.FromSlash(name) + ".trace"
+}
+
+// writeTrace writes the transcript of tb's session, unless tb was
+// skipped.
+func writeTrace(tb testing.TB, tr *trace) {
+	if tb.Skipped() {
+		return
+	}
+	file := filepath.Join(recordDir, traceFile(tb.Name()))
+	if tr.size > traceLimit {
+		tb.Logf("not recording %s: %d bytes is more than %d", file, tr.size, traceLimit)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(file, tr.transcript(tb.Name()), 0666); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// A trace is the traffic of a session, connection by connection.
+type trace struct {
+	mu    sync.Mutex
+	conns [][]segment // in the order accepted
+	size  int         // bytes sent on all of them
+}
+
+// A segment is bytes sent in one direction of a connection, before it
+// turned the other way, or the end of that direction.
+type segment struct {
+	dir  faultproxy.Direction
+	data []byte
+	end  bool
+}
+
+// tap records b, sent in direction d of the nth connection; it is the
+// proxy's Tap.
+func (tr *trace) tap(n int, d faultproxy.Direction, b []byte) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for len(tr.conns) <= n {
+		tr.conns = append(tr.conns, nil)
+	}
+	segs := tr.conns[n]
+	tr.size += len(b)
+	switch k := len(segs) - 1; {
+	case b == nil:
+		tr.conns[n] = append(segs, segment{dir: d, end: true})
+	case tr.size > traceLimit:
+		// Too long to write; keep only the count.
+	case k >= 0 && segs[k].dir == d && !segs[k].end:
+		segs[k].data = append(segs[k].data, b...)
+	default:
+		tr.conns[n] = append(segs, segment{dir: d, data: append([]byte(nil), b...)})
+	}
+}
+
+// wait waits up to timeout for the driver to end every connection, so
+// that closing the proxy cuts off nothing it sent.
+func (tr *trace) wait(timeout time.Duration) {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if tr.ended() {
+			return
+		}
+	}
+}
+
+// ended reports whether the driver has ended every connection.
+func (tr *trace) ended() bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, segs := range tr.conns {
+		ended := false
+		for _, s := range segs {
+			ended = ended || s.dir == faultproxy.ToServer && s.end
+		}
+		if !ended {
+			return false
+		}
+	}
+	return true
+}
+
+// arrows mark the direction of a segment in a transcript.
+var arrows = map[faultproxy.Direction]string{faultproxy.ToServer: ">", faultproxy.ToClient: "<"}
+
+// transcript returns tr as the test with the given name recorded it:
+// for each connection, a line "conn N" followed by its segments, each
+// a line "> N" for N bytes the driver sent or "< N" for N the server
+// sent, with their hex dump, or "> end" or "< end" where that side
+// ended the connection.
+func (tr *trace) transcript(name string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# %s\n# > driver to server, < server to driver\n", name)
+	for n, segs := range tr.conns {
+		fmt.Fprintf(&b, "\nconn %d\n", n)
+		for i, s := range segs {
+			if s.end {
+				fmt.Fprintf(&b, "%s end\n", arrows[s.dir])
+				continue
+			}
+			data := s.data
+			if i == firstSent(segs) {
+				data = canonical(data)
+			}
+			fmt.Fprintf(&b, "%s %d\n", arrows[s.dir], len(data))
+			for _, line := range strings.SplitAfter(hex.Dump(data), "\n") {
+				if line != "" {
+					b.WriteString("  " + line)
+				}
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+// firstSent returns the index of the first bytes the driver sent among
+// segs, or -1.
+func firstSent(segs []segment) int {
+	for i, s := range segs {
+		if s.dir == faultproxy.ToServer && !s.end {
+			return i
+		}
+	}
+	return -1
+}
+
+// canonical returns b, the first bytes a driver sent on a connection,
+// with the parameters of a Postgres startup message at its start sorted
+// by name, as lib/pq sends them in the random order of a Go map.
+func canonical(b []byte) []byte {
+	if len(b) < 9 || binary.BigEndian.Uint32(b[4:]) != 3<<16 {
+		return b
+	}
+	n := int(binary.BigEndian.Uint32(b))
+	if n < 10 || n > len(b) || b[n-2] != 0 || b[n-1] != 0 {
+		return b
+	}
+	f := strings.Split(strings.TrimSuffix(string(b[8:n-1]), "\x00"), "\x00")
+	if len(f)%2 != 0 {
+		return b
+	}
+	var params []string
+	for i := 0; i < len(f); i += 2 {
+		params = append(params, f[i]+"\x00"+f[i+1]+"\x00")
+	}
+	sort.Strings(params)
+	c := append([]byte(nil), b[:8]...)
+	c = append(c, strings.Join(params, "")...)
+	c = append(c, 0)
+	return append(c, b[n:]...)
+}
+
+// parseTrace parses a transcript.
+func parseTrace(data []byte) (*trace, error) {
+	tr := &trace{}
+	var seg *segment
+	want := 0 // bytes in seg
+	done := func() error {
+		if seg != nil && len(seg.data) != want {
+			return fmt.Errorf("segment of %d bytes has %d", want, len(seg.data))
+		}
+		return nil
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := sc.Text()
+		fail := func(format string, args ...interface{}) (*trace, error) {
+			return nil, fmt.Errorf("line %d: %s", lineno, fmt.Sprintf(format, args...))
+		}
+		if strings.HasPrefix(line, "  ") {
+			if seg == nil {
+				return fail("bytes outside a segment")
+			}
+			b, err := parseDumpLine(line)
+			if err != nil {
+				return fail("%v", err)
+			}
+			seg.data = append(seg.data, b...)
+			continue
+		}
+		if err := done(); err != nil {
+			return fail("%v", err)
+		}
+		seg = nil
+		f := strings.Fields(line)
+		switch {
+		case len(f) == 0 || strings.HasPrefix(f[0], "#"):
+		case len(f) == 2 && f[0] == "conn":
+			if n, err := strconv.Atoi(f[1]); err != nil || n != len(tr.conns) {
+				return fail("want conn %d", len(tr.conns))
+			}
+			tr.conns = append(tr.conns, nil)
+		case len(f) == 2 && (f[0] == ">" || f[0] == "<") && len(tr.conns) > 0:
+			s := segment{dir: faultproxy.ToServer}
+			if f[0] == "<" {
+				s.dir = faultproxy.ToClient
+			}
+			if f[1] == "end" {
+				s.end = true
+			} else if n, err := strconv.Atoi(f[1]); err == nil && n > 0 {
+				want = n
+			} else {
+				return fail("bad byte count %q", f[1])
+			}
+			k := len(tr.conns) - 1
+			tr.conns[k] = append(tr.conns[k], s)
+			if !s.end {
+				seg = &tr.conns[k][len(tr.conns[k])-1]
+			}
+		default:
+			return fail("unexpected %q", line)
+		}
+	}
+	if err := done(); err != nil {
+		return nil, err
+	}
+	return tr, sc.Err()
+}
+
+// parseDumpLine returns the bytes of a line of hex.Dump output: an
+// offset, up to 16 bytes in hex, and the same bytes as text between
+// bars.
+func parseDumpLine(line string) ([]byte, error) {
+	f := strings.Fields(line)
+	var b []byte
+	for _, x := range f[1:] {
+		if strings.HasPrefix(x, "|") {
+			return b, nil
+		}
+		c, err := strconv.ParseUint(x, 16, 8)
+		if err != nil || len(x) != 2 {
+			return nil, fmt.Errorf("bad byte %q", x)
+		}
+		b = append(b, byte(c))
+	}
+	return nil, fmt.Errorf("no text column in %q", line)
+}
+
+// A replayServer stands in for a database, serving the nth connection
+// it accepts the nth of a trace's: it reads what the driver sent in the
+// recording and writes what the server did, in the recorded order.
+type replayServer struct {
+	tb testing.TB
+	tr *trace
+	ln net.Listener
+
+	mu       sync.Mutex
+	accepted int
+	conns    map[net.Conn]bool
+	closing  bool
+	wg       sync.WaitGroup
+}
+
+// startReplay starts a server replaying tr for tb, closed when tb
+// finishes.
+func startReplay(tb testing.TB, tr *trace) *replayServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("starting replay server: %v", err)
+	}
+	r := &replayServer{tb: tb, tr: tr, ln: ln, conns: map[net.Conn]bool{}}
+	r.wg.Add(1)
+	go r.serve()
+	tb.Cleanup(r.close)
+	return r
+}
+
+func (r *replayServer) Addr() string { return r.ln.Addr().String() }
+
+func (r *replayServer) serve() {
+	defer r.wg.Done()
+	for {
+		c, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		n := r.accepted
+		r.accepted++
+		r.conns[c] = true
+		r.mu.Unlock()
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			if err := r.play(c, n); err != nil {
+				r.tb.Errorf("replaying conn %d: %v", n, err)
+			}
+			c.Close()
+			r.mu.Lock()
+			delete(r.conns, c)
+			r.mu.Unlock()
+		}()
+	}
+}
+
+// close stops the server once its connections end, giving the driver
+// a second to close them as it did in the recording before closing them
+// itself, as the recording proxy would have.
+func (r *replayServer) close() {
+	r.ln.Close()
+	done := make(chan bool)
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		r.mu.Lock()
+		r.closing = true
+		for c := range r.conns {
+			c.Close()
+		}
+		r.mu.Unlock()
+		<-done
+	}
+	if n := len(r.tr.conns); r.accepted < n && !r.tb.Skipped() {
+		r.tb.Errorf("the driver opened %d connections; the recording has %d", r.accepted, n)
+	}
+}
+
+// play replays the nth connection of the trace on c.
+func (r *replayServer) play(c net.Conn, n int) error {
+	if n >= len(r.tr.conns) {
+		return fmt.Errorf("the recording has only %d connections", len(r.tr.conns))
+	}
+	segs := r.tr.conns[n]
+	for i, s := range segs {
+		var err error
+		switch {
+		case s.dir == faultproxy.ToClient && s.end:
+			// The driver may have closed the connection first.
+			c.(*net.TCPConn).CloseWrite()
+		case s.dir == faultproxy.ToClient:
+			c.SetWriteDeadline(time.Now().Add(replayTimeout))
+			_, err = c.Write(s.data)
+		case s.end:
+			err = r.expectEnd(c)
+		default:
+			err = r.expect(c, s.data, i == firstSent(segs))
+		}
+		if err != nil && !r.isClosing() {
+			return fmt.Errorf("segment %d (%s %d): %v", i, arrows[s.dir], len(s.data), err)
+		}
+	}
+	return nil
+}
+
+// expect reads want from c, failing at the first byte that differs.
+// The first bytes sent on a connection are compared once all have come,
+// in canonical form.
+func (r *replayServer) expect(c net.Conn, want []byte, first bool) error {
+	got := make([]byte, 0, len(want))
+	buf := make([]byte, 32<<10)
+	for len(got) < len(want) {
+		c.SetReadDeadline(time.Now().Add(replayTimeout))
+		k := len(want) - len(got)
+		if k > len(buf) {
+			k = len(buf)
+		}
+		k, err := c.Read(buf[:k])
+		got = append(got, buf[:k]...)
+		from := len(got) - k
+		if first && len(got) == len(want) {
+			got, from = canonical(got), 0
+		}
+		if !first || len(got) == len(want) {
+			for i := from; i < len(got); i++ {
+				if got[i] != want[i] {
+					return fmt.Errorf("the driver sent other bytes from byte %d:\n%swant:\n%s", i, dumpFrom(got, i), dumpFrom(want, i))
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("after %d bytes: %v", len(got), err)
+		}
+	}
+	return nil
+}
+
+// expectEnd reads the end of what the driver sends on c, as it closes
+// c or the server closes it.
+func (r *replayServer) expectEnd(c net.Conn) error {
+	c.SetReadDeadline(time.Time{})
+	b := make([]byte, 64)
+	k, err := io.ReadFull(c, b)
+	if k > 0 {
+		return fmt.Errorf("the driver sent more bytes:\n%s", hex.Dump(b[:k]))
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// isClosing reports whether the server has closed the connections the
+// driver left open.
+func (r *replayServer) isClosing() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closing
+}
+
+// dumpFrom dumps up to 64 bytes of b from the line holding byte i.
+func dumpFrom(b []byte, i int) string {
+	i &^= 15
+	end := i + 64
+	if end > len(b) {
+		end = len(b)
+	}
+	return fmt.Sprintf("  (from byte %d)\n%s", i, hex.Dump(b[i:end]))
+}
+
+// TestReplay replays the transcripts in committedTraces, as
+// GOSQLTEST_REPLAY=testdata/traces would for TestAll, so that a driver
+// sending other bytes than when they were recorded fails with no
+// database installed. After a deliberate change, record them again with
+//
+//	GOSQLTEST_RECORD=testdata/traces go test -run 'TestAll/.*/-fake$'
+func TestReplay(t *testing.T) {
+	if tracing() {
+		t.Skip("TestAll traces the sessions itself")
+	}
+	if _, err := os.Stat(committedTraces); errors.Is(err, fs.ErrNotExist) {
+		t.Skipf("no transcripts in %s", committedTraces)
+	}
+	replayDir = committedTraces
+	t.Cleanup(func() { replayDir = "" })
+	for _, s := range scenarios {
+		s := s
+		t.Run(s.name, func(t *testing.T) {
+			for _, d := range drivers {
+				d := d
+				if _, err := os.Stat(filepath.Join(committedTraces, d.name)); err != nil {
+					continue
+				}
+				t.Run(d.name, func(t *testing.T) { runScenario(t, s, d) })
+			}
+		})
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	startup := []byte("\x00\x00\x00\x1b\x00\x03\x00\x00user\x00u\x00database\x00d\x00\x00")
+	tr := &trace{}
+	tr.tap(0, faultproxy.ToServer, startup[:5])
+	tr.tap(0, faultproxy.ToServer, startup[5:])
+	tr.tap(0, faultproxy.ToClient, []byte("R\x00\x00\x00\x08\x00\x00\x00\x00"))
+	tr.tap(1, faultproxy.ToClient, []byte("greeting |with| bars, and more than sixteen bytes"))
+	tr.tap(0, faultproxy.ToServer, []byte("X\x00\x00\x00\x04"))
+	tr.tap(0, faultproxy.ToServer, nil)
+	tr.tap(1, faultproxy.ToClient, nil)
+	text := tr.transcript("TestTranscript")
+	got, err := parseTrace(text)
+	if err != nil {
+		t.Fatalf("%v in\n%s", err, text)
+	}
+
+	sorted := []byte("\x00\x00\x00\x1b\x00\x03\x00\x00database\x00d\x00user\x00u\x00\x00")
+	if !bytes.Equal(canonical(startup), sorted) {
+		t.Errorf("canonical(%q) = %q; want %q", startup, canonical(startup), sorted)
+	}
+	tr.conns[0][0].data = sorted
+	if fmt.Sprint(got.conns) != fmt.Sprint(tr.conns) {
+		t.Errorf("parsed\n%s\nas %v; want %v", text, got.conns, tr.conns)
+	}
+
+	for _, bad := range []string{
+		"> 1\n  00000000  00  |.|\n",
+		"conn 1\n",
+		"conn 0\n> 2\n  00000000  00  |.|\n",
+		"conn 0\n> 1\n  00000000  zz  |.|\n",
+		"conn 0\n< many\n",
+	} {
+		if _, err := parseTrace([]byte(bad)); err == nil {
+			t.Errorf("parseTrace(%q) succeeded; want an error", bad)
+		}
+	}
+}
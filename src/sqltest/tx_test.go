@@ -0,0 +1,317 @@
+package sqltest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"sqltest/faultproxy"
+)
+
+func init() {
+	registerScenario("TxRollback", testTxRollback, 0)
+	registerScenario("TxCommitVisible", testTxCommitVisible, 0)
+	registerScenario("TxIsolation", testTxIsolation, 0)
+	registerScenario("TxDone", testTxDone, 0)
+	registerScenario("TxFailedStatement", testTxFailedStatement, 0)
+	registerScenario("TxConnLost", testTxConnLost, 0)
+	registerScenario("TxBusyCommit", testTxBusyCommit, 0)
+}
+
+// rowQueryer is implemented by *sql.DB, *sql.Conn and *sql.Tx.
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// txTable creates an empty table for the transaction scenarios and
+// returns its name.
+func txTable(t params) string {
+	tbl := t.table("tx")
+	t.mustExec("CREATE TABLE " + tbl + " (id INTEGER PRIMARY KEY, name VARCHAR(50))")
+	return tbl
+}
+
+// countRows returns the number of rows in tbl as seen by q.
+func countRows(t params, q rowQueryer, tbl string) int {
+	var n int
+	if err := q.QueryRowContext(context.Background(), "SELECT COUNT(*) FROM "+tbl).Scan(&n); err != nil {
+		t.Fatalf("counting rows of %s: %v", tbl, err)
+	}
+	return n
+}
+
+// twoConns returns two distinct connections from the pool.
+func twoConns(t params) (*sql.Conn, *sql.Conn) {
+	ctx := context.Background()
+	c1, err := t.Conn(ctx)
+	if err != nil {
+		t.Fatalf("first connection: %v", err)
+	}
+	t.Cleanup(func() { c1.Close() })
+	c2, err := t.Conn(ctx)
+	if err != nil {
+		t.Fatalf("second connection: %v", err)
+	}
+	t.Cleanup(func() { c2.Close() })
+	return c1, c2
+}
+
+func testTxRollback(t params) {
+	t.Parallel()
+	tbl := txTable(t)
+	tx, err := t.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(t.q("INSERT INTO "+tbl+" (id, name) VALUES (?, ?)"), 1, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, tx, tbl); n != 1 {
+		t.Errorf("inside tx, count = %d; want 1", n)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if n := countRows(t, t.DB, tbl); n != 0 {
+		t.Errorf("after rollback, count = %d; want 0", n)
+	}
+}
+
+func testTxCommitVisible(t params) {
+	t.Parallel()
+	tbl := txTable(t)
+	writer, reader := twoConns(t)
+	ctx := context.Background()
+	tx, err := writer.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(t.q("INSERT INTO "+tbl+" (id, name) VALUES (?, ?)"), 1, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if n := countRows(t, reader, tbl); n != 1 {
+		t.Errorf("after commit, other connection sees %d rows; want 1", n)
+	}
+}
+
+// testTxIsolation checks that a concurrent reader on another connection
+// sees neither uncommitted inserts nor, after commit, stale data.
+func testTxIsolation(t params) {
+	t.Parallel()
+	tbl := txTable(t)
+	writer, reader := twoConns(t)
+	ctx := context.Background()
+	tx, err := writer.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(t.q("INSERT INTO "+tbl+" (id, name) VALUES (?, ?)"), 1, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, reader, tbl); n != 0 {
+		t.Errorf("before commit, other connection sees %d rows; want 0", n)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if n := countRows(t, reader, tbl); n != 1 {
+		t.Errorf("after commit, other connection sees %d rows; want 1", n)
+	}
+}
+
+func testTxDone(t params) {
+	t.Parallel()
+	tbl := txTable(t)
+
+	tx, err := t.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if err := tx.Commit(); err != sql.ErrTxDone {
+		t.Errorf("Commit after Rollback = %v; want sql.ErrTxDone", err)
+	}
+
+	tx, err = t.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := tx.Rollback(); err != sql.ErrTxDone {
+		t.Errorf("Rollback after Commit = %v; want sql.ErrTxDone", err)
+	}
+	if _, err := tx.Exec(t.q("INSERT INTO "+tbl+" (id, name) VALUES (?, ?)"), 1, "bob"); err != sql.ErrTxDone {
+		t.Errorf("Exec after Commit = %v; want sql.ErrTxDone", err)
+	}
+	if n := countRows(t, t.DB, tbl); n != 0 {
+		t.Errorf("count = %d; want 0", n)
+	}
+}
+
+// testTxConnLost loses the connection of a transaction holding an
+// uncommitted insert, resetting it in the proxy and, where the backend
+// can kill sessions, killing its session on the server, which reaches
+// drivers the proxy cannot, such as goracle. Commit must then fail
+// rather than report success, and the insert must be lost.
+func testTxConnLost(t params) {
+	tbl := txTable(t)
+	d := t.dialect()
+	t.Run(proxyKiller.name, func(tt *testing.T) {
+		pt, ok := t.dbType.(proxiedTester)
+		if !ok {
+			tt.Skip("driver does not connect over TCP")
+		}
+		db, p := pt.OpenProxied(tt)
+		checkTxConnLost(t, tt, db, p, proxyKiller, 1, tbl)
+	})
+	t.Run("server kill", func(tt *testing.T) {
+		if d.sessionID == "" || d.killSession == "" {
+			tt.Skip("sessions cannot be killed")
+		}
+		skipTraced(tt, "it kills a session of a handle of its own")
+		// A driver with quirkBrokenConnReused would keep the killed
+		// connection in t.DB's pool.
+		checkTxConnLost(t, tt, t.dbType.Open(tt), nil, sqlKiller(d, t.DB), 2, tbl)
+	})
+}
+
+// checkTxConnLost inserts the row id into tbl in a transaction on db,
+// kills its session with k and commits, resetting the connections of p,
+// if db goes through one, should Commit hang.
+func checkTxConnLost(t params, tt *testing.T, db *sql.DB, p *faultproxy.Proxy, k connKiller, id int, tbl string) {
+	d := t.dialect()
+	release := func() {}
+	if p != nil {
+		release = p.CloseConns
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		tt.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(t.q("INSERT INTO "+tbl+" (id, name) VALUES (?, ?)"), id, "bob"); err != nil {
+		tt.Fatal(err)
+	}
+	var session int64
+	if d.sessionID != "" {
+		if session, err = sessionOf(tx, d); err != nil {
+			tt.Fatalf("before the kill: %v", err)
+		}
+	}
+	if err := k.kill(session, p); err != nil {
+		tt.Fatalf("%s of session %d: %v", k.name, session, err)
+	}
+	if !within(tt, release, "Commit", func() { err = tx.Commit() }) {
+		return
+	}
+	if err == nil {
+		tt.Error("Commit on a lost connection succeeded")
+	}
+	var n int
+	if err := t.QueryRow(t.q("SELECT COUNT(*) FROM "+tbl+" WHERE id = ?"), id).Scan(&n); err != nil {
+		tt.Fatal(err)
+	}
+	if n != 0 {
+		tt.Errorf("count = %d; want 0", n)
+	}
+}
+
+// testTxBusyCommit commits a transaction that updated a row another
+// transaction has read. Backends that lock rows for readers fail the
+// COMMIT, which must end the transaction unless the driver has
+// quirkBusyCommitKeepsTx; ending it again with ROLLBACK tells which.
+// Backends that let the COMMIT through skip the scenario.
+func testTxBusyCommit(t params) {
+	tbl := txTable(t)
+	t.mustExec(t.q("INSERT INTO "+tbl+" (id, name) VALUES (?, ?)"), 1, "bob")
+	ctx := context.Background()
+	reader, writer := twoConns(t)
+	if q := t.dialect().lockTimeoutSession; q != "" {
+		if _, err := writer.ExecContext(ctx, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rtx, err := reader.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtx.Rollback()
+	if n := countRows(t, rtx, tbl); n != 1 {
+		t.Fatalf("count = %d; want 1", n)
+	}
+	wtx, err := writer.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wtx.Exec(t.q("UPDATE "+tbl+" SET name = ? WHERE id = ?"), "alice", 1); err != nil {
+		wtx.Rollback()
+		t.Skipf("UPDATE waits for readers instead of COMMIT: %v", err)
+	}
+	err = wtx.Commit()
+	if err == nil {
+		t.Skip("COMMIT does not wait for readers")
+	}
+	t.Logf("COMMIT: %v", err)
+	_, err = writer.ExecContext(ctx, "ROLLBACK")
+	switch {
+	case err == nil && t.hasQuirk(quirkBusyCommitKeepsTx):
+		t.Logf("the failed COMMIT left the transaction open, as documented")
+	case err == nil:
+		t.Errorf("the failed COMMIT left the transaction open")
+	case t.hasQuirk(quirkBusyCommitKeepsTx):
+		t.Errorf("the failed COMMIT ended the transaction; remove quirkBusyCommitKeepsTx")
+	}
+}
+
+// testTxFailedStatement checks that a failed statement inside a
+// transaction neither breaks the transaction's connection nor poisons the
+// pool. On backends where an error aborts the transaction, later
+// statements in it must fail too.
+func testTxFailedStatement(t params) {
+	t.Parallel()
+	tbl := txTable(t)
+	t.SetMaxOpenConns(1)
+
+	tx, err := t.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := t.q("INSERT INTO " + tbl + " (id, name) VALUES (?, ?)")
+	if _, err := tx.Exec(insert, 1, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(insert, 1, "dup"); err == nil {
+		t.Fatal("duplicate primary key insert succeeded")
+	}
+	_, err = tx.Exec(insert, 2, "alice")
+	if t.dialect().errorAbortsTx {
+		if err == nil {
+			t.Error("statement after an error succeeded; want the transaction aborted")
+		}
+	} else if err != nil {
+		t.Errorf("statement after an error: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Errorf("Rollback: %v", err)
+	}
+
+	// The only connection in the pool is the one the transaction used.
+	if n := countRows(t, t.DB, tbl); n != 0 {
+		t.Errorf("after rollback, count = %d; want 0", n)
+	}
+	if _, err := t.Exec(insert, 3, "carol"); err != nil {
+		t.Errorf("insert after rolled back tx: %v", err)
+	}
+	if n := countRows(t, t.DB, tbl); n != 1 {
+		t.Errorf("count = %d; want 1", n)
+	}
+}
@@ -0,0 +1,200 @@
+package sqltest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+func init() {
+	registerScenario("UnicodeRoundTrip", testUnicodeRoundTrip, 0)
+	registerScenario("UnicodeLength", testUnicodeLength, 0)
+	registerScenario("UnicodeOrder", testUnicodeOrder, 0)
+	registerScenario("TextNul", testTextNul, 0)
+}
+
+// unicodeStrings are the texts the Unicode scenarios store, with IDs
+// from 1 in this order.
+var unicodeStrings = []string{
+	"plain ASCII",
+	"\U0001F600 grin, \U0001F44D\U0001F3FD thumbs up", // 4-byte UTF-8, with a skin tone modifier
+	"cafe\u0301",                        // e and a combining acute accent
+	"caf\u00e9",                         // precomposed
+	"\u05e9\u05dc\u05d5\u05dd",          // Hebrew, written right to left
+	"\u0645\u0631\u062d\u0628\u0627 42", // Arabic, with digits left to right
+	"\u202eevil\u202c",                  // right-to-left override
+	"\u4e2d\u6587",                      // CJK, 3-byte UTF-8
+	"Zebra",
+	"apple",
+}
+
+// unicodeTable stores unicodeStrings in a new table and returns its
+// name and the connection they were stored on, which has run the
+// dialect's utf8Session statement.
+func unicodeTable(t params) (*sql.Conn, string) {
+	d := t.dialect()
+	ctx := context.Background()
+	c, err := t.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if d.utf8Session != "" {
+		if _, err := c.ExecContext(ctx, d.utf8Session); err != nil {
+			t.Fatalf("%s: %v", d.utf8Session, err)
+		}
+	}
+	tbl := t.table("unicode")
+	t.mustExec("CREATE TABLE " + tbl + " (id INTEGER PRIMARY KEY, s " + d.utf8Text + ")")
+	insert := t.q("INSERT INTO " + tbl + " (id, s) VALUES (?, ?)")
+	for i, s := range unicodeStrings {
+		if _, err := c.ExecContext(ctx, insert, i+1, s); err != nil {
+			t.Fatalf("storing %+q: %v", s, err)
+		}
+	}
+	return c, tbl
+}
+
+// readBack returns the string with the given ID in tbl, read on q.
+func readBack(q rowQueryer, t params, tbl string, id int) (string, error) {
+	var s string
+	err := q.QueryRowContext(context.Background(), t.q("SELECT s FROM "+tbl+" WHERE id = ?"), id).Scan(&s)
+	return s, err
+}
+
+// testUnicodeRoundTrip reads back each of unicodeStrings, which must be
+// unchanged. On backends where a session must ask for UTF-8, it also
+// logs which strings survive a connection as the driver sets it up.
+func testUnicodeRoundTrip(t params) {
+	t.Parallel()
+	c, tbl := unicodeTable(t)
+	for i, want := range unicodeStrings {
+		got, err := readBack(c, t, tbl, i+1)
+		if err != nil || got != want {
+			t.Errorf("stored %+q, read back %+q, %v", want, got, err)
+		}
+	}
+
+	d := t.dialect()
+	if d.utf8Session == "" {
+		return
+	}
+	fresh, err := t.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	var altered []string
+	for i, want := range unicodeStrings {
+		if got, err := readBack(fresh, t, tbl, i+1); err != nil || got != want {
+			altered = append(altered, fmt.Sprintf("%+q as %+q, %v", want, got, err))
+		}
+	}
+	if altered != nil {
+		t.Logf("without %s, the driver's connection reads %d strings altered: %q", d.utf8Session, len(altered), altered)
+	} else {
+		t.Logf("the driver's connection reads every string intact without %s", d.utf8Session)
+	}
+}
+
+// testUnicodeLength checks that the backend counts the characters of
+// each of unicodeStrings as Go counts its runes: combining marks and
+// modifiers are characters of their own.
+func testUnicodeLength(t params) {
+	t.Parallel()
+	c, tbl := unicodeTable(t)
+	d := t.dialect()
+	for i, s := range unicodeStrings {
+		var n int
+		err := c.QueryRowContext(context.Background(), t.q("SELECT "+d.charLength+"(s) FROM "+tbl+" WHERE id = ?"), i+1).Scan(&n)
+		if err != nil {
+			t.Fatalf("%s of %+q: %v", d.charLength, s, err)
+		}
+		if want := utf8.RuneCountInString(s); n != want {
+			t.Errorf("%s(%+q) = %d; want %d, its runes", d.charLength, s, n, want)
+		}
+	}
+}
+
+// testUnicodeOrder checks that the dialect's byteOrder sorts
+// unicodeStrings as Go does, by their bytes, and logs whether the
+// backend's default order does too.
+func testUnicodeOrder(t params) {
+	t.Parallel()
+	c, tbl := unicodeTable(t)
+	d := t.dialect()
+	want := append([]string(nil), unicodeStrings...)
+	sort.Strings(want)
+	sorted := func(key string) []string {
+		rows, err := c.QueryContext(context.Background(), "SELECT s FROM "+tbl+" ORDER BY "+key)
+		if err != nil {
+			t.Fatalf("ORDER BY %s: %v", key, err)
+		}
+		defer rows.Close()
+		var got []string
+		for rows.Next() {
+			var s string
+			if err := rows.Scan(&s); err != nil {
+				t.Fatalf("ORDER BY %s: %v", key, err)
+			}
+			got = append(got, s)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatalf("ORDER BY %s: %v", key, err)
+		}
+		return got
+	}
+	key := fmt.Sprintf(d.byteOrder, "s")
+	if got := sorted(key); fmt.Sprintf("%+q", got) != fmt.Sprintf("%+q", want) {
+		t.Errorf("ORDER BY %s = %+q; want %+q", key, got, want)
+	}
+	if got := sorted("s"); fmt.Sprintf("%+q", got) != fmt.Sprintf("%+q", want) {
+		t.Logf("the default collation orders differently from Go: %+q", got)
+	}
+}
+
+// testTextNul stores text holding a NUL byte, which backends with
+// nulTextFails must refuse.
+func testTextNul(t params) {
+	t.Parallel()
+	const s = "a\x00b"
+	d := t.dialect()
+	tbl := t.table("nul")
+	t.mustExec("CREATE TABLE " + tbl + " (id INTEGER PRIMARY KEY, s " + d.utf8Text + ")")
+	_, err := t.Exec(t.q("INSERT INTO "+tbl+" (id, s) VALUES (?, ?)"), 1, s)
+	if d.nulTextFails {
+		if err == nil {
+			t.Errorf("stored %+q; backend is listed as refusing NUL in text", s)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("storing %+q: %v", s, err)
+	}
+
+	got, err := readBack(t.DB, t, tbl, 1)
+	switch {
+	case err != nil:
+		t.Errorf("reading %+q back: %v", s, err)
+	case t.hasQuirk(quirkTextEndsAtNul):
+		if got != "a" {
+			t.Errorf("read %+q back as %+q; driver is listed as cutting it at NUL, remove quirkTextEndsAtNul", s, got)
+		}
+	case got != s:
+		t.Errorf("read %+q back as %+q", s, got)
+	}
+
+	var n int
+	if err := t.QueryRow(t.q("SELECT "+d.charLength+"(s) FROM "+tbl+" WHERE id = ?"), 1).Scan(&n); err != nil {
+		t.Fatalf("%s of %+q: %v", d.charLength, s, err)
+	}
+	want := 3
+	if d.lengthEndsAtNul {
+		want = 1
+	}
+	if n != want {
+		t.Errorf("%s(%+q) = %d; want %d", d.charLength, s, n, want)
+	}
+}